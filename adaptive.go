@@ -0,0 +1,84 @@
+package nsq
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// observeHandler records the outcome of a handler invocation for adaptive max-in-flight
+func (r *Consumer) observeHandler(latency time.Duration, err error) {
+	if !r.config.AdaptiveMaxInFlight {
+		return
+	}
+	atomic.AddUint64(&r.adaptiveHandled, 1)
+	atomic.AddInt64(&r.adaptiveLatency, int64(latency))
+	if err != nil {
+		atomic.AddUint64(&r.adaptiveFailed, 1)
+	}
+}
+
+func (r *Consumer) adaptiveMaxInFlightLoop() {
+	ticker := time.NewTicker(r.config.AdaptiveMaxInFlightInterval)
+
+	for {
+		select {
+		case <-ticker.C:
+			r.adaptMaxInFlight()
+		case <-r.exitChan:
+			goto exit
+		}
+	}
+
+exit:
+	ticker.Stop()
+	r.log(LogLevelInfo, "adaptiveMaxInFlightLoop exiting")
+	r.wg.Done()
+}
+
+func (r *Consumer) adaptMaxInFlight() {
+	handled := atomic.SwapUint64(&r.adaptiveHandled, 0)
+	failed := atomic.SwapUint64(&r.adaptiveFailed, 0)
+	latency := atomic.SwapInt64(&r.adaptiveLatency, 0)
+	if handled == 0 {
+		// nothing to base a decision on
+		return
+	}
+
+	current := int(r.getMaxInFlight())
+	avgLatency := time.Duration(latency / int64(handled))
+	errorRate := float64(failed) / float64(handled)
+	next := nextAdaptiveMaxInFlight(&r.config, current, avgLatency, errorRate, r.IsStarved())
+	if next == current {
+		return
+	}
+
+	r.log(LogLevelInfo, "adjusting max-in-flight %d -> %d (avg latency %s, error rate %.2f)",
+		current, next, avgLatency, errorRate)
+	r.ChangeMaxInFlight(next)
+}
+
+// nextAdaptiveMaxInFlight returns the max-in-flight to use after an interval with
+// the given observations
+func nextAdaptiveMaxInFlight(c *Config, current int, avgLatency time.Duration,
+	errorRate float64, starved bool) int {
+	next := current
+	switch {
+	case errorRate > c.AdaptiveMaxInFlightErrorRate,
+		c.AdaptiveMaxInFlightLatency > 0 && avgLatency > c.AdaptiveMaxInFlightLatency:
+		next = current / 2
+	case starved:
+		next = current + 1
+	}
+
+	ceiling := c.AdaptiveMaxInFlightMax
+	if ceiling <= 0 {
+		ceiling = c.MaxInFlight
+	}
+	if next > ceiling {
+		next = ceiling
+	}
+	if next < c.AdaptiveMaxInFlightMin {
+		next = c.AdaptiveMaxInFlightMin
+	}
+	return next
+}
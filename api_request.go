@@ -1,6 +1,7 @@
 package nsq
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -25,11 +26,17 @@ func (c *deadlinedConn) Write(b []byte) (n int, err error) {
 	return c.Conn.Write(b)
 }
 
-func newDeadlineTransport(timeout time.Duration) *http.Transport {
+// newDeadlineTransport returns a transport dialing via dial (or net.Dialer when nil)
+func newDeadlineTransport(timeout time.Duration, dial DialContextFunc) *http.Transport {
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
 	transport := &http.Transport{
 		DisableKeepAlives: true,
-		Dial: func(netw, addr string) (net.Conn, error) {
-			c, err := net.DialTimeout(netw, addr, timeout)
+		DialContext: func(ctx context.Context, netw, addr string) (net.Conn, error) {
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			c, err := dial(ctx, netw, addr)
 			if err != nil {
 				return nil, err
 			}
@@ -46,13 +53,22 @@ type wrappedResp struct {
 }
 
 // stores the result in the value pointed to by ret(must be a pointer)
-func apiRequestNegotiateV1(method string, endpoint string, body io.Reader, ret interface{}) error {
-	httpclient := &http.Client{Transport: newDeadlineTransport(2 * time.Second)}
+//
+// httpclient may be nil to use a client with a 2s timeout, and header adds
+// to the headers of the request
+func apiRequestNegotiateV1(httpclient *http.Client, header http.Header,
+	method string, endpoint string, body io.Reader, ret interface{}) error {
+	if httpclient == nil {
+		httpclient = &http.Client{Transport: newDeadlineTransport(2*time.Second, nil)}
+	}
 	req, err := http.NewRequest(method, endpoint, body)
 	if err != nil {
 		return err
 	}
 
+	for k, v := range header {
+		req.Header[k] = v
+	}
 	req.Header.Add("Accept", "application/vnd.nsq; version=1.0")
 
 	resp, err := httpclient.Do(req)
@@ -0,0 +1,79 @@
+package nsq
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// DeliveryOutcome is the response sent to nsqd for a message
+type DeliveryOutcome int
+
+// Delivery outcomes
+const (
+	DeliveryFinished DeliveryOutcome = iota
+	DeliveryRequeued
+)
+
+// String returns the string form of a DeliveryOutcome
+func (o DeliveryOutcome) String() string {
+	if o == DeliveryRequeued {
+		return "requeued"
+	}
+	return "finished"
+}
+
+// DeliveryRecord describes the response (FIN or REQ) to a message, once written to the
+// nsqd the message was received from
+type DeliveryRecord struct {
+	MessageID   MessageID
+	Attempts    uint16
+	NSQDAddress string
+	Outcome     DeliveryOutcome
+
+	// the time taken by the handler (0 when the message was not passed to a handler,
+	// e.g. it was filtered or exceeded MaxAttempts)
+	HandlerLatency time.Duration
+
+	// non-nil when the response could not be written, in which case nsqd redelivers
+	// the message once its timeout expires
+	Err error
+}
+
+// DeliveryHook is called with the DeliveryRecord of each message (see Consumer.OnDelivery)
+type DeliveryHook func(record DeliveryRecord)
+
+// OnDelivery registers hook to be called after the response to each message (FIN or
+// REQ) has been written to nsqd, or has failed to be written, e.g. to maintain an
+// external audit log of processing.
+//
+// Hooks are called synchronously on the connection's write goroutine (or, with
+// Config.WriteCoalesceLinger, on the goroutine flushing the coalesced responses), so they
+// must be fast and must not block.
+func (r *Consumer) OnDelivery(hook DeliveryHook) {
+	r.deliveryHooksMtx.Lock()
+	r.deliveryHooks = append(r.deliveryHooks, hook)
+	r.deliveryHooksMtx.Unlock()
+}
+
+func (r *Consumer) onConnResponseWritten(c *Conn, m *Message, success bool, err error) {
+	r.deliveryHooksMtx.RLock()
+	defer r.deliveryHooksMtx.RUnlock()
+	if len(r.deliveryHooks) == 0 {
+		return
+	}
+
+	record := DeliveryRecord{
+		MessageID:      m.ID,
+		Attempts:       m.Attempts,
+		NSQDAddress:    c.String(),
+		Outcome:        DeliveryFinished,
+		HandlerLatency: time.Duration(atomic.LoadInt64(&m.handlerLatency)),
+		Err:            err,
+	}
+	if !success {
+		record.Outcome = DeliveryRequeued
+	}
+	for _, hook := range r.deliveryHooks {
+		hook(record)
+	}
+}
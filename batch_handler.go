@@ -0,0 +1,151 @@
+package nsq
+
+import (
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+)
+
+// BatchHandler is the message processing interface for Consumer when messages
+// are to be processed in batches (see Consumer.AddBatchHandler)
+//
+// HandleMessages returns the per-message result of processing the batch. When the
+// returned slice is nil every message is considered successful. Otherwise it must be
+// the same length as messages, where a nil entry means the corresponding message
+// will be FINished and a non-nil entry means it will be REQueued.
+//
+// Messages for which auto-response has been disabled are not responded to.
+type BatchHandler interface {
+	HandleMessages(messages []*Message) []error
+}
+
+// BatchHandlerFunc is a convenience type to avoid having to declare a struct
+// to implement the BatchHandler interface, it can be used like this:
+//
+// 	consumer.AddBatchHandler(nsq.BatchHandlerFunc(func(m []*Message) []error {
+// 		// handle the messages
+// 	}), 100, time.Second)
+type BatchHandlerFunc func(messages []*Message) []error
+
+// HandleMessages implements the BatchHandler interface
+func (h BatchHandlerFunc) HandleMessages(m []*Message) []error {
+	return h(m)
+}
+
+// AddBatchHandler sets a BatchHandler for messages received by this Consumer.
+//
+// Messages are accumulated until either maxBatch messages have been received or maxWait
+// has elapsed since the first message of the batch arrived, at which point the batch is
+// delivered to the handler. Because messages are only delivered while in flight, MaxInFlight
+// should be at least maxBatch for batches to fill up.
+//
+// This can be called after connecting to NSQD or NSQ Lookupd, in which case the handler
+// receives subsequently received messages alongside those already added.
+//
+// (see BatchHandler or BatchHandlerFunc for details on implementing this interface)
+func (r *Consumer) AddBatchHandler(handler BatchHandler, maxBatch int, maxWait time.Duration) {
+	if maxBatch < 1 {
+		panic("maxBatch must be >= 1")
+	}
+
+	atomic.AddInt32(&r.runningHandlers, 1)
+	go r.batchHandlerLoop(handler, maxBatch, maxWait)
+}
+
+func (r *Consumer) batchHandlerLoop(handler BatchHandler, maxBatch int, maxWait time.Duration) {
+	r.log(LogLevelDebug, "starting BatchHandler")
+
+	var timeoutChan <-chan time.Time
+	var timer *time.Timer
+	batch := make([]*Message, 0, maxBatch)
+
+	for {
+		select {
+		case message, ok := <-r.incomingMessages:
+			if !ok {
+				goto exit
+			}
+
+			if r.shouldFailMessage(message, handler) {
+				message.Finish()
+				continue
+			}
+
+			batch = append(batch, message)
+			if len(batch) == 1 {
+				timer = time.NewTimer(maxWait)
+				timeoutChan = timer.C
+			}
+			if len(batch) < maxBatch {
+				continue
+			}
+			timer.Stop()
+		case <-timeoutChan:
+		}
+
+		r.handleBatch(handler, batch)
+		batch = make([]*Message, 0, maxBatch)
+		timeoutChan = nil
+	}
+
+exit:
+	if timer != nil {
+		timer.Stop()
+	}
+	if len(batch) > 0 {
+		r.handleBatch(handler, batch)
+	}
+	r.log(LogLevelDebug, "stopping BatchHandler")
+	if atomic.AddInt32(&r.runningHandlers, -1) == 0 {
+		r.exit()
+	}
+}
+
+func (r *Consumer) handleBatch(handler BatchHandler, batch []*Message) {
+	r.rateLimit(len(batch))
+	start := time.Now()
+	errs, err := r.invokeBatchHandler(handler, batch)
+	elapsed := time.Since(start)
+	for _, message := range batch {
+		atomic.StoreInt64(&message.handlerLatency, int64(elapsed))
+	}
+	if perr, ok := err.(ErrHandlerPanic); ok {
+		r.handlerPanicked(perr, batch)
+		return
+	}
+	if errs != nil && len(errs) != len(batch) {
+		r.log(LogLevelError, "BatchHandler returned %d results for %d messages, requeueing batch",
+			len(errs), len(batch))
+		for _, message := range batch {
+			if !message.IsAutoResponseDisabled() {
+				message.Requeue(-1)
+			}
+		}
+		return
+	}
+
+	for i, message := range batch {
+		if message.IsAutoResponseDisabled() {
+			continue
+		}
+		if errs != nil && errs[i] != nil {
+			r.log(LogLevelError, "BatchHandler returned error (%s) for msg %s", errs[i], message.ID)
+			r.requeueFailed(message)
+			continue
+		}
+		message.Finish()
+	}
+}
+
+// invokeBatchHandler calls handler for batch, returning an ErrHandlerPanic if it panics
+// (when Config.RecoverPanics is enabled)
+func (r *Consumer) invokeBatchHandler(handler BatchHandler, batch []*Message) (errs []error, err error) {
+	if r.config.RecoverPanics {
+		defer func() {
+			if p := recover(); p != nil {
+				err = ErrHandlerPanic{Value: p, Stack: debug.Stack()}
+			}
+		}()
+	}
+	return handler.HandleMessages(batch), nil
+}
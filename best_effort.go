@@ -0,0 +1,163 @@
+package nsq
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+type bestEffortEntry struct {
+	topic string
+	body  []byte
+}
+
+// bestEffortBuffer is a bounded ring of pending publishes that never blocks the writer
+//
+// When full, either the oldest buffered entry or the entry being pushed is discarded
+// depending on dropNewest.
+type bestEffortBuffer struct {
+	mtx        sync.Mutex
+	entries    []bestEffortEntry
+	head       int
+	count      int
+	dropNewest bool
+
+	notifyChan chan int
+}
+
+func newBestEffortBuffer(size int, dropNewest bool) *bestEffortBuffer {
+	return &bestEffortBuffer{
+		entries:    make([]bestEffortEntry, size),
+		dropNewest: dropNewest,
+		notifyChan: make(chan int, 1),
+	}
+}
+
+// push adds an entry to the buffer, returning true if an entry was dropped to make room
+func (b *bestEffortBuffer) push(e bestEffortEntry) bool {
+	b.mtx.Lock()
+	dropped := false
+	if b.count == len(b.entries) {
+		dropped = true
+		if b.dropNewest {
+			b.mtx.Unlock()
+			return dropped
+		}
+		// overwrite the oldest entry
+		b.entries[b.head] = bestEffortEntry{}
+		b.head = (b.head + 1) % len(b.entries)
+		b.count--
+	}
+	b.entries[(b.head+b.count)%len(b.entries)] = e
+	b.count++
+	b.mtx.Unlock()
+
+	select {
+	case b.notifyChan <- 1:
+	default:
+	}
+	return dropped
+}
+
+// pop removes the oldest entry from the buffer, returning false if it is empty
+func (b *bestEffortBuffer) pop() (bestEffortEntry, bool) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if b.count == 0 {
+		return bestEffortEntry{}, false
+	}
+	e := b.entries[b.head]
+	b.entries[b.head] = bestEffortEntry{}
+	b.head = (b.head + 1) % len(b.entries)
+	b.count--
+	return e, true
+}
+
+func (b *bestEffortBuffer) len() int {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return b.count
+}
+
+// PublishBestEffort queues a message body for asynchronous publishing to the specified
+// topic and returns immediately, without waiting for a connection or a response.
+//
+// Messages are held in a bounded in-memory buffer (see Config.BestEffortBufferSize).
+// When the buffer is full the oldest buffered message (or the new message, when
+// Config.BestEffortDropNewest is set) is dropped. Messages that cannot be written
+// because the connection to nsqd is unavailable are also dropped. Dropped messages
+// are counted and can be retrieved via BestEffortDropped.
+//
+// This is intended for data like metrics or telemetry, where blocking the
+// application is worse than losing samples. Bodies are validated and compressed (see
+// Config.SchemaValidator and Config.MessageCompression) before they are queued, and
+// those rejected are not queued, returning the error.
+func (w *Producer) PublishBestEffort(topic string, body []byte) error {
+	if atomic.LoadInt32(&w.stopFlag) == 1 {
+		return ErrStopped
+	}
+	if err := ValidateTopicName(topic); err != nil {
+		return err
+	}
+	body, err := w.prepare(topic, body)
+	if err != nil {
+		return err
+	}
+
+	w.bestEffortMtx.Lock()
+	defer w.bestEffortMtx.Unlock()
+	if atomic.LoadInt32(&w.stopFlag) == 1 {
+		return ErrStopped
+	}
+	if w.bestEffort == nil {
+		w.bestEffort = newBestEffortBuffer(w.config.BestEffortBufferSize, w.config.BestEffortDropNewest)
+		w.bestEffortWg.Add(1)
+		go w.bestEffortLoop()
+	}
+	if w.bestEffort.push(bestEffortEntry{topic, body}) {
+		atomic.AddUint64(&w.bestEffortDropped, 1)
+	}
+	return nil
+}
+
+// stopBestEffort waits for the best-effort loop (if any) to exit once the Producer
+// is stopped, counting the messages left in the buffer as dropped
+func (w *Producer) stopBestEffort() {
+	// PublishBestEffort observes stopFlag from now on
+	w.bestEffortMtx.Lock()
+	w.bestEffortMtx.Unlock()
+
+	w.bestEffortWg.Wait()
+	if w.bestEffort != nil {
+		// anything left in the buffer will never be published
+		atomic.AddUint64(&w.bestEffortDropped, uint64(w.bestEffort.len()))
+	}
+}
+
+// BestEffortDropped returns the number of messages dropped by PublishBestEffort
+func (w *Producer) BestEffortDropped() uint64 {
+	return atomic.LoadUint64(&w.bestEffortDropped)
+}
+
+func (w *Producer) bestEffortLoop() {
+	for {
+		e, ok := w.bestEffort.pop()
+		if !ok {
+			select {
+			case <-w.bestEffort.notifyChan:
+				continue
+			case <-w.exitChan:
+				goto exit
+			}
+		}
+
+		err := w.sendCommandAsync(Publish(e.topic, e.body), nil, nil)
+		if err != nil {
+			w.log(LogLevelDebug, "dropping best-effort publish to %s - %s", e.topic, err)
+			atomic.AddUint64(&w.bestEffortDropped, 1)
+		}
+	}
+
+exit:
+	w.bestEffortWg.Done()
+	w.log(LogLevelInfo, "exiting best-effort loop")
+}
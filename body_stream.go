@@ -0,0 +1,126 @@
+package nsq
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// ErrStreamClosed is returned when reading the body of a streamed message (see
+// Config.StreamBodyThreshold) after it has been responded to
+var ErrStreamClosed = errors.New("body stream closed")
+
+// bodyStream streams the body of a message directly from its connection, whose
+// readLoop waits for done until the body has been read (or discarded)
+type bodyStream struct {
+	mtx  sync.Mutex
+	r    io.Reader
+	size int64
+	err  error
+	done chan struct{}
+	once sync.Once
+}
+
+func newBodyStream(r io.Reader, size int64) *bodyStream {
+	return &bodyStream{
+		r:    io.LimitReader(r, size),
+		size: size,
+		done: make(chan struct{}),
+	}
+}
+
+func (s *bodyStream) Read(p []byte) (int, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	select {
+	case <-s.done:
+		if s.err != nil {
+			return 0, s.err
+		}
+		return 0, ErrStreamClosed
+	default:
+	}
+	n, err := s.r.Read(p)
+	if err == io.EOF {
+		s.finish(nil)
+	} else if err != nil {
+		s.finish(err)
+	}
+	return n, err
+}
+
+// close discards the rest of the body, releasing the connection
+func (s *bodyStream) close() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	select {
+	case <-s.done:
+		return
+	default:
+	}
+	_, err := io.Copy(ioutil.Discard, s.r)
+	s.finish(err)
+}
+
+func (s *bodyStream) finish(err error) {
+	s.once.Do(func() {
+		s.err = err
+		close(s.done)
+	})
+}
+
+// BodyReader returns a reader of the body of the message, which streams the body from
+// the connection for messages exceeding Config.StreamBodyThreshold (see Streamed). A
+// streamed body is read as published: its envelope is not decoded, nor is it decompressed
+// (see Config.MessageCompression)
+func (m *Message) BodyReader() io.Reader {
+	if m.stream != nil {
+		return m.stream
+	}
+	return bytes.NewReader(m.Body)
+}
+
+// Streamed indicates whether the body of the message is streamed from the connection
+// (see Config.StreamBodyThreshold) and must be read with BodyReader, rather than Body
+func (m *Message) Streamed() bool {
+	return m.stream != nil
+}
+
+// BodySize returns the size of the body of the message, including that of a streamed
+// body yet to be read
+func (m *Message) BodySize() int64 {
+	if m.stream != nil {
+		return m.stream.size
+	}
+	return int64(len(m.Body))
+}
+
+// readStreamedFrame reads a frame like readPooledFrame (when zeroCopy is set) or
+// ReadUnpackedResponse, except for message frames whose body exceeds threshold, of which
+// only the message header is read, returning a stream of the body
+func readStreamedFrame(r io.Reader, threshold int, zeroCopy bool) (int32, []byte, *[]byte, *bodyStream, error) {
+	var header [8]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return -1, nil, nil, nil, err
+	}
+	size := int32(binary.BigEndian.Uint32(header[:4]))
+	if size < 4 {
+		return -1, nil, nil, nil, errors.New("length of response is too small")
+	}
+	frameType := int32(binary.BigEndian.Uint32(header[4:]))
+
+	n := int(size - 4)
+	const msgHeaderSize = 10 + MsgIDLength
+	if frameType == FrameTypeMessage && n-msgHeaderSize > threshold {
+		data := make([]byte, msgHeaderSize)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return -1, nil, nil, nil, err
+		}
+		return frameType, data, nil, newBodyStream(r, int64(n-msgHeaderSize)), nil
+	}
+	frameType, data, buf, err := readFrameData(r, frameType, n, zeroCopy)
+	return frameType, data, buf, nil, err
+}
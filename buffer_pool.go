@@ -0,0 +1,125 @@
+package nsq
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/bits"
+	"sync"
+)
+
+// pools of bufio.Readers and bufio.Writers shared by all connections, keyed by size
+// (see Config.ReadBufferSize and Config.WriteBufferSize)
+var (
+	bufReaderPools sync.Map
+	bufWriterPools sync.Map
+)
+
+func bufPool(pools *sync.Map, size int) *sync.Pool {
+	if pool, ok := pools.Load(size); ok {
+		return pool.(*sync.Pool)
+	}
+	pool, _ := pools.LoadOrStore(size, &sync.Pool{})
+	return pool.(*sync.Pool)
+}
+
+func getBufReader(r io.Reader, size int) *bufio.Reader {
+	if br, ok := bufPool(&bufReaderPools, size).Get().(*bufio.Reader); ok {
+		br.Reset(r)
+		return br
+	}
+	return bufio.NewReaderSize(r, size)
+}
+
+func putBufReader(br *bufio.Reader) {
+	size := br.Size()
+	br.Reset(nil)
+	bufPool(&bufReaderPools, size).Put(br)
+}
+
+func getBufWriter(w io.Writer, size int) *bufio.Writer {
+	if bw, ok := bufPool(&bufWriterPools, size).Get().(*bufio.Writer); ok {
+		bw.Reset(w)
+		return bw
+	}
+	return bufio.NewWriterSize(w, size)
+}
+
+func putBufWriter(bw *bufio.Writer) {
+	size := bw.Size()
+	bw.Reset(nil)
+	bufPool(&bufWriterPools, size).Put(bw)
+}
+
+// closedReadWriter replaces the pooled buffers of a closed connection
+type closedReadWriter struct{}
+
+func (closedReadWriter) Read(p []byte) (int, error)  { return 0, ErrNotConnected }
+func (closedReadWriter) Write(p []byte) (int, error) { return 0, ErrNotConnected }
+
+// pools of buffers for message frames read in zero-copy mode (see Config.ZeroCopy),
+// by power of two size class
+var frameBufferPools [32]sync.Pool
+
+// the smallest frame buffer size class (1KB)
+const minFrameBufferClass = 10
+
+func getFrameBuffer(n int) *[]byte {
+	class := bits.Len(uint(n - 1))
+	if class < minFrameBufferClass {
+		class = minFrameBufferClass
+	}
+	if class >= len(frameBufferPools) {
+		buf := make([]byte, n)
+		return &buf
+	}
+	if buf, ok := frameBufferPools[class].Get().(*[]byte); ok {
+		return buf
+	}
+	buf := make([]byte, 1<<uint(class))
+	return &buf
+}
+
+func putFrameBuffer(buf *[]byte) {
+	class := bits.Len(uint(cap(*buf) - 1))
+	if cap(*buf) != 1<<uint(class) || class < minFrameBufferClass || class >= len(frameBufferPools) {
+		return
+	}
+	frameBufferPools[class].Put(buf)
+}
+
+// readPooledFrame reads a frame like ReadUnpackedResponse, but reads message frames into
+// a pooled buffer (also returned), which must be returned with putFrameBuffer
+func readPooledFrame(r io.Reader) (int32, []byte, *[]byte, error) {
+	var header [8]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return -1, nil, nil, err
+	}
+	size := int32(binary.BigEndian.Uint32(header[:4]))
+	if size < 4 {
+		return -1, nil, nil, errors.New("length of response is too small")
+	}
+	frameType := int32(binary.BigEndian.Uint32(header[4:]))
+	return readFrameData(r, frameType, int(size-4), true)
+}
+
+// readFrameData reads the n bytes of data of a frame, into a pooled buffer (also returned)
+// for message frames when pooled is set
+func readFrameData(r io.Reader, frameType int32, n int, pooled bool) (int32, []byte, *[]byte, error) {
+	var buf *[]byte
+	var data []byte
+	if pooled && frameType == FrameTypeMessage {
+		buf = getFrameBuffer(n)
+		data = (*buf)[:n]
+	} else {
+		data = make([]byte, n)
+	}
+	if _, err := io.ReadFull(r, data); err != nil {
+		if buf != nil {
+			putFrameBuffer(buf)
+		}
+		return -1, nil, nil, err
+	}
+	return frameType, data, buf, nil
+}
@@ -0,0 +1,198 @@
+package nsq
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Codec marshals values to, and unmarshals values from, message bodies (see Config.Codec)
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// Content types of the codec registry (see RegisterCodec), sent as the HeaderContentType
+// header of envelopes
+const (
+	ContentTypeJSON     = "application/json"
+	ContentTypeRaw      = "application/octet-stream"
+	ContentTypeProtobuf = "application/x-protobuf"
+	ContentTypeMsgpack  = "application/x-msgpack"
+)
+
+// the names accepted for content types (e.g. as the codec option)
+var contentTypeAliases = map[string]string{
+	"json":     ContentTypeJSON,
+	"raw":      ContentTypeRaw,
+	"protobuf": ContentTypeProtobuf,
+	"msgpack":  ContentTypeMsgpack,
+}
+
+var codecs = struct {
+	sync.RWMutex
+	m map[string]Codec
+}{
+	m: map[string]Codec{
+		ContentTypeJSON: JSONCodec{},
+		ContentTypeRaw:  RawCodec{},
+	},
+}
+
+// RegisterCodec adds codec to the registry of codecs, used to decode the bodies of
+// envelopes with a HeaderContentType header of contentType (see Message.Decode), and
+// which can be selected by content type (or short name, e.g. "protobuf") as the codec
+// option. Registering a content type again replaces its codec.
+//
+// JSON and raw codecs are registered by default. To keep this package free of
+// dependencies, protobuf and msgpack codecs are registered by the application, e.g.
+//
+//	type protobufCodec struct{}
+//
+//	func (protobufCodec) Marshal(v interface{}) ([]byte, error) {
+//		return proto.Marshal(v.(proto.Message))
+//	}
+//
+//	func (protobufCodec) Unmarshal(data []byte, v interface{}) error {
+//		return proto.Unmarshal(data, v.(proto.Message))
+//	}
+//
+//	func (protobufCodec) ContentType() string { return nsq.ContentTypeProtobuf }
+//
+//	nsq.RegisterCodec(nsq.ContentTypeProtobuf, protobufCodec{})
+func RegisterCodec(contentType string, codec Codec) {
+	codecs.Lock()
+	codecs.m[normalizeContentType(contentType)] = codec
+	codecs.Unlock()
+}
+
+// LookupCodec returns the codec registered for contentType (a content type, with or
+// without parameters, or its short name, e.g. "json")
+func LookupCodec(contentType string) (Codec, bool) {
+	codecs.RLock()
+	codec, ok := codecs.m[normalizeContentType(contentType)]
+	codecs.RUnlock()
+	return codec, ok
+}
+
+func normalizeContentType(contentType string) string {
+	if i := strings.IndexByte(contentType, ';'); i != -1 {
+		contentType = contentType[:i]
+	}
+	contentType = strings.ToLower(strings.TrimSpace(contentType))
+	if alias, ok := contentTypeAliases[contentType]; ok {
+		return alias
+	}
+	return contentType
+}
+
+// codecContentType returns the content type of codec, when it has one (see RegisterCodec)
+func codecContentType(codec Codec) string {
+	if c, ok := codec.(interface{ ContentType() string }); ok {
+		return c.ContentType()
+	}
+	return ""
+}
+
+// JSONCodec is a Codec using encoding/json (default)
+type JSONCodec struct{}
+
+// Marshal implements the Codec interface
+func (JSONCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// Unmarshal implements the Codec interface
+func (JSONCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// ContentType returns ContentTypeJSON
+func (JSONCodec) ContentType() string {
+	return ContentTypeJSON
+}
+
+// RawCodec is a Codec passing bodies through as is, to and from []byte and string
+// values (and pointers to them)
+type RawCodec struct{}
+
+// Marshal implements the Codec interface
+func (RawCodec) Marshal(v interface{}) ([]byte, error) {
+	switch v := v.(type) {
+	case []byte:
+		return v, nil
+	case *[]byte:
+		return *v, nil
+	case string:
+		return []byte(v), nil
+	case *string:
+		return []byte(*v), nil
+	}
+	return nil, fmt.Errorf("raw codec cannot marshal %T", v)
+}
+
+// Unmarshal implements the Codec interface
+func (RawCodec) Unmarshal(data []byte, v interface{}) error {
+	switch v := v.(type) {
+	case *[]byte:
+		*v = append([]byte(nil), data...)
+	case *string:
+		*v = string(data)
+	default:
+		return fmt.Errorf("raw codec cannot unmarshal into %T", v)
+	}
+	return nil
+}
+
+// ContentType returns ContentTypeRaw
+func (RawCodec) ContentType() string {
+	return ContentTypeRaw
+}
+
+// DecodeErrorHandler is called with messages whose body cannot be decoded by a typed
+// handler (see Consumer.SetDecodeErrorHandler), returning nil to FINish the message
+// or an error to REQueue it
+type DecodeErrorHandler func(ctx context.Context, message *Message, err error) error
+
+// SetDecodeErrorHandler sets the DecodeErrorHandler of the typed handlers of this Consumer
+// (see AddTypedHandler)
+//
+// By default, decoding errors are returned as the handler's error, so undecodable messages are
+// REQueued until they exceed MaxAttempts (and are dead-lettered, when enabled).
+//
+// This panics if called after connecting to NSQD or NSQ Lookupd
+func (r *Consumer) SetDecodeErrorHandler(handler DecodeErrorHandler) {
+	if atomic.LoadInt32(&r.connectedFlag) == 1 {
+		panic("already connected")
+	}
+	r.decodeErrorHandler = handler
+}
+
+// Decode unmarshals the body of the message (or the body of its envelope) into v, with
+// the codec registered for the HeaderContentType header of the envelope (see
+// RegisterCodec), or Config.Codec when there is none
+func (m *Message) Decode(v interface{}) error {
+	headers, body, _ := m.Envelope()
+	codec := m.codec
+	if contentType := headers.Get(HeaderContentType); contentType != "" {
+		var ok bool
+		codec, ok = LookupCodec(contentType)
+		if !ok {
+			return fmt.Errorf("no codec registered for content-type %s", contentType)
+		}
+	}
+	if codec == nil {
+		codec = JSONCodec{}
+	}
+	return codec.Unmarshal(body, v)
+}
+
+func (r *Consumer) onDecodeError(ctx context.Context, message *Message, err error) error {
+	if r.decodeErrorHandler != nil {
+		return r.decodeErrorHandler(ctx, message, err)
+	}
+	return fmt.Errorf("failed to decode msg - %s", err)
+}
@@ -0,0 +1,85 @@
+package nsq
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+type upperCodec struct{}
+
+func (upperCodec) Marshal(v interface{}) ([]byte, error) {
+	return []byte(strings.ToUpper(v.(string))), nil
+}
+
+func (upperCodec) Unmarshal(data []byte, v interface{}) error {
+	*v.(*string) = strings.ToLower(string(data))
+	return nil
+}
+
+func TestCodecRegistry(t *testing.T) {
+	for _, name := range []string{"json", "JSON", "application/json", "application/json; charset=utf-8"} {
+		if codec, ok := LookupCodec(name); !ok || codec != (JSONCodec{}) {
+			t.Fatalf("%s: unexpected codec %v (%v)", name, codec, ok)
+		}
+	}
+	if _, ok := LookupCodec("protobuf"); ok {
+		t.Fatalf("protobuf codec should not be registered by default")
+	}
+
+	RegisterCodec("application/x-upper", upperCodec{})
+	config := NewConfig()
+	if err := config.Set("codec", "application/x-upper"); err != nil {
+		t.Fatal(err)
+	}
+	if config.Codec != (upperCodec{}) {
+		t.Fatalf("unexpected codec %v", config.Codec)
+	}
+	if err := config.Set("codec", "msgpack"); err == nil || !strings.Contains(err.Error(), "no codec registered") {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	var raw []byte
+	if err := (RawCodec{}).Unmarshal([]byte("body"), &raw); err != nil || string(raw) != "body" {
+		t.Fatalf("unexpected raw body %q (%v)", raw, err)
+	}
+	if _, err := (RawCodec{}).Marshal(1); err == nil {
+		t.Fatalf("raw codec should not marshal ints")
+	}
+}
+
+func TestMessageDecode(t *testing.T) {
+	RegisterCodec("application/x-upper", upperCodec{})
+
+	body, _ := json.Marshal("hello")
+	tests := []struct {
+		name  string
+		body  []byte
+		codec Codec
+		want  string
+		err   string
+	}{
+		{"plain", body, nil, "hello", ""},
+		{"envelope", EncodeEnvelope(Headers{"x": "y"}, body), nil, "hello", ""},
+		{"config codec", []byte("hello"), RawCodec{}, "hello", ""},
+		{"content type", EncodeEnvelope(Headers{HeaderContentType: "application/x-upper"}, []byte("HELLO")),
+			JSONCodec{}, "hello", ""},
+		{"unknown content type", EncodeEnvelope(Headers{HeaderContentType: "text/csv"}, body),
+			nil, "", "no codec registered for content-type text/csv"},
+	}
+	for _, tc := range tests {
+		msg := NewMessage(MessageID{}, tc.body)
+		msg.codec = tc.codec
+		var v string
+		err := msg.Decode(&v)
+		if tc.err != "" {
+			if err == nil || err.Error() != tc.err {
+				t.Fatalf("%s: unexpected error %v", tc.name, err)
+			}
+			continue
+		}
+		if err != nil || v != tc.want {
+			t.Fatalf("%s: decoded %q (%v), want %q", tc.name, v, err, tc.want)
+		}
+	}
+}
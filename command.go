@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"io"
 	"strconv"
+	"sync"
 	"time"
 )
 
@@ -34,50 +35,99 @@ func (c *Command) String() string {
 // It is suggested that the target Writer is buffered
 // to avoid performing many system calls.
 func (c *Command) WriteTo(w io.Writer) (int64, error) {
-	var total int64
-	var buf [4]byte
-
-	n, err := w.Write(c.Name)
-	total += int64(n)
-	if err != nil {
+	// the name, params and body size are written at once, from a pooled buffer
+	bp := commandHeaderPool.Get().(*[]byte)
+	header := c.appendHeader((*bp)[:0])
+	n, err := w.Write(header)
+	*bp = header
+	commandHeaderPool.Put(bp)
+	total := int64(n)
+	if err != nil || c.Body == nil {
 		return total, err
 	}
 
+	n, err = w.Write(c.Body)
+	total += int64(n)
+	return total, err
+}
+
+// AppendTo appends the serialized Command to b, for encoding commands into a reusable
+// buffer (e.g. to write several at once)
+func (c *Command) AppendTo(b []byte) []byte {
+	b = c.appendHeader(b)
+	return append(b, c.Body...)
+}
+
+// appendHeader appends the serialized name and params of the Command, and the size of its
+// body, to b
+func (c *Command) appendHeader(b []byte) []byte {
+	b = append(b, c.Name...)
 	for _, param := range c.Params {
-		n, err := w.Write(byteSpace)
-		total += int64(n)
-		if err != nil {
-			return total, err
-		}
-		n, err = w.Write(param)
-		total += int64(n)
-		if err != nil {
-			return total, err
-		}
+		b = append(b, byteSpace...)
+		b = append(b, param...)
 	}
-
-	n, err = w.Write(byteNewLine)
-	total += int64(n)
-	if err != nil {
-		return total, err
+	b = append(b, byteNewLine...)
+	if c.Body != nil {
+		var size [4]byte
+		binary.BigEndian.PutUint32(size[:], uint32(len(c.Body)))
+		b = append(b, size[:]...)
 	}
+	return b
+}
 
-	if c.Body != nil {
-		bufs := buf[:]
-		binary.BigEndian.PutUint32(bufs, uint32(len(c.Body)))
-		n, err := w.Write(bufs)
-		total += int64(n)
-		if err != nil {
-			return total, err
-		}
-		n, err = w.Write(c.Body)
-		total += int64(n)
-		if err != nil {
-			return total, err
-		}
+// pool of buffers for serializing commands (see Command.WriteTo)
+var commandHeaderPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, 64)
+		return &b
+	},
+}
+
+// the names of the commands of the hot paths, shared by the Commands created for them
+var (
+	nameFIN   = []byte("FIN")
+	nameREQ   = []byte("REQ")
+	nameTOUCH = []byte("TOUCH")
+	nameRDY   = []byte("RDY")
+	namePUB   = []byte("PUB")
+)
+
+// msgCommand is a Command with storage for its params (a message ID and/or a number), so
+// that FIN, REQ, TOUCH and RDY are created with a single allocation, or none when reused
+// (see msgResponsePool)
+type msgCommand struct {
+	Command
+	params [2][]byte
+	buf    [MsgIDLength + 20]byte
+}
+
+func (c *msgCommand) set(name []byte, id *MessageID, n int64, hasN bool) *Command {
+	params := c.params[:0]
+	if id != nil {
+		copy(c.buf[:], id[:])
+		params = append(params, c.buf[:MsgIDLength])
 	}
+	if hasN {
+		params = append(params, strconv.AppendInt(c.buf[MsgIDLength:MsgIDLength], n, 10))
+	}
+	c.Command = Command{name, params, nil}
+	return &c.Command
+}
 
-	return total, nil
+func (c *msgCommand) finish(id MessageID) *Command {
+	return c.set(nameFIN, &id, 0, false)
+}
+
+func (c *msgCommand) requeue(id MessageID, delay time.Duration) *Command {
+	return c.set(nameREQ, &id, int64(delay/time.Millisecond), true)
+}
+
+func (c *msgCommand) touch(id MessageID) *Command {
+	return c.set(nameTOUCH, &id, 0, false)
+}
+
+func (c *msgCommand) ready(count int) *Command {
+	return c.set(nameRDY, nil, int64(count), true)
 }
 
 // Identify creates a new Command to provide information about the client.  After connecting,
@@ -129,8 +179,13 @@ func Ping() *Command {
 
 // Publish creates a new Command to write a message to a given topic
 func Publish(topic string, body []byte) *Command {
-	var params = [][]byte{[]byte(topic)}
-	return &Command{[]byte("PUB"), params, body}
+	cmd := &struct {
+		Command
+		params [1][]byte
+	}{}
+	cmd.params[0] = []byte(topic)
+	cmd.Command = Command{namePUB, cmd.params[:], body}
+	return &cmd.Command
 }
 
 // DeferredPublish creates a new Command to write a message to a given topic
@@ -180,30 +235,26 @@ func Subscribe(topic string, channel string) *Command {
 // Ready creates a new Command to specify
 // the number of messages a client is willing to receive
 func Ready(count int) *Command {
-	var params = [][]byte{[]byte(strconv.Itoa(count))}
-	return &Command{[]byte("RDY"), params, nil}
+	return new(msgCommand).ready(count)
 }
 
 // Finish creates a new Command to indiciate that
 // a given message (by id) has been processed successfully
 func Finish(id MessageID) *Command {
-	var params = [][]byte{id[:]}
-	return &Command{[]byte("FIN"), params, nil}
+	return new(msgCommand).finish(id)
 }
 
 // Requeue creates a new Command to indicate that
 // a given message (by id) should be requeued after the given delay
 // NOTE: a delay of 0 indicates immediate requeue
 func Requeue(id MessageID, delay time.Duration) *Command {
-	var params = [][]byte{id[:], []byte(strconv.Itoa(int(delay / time.Millisecond)))}
-	return &Command{[]byte("REQ"), params, nil}
+	return new(msgCommand).requeue(id, delay)
 }
 
 // Touch creates a new Command to reset the timeout for
 // a given message (by id)
 func Touch(id MessageID) *Command {
-	var params = [][]byte{id[:]}
-	return &Command{[]byte("TOUCH"), params, nil}
+	return new(msgCommand).touch(id)
 }
 
 // StartClose creates a new Command to indicate that the
@@ -214,6 +265,14 @@ func StartClose() *Command {
 	return &Command{[]byte("CLS"), nil, nil}
 }
 
+// NewRawCommand creates a new Command with the given name, parameters and body (nil for
+// none), for the verbs of patched or forked nsqd that this package has no builder for.
+//
+// Send it with Producer.SendCommand, which returns the response correlated with it.
+func NewRawCommand(name string, params [][]byte, body []byte) *Command {
+	return &Command{[]byte(name), params, body}
+}
+
 // Nop creates a new Command that has no effect server side.
 // Commonly used to respond to heartbeats
 func Nop() *Command {
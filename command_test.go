@@ -2,7 +2,9 @@ package nsq
 
 import (
 	"bytes"
+	"io/ioutil"
 	"testing"
+	"time"
 )
 
 func BenchmarkCommand(b *testing.B) {
@@ -16,3 +18,72 @@ func BenchmarkCommand(b *testing.B) {
 		cmd.WriteTo(&buf)
 	}
 }
+
+func TestCommandSerialization(t *testing.T) {
+	id := MessageID{'0', '1', '2', '3', '4', '5', '6', '7', '8', '9', 'a', 'b', 'c', 'd', 'e', 'f'}
+	tests := []struct {
+		cmd      *Command
+		expected string
+	}{
+		{Finish(id), "FIN 0123456789abcdef\n"},
+		{Requeue(id, 1500*time.Millisecond), "REQ 0123456789abcdef 1500\n"},
+		{Touch(id), "TOUCH 0123456789abcdef\n"},
+		{Ready(2500), "RDY 2500\n"},
+		{Publish("test", []byte("body")), "PUB test\n\x00\x00\x00\x04body"},
+		{Nop(), "NOP\n"},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		n, err := tt.cmd.WriteTo(&buf)
+		if err != nil || buf.String() != tt.expected || n != int64(len(tt.expected)) {
+			t.Fatalf("WriteTo = %q (%d, %v), expected %q", buf.String(), n, err, tt.expected)
+		}
+		if b := tt.cmd.AppendTo([]byte("x")); string(b) != "x"+tt.expected {
+			t.Fatalf("AppendTo = %q, expected %q", b, tt.expected)
+		}
+	}
+}
+
+func BenchmarkCommandFinish(b *testing.B) {
+	b.ReportAllocs()
+	id := MessageID{'f', 'i', 'n'}
+	for i := 0; i < b.N; i++ {
+		Finish(id).WriteTo(ioutil.Discard)
+	}
+}
+
+func BenchmarkCommandRequeue(b *testing.B) {
+	b.ReportAllocs()
+	id := MessageID{'r', 'e', 'q'}
+	for i := 0; i < b.N; i++ {
+		Requeue(id, 1500*time.Millisecond).WriteTo(ioutil.Discard)
+	}
+}
+
+func BenchmarkCommandReady(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		Ready(2500).WriteTo(ioutil.Discard)
+	}
+}
+
+func BenchmarkCommandPublish(b *testing.B) {
+	b.ReportAllocs()
+	body := make([]byte, 256)
+	for i := 0; i < b.N; i++ {
+		Publish("test", body).WriteTo(ioutil.Discard)
+	}
+}
+
+func BenchmarkConnResponse(b *testing.B) {
+	b.ReportAllocs()
+	c := NewConn("127.0.0.1:4150", NewConfig(), nil)
+	c.msgResponseChan = make(chan *msgResponse, 1)
+	msg := NewMessage(MessageID{'f', 'i', 'n'}, nil)
+	for i := 0; i < b.N; i++ {
+		c.onMessageFinish(msg)
+		resp := <-c.msgResponseChan
+		resp.cmd.WriteTo(ioutil.Discard)
+		putMsgResponse(resp)
+	}
+}
@@ -0,0 +1,156 @@
+package nsq
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"sync"
+
+	"github.com/golang/snappy"
+)
+
+// HeaderContentEncoding is the header naming the Compressor of the body of a message
+// compressed by a Producer (see Config.MessageCompression)
+const HeaderContentEncoding = "content-encoding"
+
+// Compressor compresses and decompresses individual message bodies (see
+// Config.MessageCompression and RegisterCompressor)
+type Compressor interface {
+	Compress(data []byte) ([]byte, error)
+	Decompress(data []byte) ([]byte, error)
+}
+
+var compressors = struct {
+	sync.RWMutex
+	m map[string]Compressor
+}{
+	m: map[string]Compressor{
+		"gzip":   GzipCompressor{},
+		"snappy": SnappyCompressor{},
+	},
+}
+
+// RegisterCompressor adds compressor to the registry of compressors, used by Producers
+// with Config.MessageCompression set to encoding, and by Consumers to decompress bodies
+// with a HeaderContentEncoding header of encoding. Registering an encoding again replaces
+// its compressor.
+//
+// gzip and snappy compressors are registered by default. To keep this package free of
+// dependencies, others (e.g. zstd) are registered by the application, in both producing
+// and consuming processes:
+//
+//	type zstdCompressor struct {
+//		enc *zstd.Encoder
+//		dec *zstd.Decoder
+//	}
+//
+//	func (c zstdCompressor) Compress(data []byte) ([]byte, error) {
+//		return c.enc.EncodeAll(data, nil), nil
+//	}
+//
+//	func (c zstdCompressor) Decompress(data []byte) ([]byte, error) {
+//		return c.dec.DecodeAll(data, nil)
+//	}
+//
+//	nsq.RegisterCompressor("zstd", zstdCompressor{enc, dec})
+func RegisterCompressor(encoding string, compressor Compressor) {
+	compressors.Lock()
+	compressors.m[encoding] = compressor
+	compressors.Unlock()
+}
+
+// LookupCompressor returns the compressor registered for encoding
+func LookupCompressor(encoding string) (Compressor, bool) {
+	compressors.RLock()
+	compressor, ok := compressors.m[encoding]
+	compressors.RUnlock()
+	return compressor, ok
+}
+
+// GzipCompressor is a Compressor using compress/gzip
+type GzipCompressor struct{}
+
+// Compress implements the Compressor interface
+func (GzipCompressor) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decompress implements the Compressor interface
+func (GzipCompressor) Decompress(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// SnappyCompressor is a Compressor using the snappy block format
+type SnappyCompressor struct{}
+
+// Compress implements the Compressor interface
+func (SnappyCompressor) Compress(data []byte) ([]byte, error) {
+	return snappy.Encode(nil, data), nil
+}
+
+// Decompress implements the Compressor interface
+func (SnappyCompressor) Decompress(data []byte) ([]byte, error) {
+	return snappy.Decode(nil, data)
+}
+
+// compressBody compresses body (or the body of its envelope) with the compressor
+// named encoding when it is at least threshold bytes, returning an envelope with a
+// HeaderContentEncoding header, or body when compression does not make it smaller
+func compressBody(body []byte, encoding string, threshold int) ([]byte, error) {
+	if encoding == "" {
+		return body, nil
+	}
+	headers, inner, ok := DecodeEnvelope(body)
+	if len(inner) < threshold || headers.Get(HeaderContentEncoding) != "" {
+		return body, nil
+	}
+	compressor, found := LookupCompressor(encoding)
+	if !found {
+		return nil, fmt.Errorf("no compressor registered for %s", encoding)
+	}
+	compressed, err := compressor.Compress(inner)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compress body with %s - %s", encoding, err)
+	}
+	if len(compressed) >= len(inner) {
+		return body, nil
+	}
+	if ok {
+		headers = headers.clone()
+	} else {
+		headers = Headers{}
+	}
+	headers.Set(HeaderContentEncoding, encoding)
+	return EncodeEnvelope(headers, compressed), nil
+}
+
+// decompressBody decompresses the body of an envelope with a HeaderContentEncoding header,
+// returning the remaining headers (if any) and the decompressed body
+func decompressBody(headers Headers, body []byte) (Headers, []byte, error) {
+	encoding := headers.Get(HeaderContentEncoding)
+	compressor, ok := LookupCompressor(encoding)
+	if !ok {
+		return nil, nil, fmt.Errorf("no compressor registered for %s", encoding)
+	}
+	decompressed, err := compressor.Decompress(body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to decompress body with %s - %s", encoding, err)
+	}
+	headers = headers.clone()
+	headers.Del(HeaderContentEncoding)
+	return headers, decompressed, nil
+}
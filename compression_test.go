@@ -0,0 +1,120 @@
+package nsq
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCompressBody(t *testing.T) {
+	body := bytes.Repeat([]byte("compressible "), 200)
+	for _, encoding := range []string{"gzip", "snappy"} {
+		compressed, err := compressBody(body, encoding, 1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		headers, inner, ok := DecodeEnvelope(compressed)
+		if !ok || headers.Get(HeaderContentEncoding) != encoding || len(inner) >= len(body) {
+			t.Fatalf("%s: body should be compressed in an envelope, got %v (%d bytes)", encoding, headers, len(inner))
+		}
+		headers, decompressed, err := decompressBody(headers, inner)
+		if err != nil || len(headers) != 0 || !bytes.Equal(decompressed, body) {
+			t.Fatalf("%s: unexpected decompressed body %v (%v)", encoding, headers, err)
+		}
+
+		// the headers of an envelope are kept
+		compressed, _ = compressBody(EncodeEnvelope(Headers{HeaderTenantID: "acme"}, body), encoding, 1024)
+		headers, inner, _ = DecodeEnvelope(compressed)
+		headers, decompressed, err = decompressBody(headers, inner)
+		if err != nil || headers.Get(HeaderTenantID) != "acme" || len(headers) != 1 || !bytes.Equal(decompressed, body) {
+			t.Fatalf("%s: unexpected decompressed envelope %v (%v)", encoding, headers, err)
+		}
+	}
+
+	// below the threshold, or incompressible
+	for _, b := range [][]byte{body[:100], []byte("x")} {
+		if compressed, err := compressBody(b, "gzip", 10); err != nil || !bytes.Equal(compressed, b) {
+			t.Fatalf("body %q should not be compressed (%v)", b, err)
+		}
+	}
+	if _, err := compressBody(body, "zstd", 1024); err == nil {
+		t.Fatalf("compressing with an unregistered compressor should fail")
+	}
+
+	config := NewConfig()
+	config.Set("message_compression", "zstd")
+	if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "MessageCompression zstd") {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	config = NewConfig()
+	config.Set("message_compression", "gzip")
+	config.Set("stream_body_threshold", 65536)
+	if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "StreamBodyThreshold") {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestConsumerDecompression(t *testing.T) {
+	body := bytes.Repeat([]byte("compressible "), 200)
+	plain, _ := compressBody(body, "gzip", 0)
+	enveloped, _ := compressBody(EncodeEnvelope(Headers{HeaderTenantID: "acme"}, body), "snappy", 0)
+	corrupt := EncodeEnvelope(Headers{HeaderContentEncoding: "gzip"}, []byte("not gzip"))
+
+	for _, decodeEnvelopes := range []bool{false, true} {
+		script := []instruction{
+			// IDENTIFY
+			instruction{0, FrameTypeResponse, []byte("OK")},
+			// SUB
+			instruction{0, FrameTypeResponse, []byte("OK")},
+			instruction{20 * time.Millisecond, FrameTypeMessage, frameMessage(NewMessage(MessageID{'1'}, plain))},
+			instruction{0, FrameTypeMessage, frameMessage(NewMessage(MessageID{'2'}, enveloped))},
+			instruction{0, FrameTypeMessage, frameMessage(NewMessage(MessageID{'3'}, corrupt))},
+			// needed to exit test
+			instruction{50 * time.Millisecond, -1, []byte("exit")},
+		}
+		addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+		n := newMockNSQD(t, script, addr.String())
+
+		config := NewConfig()
+		config.DecodeEnvelopes = decodeEnvelopes
+		config.MaxInFlight = 3
+		q, _ := NewConsumer("test_decompression", "ch", config)
+		q.SetLogger(nullLogger, LogLevelInfo)
+		handled := make(chan *Message, 3)
+		q.AddHandler(HandlerFunc(func(m *Message) error {
+			handled <- m
+			return nil
+		}))
+		if err := q.ConnectToNSQD(n.tcpAddr.String()); err != nil {
+			t.Fatal(err)
+		}
+		<-n.exitChan
+		q.Stop()
+		<-q.StopChan
+
+		for i := 0; i < 3; i++ {
+			m := <-handled
+			headers, b, _ := m.Envelope()
+			switch m.ID[0] {
+			case '1':
+				if !bytes.Equal(b, body) || len(headers) != 0 {
+					t.Fatalf("unexpected body of a compressed message %v (%d bytes)", headers, len(b))
+				}
+				if !decodeEnvelopes && !bytes.Equal(m.Body, body) {
+					t.Fatalf("compressed message without headers should be delivered without envelope")
+				}
+			case '2':
+				if !bytes.Equal(b, body) || len(headers) != 1 || headers.Get(HeaderTenantID) != "acme" {
+					t.Fatalf("unexpected envelope of a compressed message %v (%d bytes)", headers, len(b))
+				}
+			case '3':
+				if headers.Get(HeaderContentEncoding) != "gzip" || string(b) != "not gzip" {
+					t.Fatalf("corrupt message should be delivered as is, got %v %q", headers, b)
+				}
+			}
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package nsq
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"errors"
@@ -10,8 +11,10 @@ import (
 	"math"
 	"math/rand"
 	"net"
+	"net/http"
 	"os"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -52,6 +55,10 @@ func (s *ExponentialStrategy) setConfig(cfg *Config) {
 	s.cfg = cfg
 }
 
+func (s *ExponentialStrategy) withConfig(cfg *Config) BackoffStrategy {
+	return &ExponentialStrategy{cfg: cfg}
+}
+
 // FullJitterStrategy implements http://www.awsarchitectureblog.com/2015/03/backoff.html
 type FullJitterStrategy struct {
 	cfg *Config
@@ -79,6 +86,102 @@ func (s *FullJitterStrategy) setConfig(cfg *Config) {
 	s.cfg = cfg
 }
 
+func (s *FullJitterStrategy) withConfig(cfg *Config) BackoffStrategy {
+	return &FullJitterStrategy{cfg: cfg}
+}
+
+// RequeueDelayStrategy defines a strategy for calculating the delay used when
+// a message is requeued without an explicit delay (i.e. when a handler returns an
+// error or calls Requeue(-1)) for a message on its given attempt.
+//
+// The result is bounded by the configured MaxRequeueDelay.
+type RequeueDelayStrategy interface {
+	RequeueDelay(attempts uint16, defaultDelay time.Duration, maxDelay time.Duration) time.Duration
+}
+
+// LinearRequeueStrategy implements a linear requeue delay strategy (default)
+type LinearRequeueStrategy struct{}
+
+// RequeueDelay returns a duration of time: defaultDelay * attempts
+func (s *LinearRequeueStrategy) RequeueDelay(attempts uint16, defaultDelay time.Duration,
+	maxDelay time.Duration) time.Duration {
+	delay := defaultDelay * time.Duration(attempts)
+	if delay > maxDelay || (defaultDelay > 0 && delay/defaultDelay != time.Duration(attempts)) {
+		return maxDelay
+	}
+	return delay
+}
+
+// ExponentialRequeueStrategy implements an exponential requeue delay strategy
+type ExponentialRequeueStrategy struct{}
+
+// RequeueDelay returns a duration of time: defaultDelay * 2 ^ (attempts - 1)
+func (s *ExponentialRequeueStrategy) RequeueDelay(attempts uint16, defaultDelay time.Duration,
+	maxDelay time.Duration) time.Duration {
+	return exponentialRequeueDelay(attempts, defaultDelay, maxDelay)
+}
+
+// FullJitterRequeueStrategy implements an exponential requeue delay strategy with
+// full jitter (see http://www.awsarchitectureblog.com/2015/03/backoff.html)
+type FullJitterRequeueStrategy struct {
+	rngOnce sync.Once
+	rngMtx  sync.Mutex
+	rng     *rand.Rand
+}
+
+// RequeueDelay returns a random duration of time [0, defaultDelay * 2 ^ (attempts - 1)]
+func (s *FullJitterRequeueStrategy) RequeueDelay(attempts uint16, defaultDelay time.Duration,
+	maxDelay time.Duration) time.Duration {
+	// lazily initialize the RNG
+	s.rngOnce.Do(func() {
+		if s.rng != nil {
+			return
+		}
+		s.rng = rand.New(rand.NewSource(time.Now().UnixNano()))
+	})
+
+	delay := exponentialRequeueDelay(attempts, defaultDelay, maxDelay)
+	if delay <= 0 {
+		return 0
+	}
+	s.rngMtx.Lock()
+	defer s.rngMtx.Unlock()
+	return time.Duration(s.rng.Int63n(int64(delay) + 1))
+}
+
+// EqualJitterRequeueStrategy implements an exponential requeue delay strategy with
+// equal jitter (see http://www.awsarchitectureblog.com/2015/03/backoff.html), spreading
+// requeues while still growing with attempts (default of Message.RequeueWithBackoff)
+type EqualJitterRequeueStrategy struct {
+	FullJitterRequeueStrategy
+}
+
+// RequeueDelay returns a random duration of time [d/2, d], where
+// d = defaultDelay * 2 ^ (attempts - 1)
+func (s *EqualJitterRequeueStrategy) RequeueDelay(attempts uint16, defaultDelay time.Duration,
+	maxDelay time.Duration) time.Duration {
+	half := exponentialRequeueDelay(attempts, defaultDelay, maxDelay) / 2
+	return half + s.FullJitterRequeueStrategy.RequeueDelay(1, half, half)
+}
+
+func exponentialRequeueDelay(attempts uint16, defaultDelay time.Duration,
+	maxDelay time.Duration) time.Duration {
+	if attempts == 0 {
+		return 0
+	}
+	delay := defaultDelay
+	for i := uint16(1); i < attempts; i++ {
+		delay *= 2
+		if delay >= maxDelay || delay <= 0 {
+			return maxDelay
+		}
+	}
+	if delay > maxDelay {
+		return maxDelay
+	}
+	return delay
+}
+
 // Config is a struct of NSQ options
 //
 // The only valid way to create a Config is via NewConfig, using a struct literal will panic.
@@ -93,15 +196,106 @@ type Config struct {
 	configHandlers []configHandler
 
 	DialTimeout time.Duration `opt:"dial_timeout" default:"1s"`
+	// Host names of nsqd addresses are resolved on every connection attempt, and when
+	// resolving to several IPs they are dialed in a rotating order, starting the next
+	// attempt after DialFallbackDelay while earlier ones are pending (0 == dial all at
+	// once). Addresses are passed to a custom DialContext as is.
+	DialFallbackDelay time.Duration `opt:"dial_fallback_delay" min:"0" default:"300ms"`
 
 	// Deadlines for network reads and writes
 	ReadTimeout  time.Duration `opt:"read_timeout" min:"100ms" max:"5m" default:"60s"`
 	WriteTimeout time.Duration `opt:"write_timeout" min:"100ms" max:"5m" default:"1s"`
+	// Deadline for writing a publish command (PUB, MPUB, DPUB), which may legitimately take
+	// longer than control commands such as FIN and REQ (0 == WriteTimeout)
+	PublishWriteTimeout time.Duration `opt:"publish_write_timeout" min:"0" max:"5m"`
+
+	// Sizes of the buffers used for reading from and writing to each nsqd connection, e.g.
+	// 1MB for high throughput consumers or 4KB for memory constrained clients. Buffers are
+	// shared by connections via a pool
+	ReadBufferSize  int `opt:"read_buffer_size" min:"512" max:"16777216" default:"4096"`
+	WriteBufferSize int `opt:"write_buffer_size" min:"512" max:"16777216" default:"4096"`
+
+	// Coalesce the FIN, REQ, TOUCH and RDY commands written to each connection, flushing
+	// them in a single write once WriteCoalesceMax are buffered or WriteCoalesceLinger has
+	// passed since the first was, to cut syscalls under high throughput (0 == flush every
+	// command). Consumer.OnDelivery hooks are called once the coalesced responses have been
+	// flushed, and an error flushing them closes the connection. Coalescing is disabled with
+	// SharedWriteLoops
+	WriteCoalesceLinger time.Duration `opt:"write_coalesce_linger" min:"0" max:"100ms"`
+	WriteCoalesceMax    int           `opt:"write_coalesce_max" min:"1" max:"1024" default:"64"`
+
+	// Read message frames into pooled buffers, which Message.Body aliases, rather than
+	// allocating a buffer per message. A buffer is returned to the pool once its message
+	// has been responded to (FIN or REQ), or, when auto-response is disabled (see
+	// Message.DisableAutoResponse), when Message.Release is called, after which Body must
+	// not be used (copy it to retain it). The buffer of a message whose handler timed out
+	// (see HandlerTimeout) is returned once the handler does.
+	ZeroCopy bool `opt:"zero_copy"`
+
+	// Stream the bodies of messages larger than this many bytes directly from the
+	// connection, rather than buffering them before the handler runs (0 == disabled).
+	// Handlers read these bodies with Message.BodyReader (Body is empty, see
+	// Message.Streamed), e.g. to pipe them to disk or object storage, and envelopes are
+	// not decoded, nor bodies compressed by a Producer (see MessageCompression)
+	// decompressed, so it cannot be set together with MessageCompression. As no other
+	// message can be read from the connection meanwhile, the body should be read promptly:
+	// the rest of it is discarded once the message is responded to.
+	StreamBodyThreshold int `opt:"stream_body_threshold" min:"0"`
+
+	// Share a fixed number of write loops between all connections, rather than running one
+	// per connection, and borrow write buffers from the pool only while a command is being
+	// written (reads are unbuffered), for processes connected to thousands of nsqd
+	// (0 == a write loop and dedicated buffers per connection).
+	//
+	// Only writes are shared: each connection still runs its own goroutine reading from it
+	// (parked by the runtime while the connection is idle), so the per-connection overhead
+	// is reduced, not constant. Connections are assigned to the loops round robin and each
+	// loop writes one command at a time, so a slow or stalled connection blocks every
+	// connection sharing its loop for up to WriteTimeout per write (head-of-line
+	// blocking): use enough loops, and a WriteTimeout short enough, to bound the delay.
+	SharedWriteLoops int `opt:"shared_write_loops" min:"0" max:"1024"`
+
+	// Speak the protocol extensions of partitioned NSQ forks (such as youzan/nsq), for
+	// clients of clusters of either kind: Consumers subscribe to each partition of the topic
+	// listed by nsqlookupd (or to Partition of nsqd connected to directly, see
+	// PartitionAddress), optionally in order, and Producer.PublishWithTrace publishes to a
+	// partition with a trace ID
+	ExtendedProtocol bool `opt:"extended_protocol"`
+	// The partition to subscribe to on nsqd connected to directly, rather than via
+	// nsqlookupd (-1 == any, as chosen by nsqd)
+	Partition int `opt:"partition" min:"-1" default:"-1"`
+	// Subscribe with SUB_ORDERED, to receive the messages of each partition in order
+	OrderedSubscribe bool `opt:"ordered_subscribe"`
 
 	// LocalAddr is the local address to use when dialing an nsqd.
 	// If empty, a local address is automatically chosen.
 	LocalAddr net.Addr `opt:"local_addr"`
 
+	// DialContext, when set, is used in place of a net.Dialer to dial every nsqd, as well
+	// as nsqlookupd and the nsqd HTTP API unless LookupdHTTPClient is set, e.g. to set
+	// socket options via net.Dialer.Control or to use a connection broker.
+	//
+	// The context passed to it carries the DialTimeout deadline. LocalAddr is ignored.
+	DialContext DialContextFunc
+
+	// Socket options of nsqd connections: TCPNoDelay disables Nagle's algorithm (lowering
+	// latency at the cost of more packets), SocketSendBuffer and SocketReceiveBuffer set
+	// SO_SNDBUF and SO_RCVBUF (0 == the OS default), and TCPKeepAlive is the period between
+	// keep-alive probes (0 == the net.Dialer default, negative to disable keep-alives).
+	//
+	// They are applied to connections returned by DialContext too, when *net.TCPConn. Use
+	// net.Dialer.Control (see DialContext) to set other options, e.g. socket marks.
+	TCPNoDelay          bool          `opt:"tcp_no_delay" default:"true"`
+	SocketSendBuffer    int           `opt:"socket_send_buffer" min:"0"`
+	SocketReceiveBuffer int           `opt:"socket_receive_buffer" min:"0"`
+	TCPKeepAlive        time.Duration `opt:"tcp_keep_alive"`
+
+	// Proxy, when set, is the URL of a SOCKS5 (`socks5://[user:password@]host:port`) or
+	// HTTP CONNECT (`http://[user:password@]host:port`) proxy through which nsqd TCP
+	// connections are made (see NewProxyDialContext). TLS, when enabled, is negotiated with
+	// nsqd through the proxy.
+	Proxy string `opt:"proxy"`
+
 	// Duration between polling lookupd for new producers, and fractional jitter to add to
 	// the lookupd pool loop. this helps evenly distribute requests even if multiple consumers
 	// restart at the same time
@@ -111,9 +305,45 @@ type Config struct {
 	LookupdPollInterval time.Duration `opt:"lookupd_poll_interval" min:"10ms" max:"5m" default:"60s"`
 	LookupdPollJitter   float64       `opt:"lookupd_poll_jitter" min:"0" max:"1" default:"0.3"`
 
+	// LookupdPollAdaptive varies the duration between polls of lookupd (and Discoverers)
+	// within [LookupdPollMinInterval, LookupdPollMaxInterval], starting at LookupdPollInterval:
+	// a poll that discovers a change in topology (an nsqd added or removed) shortens it to
+	// LookupdPollMinInterval, while every poll without changes doubles it (plus
+	// LookupdPollJitter), reducing the load on lookupd during steady state.
+	LookupdPollAdaptive    bool          `opt:"lookupd_poll_adaptive"`
+	LookupdPollMinInterval time.Duration `opt:"lookupd_poll_min_interval" min:"10ms" max:"5m" default:"5s"`
+	LookupdPollMaxInterval time.Duration `opt:"lookupd_poll_max_interval" min:"10ms" max:"60m" default:"5m"`
+
+	// LookupdHTTPClient, when set, is used to query nsqlookupd in place of the default client
+	// (which does not reuse connections and times out after 2s), e.g. to use TLS with a
+	// private CA (for https:// nsqlookupd addresses), a proxy, or different timeouts.
+	//
+	// LookupdHTTPHeader is added to every nsqlookupd request, e.g. an Authorization header
+	// required by a proxy in front of nsqlookupd.
+	LookupdHTTPClient *http.Client
+	LookupdHTTPHeader http.Header
+
+	// DepthMonitorInterval, when non-zero, is the duration between polls of the /stats
+	// endpoint of every connected nsqd, monitoring the depth of the subscribed channel
+	// (see Consumer.Lag and Consumer.OnLagThreshold).
+	//
+	// The HTTP address of nsqd discovered via nsqlookupd is known, otherwise the nsqd
+	// TCP port + 1 is assumed (as per the nsqd defaults of 4150 and 4151).
+	DepthMonitorInterval time.Duration `opt:"depth_monitor_interval" min:"0" max:"60m"`
+
+	// Stop the Consumer (see Consumer.Wait) after MaxLookupdFailures consecutive polls in
+	// which every nsqlookupd query failed, or after MaxReconnectAttempts consecutive failed
+	// attempts to connect to nsqd while no connection is established (0 == retry forever)
+	MaxLookupdFailures   int `opt:"max_lookupd_failures" min:"0"`
+	MaxReconnectAttempts int `opt:"max_reconnect_attempts" min:"0"`
+
 	// Maximum duration when REQueueing (for doubling of deferred requeue)
 	MaxRequeueDelay     time.Duration `opt:"max_requeue_delay" min:"0" max:"60m" default:"15m"`
 	DefaultRequeueDelay time.Duration `opt:"default_requeue_delay" min:"0" max:"60m" default:"90s"`
+	// Requeue delay strategy, defaults to linear (DefaultRequeueDelay * attempts), or
+	// "exponential", "full_jitter" or "equal_jitter".
+	// Overwrite this to define alternative requeue delay algorithms.
+	RequeueDelayStrategy RequeueDelayStrategy `opt:"requeue_delay_strategy" default:"linear"`
 
 	// Backoff strategy, defaults to exponential backoff. Overwrite this to define alternative backoff algrithms.
 	BackoffStrategy BackoffStrategy `opt:"backoff_strategy" default:"exponential"`
@@ -121,9 +351,105 @@ type Config struct {
 	MaxBackoffDuration time.Duration `opt:"max_backoff_duration" min:"0" max:"60m" default:"2m"`
 	// Unit of time for calculating consumer backoff
 	BackoffMultiplier time.Duration `opt:"backoff_multiplier" min:"0" max:"60m" default:"1s"`
+	// Track backoff state per nsqd connection, so that failures of messages received from
+	// one nsqd only backoff (set RDY 0 on) that connection rather than all of them
+	BackoffPerConnection bool `opt:"backoff_per_connection"`
 
 	// Maximum number of times this consumer will attempt to process a message before giving up
 	MaxAttempts uint16 `opt:"max_attempts" min:"0" max:"65535" default:"5"`
+	// Republish messages that exceed MaxAttempts to a dead-letter topic (by default
+	// `<topic>.<channel>.dlq`, see DeadLetterNamer) before FINishing them
+	DeadLetter bool `opt:"dead_letter"`
+
+	// Number of tiers of retry topics (0 == disabled). When set, messages whose handler
+	// fails are republished to the next tier's topic (by default `<topic>.retry.<tier>`,
+	// see RetryTopicNamer) with a delay, rather than REQueued, keeping the channel shallow
+	// during long downstream outages. Messages that fail in the last tier are REQueued.
+	//
+	// The Consumer also consumes its retry topics, on the same channel and with the same
+	// handlers, connecting to them alongside its own nsqlookupd, Discoverer or nsqd.
+	RetryTiers int `opt:"retry_tiers" min:"0" max:"10"`
+	// The delay of messages republished to the first retry tier, multiplied by
+	// RetryTierMultiplier for each subsequent tier (and limited by nsqd's max-req-timeout)
+	RetryTierDelay      time.Duration `opt:"retry_tier_delay" min:"1ms" default:"1m"`
+	RetryTierMultiplier float64       `opt:"retry_tier_multiplier" min:"1" default:"4"`
+
+	// Run as a shadow (canary) Consumer, e.g. on a separate channel to try out a new handler
+	// against production traffic: only ShadowFraction of messages are handled (chosen by
+	// message ID, the others are FINished as filtered) and messages are never REQueued,
+	// they are FINished instead (without backoff)
+	Shadow         bool    `opt:"shadow"`
+	ShadowFraction float64 `opt:"shadow_fraction" min:"0" max:"1" default:"1"`
+
+	// Maximum duration a handler may spend processing a single message (0 == no limit).
+	// When exceeded, the handler's context is cancelled and the message is REQueued
+	// (with backoff) without waiting for the handler to return, unless the handler disabled
+	// auto-response (see Message.DisableAutoResponse), leaving it to respond.
+	HandlerTimeout time.Duration `opt:"handler_timeout" min:"0"`
+	// Duration above which a handler processing a single message is considered slow
+	// (0 == disabled): a warning is logged, EventSlowHandler emitted and
+	// ConsumerStats.SlowHandlers incremented, to help identify poison messages
+	SlowHandlerThreshold time.Duration `opt:"slow_handler_threshold" min:"0"`
+
+	// Recover from panics in handlers, rather than crashing the process: the panic and
+	// its stack are logged, EventHandlerPanic emitted, ConsumerStats.HandlerPanics
+	// incremented and the message REQueued (without backoff, unless BackoffOnPanic)
+	RecoverPanics bool `opt:"recover_panics"`
+	// Republish messages whose handler panicked to the dead-letter topic (see DeadLetter)
+	// and FINish them, rather than REQueueing them
+	DeadLetterOnPanic bool `opt:"dead_letter_on_panic"`
+	// Trigger backoff when REQueueing a message whose handler panicked
+	BackoffOnPanic bool `opt:"backoff_on_panic"`
+
+	// Automatically TOUCH messages while their handler is still running, every
+	// AutoTouchFraction of the negotiated msg_timeout, until the handler returns or
+	// AutoTouchMaxExtension (measured from receipt, 0 == no limit) is reached
+	AutoTouch             bool          `opt:"auto_touch"`
+	AutoTouchFraction     float64       `opt:"auto_touch_fraction" min:"0.1" max:"0.9" default:"0.5"`
+	AutoTouchMaxExtension time.Duration `opt:"auto_touch_max_extension" min:"0"`
+
+	// Warn (log and emit EventMessageExpiring) when an in-flight message has been neither
+	// touched nor responded to within ExpiringMessageFraction of the negotiated msg_timeout
+	// (0 == disabled), e.g. to find messages whose auto-response was disabled but that are
+	// never FINished. With RequeueExpiringMessages they are also REQueued (without backoff),
+	// rather than left to time out.
+	ExpiringMessageFraction float64 `opt:"expiring_message_fraction" min:"0" max:"1"`
+	RequeueExpiringMessages bool    `opt:"requeue_expiring_messages"`
+
+	// Durations for which the IdempotencyStore of a Consumer (see Consumer.SetIdempotencyStore)
+	// holds the key of a message that is being processed, and of a message that has been
+	// processed. IdempotencyPendingTTL should exceed the time a handler may take.
+	IdempotencyPendingTTL time.Duration `opt:"idempotency_pending_ttl" min:"1ms" max:"24h" default:"5m"`
+	IdempotencyDoneTTL    time.Duration `opt:"idempotency_done_ttl" min:"1ms" max:"720h" default:"24h"`
+
+	// Codec used to decode message bodies for typed handlers (see AddTypedHandler and
+	// Message.Decode) without a content type, and to encode values published with
+	// Producer.PublishValue, defaults to JSON. Set by name, this is one of the codecs
+	// registered with RegisterCodec, e.g. "json", "raw" or "application/x-protobuf".
+	Codec Codec `opt:"codec" default:"json"`
+
+	// Decode the envelope (see EncodeEnvelope) of received messages, setting
+	// Message.Headers and leaving only the enclosed body in Message.Body
+	DecodeEnvelopes bool `opt:"decode_envelopes"`
+	// SchemaValidator, when set, validates the bodies of messages before they are
+	// published by a Producer (which returns the error, typically an ErrSchemaValidation)
+	// and before they are passed to the handlers of a Consumer, or sent on its Messages
+	// channel (which passes the error to its DecodeErrorHandler, see
+	// Consumer.SetDecodeErrorHandler), e.g. a JSONSchemaValidator. Streamed bodies (see
+	// StreamBodyThreshold) and batch handlers are not validated.
+	SchemaValidator SchemaValidator
+
+	// Propagator used by Message.Context to extract the values carried in the headers
+	// of a message, e.g. the trace context of the producing request (default:
+	// HeaderPropagator)
+	Propagator Propagator
+
+	// Maximum rate at which messages are passed to handlers (0 == unlimited). Messages
+	// are held (in flight) until they may be handled, which in turn limits the rate at
+	// which nsqd delivers them, so MaxInFlight should not exceed what can be handled at
+	// this rate within the msg_timeout. Backoff is unaffected, nor is there a burst of
+	// messages when exiting it.
+	MaxMessagesPerSecond float64 `opt:"max_messages_per_second" min:"0"`
 
 	// Duration to wait for a message from an nsqd when in a state where RDY
 	// counts are re-distributed (e.g. max_in_flight < num_producers)
@@ -132,6 +458,14 @@ type Config struct {
 	LowRdyTimeout time.Duration `opt:"low_rdy_timeout" min:"1s" max:"5m" default:"30s"`
 	// Duration between redistributing max-in-flight to connections
 	RDYRedistributeInterval time.Duration `opt:"rdy_redistribute_interval" min:"1ms" max:"5s" default:"5s"`
+	// Strategy used to choose which connections receive RDY when redistributing,
+	// "random" (default) or "weighted" (by depth or recent message rate, see
+	// WeightedRDYStrategy). Overwrite this to define alternative policies.
+	RDYStrategy RDYStrategy `opt:"rdy_strategy" default:"random"`
+	// Duration over which the RDY count of a new connection (or of connections exiting
+	// backoff) is raised gradually from 1 to its share of max-in-flight, rather than all
+	// at once (0 == disabled), so handlers with cold caches or pools aren't flooded
+	RDYRampUpDuration time.Duration `opt:"rdy_ramp_up_duration" min:"0" max:"10m"`
 
 	// Identifiers sent to nsqd representing this client
 	// UserAgent is in the spirit of HTTP (default: "<client_library_name>/<version>")
@@ -139,8 +473,21 @@ type Config struct {
 	Hostname  string `opt:"hostname"`
 	UserAgent string `opt:"user_agent"`
 
+	// Additional fields sent in the IDENTIFY body, e.g. deployment, version or region
+	// (fields named like the built-in ones are ignored). As nsqd only records the built-in
+	// fields, they are also appended to the user agent shown in nsqadmin's client list,
+	// e.g. "go-nsq/1.1.0 (deployment=prod; region=eu)".
+	IdentifyMetadata map[string]string
+	// IdentifyHook, when set, is called with the address of the nsqd and the IDENTIFY
+	// body of every connection before it is sent, to inspect (or modify) it
+	IdentifyHook func(addr string, body map[string]interface{})
+
 	// Duration of time between heartbeats. This must be less than ReadTimeout
 	HeartbeatInterval time.Duration `opt:"heartbeat_interval" default:"30s"`
+	// Close (and reconnect) a connection once this many consecutive heartbeats have been
+	// missed (0 == disabled), e.g. detecting half-open connections through NAT sooner than
+	// ReadTimeout would
+	MaxMissedHeartbeats int `opt:"max_missed_heartbeats" min:"0"`
 	// Integer percentage to sample the channel (requires nsqd 0.2.25+)
 	SampleRate int32 `opt:"sample_rate" min:"0" max:"99"`
 
@@ -151,16 +498,37 @@ type Config struct {
 	// tls_insecure_skip_verify - Bool indicates whether this client should verify server certificates
 	// tls_cert - String path to file containing public key for certificate
 	// tls_key - String path to file containing private key for certificate
+	// tls_cert_reload - Bool reload tls_cert and tls_key when they change on disk, for new
+	//                   connections (see CertificateReloader)
 	// tls_min_version - String indicating the minimum version of tls acceptable ('ssl3.0', 'tls1.0', 'tls1.1', 'tls1.2')
+	// tls_server_name - String server name used to verify the certificate presented by nsqd
+	//                   (defaults to the host portion of the nsqd address being connected to)
 	//
 	TlsV1     bool        `opt:"tls_v1"`
 	TlsConfig *tls.Config `opt:"tls_config"`
 
+	// TlsConfigForAddr, when set, is called with the address of the nsqd being connected to
+	// and returns the TLS configuration to use for that connection in place of TlsConfig.
+	//
+	// This is useful when TLS is terminated by something other than nsqd (e.g. a load balancer)
+	// and a per-address ServerName (or an entirely different tls.Config) is required.
+	// Returning nil falls back to TlsConfig.
+	TlsConfigForAddr func(addr string) *tls.Config
+
 	// Compression Settings
 	Deflate      bool `opt:"deflate"`
 	DeflateLevel int  `opt:"deflate_level" min:"1" max:"9" default:"6"`
 	Snappy       bool `opt:"snappy"`
 
+	// Compress the bodies of published messages of at least MessageCompressionThreshold
+	// bytes with this Compressor, e.g. "gzip" or "snappy" (see RegisterCompressor), when
+	// connection-level compression is not available. Compressed bodies are published in an
+	// envelope with a HeaderContentEncoding header, and transparently decompressed by
+	// Consumers (with the compressor registered), except those streaming them (see
+	// StreamBodyThreshold), whose handlers read them compressed, in their envelope.
+	MessageCompression          string `opt:"message_compression"`
+	MessageCompressionThreshold int    `opt:"message_compression_threshold" min:"0" default:"1024"`
+
 	// Size of the buffer (in bytes) used by nsqd for buffering writes to this connection
 	OutputBufferSize int64 `opt:"output_buffer_size" default:"16384"`
 	// Timeout used by nsqd before flushing buffered writes (set to 0 to disable).
@@ -172,12 +540,62 @@ type Config struct {
 
 	// Maximum number of messages to allow in flight (concurrency knob)
 	MaxInFlight int `opt:"max_in_flight" min:"0" default:"1"`
+	// Maximum summed body size (in bytes) of messages in flight (0 == no limit), in addition
+	// to MaxInFlight. While reached, RDY is withheld from all connections until enough
+	// messages are FINished or REQueued, bounding memory use when messages are large. It
+	// can be exceeded by messages already sent by nsqd before RDY 0 takes effect.
+	MaxInFlightBytes int64 `opt:"max_in_flight_bytes" min:"0"`
+
+	// Automatically tune max-in-flight (additive increase, multiplicative decrease) every
+	// AdaptiveMaxInFlightInterval based on observed handler latency and error rate.
+	//
+	// When the average handler latency exceeds AdaptiveMaxInFlightLatency (0 == ignore latency)
+	// or the error rate exceeds AdaptiveMaxInFlightErrorRate, max-in-flight is halved.
+	// Otherwise, when the Consumer is starved (see IsStarved), it is incremented.
+	// It is kept between AdaptiveMaxInFlightMin and AdaptiveMaxInFlightMax (0 == MaxInFlight).
+	AdaptiveMaxInFlight          bool          `opt:"adaptive_max_in_flight"`
+	AdaptiveMaxInFlightMin       int           `opt:"adaptive_max_in_flight_min" min:"1" default:"1"`
+	AdaptiveMaxInFlightMax       int           `opt:"adaptive_max_in_flight_max" min:"0"`
+	AdaptiveMaxInFlightInterval  time.Duration `opt:"adaptive_max_in_flight_interval" min:"100ms" max:"5m" default:"5s"`
+	AdaptiveMaxInFlightLatency   time.Duration `opt:"adaptive_max_in_flight_latency" min:"0"`
+	AdaptiveMaxInFlightErrorRate float64       `opt:"adaptive_max_in_flight_error_rate" min:"0" max:"1" default:"0.1"`
 
 	// The server-side message timeout for messages delivered to this client
 	MsgTimeout time.Duration `opt:"msg_timeout" min:"0"`
 
+	// Maximum time a stopping Consumer waits, after sending CLS, for nsqd to acknowledge
+	// (CLOSE_WAIT) and for the messages in flight to be responded to, before closing its
+	// connections and abandoning the remaining messages to be redelivered by nsqd
+	// (0 == wait indefinitely, see ConsumerStats.MessagesAbandoned)
+	DrainTimeout time.Duration `opt:"drain_timeout" min:"0" default:"30s"`
+
 	// secret for nsqd authentication (requires nsqd 0.2.29+)
 	AuthSecret string `opt:"auth_secret"`
+	// AuthProvider, when set, is asked for the secret each time a connection to an nsqd
+	// requiring authentication is made (in place of AuthSecret), so that short-lived
+	// tokens can be fetched when connecting and refreshed when reconnecting
+	AuthProvider AuthProvider
+	// Stop the Consumer (see Consumer.Wait) when nsqd rejects its authentication
+	StopOnAuthFailure bool `opt:"stop_on_auth_failure"`
+
+	// FrameTracer, when set, is called with every frame read from and command written to
+	// nsqd connections logging at LogLevelDebug, e.g. to debug protocol issues in
+	// production. FrameTraceMaxBytes truncates the payloads passed (0 == unlimited).
+	FrameTracer        FrameTracer
+	FrameTraceMaxBytes int `opt:"frame_trace_max_bytes" min:"0" default:"256"`
+
+	// Maximum number of messages buffered by Producer.PublishBestEffort before entries are dropped
+	BestEffortBufferSize int `opt:"best_effort_buffer_size" min:"1" default:"10000"`
+	// When the best-effort buffer is full, drop the newly published message instead of
+	// the oldest buffered message
+	BestEffortDropNewest bool `opt:"best_effort_drop_newest"`
+
+	// Maximum number of commands (e.g. publishes) a Producer sends to nsqd ahead of their
+	// responses (0 == unbounded). When reached, publishing waits up to
+	// PendingCommandsTimeout for a response to free a slot and then fails with
+	// ErrBackpressure, so that async publishers learn nsqd is not keeping up.
+	MaxPendingCommands     int           `opt:"max_pending_commands" min:"0"`
+	PendingCommandsTimeout time.Duration `opt:"pending_commands_timeout" min:"0"`
 }
 
 // NewConfig returns a new default nsq configuration.
@@ -221,7 +639,160 @@ func (c *Config) Set(option string, value interface{}) error {
 			return h.Set(c, option, value)
 		}
 	}
-	return fmt.Errorf("invalid option %s", option)
+	return ErrUnknownOption{Option: option, Suggestions: suggestOptions(option)}
+}
+
+// suggestOptions returns (at most 3 of) the options nearest to the unknown option, by
+// edit distance, each followed by its type
+func suggestOptions(option string) []string {
+	type candidate struct {
+		option   string
+		distance int
+	}
+	var candidates []candidate
+	squash := func(s string) string { return strings.Replace(s, "_", "", -1) }
+	for _, opt := range configOptions() {
+		d := editDistance(option, opt)
+		if sd := editDistance(squash(option), squash(opt)); sd < d {
+			d = sd
+		}
+		if d <= len(opt)/3 || strings.Contains(opt, option) || strings.Contains(option, opt) {
+			candidates = append(candidates, candidate{opt, d})
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].distance < candidates[j].distance
+	})
+	var suggestions []string
+	for i := 0; i < len(candidates) && i < 3; i++ {
+		opt := candidates[i].option
+		suggestions = append(suggestions, fmt.Sprintf("%s (%s)", opt, optionType(opt)))
+	}
+	return suggestions
+}
+
+// editDistance returns the Levenshtein distance between a and b
+func editDistance(a string, b string) int {
+	prev := make([]int, len(b)+1)
+	curr := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		curr[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			curr[j] = min3(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+// optionType returns the name of the type of the values of option
+func optionType(option string) string {
+	if field, ok := optionField(option); ok {
+		return strings.TrimPrefix(field.Type.String(), "nsq.")
+	}
+	if option == "tls_insecure_skip_verify" || option == "tls_cert_reload" {
+		return "bool"
+	}
+	return "string"
+}
+
+// Clone returns a copy of c whose options can be set independently of c, e.g. to
+// derive a Config for each topic from a base Config
+func (c *Config) Clone() *Config {
+	c.assertInitialized()
+	cc := *c
+	if c.TlsConfig != nil {
+		cc.TlsConfig = c.TlsConfig.Clone()
+	}
+	if c.IdentifyMetadata != nil {
+		cc.IdentifyMetadata = make(map[string]string, len(c.IdentifyMetadata))
+		for k, v := range c.IdentifyMetadata {
+			cc.IdentifyMetadata[k] = v
+		}
+	}
+	cc.configHandlers = make([]configHandler, len(c.configHandlers))
+	for i, h := range c.configHandlers {
+		if t, ok := h.(*tlsConfig); ok {
+			tc := *t
+			h = &tc
+		}
+		cc.configHandlers[i] = h
+	}
+	// the built-in backoff strategies read the multiplier from the Config they are set on
+	if s, ok := c.BackoffStrategy.(interface {
+		withConfig(*Config) BackoffStrategy
+	}); ok {
+		cc.BackoffStrategy = s.withConfig(&cc)
+	}
+	return &cc
+}
+
+// ConfigChange is an option whose value differs between two Configs (see Config.Diff)
+type ConfigChange struct {
+	Option string
+	Old    interface{}
+	New    interface{}
+}
+
+// String returns the string form of a ConfigChange, e.g. "max_in_flight: 1 -> 100"
+func (c ConfigChange) String() string {
+	return fmt.Sprintf("%s: %v -> %v", c.Option, c.Old, c.New)
+}
+
+// Diff returns the options (in the order of the Config fields) whose values in other
+// differ from those in c, e.g. to log the effective settings of a Consumer derived from
+// a base Config
+//
+// Options set through the tls_* options are reported as tls_config.
+func (c *Config) Diff(other *Config) []ConfigChange {
+	c.assertInitialized()
+	other.assertInitialized()
+	var changes []ConfigChange
+	val := reflect.ValueOf(c).Elem()
+	otherVal := reflect.ValueOf(other).Elem()
+	typ := val.Type()
+	for i := 0; i < typ.NumField(); i++ {
+		opt := typ.Field(i).Tag.Get("opt")
+		if opt == "" {
+			continue
+		}
+		old := val.Field(i).Interface()
+		new := otherVal.Field(i).Interface()
+		if !configValueEqual(old, new) {
+			changes = append(changes, ConfigChange{opt, old, new})
+		}
+	}
+	return changes
+}
+
+func configValueEqual(a interface{}, b interface{}) bool {
+	type configured interface {
+		withConfig(*Config) BackoffStrategy
+	}
+	// (the built-in backoff strategies only differ by the Config they are set on)
+	if _, ok := a.(configured); ok {
+		if _, ok := b.(configured); ok {
+			return reflect.TypeOf(a) == reflect.TypeOf(b)
+		}
+	}
+	return reflect.DeepEqual(a, b)
 }
 
 func (c *Config) assertInitialized() {
@@ -230,14 +801,23 @@ func (c *Config) assertInitialized() {
 	}
 }
 
-// Validate checks that all values are within specified min/max ranges
+// Validate checks that all values are within specified min/max ranges, and consistent
+// with each other (e.g. HeartbeatInterval < ReadTimeout), returning an ErrConfig listing
+// every violation
 func (c *Config) Validate() error {
 	c.assertInitialized()
+	var violations []string
 	for _, h := range c.configHandlers {
-		if err := h.Validate(c); err != nil {
-			return err
+		err := h.Validate(c)
+		if e, ok := err.(ErrConfig); ok {
+			violations = append(violations, e.Violations...)
+		} else if err != nil {
+			violations = append(violations, err.Error())
 		}
 	}
+	if len(violations) > 0 {
+		return ErrConfig{violations}
+	}
 	return nil
 }
 
@@ -288,8 +868,8 @@ func (h *structTagsConfig) Set(c *Config, option string, value interface{}) erro
 		dest := unsafeValueOf(fieldVal)
 		coercedVal, err := coerce(value, field.Type)
 		if err != nil {
-			return fmt.Errorf("failed to coerce option %s (%v) - %s",
-				option, value, err)
+			return fmt.Errorf("failed to coerce option %s (%v) to %s - %s",
+				option, value, optionType(option), err)
 		}
 		if min != "" {
 			coercedMinVal, _ := coerce(min, field.Type)
@@ -347,6 +927,7 @@ func (h *structTagsConfig) SetDefaults(c *Config) error {
 }
 
 func (h *structTagsConfig) Validate(c *Config) error {
+	var violations []string
 	val := reflect.ValueOf(c).Elem()
 	typ := val.Type()
 	for i := 0; i < typ.NumField(); i++ {
@@ -364,36 +945,79 @@ func (h *structTagsConfig) Validate(c *Config) error {
 		if min != "" {
 			coercedMinVal, _ := coerce(min, field.Type)
 			if valueCompare(value, coercedMinVal) == -1 {
-				return fmt.Errorf("invalid %s ! %v < %v",
-					field.Name, value.Interface(), coercedMinVal.Interface())
+				violations = append(violations, fmt.Sprintf("invalid %s ! %v < %v",
+					field.Name, value.Interface(), coercedMinVal.Interface()))
 			}
 		}
 		if max != "" {
 			coercedMaxVal, _ := coerce(max, field.Type)
 			if valueCompare(value, coercedMaxVal) == 1 {
-				return fmt.Errorf("invalid %s ! %v > %v",
-					field.Name, value.Interface(), coercedMaxVal.Interface())
+				violations = append(violations, fmt.Sprintf("invalid %s ! %v > %v",
+					field.Name, value.Interface(), coercedMaxVal.Interface()))
 			}
 		}
 	}
 
 	if c.HeartbeatInterval > c.ReadTimeout {
-		return fmt.Errorf("HeartbeatInterval %v must be less than ReadTimeout %v", c.HeartbeatInterval, c.ReadTimeout)
+		violations = append(violations, fmt.Sprintf("HeartbeatInterval %v must be less than ReadTimeout %v",
+			c.HeartbeatInterval, c.ReadTimeout))
+	}
+
+	if c.LookupdPollMinInterval > c.LookupdPollMaxInterval {
+		violations = append(violations, fmt.Sprintf("LookupdPollMinInterval %v must be less than LookupdPollMaxInterval %v",
+			c.LookupdPollMinInterval, c.LookupdPollMaxInterval))
+	}
+
+	if c.DefaultRequeueDelay > c.MaxRequeueDelay {
+		violations = append(violations, fmt.Sprintf("DefaultRequeueDelay %v must not exceed MaxRequeueDelay %v",
+			c.DefaultRequeueDelay, c.MaxRequeueDelay))
 	}
 
+	if c.AdaptiveMaxInFlightMax > 0 && c.AdaptiveMaxInFlightMin > c.AdaptiveMaxInFlightMax {
+		violations = append(violations, fmt.Sprintf("AdaptiveMaxInFlightMin %d must not exceed AdaptiveMaxInFlightMax %d",
+			c.AdaptiveMaxInFlightMin, c.AdaptiveMaxInFlightMax))
+	}
+
+	if c.MessageCompression != "" {
+		if _, ok := LookupCompressor(c.MessageCompression); !ok {
+			violations = append(violations, fmt.Sprintf("MessageCompression %s is not a registered compressor",
+				c.MessageCompression))
+		}
+		// streamed bodies would be read compressed
+		if c.StreamBodyThreshold > 0 {
+			violations = append(violations, fmt.Sprintf("MessageCompression %s cannot be set with StreamBodyThreshold",
+				c.MessageCompression))
+		}
+	}
+
+	// nsqd would time messages out (and redeliver them) before their handler does
+	if c.MsgTimeout > 0 && c.HandlerTimeout > c.MsgTimeout && !c.AutoTouch {
+		violations = append(violations, fmt.Sprintf("HandlerTimeout %v must not exceed MsgTimeout %v (without AutoTouch)",
+			c.HandlerTimeout, c.MsgTimeout))
+	}
+
+	if len(violations) > 0 {
+		return ErrConfig{violations}
+	}
 	return nil
 }
 
 // Parsing for higher order TLS settings
 type tlsConfig struct {
-	certFile string
-	keyFile  string
+	certFile   string
+	keyFile    string
+	certReload bool
 }
 
+// the options handled by tlsConfig
+var tlsOptions = []string{"tls_root_ca_file", "tls_insecure_skip_verify", "tls_cert", "tls_key",
+	"tls_cert_reload", "tls_min_version", "tls_server_name"}
+
 func (t *tlsConfig) HandlesOption(c *Config, option string) bool {
-	switch option {
-	case "tls_root_ca_file", "tls_insecure_skip_verify", "tls_cert", "tls_key", "tls_min_version":
-		return true
+	for _, opt := range tlsOptions {
+		if option == opt {
+			return true
+		}
 	}
 	return false
 }
@@ -408,13 +1032,30 @@ func (t *tlsConfig) Set(c *Config, option string, value interface{}) error {
 	val := reflect.ValueOf(c.TlsConfig).Elem()
 
 	switch option {
-	case "tls_cert", "tls_key":
-		if option == "tls_cert" {
+	case "tls_cert", "tls_key", "tls_cert_reload":
+		switch option {
+		case "tls_cert":
 			t.certFile = value.(string)
-		} else {
+		case "tls_key":
 			t.keyFile = value.(string)
+		default:
+			coercedVal, err := coerce(value, reflect.TypeOf(true))
+			if err != nil {
+				return fmt.Errorf("failed to coerce option %s (%v) - %s",
+					option, value, err)
+			}
+			t.certReload = coercedVal.Bool()
+		}
+		if t.certFile == "" || t.keyFile == "" {
+			return nil
 		}
-		if t.certFile != "" && t.keyFile != "" && len(c.TlsConfig.Certificates) == 0 {
+		if t.certReload {
+			reloader, err := NewCertificateReloader(t.certFile, t.keyFile)
+			if err != nil {
+				return err
+			}
+			c.TlsConfig.GetClientCertificate = reloader.GetClientCertificate
+		} else if len(c.TlsConfig.Certificates) == 0 {
 			cert, err := tls.LoadX509KeyPair(t.certFile, t.keyFile)
 			if err != nil {
 				return err
@@ -447,6 +1088,13 @@ func (t *tlsConfig) Set(c *Config, option string, value interface{}) error {
 		}
 		dest.Set(coercedVal)
 		return nil
+	case "tls_server_name":
+		serverName, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("ERROR: %v is not a string", value)
+		}
+		c.TlsConfig.ServerName = serverName
+		return nil
 	case "tls_min_version":
 		version, ok := value.(string)
 		if !ok {
@@ -471,6 +1119,9 @@ func (t *tlsConfig) Set(c *Config, option string, value interface{}) error {
 }
 
 func (t *tlsConfig) Validate(c *Config) error {
+	if (t.certFile == "") != (t.keyFile == "") {
+		return errors.New("tls_cert and tls_key must be set together")
+	}
 	return nil
 }
 
@@ -518,6 +1169,12 @@ func valueCompare(v1 reflect.Value, v2 reflect.Value) int {
 func coerce(v interface{}, typ reflect.Type) (reflect.Value, error) {
 	var err error
 	if typ.Kind() == reflect.Ptr {
+		if v == nil {
+			return reflect.Zero(typ), nil
+		}
+		if reflect.TypeOf(v) != typ {
+			return reflect.Value{}, errors.New("invalid value type")
+		}
 		return reflect.ValueOf(v), nil
 	}
 	switch typ.String() {
@@ -537,11 +1194,20 @@ func coerce(v interface{}, typ reflect.Type) (reflect.Value, error) {
 		v, err = coerceAddr(v)
 	case "nsq.BackoffStrategy":
 		v, err = coerceBackoffStrategy(v)
+	case "nsq.RequeueDelayStrategy":
+		v, err = coerceRequeueDelayStrategy(v)
+	case "nsq.RDYStrategy":
+		v, err = coerceRDYStrategy(v)
+	case "nsq.Codec":
+		v, err = coerceCodec(v)
 	default:
 		v = nil
 		err = fmt.Errorf("invalid type %s", typ.String())
 	}
-	return valueTypeCoerce(v, typ), err
+	if err != nil {
+		return reflect.Value{}, err
+	}
+	return valueTypeCoerce(v, typ), nil
 }
 
 func valueTypeCoerce(v interface{}, typ reflect.Type) reflect.Value {
@@ -616,6 +1282,56 @@ func coerceBackoffStrategy(v interface{}) (BackoffStrategy, error) {
 	return nil, errors.New("invalid value type")
 }
 
+func coerceRequeueDelayStrategy(v interface{}) (RequeueDelayStrategy, error) {
+	switch v := v.(type) {
+	case string:
+		switch v {
+		case "", "linear":
+			return &LinearRequeueStrategy{}, nil
+		case "exponential":
+			return &ExponentialRequeueStrategy{}, nil
+		case "full_jitter":
+			return &FullJitterRequeueStrategy{}, nil
+		case "equal_jitter":
+			return &EqualJitterRequeueStrategy{}, nil
+		}
+	case RequeueDelayStrategy:
+		return v, nil
+	}
+	return nil, errors.New("invalid value type")
+}
+
+func coerceRDYStrategy(v interface{}) (RDYStrategy, error) {
+	switch v := v.(type) {
+	case string:
+		switch v {
+		case "", "random":
+			return &RandomRDYStrategy{}, nil
+		case "weighted":
+			return &WeightedRDYStrategy{}, nil
+		}
+	case RDYStrategy:
+		return v, nil
+	}
+	return nil, errors.New("invalid value type")
+}
+
+func coerceCodec(v interface{}) (Codec, error) {
+	switch v := v.(type) {
+	case string:
+		if v == "" {
+			return JSONCodec{}, nil
+		}
+		if codec, ok := LookupCodec(v); ok {
+			return codec, nil
+		}
+		return nil, fmt.Errorf("no codec registered for %s", v)
+	case Codec:
+		return v, nil
+	}
+	return nil, errors.New("invalid value type")
+}
+
 func coerceBool(v interface{}) (bool, error) {
 	switch v := v.(type) {
 	case bool:
@@ -669,3 +1385,38 @@ func coerceUint64(v interface{}) (uint64, error) {
 	}
 	return 0, errors.New("invalid value type")
 }
+
+// DialContextFunc dials a network address, like net.Dialer.DialContext (see Config.DialContext)
+type DialContextFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// AuthProvider provides the secret to authenticate with nsqd (see Config.AuthProvider)
+type AuthProvider interface {
+	// Secret returns the secret for the nsqd at addr. ctx is done once the connection
+	// attempt times out (see Config.DialTimeout).
+	Secret(ctx context.Context, addr string) (string, error)
+}
+
+// AuthProviderFunc is a convenience type to avoid having to declare a struct
+// to implement the AuthProvider interface
+type AuthProviderFunc func(ctx context.Context, addr string) (string, error)
+
+// Secret implements the AuthProvider interface
+func (f AuthProviderFunc) Secret(ctx context.Context, addr string) (string, error) {
+	return f(ctx, addr)
+}
+
+// lookupdHTTPClient returns the client to query nsqlookupd with (nil for the default)
+func (c *Config) lookupdHTTPClient() *http.Client {
+	if c.LookupdHTTPClient != nil {
+		return c.LookupdHTTPClient
+	}
+	return c.dialHTTPClient()
+}
+
+// dialHTTPClient returns a default client dialing via DialContext (nil when unset)
+func (c *Config) dialHTTPClient() *http.Client {
+	if c.DialContext == nil {
+		return nil
+	}
+	return &http.Client{Transport: newDeadlineTransport(2*time.Second, c.DialContext)}
+}
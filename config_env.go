@@ -0,0 +1,54 @@
+package nsq
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+)
+
+// NewConfigFromEnv returns a new Config (see NewConfig) with the options set by the
+// environment variables named by prefix and the upper case option names used by
+// Config.Set, e.g. NSQ_MAX_IN_FLIGHT=100, NSQ_LOOKUPD_POLL_INTERVAL=30s or
+// NSQ_TLS_CERT=/etc/nsq/cert.pem for the prefix "NSQ"
+//
+// Numbers set durations in milliseconds. Every invalid value and violation of
+// Config.Validate is reported in the returned ErrConfig.
+func NewConfigFromEnv(prefix string) (*Config, error) {
+	prefix = strings.TrimSuffix(prefix, "_")
+	if prefix != "" {
+		prefix += "_"
+	}
+
+	c := NewConfig()
+	var violations []string
+	for _, opt := range configOptions() {
+		name := prefix + strings.ToUpper(opt)
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		if err := setOptionString(c, opt, value); err != nil {
+			violations = append(violations, fmt.Sprintf("%s: %s", name, err))
+		}
+	}
+	if len(violations) > 0 {
+		return nil, ErrConfig{violations}
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// configOptions returns the names of every option that can be set with Config.Set
+func configOptions() []string {
+	var options []string
+	typ := reflect.TypeOf(Config{})
+	for i := 0; i < typ.NumField(); i++ {
+		if opt := typ.Field(i).Tag.Get("opt"); opt != "" {
+			options = append(options, opt)
+		}
+	}
+	return append(options, tlsOptions...)
+}
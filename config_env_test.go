@@ -0,0 +1,73 @@
+package nsq
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func setenv(t *testing.T, env map[string]string) func() {
+	for k, v := range env {
+		if err := os.Setenv(k, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return func() {
+		for k := range env {
+			os.Unsetenv(k)
+		}
+	}
+}
+
+func TestNewConfigFromEnv(t *testing.T) {
+	unset := setenv(t, map[string]string{
+		"NSQTEST_MAX_IN_FLIGHT":           "100",
+		"NSQTEST_LOOKUPD_POLL_INTERVAL":   "30s",
+		"NSQTEST_MSG_TIMEOUT":             "90000",
+		"NSQTEST_SNAPPY":                  "true",
+		"NSQTEST_TLS_SERVER_NAME":         "nsqd.local",
+		"NSQTEST_UNRELATED_SETTING":       "ignored",
+		"NSQTEST_LOOKUPD_POLL_JITTER_BAD": "ignored",
+	})
+	c, err := NewConfigFromEnv("NSQTEST_")
+	unset()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.MaxInFlight != 100 || c.LookupdPollInterval != 30*time.Second ||
+		c.MsgTimeout != 90*time.Second || !c.Snappy ||
+		c.TlsConfig == nil || c.TlsConfig.ServerName != "nsqd.local" {
+		t.Fatalf("unexpected config %+v", c)
+	}
+
+	unset = setenv(t, map[string]string{
+		"NSQTEST_MAX_IN_FLIGHT":       "lots",
+		"NSQTEST_LOOKUPD_POLL_JITTER": "2",
+	})
+	defer unset()
+	_, err = NewConfigFromEnv("NSQTEST")
+	cfgErr, ok := err.(ErrConfig)
+	if !ok || len(cfgErr.Violations) != 2 {
+		t.Fatalf("expected two violations, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "NSQTEST_MAX_IN_FLIGHT") {
+		t.Fatalf("expected the variable name in %q", err)
+	}
+}
+
+func TestNewConfigFromEnvStrings(t *testing.T) {
+	unset := setenv(t, map[string]string{
+		"NSQTEST_AUTH_SECRET": "007",
+		"NSQTEST_CLIENT_ID":   "1.50",
+		"NSQTEST_HOSTNAME":    "10",
+	})
+	defer unset()
+	c, err := NewConfigFromEnv("NSQTEST")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.AuthSecret != "007" || c.ClientID != "1.50" || c.Hostname != "10" {
+		t.Fatalf("string options should be set unchanged, got %q, %q, %q", c.AuthSecret, c.ClientID, c.Hostname)
+	}
+}
@@ -0,0 +1,184 @@
+package nsq
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// LoadConfigFile returns a new Config (see NewConfig) with the options set in the file at
+// path, a JSON object, or flat YAML (`key: value`) or TOML (`key = value`) file, by
+// the names used by Config.Set, e.g.
+//
+//	max_in_flight: 100
+//	lookupd_poll_interval: 30s
+//	tls_v1: true
+//
+// Every unknown option, invalid value and violation of Config.Validate is reported in
+// the returned ErrConfig. Nested values (YAML mappings, TOML tables) are not supported.
+func LoadConfigFile(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	c := NewConfig()
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		err = c.UnmarshalJSON(data)
+		if e, ok := err.(ErrConfig); ok {
+			for i, v := range e.Violations {
+				e.Violations[i] = path + ": " + v
+			}
+		} else if err != nil {
+			err = fmt.Errorf("%s: %s", path, err)
+		}
+	case ".yaml", ".yml":
+		err = c.setFlat(path, data, ':')
+	case ".toml":
+		err = c.setFlat(path, data, '=')
+	default:
+		return nil, fmt.Errorf("%s: unsupported config file format (expected .json, .yaml, .yml or .toml)", path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// UnmarshalJSON sets the options of a JSON object, by the names used by Set, e.g.
+// `{"max_in_flight": 100, "lookupd_poll_interval": "30s"}` (numbers set durations in
+// milliseconds), returning an ErrConfig listing every unknown option and invalid value
+//
+// A Config that wasn't created with NewConfig is initialized with the defaults first.
+func (c *Config) UnmarshalJSON(data []byte) error {
+	if !c.initialized {
+		*c = *NewConfig()
+	}
+
+	var options map[string]interface{}
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	if err := d.Decode(&options); err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(options))
+	for key := range options {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var violations []string
+	for _, key := range keys {
+		value := options[key]
+		if n, ok := value.(json.Number); ok {
+			value = numberValue(n.String())
+		}
+		if err := c.Set(key, value); err != nil {
+			violations = append(violations, err.Error())
+		}
+	}
+	if len(violations) > 0 {
+		return ErrConfig{violations}
+	}
+	return nil
+}
+
+// setFlat sets the options of a flat YAML or TOML file, whose keys and values are
+// separated by sep
+func (c *Config) setFlat(path string, data []byte, sep byte) error {
+	var violations []string
+	for i, line := range strings.Split(string(data), "\n") {
+		violation := func(format string, args ...interface{}) {
+			violations = append(violations, fmt.Sprintf("%s:%d: ", path, i+1)+fmt.Sprintf(format, args...))
+		}
+
+		line = strings.TrimRight(stripComment(line), " \t\r")
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || trimmed == "---" {
+			continue
+		}
+		if trimmed != line || strings.HasPrefix(trimmed, "[") || strings.HasPrefix(trimmed, "-") {
+			violation("nested values are not supported")
+			continue
+		}
+		idx := strings.IndexByte(line, sep)
+		if idx == -1 {
+			violation("expected key %c value", sep)
+			continue
+		}
+		key := strings.Trim(strings.TrimSpace(line[:idx]), `"'`)
+		value, err := flatValue(strings.TrimSpace(line[idx+1:]))
+		if err != nil {
+			violation("%s: %s", key, err)
+			continue
+		}
+		if err := c.Set(key, value); err != nil {
+			violation("%s", err)
+		}
+	}
+	if len(violations) > 0 {
+		return ErrConfig{violations}
+	}
+	return nil
+}
+
+// stripComment removes a trailing `# comment` (outside of quotes) from line
+func stripComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		switch b := line[i]; {
+		case quote != 0:
+			if b == '\\' && quote == '"' {
+				// skip the escaped character
+				i++
+			} else if b == quote {
+				quote = 0
+			}
+		case b == '"' || b == '\'':
+			quote = b
+		case b == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// flatValue returns the value of a flat YAML or TOML scalar: a quoted string, a boolean,
+// a number or (YAML) a plain string
+func flatValue(s string) (interface{}, error) {
+	switch {
+	case s == "":
+		return nil, fmt.Errorf("missing value")
+	case s[0] == '"':
+		return strconv.Unquote(s)
+	case s[0] == '\'':
+		if len(s) < 2 || s[len(s)-1] != '\'' {
+			return nil, fmt.Errorf("unterminated string %s", s)
+		}
+		return strings.Replace(s[1:len(s)-1], "''", "'", -1), nil
+	case s == "true" || s == "false":
+		return s == "true", nil
+	}
+	return numberValue(s), nil
+}
+
+// numberValue returns s as an int64 or float64 when it is a number (so that durations
+// are set in milliseconds), or as is
+func numberValue(s string) interface{} {
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return n
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return f
+	}
+	return s
+}
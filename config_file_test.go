@@ -0,0 +1,68 @@
+package nsq
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadConfigFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nsq-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"c.json": `{"max_in_flight": 100, "lookupd_poll_interval": "30s", "max-attempts": 7,
+			"tls_v1": true, "auth_secret": "s#cret", "read_timeout": 90000}`,
+		"c.yaml": "# consumer tuning\n---\nmax_in_flight: 100\nlookupd_poll_interval: 30s # comment\n" +
+			"max-attempts: 7\ntls_v1: true\nauth_secret: 's#cret'\nread_timeout: 90000\n",
+		"c.toml": "max_in_flight = 100\nlookupd_poll_interval = \"30s\"\nmax-attempts = 7\n\n" +
+			"tls_v1 = true\nauth_secret = \"s#cret\" # comment\nread_timeout = 90000\n",
+	}
+	for name, data := range files {
+		path := filepath.Join(dir, name)
+		ioutil.WriteFile(path, []byte(data), 0644)
+		c, err := LoadConfigFile(path)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if c.MaxInFlight != 100 || c.LookupdPollInterval != 30*time.Second || c.MaxAttempts != 7 ||
+			!c.TlsV1 || c.AuthSecret != "s#cret" || c.ReadTimeout != 90*time.Second {
+			t.Fatalf("%s: unexpected config %+v", name, c)
+		}
+	}
+
+	invalid := map[string]string{
+		"bad.json": `{"max_inflight": 100, "max_in_flight": "many", "deflate_level": 100}`,
+		"bad.yaml": "max_inflight: 100\nmax_in_flight: many\nnested:\n  key: value\ndeflate_level: 100\n",
+	}
+	for name, data := range invalid {
+		path := filepath.Join(dir, name)
+		ioutil.WriteFile(path, []byte(data), 0644)
+		_, err := LoadConfigFile(path)
+		e, ok := err.(ErrConfig)
+		if !ok || len(e.Violations) < 3 {
+			t.Fatalf("%s: unexpected error %v", name, err)
+		}
+		for _, s := range []string{"invalid option max_inflight", "max_in_flight (many)", "deflate_level ! 100"} {
+			if !strings.Contains(err.Error(), s) {
+				t.Errorf("%s: expected %q in %q", name, s, err)
+			}
+		}
+	}
+	if _, err := LoadConfigFile(filepath.Join(dir, "c.ini")); err == nil {
+		t.Fatal("expected an error for an unsupported format")
+	}
+
+	var c Config
+	if err := json.Unmarshal([]byte(`{"max_in_flight": 3}`), &c); err != nil || c.MaxInFlight != 3 ||
+		c.ReadTimeout != 60*time.Second {
+		t.Fatalf("unexpected config %+v (%v)", c, err)
+	}
+}
@@ -1,7 +1,11 @@
 package nsq
 
 import (
+	"flag"
+	"fmt"
+	"reflect"
 	"strings"
+	"time"
 )
 
 // ConfigFlag wraps a Config and implements the flag.Value interface
@@ -29,3 +33,93 @@ func (c *ConfigFlag) Set(opt string) (err error) {
 func (c *ConfigFlag) String() string {
 	return ""
 }
+
+// ConfigKeyValueFlag wraps a Config and implements the flag.Value interface, taking
+// options as key=value pairs (e.g. -nsq-opt=max_in_flight=100), or a key alone to set a
+// boolean option to true
+type ConfigKeyValueFlag struct {
+	Config *Config
+}
+
+// Set follows the rules in Config.Set, with numbers setting durations in milliseconds
+func (c *ConfigKeyValueFlag) Set(opt string) error {
+	parts := strings.SplitN(opt, "=", 2)
+	if len(parts) == 1 {
+		return c.Config.Set(parts[0], true)
+	}
+	return setOptionString(c.Config, parts[0], parts[1])
+}
+
+// String implements the flag.Value interface
+func (c *ConfigKeyValueFlag) String() string {
+	return ""
+}
+
+// RegisterConfigFlags defines a flag on fs for every option of c that can be set from a
+// string, named by prefix and the option with underscores replaced by dashes (e.g.
+// -nsq-max-in-flight=100 and -nsq-tls-cert=cert.pem for the prefix "nsq-"). The flags
+// set the options of c as they are parsed.
+func RegisterConfigFlags(fs *flag.FlagSet, prefix string, c *Config) {
+	c.assertInitialized()
+	for _, opt := range configOptions() {
+		f := &configOptionFlag{config: c, option: opt, isBool: optionType(opt) == "bool"}
+		if field, ok := optionField(opt); ok {
+			if field.Type.Kind() == reflect.Ptr {
+				continue
+			}
+			f.index = field.Index
+		}
+		name := prefix + strings.Replace(opt, "_", "-", -1)
+		fs.Var(f, name, fmt.Sprintf("nsq option %s (%s)", opt, optionType(opt)))
+	}
+}
+
+// configOptionFlag is the flag.Value of a single option (see RegisterConfigFlags)
+type configOptionFlag struct {
+	config *Config
+	option string
+	index  []int
+	isBool bool
+}
+
+func (f *configOptionFlag) Set(value string) error {
+	return setOptionString(f.config, f.option, value)
+}
+
+func (f *configOptionFlag) String() string {
+	if f.config == nil || f.index == nil {
+		return ""
+	}
+	v := reflect.ValueOf(f.config).Elem().FieldByIndex(f.index)
+	if v.Kind() == reflect.Interface {
+		// (strategies and codecs are named by their options only)
+		return ""
+	}
+	return fmt.Sprint(v.Interface())
+}
+
+// IsBoolFlag allows boolean options to be given without a value
+func (f *configOptionFlag) IsBoolFlag() bool {
+	return f.isBool
+}
+
+// setOptionString sets option from the string value, with numbers setting durations
+// in milliseconds
+func setOptionString(c *Config, option string, value string) error {
+	option = strings.Replace(option, "-", "_", -1)
+	if field, ok := optionField(option); ok && field.Type == reflect.TypeOf(time.Duration(0)) {
+		return c.Set(option, numberValue(value))
+	}
+	return c.Set(option, value)
+}
+
+// optionField returns the Config field of option
+func optionField(option string) (reflect.StructField, bool) {
+	typ := reflect.TypeOf(Config{})
+	for i := 0; i < typ.NumField(); i++ {
+		if typ.Field(i).Tag.Get("opt") == option {
+			return typ.Field(i), true
+		}
+	}
+	return reflect.StructField{}, false
+}
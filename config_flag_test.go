@@ -2,6 +2,7 @@ package nsq_test
 
 import (
 	"flag"
+	"fmt"
 
 	"github.com/nsqio/go-nsq"
 )
@@ -23,3 +24,26 @@ func ExampleConfigFlag() {
 	println("HeartbeatInterval", cfg.HeartbeatInterval)
 	println("MaxAttempts", cfg.MaxAttempts)
 }
+
+func ExampleRegisterConfigFlags() {
+	cfg := nsq.NewConfig()
+	flagSet := flag.NewFlagSet("", flag.ExitOnError)
+	nsq.RegisterConfigFlags(flagSet, "nsq-", cfg)
+	flagSet.Var(&nsq.ConfigKeyValueFlag{cfg}, "nsq-opt", "option to pass through to nsq.Consumer (key=value)")
+
+	err := flagSet.Parse([]string{
+		"-nsq-max-in-flight=100",
+		"-nsq-lookupd-poll-interval=30000",
+		"-nsq-snappy",
+		"-nsq-opt=heartbeat_interval=10s",
+		"-nsq-opt=max_attempts=10",
+	})
+	if err != nil {
+		panic(err.Error())
+	}
+	fmt.Println(cfg.MaxInFlight, cfg.LookupdPollInterval, cfg.Snappy, cfg.HeartbeatInterval, cfg.MaxAttempts)
+	fmt.Println(flagSet.Lookup("nsq-msg-timeout").Usage)
+	// Output:
+	// 100 30s true 10s 10
+	// nsq option msg_timeout (time.Duration)
+}
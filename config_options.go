@@ -0,0 +1,162 @@
+package nsq
+
+import (
+	"crypto/tls"
+	"time"
+)
+
+// Option sets one or more Config fields (see NewConfigWith)
+type Option func(c *Config)
+
+// NewConfigWith returns a new Config (see NewConfig) with opts applied in order,
+// or the ErrConfig reported by Config.Validate
+func NewConfigWith(opts ...Option) (*Config, error) {
+	c := NewConfig()
+	for _, opt := range opts {
+		opt(c)
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// WithMaxInFlight sets the maximum number of messages in flight (see Config.MaxInFlight)
+func WithMaxInFlight(n int) Option {
+	return func(c *Config) {
+		c.MaxInFlight = n
+	}
+}
+
+// WithMaxAttempts sets the number of attempts after which messages are given up on
+// (see Config.MaxAttempts)
+func WithMaxAttempts(n uint16) Option {
+	return func(c *Config) {
+		c.MaxAttempts = n
+	}
+}
+
+// WithMsgTimeout sets the duration nsqd waits before re-queueing an in-flight message
+func WithMsgTimeout(d time.Duration) Option {
+	return func(c *Config) {
+		c.MsgTimeout = d
+	}
+}
+
+// WithHeartbeatInterval sets the interval of heartbeats from nsqd
+func WithHeartbeatInterval(d time.Duration) Option {
+	return func(c *Config) {
+		c.HeartbeatInterval = d
+	}
+}
+
+// WithTimeouts sets the dial, read and write timeouts of connections
+func WithTimeouts(dial, read, write time.Duration) Option {
+	return func(c *Config) {
+		c.DialTimeout = dial
+		c.ReadTimeout = read
+		c.WriteTimeout = write
+	}
+}
+
+// WithLookupdPollInterval sets the interval at which nsqlookupd is polled for producers
+func WithLookupdPollInterval(d time.Duration) Option {
+	return func(c *Config) {
+		c.LookupdPollInterval = d
+	}
+}
+
+// WithRequeueDelay sets the default and maximum delay of re-queued messages
+func WithRequeueDelay(def, max time.Duration) Option {
+	return func(c *Config) {
+		c.DefaultRequeueDelay = def
+		c.MaxRequeueDelay = max
+	}
+}
+
+// WithBackoff sets the backoff multiplier and the maximum backoff duration (0 disables
+// backoff)
+func WithBackoff(multiplier, max time.Duration) Option {
+	return func(c *Config) {
+		c.BackoffMultiplier = multiplier
+		c.MaxBackoffDuration = max
+	}
+}
+
+// WithBackoffStrategy sets the strategy used to calculate backoff durations
+func WithBackoffStrategy(s BackoffStrategy) Option {
+	return func(c *Config) {
+		if setter, ok := s.(interface {
+			setConfig(*Config)
+		}); ok {
+			setter.setConfig(c)
+		}
+		c.BackoffStrategy = s
+	}
+}
+
+// WithHandlerTimeout sets the duration after which a handler is considered to have
+// failed its message (see Config.HandlerTimeout)
+func WithHandlerTimeout(d time.Duration) Option {
+	return func(c *Config) {
+		c.HandlerTimeout = d
+	}
+}
+
+// WithTLS enables TLS negotiation with nsqd, using tlsConfig (which may be nil for
+// the default configuration)
+func WithTLS(tlsConfig *tls.Config) Option {
+	return func(c *Config) {
+		c.TlsV1 = true
+		c.TlsConfig = tlsConfig
+	}
+}
+
+// WithAuthSecret sets the secret sent to nsqd in AUTH
+func WithAuthSecret(secret string) Option {
+	return func(c *Config) {
+		c.AuthSecret = secret
+	}
+}
+
+// WithDeflate enables deflate compression at level (1-9)
+func WithDeflate(level int) Option {
+	return func(c *Config) {
+		c.Deflate = true
+		c.Snappy = false
+		c.DeflateLevel = level
+	}
+}
+
+// WithSnappy enables snappy compression
+func WithSnappy() Option {
+	return func(c *Config) {
+		c.Snappy = true
+		c.Deflate = false
+	}
+}
+
+// WithOutputBuffer sets the size and timeout of nsqd's buffering of writes to
+// connections
+func WithOutputBuffer(size int64, timeout time.Duration) Option {
+	return func(c *Config) {
+		c.OutputBufferSize = size
+		c.OutputBufferTimeout = timeout
+	}
+}
+
+// WithIdentity sets the client ID, hostname and user agent sent in IDENTIFY (empty
+// values keep the defaults)
+func WithIdentity(clientID, hostname, userAgent string) Option {
+	return func(c *Config) {
+		if clientID != "" {
+			c.ClientID = clientID
+		}
+		if hostname != "" {
+			c.Hostname = hostname
+		}
+		if userAgent != "" {
+			c.UserAgent = userAgent
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package nsq
+
+import (
+	"time"
+)
+
+// ConfigHighThroughput returns a new Config (see NewConfig) tuned for consumers and
+// producers moving many small messages, at the expense of latency and memory:
+//
+//	max_in_flight          2500
+//	read/write_buffer_size 256KB
+//	write_coalesce_linger  1ms (write_coalesce_max 256)
+//	output_buffer_size     64KB (output_buffer_timeout 250ms)
+//	backoff_multiplier     500ms (max_backoff_duration 30s)
+//
+// Handlers should be added with AddConcurrentHandlers to keep up.
+func ConfigHighThroughput() *Config {
+	c := NewConfig()
+	c.MaxInFlight = 2500
+	c.ReadBufferSize = 256 * 1024
+	c.WriteBufferSize = 256 * 1024
+	c.WriteCoalesceLinger = time.Millisecond
+	c.WriteCoalesceMax = 256
+	c.OutputBufferSize = 64 * 1024
+	c.OutputBufferTimeout = 250 * time.Millisecond
+	c.BackoffMultiplier = 500 * time.Millisecond
+	c.MaxBackoffDuration = 30 * time.Second
+	return c
+}
+
+// ConfigLowLatency returns a new Config (see NewConfig) tuned for delivering each
+// message as soon as possible, at the expense of nsqd CPU usage:
+//
+//	max_in_flight          100
+//	output_buffer_size     4KB (output_buffer_timeout 25ms)
+//	write_coalesce_linger  0 (every command is flushed)
+//	tcp_no_delay           true
+//	backoff_multiplier     100ms (max_backoff_duration 5s)
+//	default_requeue_delay  1s (max_requeue_delay 1m)
+func ConfigLowLatency() *Config {
+	c := NewConfig()
+	c.MaxInFlight = 100
+	c.OutputBufferSize = 4096
+	c.OutputBufferTimeout = 25 * time.Millisecond
+	c.WriteCoalesceLinger = 0
+	c.TCPNoDelay = true
+	c.BackoffMultiplier = 100 * time.Millisecond
+	c.MaxBackoffDuration = 5 * time.Second
+	c.DefaultRequeueDelay = time.Second
+	c.MaxRequeueDelay = time.Minute
+	return c
+}
+
+// ConfigReliableProcessing returns a new Config (see NewConfig) tuned for slow or
+// failure prone handlers that must not lose or duplicate work, at the expense of
+// throughput:
+//
+//	max_in_flight          10
+//	max_attempts           10
+//	auto_touch             true (messages are TOUCHed while handlers run)
+//	recover_panics         true (with backoff_on_panic)
+//	backoff_multiplier     2s (max_backoff_duration 5m)
+//	default_requeue_delay  30s (max_requeue_delay 30m)
+//	drain_timeout          2m
+func ConfigReliableProcessing() *Config {
+	c := NewConfig()
+	c.MaxInFlight = 10
+	c.MaxAttempts = 10
+	c.AutoTouch = true
+	c.RecoverPanics = true
+	c.BackoffOnPanic = true
+	c.BackoffMultiplier = 2 * time.Second
+	c.MaxBackoffDuration = 5 * time.Minute
+	c.DefaultRequeueDelay = 30 * time.Second
+	c.MaxRequeueDelay = 30 * time.Minute
+	c.DrainTimeout = 2 * time.Minute
+	return c
+}
@@ -1,9 +1,13 @@
 package nsq
 
 import (
+	"crypto/tls"
+	"fmt"
 	"math/rand"
 	"net"
 	"reflect"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -55,6 +59,30 @@ func TestConfigSet(t *testing.T) {
 	}
 }
 
+func TestConfigTLSServerName(t *testing.T) {
+	c := NewConfig()
+	if err := c.Set("tls_server_name", "nsqd.example.com"); err != nil {
+		t.Fatalf("Error setting `tls_server_name` config: %s", err)
+	}
+	if c.TlsConfig.ServerName != "nsqd.example.com" {
+		t.Errorf("Error setting `tls_server_name` config: %v", c.TlsConfig.ServerName)
+	}
+
+	override := &tls.Config{ServerName: "lb.example.com"}
+	c.TlsConfigForAddr = func(addr string) *tls.Config {
+		if addr == "10.0.0.1:4150" {
+			return override
+		}
+		return nil
+	}
+	if conn := NewConn("10.0.0.1:4150", c, nil); conn.tlsConfig() != override {
+		t.Error("per-address TLS config was not used")
+	}
+	if conn := NewConn("10.0.0.2:4150", c, nil); conn.tlsConfig() != c.TlsConfig {
+		t.Error("default TLS config was not used as a fallback")
+	}
+}
+
 func TestConfigValidate(t *testing.T) {
 	c := NewConfig()
 	if err := c.Validate(); err != nil {
@@ -64,6 +92,126 @@ func TestConfigValidate(t *testing.T) {
 	if err := c.Validate(); err == nil {
 		t.Error("no error set for invalid value")
 	}
+
+	// every violation is reported
+	c = NewConfig()
+	c.DeflateLevel = 100
+	c.HeartbeatInterval = 2 * c.ReadTimeout
+	c.LookupdPollJitter = 2
+	c.MsgTimeout = time.Minute
+	c.HandlerTimeout = 2 * time.Minute
+	c.Set("tls_cert", "cert.pem")
+	err, ok := c.Validate().(ErrConfig)
+	if !ok || len(err.Violations) != 5 {
+		t.Fatalf("unexpected error %v", err)
+	}
+	for _, s := range []string{"DeflateLevel", "ReadTimeout", "LookupdPollJitter", "MsgTimeout", "tls_key"} {
+		if !strings.Contains(err.Error(), s) {
+			t.Errorf("expected a violation mentioning %s in %q", s, err)
+		}
+	}
+	c.AutoTouch = true
+	c.Set("tls_cert", "")
+	c.DeflateLevel = 6
+	c.LookupdPollJitter = 0.3
+	if err, _ := c.Validate().(ErrConfig); len(err.Violations) != 1 {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestNewConfigWith(t *testing.T) {
+	tlsConf := &tls.Config{ServerName: "nsqd.local"}
+	c, err := NewConfigWith(
+		WithMaxInFlight(200),
+		WithTLS(tlsConf),
+		WithBackoff(2*time.Second, time.Minute),
+		WithAuthSecret("secret"),
+		WithDeflate(3),
+		WithBackoffStrategy(&FullJitterStrategy{}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.MaxInFlight != 200 || !c.TlsV1 || c.TlsConfig != tlsConf ||
+		c.BackoffMultiplier != 2*time.Second || c.MaxBackoffDuration != time.Minute ||
+		c.AuthSecret != "secret" || !c.Deflate || c.DeflateLevel != 3 {
+		t.Fatalf("unexpected config %+v", c)
+	}
+	if d := c.BackoffStrategy.Calculate(1); d > 4*time.Second {
+		t.Fatalf("backoff strategy not configured - %v", d)
+	}
+
+	_, err = NewConfigWith(WithMaxInFlight(-1), WithRequeueDelay(time.Hour, time.Minute))
+	if cfgErr, ok := err.(ErrConfig); !ok || len(cfgErr.Violations) != 2 {
+		t.Fatalf("expected two violations, got %v", err)
+	}
+}
+
+func TestConfigPresets(t *testing.T) {
+	for name, c := range map[string]*Config{
+		"high throughput":     ConfigHighThroughput(),
+		"low latency":         ConfigLowLatency(),
+		"reliable processing": ConfigReliableProcessing(),
+	} {
+		if err := c.Validate(); err != nil {
+			t.Errorf("%s: %s", name, err)
+		}
+	}
+}
+
+func TestConfigCloneDiff(t *testing.T) {
+	base := NewConfig()
+	base.Set("tls_server_name", "nsqd.local")
+
+	c := base.Clone()
+	if changes := base.Diff(c); len(changes) != 0 {
+		t.Fatalf("unexpected changes %v", changes)
+	}
+	c.Set("max_in_flight", 100)
+	c.Set("backoff_multiplier", "2s")
+	c.Set("tls_server_name", "other.local")
+	if base.MaxInFlight != 1 || base.TlsConfig.ServerName != "nsqd.local" {
+		t.Fatalf("clone changed the base config %+v", base)
+	}
+	if d := c.BackoffStrategy.Calculate(1); d != 4*time.Second {
+		t.Fatalf("backoff strategy not set on the clone - %s", d)
+	}
+
+	var options []string
+	for _, change := range base.Diff(c) {
+		options = append(options, change.Option)
+	}
+	if s := strings.Join(options, ","); s != "backoff_multiplier,tls_config,max_in_flight" {
+		t.Fatalf("unexpected changes %s", s)
+	}
+	if s := base.Diff(c)[0].String(); s != "backoff_multiplier: 1s -> 2s" {
+		t.Fatalf("unexpected change %s", s)
+	}
+}
+
+func TestConfigUnknownOption(t *testing.T) {
+	c := NewConfig()
+	err := c.Set("max_inflight", 100)
+	unknown, ok := err.(ErrUnknownOption)
+	if !ok || len(unknown.Suggestions) == 0 || unknown.Suggestions[0] != "max_in_flight (int)" {
+		t.Fatalf("unexpected error %v", err)
+	}
+	for option, suggestion := range map[string]string{
+		"hearbeat_interval": "heartbeat_interval (time.Duration)",
+		"tls_insecure":      "tls_insecure_skip_verify (bool)",
+		"backoff_stratgy":   "backoff_strategy (BackoffStrategy)",
+	} {
+		err := c.Set(option, 1)
+		if !strings.Contains(err.Error(), suggestion) {
+			t.Errorf("expected %q suggested in %q", suggestion, err)
+		}
+	}
+	if err := c.Set("completely_unrelated", 1); err.Error() != "invalid option completely_unrelated" {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if err := c.Set("max_in_flight", "many"); !strings.Contains(err.Error(), "to int") {
+		t.Fatalf("expected the option type in %v", err)
+	}
 }
 
 func TestExponentialBackoff(t *testing.T) {
@@ -102,3 +250,140 @@ func backoffTest(t *testing.T, expected []time.Duration, cb func(c *Config) Back
 		}
 	}
 }
+
+func TestRequeueDelayStrategies(t *testing.T) {
+	c := NewConfig()
+	if reflect.ValueOf(c.RequeueDelayStrategy).Type().String() != "*nsq.LinearRequeueStrategy" {
+		t.Error("Failed to set default `linear` requeue delay strategy")
+	}
+	if err := c.Set("requeue_delay_strategy", "exponential"); err != nil {
+		t.Errorf("Failed to assign `requeue_delay_strategy` config: %v", err)
+	}
+	if reflect.ValueOf(c.RequeueDelayStrategy).Type().String() != "*nsq.ExponentialRequeueStrategy" {
+		t.Error("Failed to set `exponential` requeue delay strategy")
+	}
+	if err := c.Set("requeue_delay_strategy", "bogus"); err == nil {
+		t.Error("No error when setting `requeue_delay_strategy` to an invalid value")
+	}
+
+	attempts := []uint16{0, 1, 2, 5, 65535}
+	tests := []struct {
+		s        RequeueDelayStrategy
+		expected []time.Duration
+	}{
+		{&LinearRequeueStrategy{}, []time.Duration{0, time.Second, 2 * time.Second, 5 * time.Second, time.Minute}},
+		{&ExponentialRequeueStrategy{}, []time.Duration{0, time.Second, 2 * time.Second, 16 * time.Second, time.Minute}},
+	}
+	for _, tt := range tests {
+		for i, a := range attempts {
+			result := tt.s.RequeueDelay(a, time.Second, time.Minute)
+			if result != tt.expected[i] {
+				t.Fatalf("%T: wrong requeue delay %v for attempt %d (should be %v)",
+					tt.s, result, a, tt.expected[i])
+			}
+		}
+	}
+
+	s := &FullJitterRequeueStrategy{rng: rand.New(rand.NewSource(99))}
+	for _, a := range attempts {
+		max := exponentialRequeueDelay(a, time.Second, time.Minute)
+		if result := s.RequeueDelay(a, time.Second, time.Minute); result < 0 || result > max {
+			t.Fatalf("jittered requeue delay %v for attempt %d out of range [0, %v]", result, a, max)
+		}
+	}
+
+	e := &EqualJitterRequeueStrategy{FullJitterRequeueStrategy{rng: rand.New(rand.NewSource(99))}}
+	for _, a := range attempts {
+		max := exponentialRequeueDelay(a, time.Second, time.Minute)
+		if result := e.RequeueDelay(a, time.Second, time.Minute); result < max/2 || result > max {
+			t.Fatalf("jittered requeue delay %v for attempt %d out of range [%v, %v]", result, a, max/2, max)
+		}
+	}
+}
+
+type firstRDYStrategy struct{}
+
+func (s firstRDYStrategy) Select(candidates []*Conn, n int) []*Conn {
+	return candidates[:n]
+}
+
+func TestRDYStrategy(t *testing.T) {
+	c := NewConfig()
+	if reflect.ValueOf(c.RDYStrategy).Type().String() != "*nsq.RandomRDYStrategy" {
+		t.Error("Failed to set default `random` RDY strategy")
+	}
+	if err := c.Set("rdy_strategy", firstRDYStrategy{}); err != nil {
+		t.Errorf("Failed to assign `rdy_strategy` config: %v", err)
+	}
+	if _, ok := c.RDYStrategy.(firstRDYStrategy); !ok {
+		t.Error("Failed to set custom RDY strategy")
+	}
+	if err := c.Set("rdy_strategy", "bogus"); err == nil {
+		t.Error("No error when setting `rdy_strategy` to an invalid value")
+	}
+
+	conns := make([]*Conn, 5)
+	for i := range conns {
+		conns[i] = NewConn(fmt.Sprintf("127.0.0.1:%d", 4150+i), c, nil)
+	}
+	s := &RandomRDYStrategy{rng: rand.New(rand.NewSource(99))}
+	for n := 0; n <= 6; n++ {
+		selected := s.Select(conns, n)
+		expected := n
+		if expected > len(conns) {
+			expected = len(conns)
+		}
+		if len(selected) != expected {
+			t.Fatalf("selected %d connections, expected %d", len(selected), expected)
+		}
+		seen := make(map[*Conn]bool)
+		for _, conn := range selected {
+			if seen[conn] {
+				t.Fatalf("connection %s selected more than once", conn)
+			}
+			seen[conn] = true
+		}
+	}
+}
+
+func TestWeightedRDYStrategy(t *testing.T) {
+	c := NewConfig()
+	if err := c.Set("rdy_strategy", "weighted"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.RDYStrategy.(*WeightedRDYStrategy); !ok {
+		t.Fatal("Failed to set `weighted` RDY strategy")
+	}
+
+	conns := make([]*Conn, 4)
+	for i := range conns {
+		conns[i] = NewConn(fmt.Sprintf("127.0.0.1:%d", 4150+i), c, nil)
+	}
+	// a deep channel on the first nsqd, and messages recently received on the second
+	atomic.StoreInt64(&conns[0].channelDepth, 1000)
+	now := time.Now()
+	for i := 0; i < 1000; i++ {
+		conns[1].observeMessage(now)
+	}
+	if rate := conns[1].MessageRate(); rate < 30 || rate > 34 {
+		t.Fatalf("unexpected message rate %f", rate)
+	}
+
+	s := &WeightedRDYStrategy{rng: rand.New(rand.NewSource(99))}
+	counts := make(map[*Conn]int)
+	for i := 0; i < 1000; i++ {
+		selected := s.Select(conns, 2)
+		if len(selected) != 2 || selected[0] == selected[1] {
+			t.Fatalf("unexpected selection %v", selected)
+		}
+		for _, conn := range selected {
+			counts[conn]++
+		}
+	}
+	if counts[conns[0]] < 950 || counts[conns[1]] < 950 {
+		t.Fatalf("busy connections were not favored %v", counts)
+	}
+	if counts[conns[2]] == 0 && counts[conns[3]] == 0 {
+		t.Fatal("idle connections were never selected")
+	}
+}
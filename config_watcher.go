@@ -0,0 +1,322 @@
+package nsq
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// ConfigReload describes the options changed by a ConfigWatcher reloading its file
+// (see EventConfigReloaded)
+type ConfigReload struct {
+	Path     string
+	Applied  []ConfigChange
+	Rejected []RejectedConfigChange
+}
+
+// RejectedConfigChange is a changed option that could not be applied to running
+// Consumers or Producers
+type RejectedConfigChange struct {
+	ConfigChange
+	Reason string
+}
+
+// ConfigWatcher reloads a config file (see LoadConfigFile) when it changes, or when the
+// process receives SIGHUP (see ReloadOnSIGHUP), applying the options that can be changed
+// at runtime (see Consumer.UpdateConfig and Producer.UpdateConfig) to the watched
+// Consumers and Producers. Every reload emits EventConfigReloaded to the handlers registered with
+// OnEvent, listing the applied and rejected options.
+//
+// Options that cannot be changed at runtime (e.g. tls_cert) are rejected, and take
+// effect for Consumers and Producers created from Config afterwards.
+type ConfigWatcher struct {
+	path     string
+	interval time.Duration
+
+	mtx       sync.Mutex
+	current   *Config
+	modTime   time.Time
+	size      int64
+	consumers []*Consumer
+	producers []*Producer
+
+	logger logger
+	logLvl LogLevel
+
+	eventMtx      sync.RWMutex
+	eventHandlers []EventHandler
+
+	sighupFlag int32
+	stopFlag   int32
+	exitChan   chan int
+	wg         sync.WaitGroup
+}
+
+// NewConfigWatcher loads the config file at path and returns a ConfigWatcher reloading
+// it whenever its modification time or size changes, checked every interval (0 ==
+// only on Reload, or SIGHUP with ReloadOnSIGHUP)
+func NewConfigWatcher(path string, interval time.Duration) (*ConfigWatcher, error) {
+	config, err := LoadConfigFile(path)
+	if err != nil {
+		return nil, err
+	}
+	w := &ConfigWatcher{
+		path:     path,
+		interval: interval,
+		current:  config,
+		logger:   log.New(os.Stderr, "", log.Flags()),
+		logLvl:   LogLevelInfo,
+		exitChan: make(chan int),
+	}
+	w.modTime, w.size = w.stat()
+
+	w.wg.Add(1)
+	go w.watchLoop()
+	return w, nil
+}
+
+// Config returns a copy of the last loaded Config, e.g. to create the Consumers and
+// Producers to watch
+func (w *ConfigWatcher) Config() *Config {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	return w.current.Clone()
+}
+
+// SetLogger assigns the logger to use as well as a level
+//
+// See Consumer.SetLogger for details.
+func (w *ConfigWatcher) SetLogger(l logger, lvl LogLevel) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	w.logger = l
+	w.logLvl = lvl
+}
+
+// Watch adds Consumers to apply reloaded options to
+func (w *ConfigWatcher) Watch(consumers ...*Consumer) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	w.consumers = append(w.consumers, consumers...)
+}
+
+// WatchProducers adds Producers to apply reloaded options to
+func (w *ConfigWatcher) WatchProducers(producers ...*Producer) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	w.producers = append(w.producers, producers...)
+}
+
+// OnEvent registers handler to be called with EventConfigReloaded for every reload
+//
+// Handlers are called synchronously, on the goroutine reloading the file.
+func (w *ConfigWatcher) OnEvent(handler EventHandler) {
+	w.eventMtx.Lock()
+	defer w.eventMtx.Unlock()
+	w.eventHandlers = append(w.eventHandlers, handler)
+}
+
+// ReloadOnSIGHUP also reloads the config file whenever the process receives SIGHUP,
+// until Stop. The signal is not handled otherwise, so as not to take it over from
+// applications handling it themselves.
+func (w *ConfigWatcher) ReloadOnSIGHUP() {
+	if atomic.LoadInt32(&w.stopFlag) == 1 || !atomic.CompareAndSwapInt32(&w.sighupFlag, 0, 1) {
+		return
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	w.wg.Add(1)
+	go w.sighupLoop(hup)
+}
+
+// Reload loads the config file and applies the changed options immediately
+//
+// An error loading the file is returned (and set on the emitted Event), and leaves the
+// running configuration unchanged.
+func (w *ConfigWatcher) Reload() error {
+	w.mtx.Lock()
+	reload, err := w.reload()
+	w.mtx.Unlock()
+
+	w.emit(Event{Type: EventConfigReloaded, ConfigReload: reload, Err: err})
+	return err
+}
+
+// must be called with mtx held
+func (w *ConfigWatcher) reload() (*ConfigReload, error) {
+	config, err := LoadConfigFile(w.path)
+	if err != nil {
+		w.log(LogLevelError, "failed to reload %s - %s", w.path, err)
+		return &ConfigReload{Path: w.path}, err
+	}
+
+	reload := &ConfigReload{Path: w.path}
+	rejected := make(map[string]string)
+	consumerDelta := make(map[string]interface{})
+	producerDelta := make(map[string]interface{})
+	changes := w.current.Diff(config)
+	for _, change := range changes {
+		mutable := false
+		if runtimeOptions[change.Option] && len(w.consumers) > 0 {
+			consumerDelta[change.Option] = change.New
+			mutable = true
+		}
+		if producerRuntimeOptions[change.Option] && len(w.producers) > 0 {
+			producerDelta[change.Option] = change.New
+			mutable = true
+		}
+		if !mutable {
+			rejected[change.Option] = "cannot be changed at runtime"
+		}
+	}
+
+	// each delta is checked against every target before it is applied to any, so that it
+	// is applied to all of them or none
+	failed := make(map[string]bool)
+	for _, c := range w.consumers {
+		if len(consumerDelta) == 0 {
+			break
+		}
+		if err := c.checkConfigUpdate(consumerDelta); err != nil {
+			rejectAll(rejected, failed, consumerDelta, err)
+			consumerDelta = nil
+		}
+	}
+	for _, p := range w.producers {
+		if len(producerDelta) == 0 {
+			break
+		}
+		if err := p.checkConfigUpdate(producerDelta); err != nil {
+			rejectAll(rejected, failed, producerDelta, err)
+			producerDelta = nil
+		}
+	}
+	for _, c := range w.consumers {
+		if len(consumerDelta) == 0 {
+			break
+		}
+		if err := c.UpdateConfig(consumerDelta); err != nil {
+			// only when the Consumer was updated concurrently since it was checked
+			w.log(LogLevelError, "%s: failed to update consumer %s - %s", w.path, c.topic, err)
+		}
+	}
+	for _, p := range w.producers {
+		if len(producerDelta) == 0 {
+			break
+		}
+		if err := p.UpdateConfig(producerDelta); err != nil {
+			w.log(LogLevelError, "%s: failed to update producer %s - %s", w.path, p.String(), err)
+		}
+	}
+
+	for _, change := range changes {
+		if reason, ok := rejected[change.Option]; ok {
+			reload.Rejected = append(reload.Rejected, RejectedConfigChange{change, reason})
+			w.log(LogLevelWarning, "%s: not applying %s - %s", w.path, change, reason)
+			if failed[change.Option] {
+				// retried on the next reload (options that cannot be changed at runtime
+				// are kept, for Consumers and Producers created from Config)
+				config.Set(change.Option, change.Old)
+			}
+			continue
+		}
+		reload.Applied = append(reload.Applied, change)
+		w.log(LogLevelInfo, "%s: applied %s", w.path, change)
+	}
+	w.current = config
+	return reload, nil
+}
+
+// rejectAll rejects the options of delta, which failed to be applied with err
+func rejectAll(rejected map[string]string, failed map[string]bool, delta map[string]interface{}, err error) {
+	for option := range delta {
+		if _, ok := rejected[option]; !ok {
+			rejected[option] = err.Error()
+			failed[option] = true
+		}
+	}
+}
+
+// Stop stops watching the config file
+func (w *ConfigWatcher) Stop() {
+	if !atomic.CompareAndSwapInt32(&w.stopFlag, 0, 1) {
+		return
+	}
+	close(w.exitChan)
+	w.wg.Wait()
+}
+
+func (w *ConfigWatcher) watchLoop() {
+	defer w.wg.Done()
+
+	var tick <-chan time.Time
+	if w.interval > 0 {
+		ticker := time.NewTicker(w.interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-tick:
+			modTime, size := w.stat()
+			w.mtx.Lock()
+			changed := !modTime.Equal(w.modTime) || size != w.size
+			w.modTime, w.size = modTime, size
+			w.mtx.Unlock()
+			if !changed {
+				continue
+			}
+		case <-w.exitChan:
+			return
+		}
+		w.Reload()
+	}
+}
+
+func (w *ConfigWatcher) sighupLoop(hup chan os.Signal) {
+	defer w.wg.Done()
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-hup:
+			w.mtx.Lock()
+			w.log(LogLevelInfo, "received SIGHUP, reloading %s", w.path)
+			w.mtx.Unlock()
+			w.Reload()
+		case <-w.exitChan:
+			return
+		}
+	}
+}
+
+func (w *ConfigWatcher) stat() (time.Time, int64) {
+	fi, err := os.Stat(w.path)
+	if err != nil {
+		return time.Time{}, -1
+	}
+	return fi.ModTime(), fi.Size()
+}
+
+func (w *ConfigWatcher) emit(event Event) {
+	w.eventMtx.RLock()
+	defer w.eventMtx.RUnlock()
+	event.Time = time.Now()
+	for _, handler := range w.eventHandlers {
+		handler(event)
+	}
+}
+
+// must be called with mtx held
+func (w *ConfigWatcher) log(lvl LogLevel, line string, args ...interface{}) {
+	if w.logger == nil || w.logLvl > lvl {
+		return
+	}
+	w.logger.Output(2, fmt.Sprintf("%-4s [config] %s", lvl, fmt.Sprintf(line, args...)))
+}
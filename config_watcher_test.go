@@ -0,0 +1,149 @@
+package nsq
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestConfigWatcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nsq-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "consumer.json")
+	ioutil.WriteFile(path, []byte(`{"max_in_flight": 10}`), 0644)
+
+	w, err := NewConfigWatcher(path, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+	w.SetLogger(nullLogger, LogLevelInfo)
+	events := make(chan Event, 2)
+	w.OnEvent(func(e Event) { events <- e })
+
+	q, _ := NewConsumer("config_watcher_test", "ch", w.Config())
+	q.SetLogger(nullLogger, LogLevelInfo)
+	defer q.Stop()
+	w.Watch(q)
+
+	ioutil.WriteFile(path, []byte(`{"max_in_flight": 20, "handler_timeout": "1s", "snappy": true}`), 0644)
+	var e Event
+	select {
+	case e = <-events:
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for the config to be reloaded")
+	}
+	if e.Type != EventConfigReloaded || e.Err != nil || e.ConfigReload.Path != path {
+		t.Fatalf("unexpected event %+v", e)
+	}
+	var applied []string
+	for _, change := range e.ConfigReload.Applied {
+		applied = append(applied, change.Option)
+	}
+	if s := strings.Join(applied, ","); s != "handler_timeout,max_in_flight" {
+		t.Fatalf("unexpected applied options %s", s)
+	}
+	if rejected := e.ConfigReload.Rejected; len(rejected) != 1 || rejected[0].Option != "snappy" {
+		t.Fatalf("unexpected rejected options %v", rejected)
+	}
+	if q.getMaxInFlight() != 20 || q.live().HandlerTimeout != time.Second {
+		t.Fatalf("options not applied to the consumer")
+	}
+	if !w.Config().Snappy {
+		t.Fatalf("rejected options not set on Config")
+	}
+
+	ioutil.WriteFile(path, []byte(`{"max_in_flight": "many"}`), 0644)
+	if err := w.Reload(); err == nil {
+		t.Fatal("expected an error reloading an invalid file")
+	}
+	if q.getMaxInFlight() != 20 {
+		t.Fatalf("invalid file applied")
+	}
+}
+
+func TestConfigWatcherPartialFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nsq-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "consumer.json")
+	ioutil.WriteFile(path, []byte(`{"max_in_flight": 10}`), 0644)
+
+	w, err := NewConfigWatcher(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+	w.SetLogger(nullLogger, LogLevelInfo)
+
+	q1, _ := NewConsumer("config_watcher_test", "ch", w.Config())
+	q1.SetLogger(nullLogger, LogLevelInfo)
+	defer q1.Stop()
+	// a handler_timeout above its msg_timeout is invalid for the second Consumer only
+	config := w.Config()
+	config.MsgTimeout = 500 * time.Millisecond
+	q2, _ := NewConsumer("config_watcher_test", "ch", config)
+	q2.SetLogger(nullLogger, LogLevelInfo)
+	defer q2.Stop()
+	w.Watch(q1, q2)
+
+	ioutil.WriteFile(path, []byte(`{"max_in_flight": 10, "handler_timeout": "1s"}`), 0644)
+	var e Event
+	w.OnEvent(func(event Event) { e = event })
+	for i := 0; i < 2; i++ {
+		w.Reload()
+		if len(e.ConfigReload.Applied) != 0 || len(e.ConfigReload.Rejected) != 1 {
+			t.Fatalf("unexpected reload %+v", e.ConfigReload)
+		}
+		if q1.live().HandlerTimeout != 0 || q2.live().HandlerTimeout != 0 {
+			t.Fatal("handler_timeout applied to some consumers")
+		}
+		// the rejected option is retried on the next reload
+		if w.Config().HandlerTimeout != 0 {
+			t.Fatal("rejected option set on Config")
+		}
+	}
+}
+
+func TestConfigWatcherSIGHUP(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nsq-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "consumer.json")
+	ioutil.WriteFile(path, []byte(`{"max_in_flight": 10}`), 0644)
+
+	w, err := NewConfigWatcher(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+	w.SetLogger(nullLogger, LogLevelInfo)
+	events := make(chan Event, 1)
+	w.OnEvent(func(e Event) { events <- e })
+	w.ReloadOnSIGHUP()
+
+	ioutil.WriteFile(path, []byte(`{"max_in_flight": 20}`), 0644)
+	p, _ := os.FindProcess(os.Getpid())
+	if err := p.Signal(syscall.SIGHUP); err != nil {
+		t.Skipf("cannot send SIGHUP - %s", err)
+	}
+	select {
+	case e := <-events:
+		if e.Err != nil || w.Config().MaxInFlight != 20 {
+			t.Fatalf("unexpected event %+v", e)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for the config to be reloaded on SIGHUP")
+	}
+}
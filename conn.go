@@ -4,12 +4,15 @@ import (
 	"bufio"
 	"bytes"
 	"compress/flate"
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -20,12 +23,23 @@ import (
 
 // IdentifyResponse represents the metadata
 // returned from an IDENTIFY command to nsqd
+//
+// Durations are in milliseconds.
 type IdentifyResponse struct {
 	MaxRdyCount  int64 `json:"max_rdy_count"`
 	TLSv1        bool  `json:"tls_v1"`
 	Deflate      bool  `json:"deflate"`
 	Snappy       bool  `json:"snappy"`
 	AuthRequired bool  `json:"auth_required"`
+	MsgTimeout   int64 `json:"msg_timeout"`
+
+	Version             string `json:"version"`
+	MaxMsgTimeout       int64  `json:"max_msg_timeout"`
+	DeflateLevel        int    `json:"deflate_level"`
+	MaxDeflateLevel     int    `json:"max_deflate_level"`
+	SampleRate          int32  `json:"sample_rate"`
+	OutputBufferSize    int64  `json:"output_buffer_size"`
+	OutputBufferTimeout int64  `json:"output_buffer_timeout"`
 }
 
 // AuthResponse represents the metadata
@@ -41,27 +55,74 @@ type msgResponse struct {
 	cmd     *Command
 	success bool
 	backoff bool
+
+	// storage for cmd, msgResponses are reused via msgResponsePool
+	cmdBuf msgCommand
 }
 
+var msgResponsePool = sync.Pool{
+	New: func() interface{} { return &msgResponse{} },
+}
+
+func getMsgResponse(m *Message, success bool, backoff bool) *msgResponse {
+	resp := msgResponsePool.Get().(*msgResponse)
+	resp.msg = m
+	resp.success = success
+	resp.backoff = backoff
+	return resp
+}
+
+// putMsgResponse returns resp to the pool once its command has been written
+func putMsgResponse(resp *msgResponse) {
+	*resp = msgResponse{}
+	msgResponsePool.Put(resp)
+}
+
+var connCount int64
+
 // Conn represents a connection to nsqd
 //
 // Conn exposes a set of callbacks for the
 // various events that occur on a connection
 type Conn struct {
 	// 64bit atomic vars need to be first for proper alignment on 32bit platforms
-	messagesInFlight int64
-	maxRdyCount      int64
-	rdyCount         int64
-	lastRdyTimestamp int64
-	lastMsgTimestamp int64
+	messagesInFlight       int64
+	maxRdyCount            int64
+	msgTimeout             int64
+	rdyCount               int64
+	lastRdyTimestamp       int64
+	lastMsgTimestamp       int64
+	lastHeartbeatTimestamp int64
+	heartbeatInterval      int64
+	backoffDuration        int64
+	rdyRampUpStart         int64
+	messagesReceived       uint64
+	messagesFinished       uint64
+	messagesRequeued       uint64
+	channelDepth           int64
 
 	mtx sync.Mutex
 
+	// exponentially decaying count of recently received messages (see MessageRate)
+	msgRateMtx  sync.Mutex
+	msgRate     float64
+	msgRateTime time.Time
+
+	// the features negotiated via IDENTIFY (nil if nsqd did not negotiate)
+	identifyResp *IdentifyResponse
+
+	// the last error encountered on this connection (see Consumer.ConnectionStats)
+	lastErrMtx  sync.Mutex
+	lastErr     error
+	lastErrTime time.Time
+	closeErr    error
+
 	config *Config
 
-	conn    *net.TCPConn
+	conn    net.Conn
 	tlsConn *tls.Conn
 	addr    string
+	id      int64
 
 	delegate ConnDelegate
 
@@ -73,16 +134,38 @@ type Conn struct {
 	r io.Reader
 	w io.Writer
 
+	// pooled buffers, released once the connection has closed
+	bufReader *bufio.Reader
+	bufWriter *bufio.Writer
+
+	// commands written but not yet flushed, the message responses among them, and the
+	// timer flushing them (see Config.WriteCoalesceLinger)
+	coalesced          int
+	coalescedResponses []*msgResponse
+	flushTimer         *time.Timer
+
 	cmdChan         chan *Command
 	msgResponseChan chan *msgResponse
 	exitChan        chan int
 	drainReady      chan int
 
+	// the shared write loop of this connection (see Config.SharedWriteLoops), which
+	// replaces writeLoop(), and the set of loops it belongs to
+	sharedWrites chan sharedWrite
+	sharedLoops  *sharedWriteLoopSet
+
+	// backoff state of this connection when Config.BackoffPerConnection is set
+	backoffCounter int32
+	backoffGen     int32
+
 	closeFlag int32
+	closeWait int32
 	stopper   sync.Once
 	wg        sync.WaitGroup
 
 	readLoopRunning int32
+	// set while readLoop waits for a streamed body to be read (see Config.StreamBodyThreshold)
+	streamingFlag int32
 }
 
 // NewConn returns a new Conn instance
@@ -92,12 +175,15 @@ func NewConn(addr string, config *Config, delegate ConnDelegate) *Conn {
 	}
 	return &Conn{
 		addr: addr,
+		id:   atomic.AddInt64(&connCount, 1),
 
 		config:   config,
 		delegate: delegate,
 
-		maxRdyCount:      2500,
-		lastMsgTimestamp: time.Now().UnixNano(),
+		maxRdyCount:            2500,
+		lastMsgTimestamp:       time.Now().UnixNano(),
+		lastHeartbeatTimestamp: time.Now().UnixNano(),
+		channelDepth:           -1,
 
 		cmdChan:         make(chan *Command),
 		msgResponseChan: make(chan *msgResponse),
@@ -171,16 +257,48 @@ func (c *Conn) getLogLevel() LogLevel {
 // Connect dials and bootstraps the nsqd connection
 // (including IDENTIFY) and returns the IdentifyResponse
 func (c *Conn) Connect() (*IdentifyResponse, error) {
-	dialer := &net.Dialer{
-		LocalAddr: c.config.LocalAddr,
-		Timeout:   c.config.DialTimeout,
+	dial := c.config.DialContext
+	if dial == nil {
+		dialer := &net.Dialer{
+			LocalAddr: c.config.LocalAddr,
+			KeepAlive: c.config.TCPKeepAlive,
+		}
+		dial = dialMultiAddr(dialer.DialContext, c.config.DialFallbackDelay)
+	}
+	if c.config.Proxy != "" {
+		var err error
+		dial, err = NewProxyDialContext(c.config.Proxy, dial)
+		if err != nil {
+			return nil, err
+		}
+	}
+	ctx := context.Background()
+	if c.config.DialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.config.DialTimeout)
+		defer cancel()
 	}
 
-	conn, err := dialer.Dial("tcp", c.addr)
-	if err != nil {
-		return nil, err
+	var conn net.Conn
+	var err error
+	addr := c.nsqdAddr()
+	if u, ok := webSocketURL(addr); ok {
+		dial = c.setSocketOptionsOnDial(dial)
+		conn, err = dialWebSocket(ctx, dial, u, c.tlsConfig())
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		network, address := "tcp", addr
+		if path, ok := unixSocketPath(addr); ok {
+			network, address = "unix", path
+		}
+		conn, err = c.setSocketOptionsOnDial(dial)(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
 	}
-	c.conn = conn.(*net.TCPConn)
+	c.conn = conn
 	c.r = conn
 	c.w = conn
 
@@ -196,21 +314,39 @@ func (c *Conn) Connect() (*IdentifyResponse, error) {
 	}
 
 	if resp != nil && resp.AuthRequired {
-		if c.config.AuthSecret == "" {
+		secret := c.config.AuthSecret
+		if c.config.AuthProvider != nil {
+			secret, err = c.config.AuthProvider.Secret(ctx, addr)
+			if err != nil {
+				c.log(LogLevelError, "Auth secret unavailable %s", err)
+				return nil, ErrAuth{fmt.Sprintf("secret unavailable - %s", err)}
+			}
+		}
+		if secret == "" {
 			c.log(LogLevelError, "Auth Required")
-			return nil, errors.New("Auth Required")
+			return nil, ErrAuth{"Auth Required"}
 		}
-		err := c.auth(c.config.AuthSecret)
+		err := c.auth(secret)
 		if err != nil {
 			c.log(LogLevelError, "Auth Failed %s", err)
 			return nil, err
 		}
 	}
 
-	c.wg.Add(2)
 	atomic.StoreInt32(&c.readLoopRunning, 1)
-	go c.readLoop()
-	go c.writeLoop()
+	if c.config.SharedWriteLoops > 0 {
+		c.sharedLoops, c.sharedWrites = acquireSharedWriteLoop(c.config.SharedWriteLoops)
+		c.wg.Add(1)
+		go c.readLoop()
+	} else {
+		c.wg.Add(2)
+		go c.readLoop()
+		go c.writeLoop()
+	}
+	if c.config.MaxMissedHeartbeats > 0 && c.config.HeartbeatInterval > 0 {
+		c.wg.Add(1)
+		go c.heartbeatLoop()
+	}
 	return resp, nil
 }
 
@@ -218,11 +354,20 @@ func (c *Conn) Connect() (*IdentifyResponse, error) {
 func (c *Conn) Close() error {
 	atomic.StoreInt32(&c.closeFlag, 1)
 	if c.conn != nil && atomic.LoadInt64(&c.messagesInFlight) == 0 {
-		return c.conn.CloseRead()
+		return closeRead(c.conn)
 	}
 	return nil
 }
 
+// forceClose immediately closes the underlying connection, without waiting
+// for messages in flight to be responded to
+func (c *Conn) forceClose() {
+	atomic.StoreInt32(&c.closeFlag, 1)
+	if c.conn != nil {
+		c.conn.Close()
+	}
+}
+
 // IsClosing indicates whether or not the
 // connection is currently in the processing of
 // gracefully closing
@@ -230,6 +375,12 @@ func (c *Conn) IsClosing() bool {
 	return atomic.LoadInt32(&c.closeFlag) == 1
 }
 
+// ClosingAcknowledged indicates whether nsqd has acknowledged (with CLOSE_WAIT) the
+// StartClose command sent on this connection, after which it sends no more messages
+func (c *Conn) ClosingAcknowledged() bool {
+	return atomic.LoadInt32(&c.closeWait) == 1
+}
+
 // RDY returns the current RDY count
 func (c *Conn) RDY() int64 {
 	return atomic.LoadInt64(&c.rdyCount)
@@ -266,6 +417,40 @@ func (c *Conn) LastMessageTime() time.Time {
 	return time.Unix(0, atomic.LoadInt64(&c.lastMsgTimestamp))
 }
 
+// the period over which MessageRate is averaged
+const messageRateWindow = 30 * time.Second
+
+// MessageRate returns the rate (per second) at which messages have been received
+// on this connection, exponentially averaged over the last ~30s
+func (c *Conn) MessageRate() float64 {
+	c.msgRateMtx.Lock()
+	defer c.msgRateMtx.Unlock()
+	return c.decayedMessageRate(time.Now())
+}
+
+// must be called with msgRateMtx held
+func (c *Conn) decayedMessageRate(now time.Time) float64 {
+	if c.msgRateTime.IsZero() {
+		return 0
+	}
+	elapsed := now.Sub(c.msgRateTime)
+	return c.msgRate * math.Exp(-elapsed.Seconds()/messageRateWindow.Seconds())
+}
+
+func (c *Conn) observeMessage(now time.Time) {
+	c.msgRateMtx.Lock()
+	c.msgRate = c.decayedMessageRate(now) + 1/messageRateWindow.Seconds()
+	c.msgRateTime = now
+	c.msgRateMtx.Unlock()
+}
+
+// ChannelDepth returns the depth of the channel being consumed on this connection's
+// nsqd as of the last poll of its /stats endpoint, or -1 when unknown (see
+// Config.DepthMonitorInterval)
+func (c *Conn) ChannelDepth() int64 {
+	return atomic.LoadInt64(&c.channelDepth)
+}
+
 // RemoteAddr returns the configured destination nsqd address
 func (c *Conn) RemoteAddr() net.Addr {
 	return c.conn.RemoteAddr()
@@ -276,6 +461,12 @@ func (c *Conn) String() string {
 	return c.addr
 }
 
+// ID returns the identifier of this connection, unique within the process (e.g. to
+// tell apart successive connections to the same nsqd)
+func (c *Conn) ID() int64 {
+	return c.id
+}
+
 // Read performs a deadlined read on the underlying TCP connection
 func (c *Conn) Read(p []byte) (int, error) {
 	c.conn.SetReadDeadline(time.Now().Add(c.config.ReadTimeout))
@@ -290,24 +481,155 @@ func (c *Conn) Write(p []byte) (int, error) {
 
 // WriteCommand is a goroutine safe method to write a Command
 // to this connection, and flush.
+//
+// Publish commands are written with Config.PublishWriteTimeout (when set), others with
+// Config.WriteTimeout.
 func (c *Conn) WriteCommand(cmd *Command) error {
+	_, err := c.writeCommand(cmd, nil)
+	return err
+}
+
+// writeCommand writes cmd, the command responding to resp when non-nil. When cmd is
+// coalesced the response is deferred: responseWritten() is called for it once the
+// coalesced commands are flushed, rather than by the caller
+func (c *Conn) writeCommand(cmd *Command, resp *msgResponse) (deferred bool, err error) {
+	var flushed []*msgResponse
 	c.mtx.Lock()
 
-	_, err := cmd.WriteTo(c)
-	if err != nil {
-		goto exit
+	w := deadlineWriter{c, c.writeTimeout(cmd)}
+	if _, ok := c.w.(flusher); !ok && c.sharedWrites != nil {
+		// borrow a buffer for the command rather than holding one per connection
+		bw := getBufWriter(w, c.config.WriteBufferSize)
+		_, err = cmd.WriteTo(bw)
+		if err == nil {
+			err = bw.Flush()
+		}
+		putBufWriter(bw)
+	} else {
+		_, err = cmd.WriteTo(w)
+		if err == nil {
+			if !c.coalesce(cmd) {
+				flushed = c.takeCoalesced()
+				err = c.Flush()
+			} else if resp != nil {
+				c.coalescedResponses = append(c.coalescedResponses, resp)
+				deferred = true
+			}
+		}
+	}
+	if err == nil {
+		c.traceWrite(cmd)
 	}
-	err = c.Flush()
-
-exit:
 	c.mtx.Unlock()
+	c.coalescedResponsesWritten(flushed, err)
 	if err != nil {
 		c.log(LogLevelError, "IO error - %s", err)
 		c.delegate.OnIOError(c, err)
 	}
+	return deferred, err
+}
+
+// coalesce returns whether flushing cmd, just written, can be deferred to coalesce it with
+// subsequent commands (see Config.WriteCoalesceLinger), scheduling the flush
+func (c *Conn) coalesce(cmd *Command) bool {
+	if c.config.WriteCoalesceLinger <= 0 || c.sharedWrites != nil {
+		return false
+	}
+	switch string(cmd.Name) {
+	case "FIN", "REQ", "TOUCH", "RDY":
+	default:
+		return false
+	}
+	c.coalesced++
+	if c.coalesced >= c.config.WriteCoalesceMax {
+		return false
+	}
+	if c.coalesced == 1 {
+		if c.flushTimer == nil {
+			c.flushTimer = time.AfterFunc(c.config.WriteCoalesceLinger, func() {
+				if err := c.flushCoalesced(); err != nil {
+					c.log(LogLevelError, "IO error - %s", err)
+					c.delegate.OnIOError(c, err)
+					c.setCloseErr(err)
+					c.close()
+				}
+			})
+		} else {
+			c.flushTimer.Reset(c.config.WriteCoalesceLinger)
+		}
+	}
+	return true
+}
+
+// flushCoalesced flushes the commands whose flush was deferred by coalesce()
+func (c *Conn) flushCoalesced() error {
+	c.mtx.Lock()
+	if c.coalesced == 0 {
+		c.mtx.Unlock()
+		return nil
+	}
+	flushed := c.takeCoalesced()
+	c.conn.SetWriteDeadline(time.Now().Add(c.config.WriteTimeout))
+	err := c.Flush()
+	c.mtx.Unlock()
+	c.coalescedResponsesWritten(flushed, err)
 	return err
 }
 
+// takeCoalesced resets the coalesced commands about to be flushed, returning the message
+// responses among them. c.mtx must be held
+func (c *Conn) takeCoalesced() []*msgResponse {
+	flushed := c.coalescedResponses
+	c.coalesced = 0
+	c.coalescedResponses = nil
+	return flushed
+}
+
+// coalescedResponsesWritten completes the message responses deferred by writeCommand()
+// once the coalesced commands have been flushed (or failed to be)
+func (c *Conn) coalescedResponsesWritten(flushed []*msgResponse, err error) {
+	for _, resp := range flushed {
+		c.responseWritten(resp, err)
+		putMsgResponse(resp)
+	}
+}
+
+// writeTimeout returns the write deadline class of cmd
+func (c *Conn) writeTimeout(cmd *Command) time.Duration {
+	if c.config.PublishWriteTimeout > 0 && isPublish(cmd) {
+		return c.config.PublishWriteTimeout
+	}
+	return c.config.WriteTimeout
+}
+
+func isPublish(cmd *Command) bool {
+	switch string(cmd.Name) {
+	case "PUB", "MPUB", "DPUB":
+		return true
+	}
+	return false
+}
+
+// deadlineWriter performs writes on a Conn with a specific deadline
+type deadlineWriter struct {
+	c       *Conn
+	timeout time.Duration
+}
+
+func (w deadlineWriter) Write(p []byte) (int, error) {
+	w.c.conn.SetWriteDeadline(time.Now().Add(w.timeout))
+	return w.c.w.Write(p)
+}
+
+// readResponse reads a response during the connection's bootstrap
+func (c *Conn) readResponse() (int32, []byte, error) {
+	frameType, data, err := ReadUnpackedResponse(c)
+	if err == nil {
+		c.traceRead(frameType, data)
+	}
+	return frameType, data, err
+}
+
 type flusher interface {
 	Flush() error
 }
@@ -320,6 +642,27 @@ func (c *Conn) Flush() error {
 	return nil
 }
 
+// addIdentifyMetadata adds the fields of metadata to the IDENTIFY body ci, and to its
+// user_agent (see Config.IdentifyMetadata)
+func addIdentifyMetadata(ci map[string]interface{}, metadata map[string]string) {
+	keys := make([]string, 0, len(metadata))
+	for k := range metadata {
+		if _, ok := ci[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	if len(keys) == 0 {
+		return
+	}
+	sort.Strings(keys)
+	pairs := make([]string, len(keys))
+	for i, k := range keys {
+		ci[k] = metadata[k]
+		pairs[i] = k + "=" + metadata[k]
+	}
+	ci["user_agent"] = fmt.Sprintf("%s (%s)", ci["user_agent"], strings.Join(pairs, "; "))
+}
+
 func (c *Conn) identify() (*IdentifyResponse, error) {
 	ci := make(map[string]interface{})
 	ci["client_id"] = c.config.ClientID
@@ -345,6 +688,10 @@ func (c *Conn) identify() (*IdentifyResponse, error) {
 		ci["output_buffer_timeout"] = int64(c.config.OutputBufferTimeout / time.Millisecond)
 	}
 	ci["msg_timeout"] = int64(c.config.MsgTimeout / time.Millisecond)
+	addIdentifyMetadata(ci, c.config.IdentifyMetadata)
+	if c.config.IdentifyHook != nil {
+		c.config.IdentifyHook(c.String(), ci)
+	}
 	cmd, err := Identify(ci)
 	if err != nil {
 		return nil, ErrIdentify{err.Error()}
@@ -355,7 +702,7 @@ func (c *Conn) identify() (*IdentifyResponse, error) {
 		return nil, ErrIdentify{err.Error()}
 	}
 
-	frameType, data, err := ReadUnpackedResponse(c)
+	frameType, data, err := c.readResponse()
 	if err != nil {
 		return nil, ErrIdentify{err.Error()}
 	}
@@ -378,11 +725,13 @@ func (c *Conn) identify() (*IdentifyResponse, error) {
 
 	c.log(LogLevelDebug, "IDENTIFY response: %+v", resp)
 
+	c.identifyResp = resp
 	c.maxRdyCount = resp.MaxRdyCount
+	c.msgTimeout = int64(time.Duration(resp.MsgTimeout) * time.Millisecond)
 
 	if resp.TLSv1 {
 		c.log(LogLevelInfo, "upgrading to TLS")
-		err := c.upgradeTLS(c.config.TlsConfig)
+		err := c.upgradeTLS(c.tlsConfig())
 		if err != nil {
 			return nil, ErrIdentify{err.Error()}
 		}
@@ -404,20 +753,46 @@ func (c *Conn) identify() (*IdentifyResponse, error) {
 		}
 	}
 
+	if c.config.SharedWriteLoops > 0 {
+		// buffers are borrowed per command written (see WriteCommand)
+		return resp, nil
+	}
+
 	// now that connection is bootstrapped, enable read buffering
 	// (and write buffering if it's not already capable of Flush())
-	c.r = bufio.NewReader(c.r)
+	c.bufReader = getBufReader(c.r, c.config.ReadBufferSize)
+	c.r = c.bufReader
 	if _, ok := c.w.(flusher); !ok {
-		c.w = bufio.NewWriter(c.w)
+		c.bufWriter = getBufWriter(c.w, c.config.WriteBufferSize)
+		c.w = c.bufWriter
 	}
 
 	return resp, nil
 }
 
+// tlsConfig returns the TLS configuration to use for this connection,
+// preferring a per-address configuration when one is provided
+func (c *Conn) tlsConfig() *tls.Config {
+	if c.config.TlsConfigForAddr != nil {
+		if conf := c.config.TlsConfigForAddr(c.nsqdAddr()); conf != nil {
+			return conf
+		}
+	}
+	return c.config.TlsConfig
+}
+
 func (c *Conn) upgradeTLS(tlsConf *tls.Config) error {
-	host, _, err := net.SplitHostPort(c.addr)
-	if err != nil {
-		return err
+	// the ServerName of a unix socket address must be configured explicitly
+	var host string
+	var err error
+	addr := c.nsqdAddr()
+	if u, ok := webSocketURL(addr); ok {
+		host = u.Hostname()
+	} else if _, ok := unixSocketPath(addr); !ok {
+		host, _, err = net.SplitHostPort(addr)
+		if err != nil {
+			return err
+		}
 	}
 
 	// create a local copy of the config to set ServerName for this connection
@@ -425,7 +800,10 @@ func (c *Conn) upgradeTLS(tlsConf *tls.Config) error {
 	if tlsConf != nil {
 		conf = tlsConf.Clone()
 	}
-	conf.ServerName = host
+	// an explicitly configured ServerName takes precedence over the dialed host
+	if conf.ServerName == "" {
+		conf.ServerName = host
+	}
 
 	c.tlsConn = tls.Client(c.conn, conf)
 	err = c.tlsConn.Handshake()
@@ -434,7 +812,7 @@ func (c *Conn) upgradeTLS(tlsConf *tls.Config) error {
 	}
 	c.r = c.tlsConn
 	c.w = c.tlsConn
-	frameType, data, err := ReadUnpackedResponse(c)
+	frameType, data, err := c.readResponse()
 	if err != nil {
 		return err
 	}
@@ -445,14 +823,14 @@ func (c *Conn) upgradeTLS(tlsConf *tls.Config) error {
 }
 
 func (c *Conn) upgradeDeflate(level int) error {
-	conn := net.Conn(c.conn)
+	conn := c.conn
 	if c.tlsConn != nil {
 		conn = c.tlsConn
 	}
 	fw, _ := flate.NewWriter(conn, level)
 	c.r = flate.NewReader(conn)
 	c.w = fw
-	frameType, data, err := ReadUnpackedResponse(c)
+	frameType, data, err := c.readResponse()
 	if err != nil {
 		return err
 	}
@@ -463,13 +841,13 @@ func (c *Conn) upgradeDeflate(level int) error {
 }
 
 func (c *Conn) upgradeSnappy() error {
-	conn := net.Conn(c.conn)
+	conn := c.conn
 	if c.tlsConn != nil {
 		conn = c.tlsConn
 	}
 	c.r = snappy.NewReader(conn)
 	c.w = snappy.NewWriter(conn)
-	frameType, data, err := ReadUnpackedResponse(c)
+	frameType, data, err := c.readResponse()
 	if err != nil {
 		return err
 	}
@@ -490,13 +868,13 @@ func (c *Conn) auth(secret string) error {
 		return err
 	}
 
-	frameType, data, err := ReadUnpackedResponse(c)
+	frameType, data, err := c.readResponse()
 	if err != nil {
 		return err
 	}
 
 	if frameType == FrameTypeError {
-		return errors.New("Error authenticating " + string(data))
+		return ErrAuth{"Error authenticating " + string(data)}
 	}
 
 	resp := &AuthResponse{}
@@ -518,24 +896,42 @@ func (c *Conn) readLoop() {
 			goto exit
 		}
 
-		frameType, data, err := ReadUnpackedResponse(c)
+		var frameType int32
+		var data []byte
+		var frameBuf *[]byte
+		var stream *bodyStream
+		var err error
+		if c.config.StreamBodyThreshold > 0 {
+			frameType, data, frameBuf, stream, err = readStreamedFrame(c,
+				c.config.StreamBodyThreshold, c.config.ZeroCopy)
+		} else if c.config.ZeroCopy {
+			frameType, data, frameBuf, err = readPooledFrame(c)
+		} else {
+			frameType, data, err = ReadUnpackedResponse(c)
+		}
 		if err != nil {
 			if err == io.EOF && atomic.LoadInt32(&c.closeFlag) == 1 {
 				goto exit
 			}
 			if !strings.Contains(err.Error(), "use of closed network connection") {
 				c.log(LogLevelError, "IO error - %s", err)
+				c.setCloseErr(err)
 				c.delegate.OnIOError(c, err)
 			}
 			goto exit
 		}
+		c.traceRead(frameType, data)
 
 		if frameType == FrameTypeResponse && bytes.Equal(data, []byte("_heartbeat_")) {
 			c.log(LogLevelDebug, "heartbeat received")
+			now := time.Now().UnixNano()
+			last := atomic.SwapInt64(&c.lastHeartbeatTimestamp, now)
+			atomic.StoreInt64(&c.heartbeatInterval, now-last)
 			c.delegate.OnHeartbeat(c)
 			err := c.WriteCommand(Nop())
 			if err != nil {
 				c.log(LogLevelError, "IO error - %s", err)
+				c.setCloseErr(err)
 				c.delegate.OnIOError(c, err)
 				goto exit
 			}
@@ -544,21 +940,43 @@ func (c *Conn) readLoop() {
 
 		switch frameType {
 		case FrameTypeResponse:
+			if bytes.Equal(data, []byte("CLOSE_WAIT")) {
+				atomic.StoreInt32(&c.closeWait, 1)
+			}
 			c.delegate.OnResponse(c, data)
 		case FrameTypeMessage:
 			msg, err := DecodeMessage(data)
 			if err != nil {
 				c.log(LogLevelError, "IO error - %s", err)
+				c.setCloseErr(err)
 				c.delegate.OnIOError(c, err)
 				goto exit
 			}
+			if stream != nil {
+				msg.stream = stream
+				msg.onResponded(stream.close)
+			} else {
+				c.decodeBody(msg)
+			}
+			msg.frameBuf = frameBuf
 			msg.Delegate = delegate
+			msg.propagator = c.config.Propagator
+			msg.codec = c.config.Codec
 			msg.NSQDAddress = c.String()
+			msg.connID = c.id
+			msg.receivedAt = time.Now()
+			msg.msgTimeout = time.Duration(c.msgTimeout)
 
 			atomic.AddInt64(&c.messagesInFlight, 1)
-			atomic.StoreInt64(&c.lastMsgTimestamp, time.Now().UnixNano())
+			now := time.Now()
+			atomic.AddUint64(&c.messagesReceived, 1)
+			atomic.StoreInt64(&c.lastMsgTimestamp, now.UnixNano())
+			c.observeMessage(now)
 
 			c.delegate.OnMessage(c, msg)
+			if stream != nil && !c.awaitStream(stream) {
+				goto exit
+			}
 		case FrameTypeError:
 			c.log(LogLevelError, "protocol error - %s", data)
 			c.delegate.OnError(c, data)
@@ -584,6 +1002,85 @@ exit:
 	c.log(LogLevelInfo, "readLoop exiting")
 }
 
+// decodeBody decompresses the body of msg when compressed by a Producer (see
+// Config.MessageCompression), and decodes its envelope when Config.DecodeEnvelopes is set.
+// Streamed bodies are left as published (see Config.StreamBodyThreshold)
+func (c *Conn) decodeBody(msg *Message) {
+	headers, body, ok := DecodeEnvelope(msg.Body)
+	if !ok {
+		return
+	}
+	if headers.Get(HeaderContentEncoding) != "" {
+		var err error
+		headers, body, err = decompressBody(headers, body)
+		if err != nil {
+			c.log(LogLevelWarning, "msg %s - %s, delivering it compressed", msg.ID, err)
+			return
+		}
+		msg.Body = body
+		if len(headers) > 0 && !c.config.DecodeEnvelopes {
+			msg.Body = EncodeEnvelope(headers, body)
+		}
+	}
+	if c.config.DecodeEnvelopes {
+		msg.Headers = headers
+		msg.Body = body
+	}
+}
+
+// awaitStream waits until the streamed body of a message has been read (or discarded),
+// returning false if the connection failed or is closing meanwhile
+func (c *Conn) awaitStream(stream *bodyStream) bool {
+	atomic.StoreInt32(&c.streamingFlag, 1)
+	defer func() {
+		// nsqd cannot send heartbeats while sending the body
+		atomic.StoreInt64(&c.lastHeartbeatTimestamp, time.Now().UnixNano())
+		atomic.StoreInt32(&c.streamingFlag, 0)
+	}()
+	select {
+	case <-stream.done:
+	case <-c.exitChan:
+		return false
+	}
+	if stream.err != nil {
+		c.log(LogLevelError, "IO error - %s", stream.err)
+		c.setCloseErr(stream.err)
+		c.delegate.OnIOError(c, stream.err)
+		return false
+	}
+	return true
+}
+
+// heartbeatLoop closes the connection once Config.MaxMissedHeartbeats consecutive
+// heartbeats have been missed
+func (c *Conn) heartbeatLoop() {
+	interval := c.config.HeartbeatInterval
+	// allow half an interval for the latest heartbeat to arrive
+	limit := time.Duration(c.config.MaxMissedHeartbeats)*interval + interval/2
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			since := time.Since(time.Unix(0, atomic.LoadInt64(&c.lastHeartbeatTimestamp)))
+			if since <= limit || atomic.LoadInt32(&c.closeFlag) == 1 ||
+				atomic.LoadInt32(&c.streamingFlag) == 1 {
+				continue
+			}
+			err := fmt.Errorf("no heartbeat received in %s", since)
+			c.log(LogLevelError, "IO error - %s", err)
+			c.setCloseErr(err)
+			c.delegate.OnIOError(c, err)
+			goto exit
+		case <-c.exitChan:
+			goto exit
+		}
+	}
+
+exit:
+	c.wg.Done()
+}
+
 func (c *Conn) writeLoop() {
 	for {
 		select {
@@ -593,42 +1090,9 @@ func (c *Conn) writeLoop() {
 			close(c.drainReady)
 			goto exit
 		case cmd := <-c.cmdChan:
-			err := c.WriteCommand(cmd)
-			if err != nil {
-				c.log(LogLevelError, "error sending command %s - %s", cmd, err)
-				c.close()
-				continue
-			}
+			c.writeCmd(cmd)
 		case resp := <-c.msgResponseChan:
-			// Decrement this here so it is correct even if we can't respond to nsqd
-			msgsInFlight := atomic.AddInt64(&c.messagesInFlight, -1)
-
-			if resp.success {
-				c.log(LogLevelDebug, "FIN %s", resp.msg.ID)
-				c.delegate.OnMessageFinished(c, resp.msg)
-				c.delegate.OnResume(c)
-			} else {
-				c.log(LogLevelDebug, "REQ %s", resp.msg.ID)
-				c.delegate.OnMessageRequeued(c, resp.msg)
-				if resp.backoff {
-					c.delegate.OnBackoff(c)
-				} else {
-					c.delegate.OnContinue(c)
-				}
-			}
-
-			err := c.WriteCommand(resp.cmd)
-			if err != nil {
-				c.log(LogLevelError, "error sending command %s - %s", resp.cmd, err)
-				c.close()
-				continue
-			}
-
-			if msgsInFlight == 0 &&
-				atomic.LoadInt32(&c.closeFlag) == 1 {
-				c.close()
-				continue
-			}
+			c.writeResponse(resp)
 		}
 	}
 
@@ -637,6 +1101,56 @@ exit:
 	c.log(LogLevelInfo, "writeLoop exiting")
 }
 
+// writeCmd writes a command queued by onMessageTouch(), closing the connection on error
+func (c *Conn) writeCmd(cmd *Command) {
+	err := c.WriteCommand(cmd)
+	if err != nil {
+		c.log(LogLevelError, "error sending command %s - %s", cmd, err)
+		c.setCloseErr(err)
+		c.close()
+	}
+}
+
+// writeResponse writes the response (FIN or REQ) to a message, closing the connection on
+// error or once the last message in flight of a closing connection has been responded to
+func (c *Conn) writeResponse(resp *msgResponse) {
+	// Decrement this here so it is correct even if we can't respond to nsqd
+	msgsInFlight := atomic.AddInt64(&c.messagesInFlight, -1)
+
+	if resp.success {
+		c.log(LogLevelDebug, "FIN %s", resp.msg.ID)
+		c.delegate.OnMessageFinished(c, resp.msg)
+		c.delegate.OnResume(c)
+	} else {
+		c.log(LogLevelDebug, "REQ %s", resp.msg.ID)
+		c.delegate.OnMessageRequeued(c, resp.msg)
+		if resp.backoff {
+			c.delegate.OnBackoff(c)
+		} else {
+			c.delegate.OnContinue(c)
+		}
+	}
+
+	deferred, err := c.writeCommand(resp.cmd, resp)
+	if err != nil {
+		c.log(LogLevelError, "error sending command %s - %s", resp.cmd, err)
+	}
+	if !deferred {
+		c.responseWritten(resp, err)
+		putMsgResponse(resp)
+	}
+	if err != nil {
+		c.setCloseErr(err)
+		c.close()
+		return
+	}
+
+	if msgsInFlight == 0 &&
+		atomic.LoadInt32(&c.closeFlag) == 1 {
+		c.close()
+	}
+}
+
 func (c *Conn) close() {
 	// a "clean" connection close is orchestrated as follows:
 	//
@@ -666,7 +1180,12 @@ func (c *Conn) close() {
 	c.stopper.Do(func() {
 		c.log(LogLevelInfo, "beginning close")
 		close(c.exitChan)
-		c.conn.CloseRead()
+		if c.sharedWrites != nil {
+			// there is no writeLoop() to wait on, and shared write loops no longer write
+			// responses to this connection
+			close(c.drainReady)
+		}
+		closeRead(c.conn)
 
 		c.wg.Add(1)
 		go c.cleanup()
@@ -686,8 +1205,10 @@ func (c *Conn) cleanup() {
 		// and readLoop has exited
 		var msgsInFlight int64
 		select {
-		case <-c.msgResponseChan:
+		case resp := <-c.msgResponseChan:
 			msgsInFlight = atomic.AddInt64(&c.messagesInFlight, -1)
+			c.responseWritten(resp, ErrNotConnected)
+			putMsgResponse(resp)
 		case <-ticker.C:
 			msgsInFlight = atomic.LoadInt64(&c.messagesInFlight)
 		}
@@ -716,32 +1237,156 @@ exit:
 	c.log(LogLevelInfo, "finished draining, cleanup exiting")
 }
 
+// responseWrittenDelegate is implemented by delegates notified of the result of
+// writing the response to a message (see Consumer.OnDelivery)
+type responseWrittenDelegate interface {
+	onResponseWritten(c *Conn, m *Message, success bool, err error)
+}
+
+func (c *Conn) responseWritten(resp *msgResponse, err error) {
+	if d, ok := c.delegate.(responseWrittenDelegate); ok {
+		d.onResponseWritten(c, resp.msg, resp.success, err)
+	}
+	// in zero-copy mode, messages responded to automatically are done with, unless their
+	// timed out handler is still using them
+	if !resp.msg.IsAutoResponseDisabled() &&
+		atomic.LoadInt32(&resp.msg.handlerState) != handlerAbandoned {
+		resp.msg.Release()
+	}
+}
+
 func (c *Conn) waitForCleanup() {
 	// this blocks until readLoop and writeLoop
 	// (and cleanup goroutine above) have exited
 	c.wg.Wait()
-	c.conn.CloseWrite()
+	c.flushCoalesced()
+	closeWrite(c.conn)
+	c.releaseBuffers()
+	if c.sharedLoops != nil {
+		releaseSharedWriteLoops(c.sharedLoops)
+	}
 	c.log(LogLevelInfo, "clean close complete")
 	c.delegate.OnClose(c)
 }
 
+// releaseBuffers returns the pooled buffers of a closed connection
+func (c *Conn) releaseBuffers() {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.flushTimer != nil {
+		c.flushTimer.Stop()
+	}
+	if c.bufReader != nil {
+		c.r = closedReadWriter{}
+		putBufReader(c.bufReader)
+		c.bufReader = nil
+	}
+	if c.bufWriter != nil {
+		c.w = closedReadWriter{}
+		putBufWriter(c.bufWriter)
+		c.bufWriter = nil
+	}
+}
+
+func (c *Conn) setLastError(err error) {
+	c.lastErrMtx.Lock()
+	c.lastErr = err
+	c.lastErrTime = time.Now()
+	c.lastErrMtx.Unlock()
+}
+
+// setCloseErr records the IO error causing the connection to close (the first one, as
+// later errors follow from it)
+func (c *Conn) setCloseErr(err error) {
+	c.lastErrMtx.Lock()
+	if c.closeErr == nil {
+		c.closeErr = err
+	}
+	c.lastErrMtx.Unlock()
+}
+
+// IdentifyResponse returns a copy of the features negotiated with nsqd via IDENTIFY, or
+// nil if not connected or nsqd does not support feature negotiation
+func (c *Conn) IdentifyResponse() *IdentifyResponse {
+	if c.identifyResp == nil {
+		return nil
+	}
+	resp := *c.identifyResp
+	return &resp
+}
+
+// CloseErr returns the IO error that caused the connection to close, or nil when it was
+// closed via Close (or has not closed)
+func (c *Conn) CloseErr() error {
+	c.lastErrMtx.Lock()
+	defer c.lastErrMtx.Unlock()
+	return c.closeErr
+}
+
+// HeartbeatInterval returns the time between the last two heartbeats received (or
+// between connecting and the first heartbeat), 0 before any heartbeat is received
+func (c *Conn) HeartbeatInterval() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.heartbeatInterval))
+}
+
 func (c *Conn) onMessageFinish(m *Message) {
-	c.msgResponseChan <- &msgResponse{msg: m, cmd: Finish(m.ID), success: true}
+	resp := getMsgResponse(m, true, false)
+	resp.cmd = resp.cmdBuf.finish(m.ID)
+	c.queueResponse(resp)
+}
+
+// requeueDelays returns the default and maximum requeue delays, as changed by
+// Consumer.UpdateConfig
+func (c *Conn) requeueDelays() (time.Duration, time.Duration) {
+	if d, ok := c.delegate.(interface {
+		requeueDelays() (time.Duration, time.Duration)
+	}); ok {
+		return d.requeueDelays()
+	}
+	return c.config.DefaultRequeueDelay, c.config.MaxRequeueDelay
 }
 
 func (c *Conn) onMessageRequeue(m *Message, delay time.Duration, backoff bool) {
+	if c.config.Shadow {
+		c.log(LogLevelDebug, "shadow mode, finishing msg %s instead of requeueing", m.ID)
+		c.onMessageFinish(m)
+		return
+	}
 	if delay == -1 {
-		// linear delay
-		delay = c.config.DefaultRequeueDelay * time.Duration(m.Attempts)
+		var strategy RequeueDelayStrategy = &LinearRequeueStrategy{}
+		if c.config.RequeueDelayStrategy != nil {
+			strategy = c.config.RequeueDelayStrategy
+		}
+		defaultDelay, maxDelay := c.requeueDelays()
+		delay = strategy.RequeueDelay(m.Attempts, defaultDelay, maxDelay)
 		// bound the requeueDelay to configured max
-		if delay > c.config.MaxRequeueDelay {
-			delay = c.config.MaxRequeueDelay
+		if delay > maxDelay {
+			delay = maxDelay
 		}
 	}
-	c.msgResponseChan <- &msgResponse{msg: m, cmd: Requeue(m.ID, delay), success: false, backoff: backoff}
+	resp := getMsgResponse(m, false, backoff)
+	resp.cmd = resp.cmdBuf.requeue(m.ID, delay)
+	c.queueResponse(resp)
+}
+
+// queueResponse queues the response to a message to the write loop of this connection
+func (c *Conn) queueResponse(resp *msgResponse) {
+	if c.sharedWrites != nil {
+		c.sharedWrites <- sharedWrite{c: c, resp: resp}
+		return
+	}
+	c.msgResponseChan <- resp
 }
 
 func (c *Conn) onMessageTouch(m *Message) {
+	if c.sharedWrites != nil {
+		// the loop may have stopped once this connection has closed
+		select {
+		case c.sharedWrites <- sharedWrite{c: c, cmd: Touch(m.ID)}:
+		case <-c.exitChan:
+		}
+		return
+	}
 	select {
 	case c.cmdChan <- Touch(m.ID):
 	case <-c.exitChan:
@@ -763,3 +1408,75 @@ func (c *Conn) log(lvl LogLevel, line string, args ...interface{}) {
 		fmt.Sprintf(logFmt, c.String()),
 		fmt.Sprintf(line, args...)))
 }
+
+// setSocketOptions applies the socket options of Config to a TCP connection
+func (c *Conn) setSocketOptions(conn net.Conn) error {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	if err := tcpConn.SetNoDelay(c.config.TCPNoDelay); err != nil {
+		return err
+	}
+	if c.config.SocketSendBuffer > 0 {
+		if err := tcpConn.SetWriteBuffer(c.config.SocketSendBuffer); err != nil {
+			return err
+		}
+	}
+	if c.config.SocketReceiveBuffer > 0 {
+		if err := tcpConn.SetReadBuffer(c.config.SocketReceiveBuffer); err != nil {
+			return err
+		}
+	}
+	if c.config.TCPKeepAlive < 0 {
+		return tcpConn.SetKeepAlive(false)
+	}
+	if c.config.TCPKeepAlive > 0 {
+		if err := tcpConn.SetKeepAlive(true); err != nil {
+			return err
+		}
+		return tcpConn.SetKeepAlivePeriod(c.config.TCPKeepAlive)
+	}
+	return nil
+}
+
+// setSocketOptionsOnDial wraps dial to apply the socket options of Config to the
+// connections it returns
+func (c *Conn) setSocketOptionsOnDial(dial DialContextFunc) DialContextFunc {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := dial(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		if err := c.setSocketOptions(conn); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+}
+
+// unixSocketPath returns the path of a `unix:///path/to.sock` address
+func unixSocketPath(addr string) (string, bool) {
+	if !strings.HasPrefix(addr, "unix://") {
+		return "", false
+	}
+	return strings.TrimPrefix(addr, "unix://"), true
+}
+
+// closeRead shuts down the reading side of conn, when supported (e.g. by TCP and Unix
+// connections), or otherwise closes it
+func closeRead(conn net.Conn) error {
+	if c, ok := conn.(interface{ CloseRead() error }); ok {
+		return c.CloseRead()
+	}
+	return conn.Close()
+}
+
+// closeWrite shuts down the writing side of conn, when supported, or otherwise closes it
+func closeWrite(conn net.Conn) error {
+	if c, ok := conn.(interface{ CloseWrite() error }); ok {
+		return c.CloseWrite()
+	}
+	return conn.Close()
+}
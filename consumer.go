@@ -2,6 +2,7 @@ package nsq
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"log"
@@ -10,6 +11,8 @@ import (
 	"net"
 	"net/url"
 	"os"
+	"runtime/debug"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -42,6 +45,60 @@ func (h HandlerFunc) HandleMessage(m *Message) error {
 	return h(m)
 }
 
+// HandlerWithContext is the context-aware message processing interface for Consumer
+//
+// It behaves identically to Handler with respect to FINishing and REQueing, additionally
+// supplying a context that is cancelled when the Consumer exits, the message's processing
+// deadline (the negotiated msg_timeout, extended by calls to Touch) passes, or the configured
+// HandlerTimeout elapses.
+type HandlerWithContext interface {
+	HandleMessage(ctx context.Context, message *Message) error
+}
+
+// HandlerWithContextFunc is a convenience type to avoid having to declare a struct
+// to implement the HandlerWithContext interface, it can be used like this:
+//
+// 	consumer.AddHandlerWithContext(nsq.HandlerWithContextFunc(func(ctx context.Context, m *Message) error {
+// 		// handle the message
+// 	}))
+type HandlerWithContextFunc func(ctx context.Context, message *Message) error
+
+// HandleMessage implements the HandlerWithContext interface
+func (h HandlerWithContextFunc) HandleMessage(ctx context.Context, m *Message) error {
+	return h(ctx, m)
+}
+
+// HandlerMiddleware wraps a HandlerWithContext with additional behavior, allowing
+// cross-cutting concerns (logging, metrics, tracing, etc.) to be applied uniformly
+// to all handlers of a Consumer (see Consumer.Use)
+type HandlerMiddleware func(next HandlerWithContext) HandlerWithContext
+
+// handlerAdapter allows a Handler to be used where a HandlerWithContext is expected
+type handlerAdapter struct {
+	h Handler
+}
+
+func (a handlerAdapter) HandleMessage(ctx context.Context, m *Message) error {
+	return a.h.HandleMessage(m)
+}
+
+// unwrapHandler returns the handler originally supplied by the user (so that
+// optional interfaces like FailedMessageLogger can be detected)
+func unwrapHandler(handler HandlerWithContext) interface{} {
+	switch h := handler.(type) {
+	case handlerAdapter:
+		return h.h
+	case *pooledHandler:
+		return unwrapHandler(h.handler)
+	}
+	return handler
+}
+
+// MessageFilter is called for every message received by a Consumer before it is
+// passed to a handler, returning false for messages that should not be handled
+// (see Consumer.AddFilter)
+type MessageFilter func(message *Message) bool
+
 // DiscoveryFilter is an interface accepted by `SetBehaviorDelegate()`
 // for filtering the nsqds returned from discovery via nsqlookupd
 type DiscoveryFilter interface {
@@ -61,7 +118,70 @@ type ConsumerStats struct {
 	MessagesReceived uint64
 	MessagesFinished uint64
 	MessagesRequeued uint64
-	Connections      int
+	MessagesTimedOut uint64
+	MessagesFiltered uint64
+	// messages in flight (neither FINished nor REQueued, see InFlightMessages), and
+	// messages that were about to time out (see Config.ExpiringMessageFraction)
+	MessagesInFlight int
+	MessagesExpiring uint64
+	// the summed body size of messages in flight (see Config.MaxInFlightBytes)
+	InFlightBytes int64
+	// handler executions exceeding Config.SlowHandlerThreshold
+	SlowHandlers uint64
+	// handler panics recovered (see Config.RecoverPanics)
+	HandlerPanics uint64
+	// messages suppressed as duplicates, and messages checked but not found
+	// (see SetDedupCache and SetIdempotencyStore)
+	DedupHits   uint64
+	DedupMisses uint64
+	// messages in flight when connections were closed by a stopping Consumer (see
+	// Config.DrainTimeout and StopWithContext), left to be redelivered by nsqd
+	MessagesAbandoned uint64
+	Connections       int
+	// the number of successful messages required to exit backoff (0 when not backing off)
+	BackoffLevel int
+}
+
+// add aggregates the statistics of another Consumer into s
+func (s *ConsumerStats) add(o *ConsumerStats) {
+	s.MessagesReceived += o.MessagesReceived
+	s.MessagesFinished += o.MessagesFinished
+	s.MessagesRequeued += o.MessagesRequeued
+	s.MessagesTimedOut += o.MessagesTimedOut
+	s.MessagesFiltered += o.MessagesFiltered
+	s.MessagesInFlight += o.MessagesInFlight
+	s.InFlightBytes += o.InFlightBytes
+	s.MessagesExpiring += o.MessagesExpiring
+	s.SlowHandlers += o.SlowHandlers
+	s.HandlerPanics += o.HandlerPanics
+	s.DedupHits += o.DedupHits
+	s.DedupMisses += o.DedupMisses
+	s.MessagesAbandoned += o.MessagesAbandoned
+	s.Connections += o.Connections
+	if o.BackoffLevel > s.BackoffLevel {
+		s.BackoffLevel = o.BackoffLevel
+	}
+}
+
+// ConnectionStats represents a snapshot of the state of a single nsqd connection of a Consumer
+type ConnectionStats struct {
+	Addr     string
+	ID       int64
+	RDY      int64
+	InFlight int64
+
+	MessagesReceived uint64
+	MessagesFinished uint64
+	MessagesRequeued uint64
+
+	// the time of the last heartbeat received (or when connected, before the first)
+	LastHeartbeat time.Time
+	// the last error encountered on the connection (nil if none), and when
+	LastError     error
+	LastErrorTime time.Time
+
+	// the features negotiated with nsqd via IDENTIFY (nil if nsqd did not negotiate)
+	IdentifyResponse *IdentifyResponse
 }
 
 var instCount int64
@@ -88,11 +208,27 @@ type Consumer struct {
 	messagesReceived uint64
 	messagesFinished uint64
 	messagesRequeued uint64
+	messagesTimedOut uint64
+	messagesFiltered uint64
+	dedupHits        uint64
+	dedupMisses      uint64
+	messagesExpiring uint64
+	slowHandlers     uint64
+	handlerPanics    uint64
+	msgsAbandoned    uint64
 	totalRdyCount    int64
+	inFlightBytes    int64
 	backoffDuration  int64
+	lookupdSuccess   int64
 	backoffCounter   int32
+	backoffGen       int32
 	maxInFlight      int32
 
+	// handler observations since the last adaptive max-in-flight adjustment
+	adaptiveHandled uint64
+	adaptiveFailed  uint64
+	adaptiveLatency int64
+
 	mtx sync.RWMutex
 
 	logger   []logger
@@ -106,6 +242,10 @@ type Consumer struct {
 	channel string
 	config  Config
 
+	// the options changed by UpdateConfig, *Config
+	liveConfig atomic.Value
+	configMtx  sync.Mutex
+
 	rngMtx sync.Mutex
 	rng    *rand.Rand
 
@@ -118,6 +258,9 @@ type Consumer struct {
 	rdyRetryMtx    sync.Mutex
 	rdyRetryTimers map[string]*time.Timer
 
+	deadLetterMtx       sync.Mutex
+	deadLetterProducers map[string]*Producer
+
 	pendingConnections map[string]*Conn
 	connections        map[string]*Conn
 
@@ -127,9 +270,73 @@ type Consumer struct {
 	lookupdRecheckChan chan int
 	lookupdHTTPAddrs   []string
 	lookupdQueryIndex  int
+	discoverers        []Discoverer
+	discoveryFlag      int32
+	nsqdHTTPAddrs      map[string]string
+
+	lagMtx        sync.RWMutex
+	lag           ConsumerLag
+	lagThresholds []*lagThreshold
+
+	filtersMtx sync.RWMutex
+	filters    []MessageFilter
+
+	rateLimiter *rateLimiter
+
+	inFlightMtx sync.Mutex
+	inFlight    map[MessageID]*inFlightMessage
+
+	dedupCache   DedupCache
+	dedupKeyFunc MessageKeyFunc
+
+	idempotencyStore   IdempotencyStore
+	idempotencyKeyFunc MessageKeyFunc
+
+	decodeErrorHandler DecodeErrorHandler
+
+	eventMtx      sync.RWMutex
+	eventHandlers []eventRegistration
+
+	stopHooksMtx sync.Mutex
+	stopHooks    []func(ctx context.Context)
+
+	deliveryHooksMtx sync.RWMutex
+	deliveryHooks    []DeliveryHook
+
+	errorChan chan error
+
+	lookupdFailures int32
+	connectFailures int32
+	terminateMtx    sync.Mutex
+	terminateErr    error
+
+	middlewareMtx     sync.RWMutex
+	middleware        []HandlerMiddleware
+	middlewareVersion int32
+
+	// goroutines running handlers added via AddConcurrentHandlersWithContext (see SetConcurrency)
+	workersMtx     sync.Mutex
+	workers        []*handlerWorker
+	workersStopped bool
+
+	// see Messages
+	messagesOnce sync.Once
+	messagesChan chan *Message
+
+	// the Consumers of the retry topics (see Config.RetryTiers), and for those
+	// Consumers the Consumer they relay messages to
+	retryMtx       sync.Mutex
+	retryConsumers []*Consumer
+	retryParent    *Consumer
+
+	// cancelled on exit, the parent of all contexts passed to handlers
+	ctx       context.Context
+	ctxCancel context.CancelFunc
 
 	wg              sync.WaitGroup
 	runningHandlers int32
+	pausedFlag      int32
+	throttledFlag   int32
 	stopFlag        int32
 	connectedFlag   int32
 	stopHandler     sync.Once
@@ -149,12 +356,12 @@ func NewConsumer(topic string, channel string, config *Config) (*Consumer, error
 		return nil, err
 	}
 
-	if !IsValidTopicName(topic) {
-		return nil, errors.New("invalid topic name")
+	if err := ValidateTopicName(topic); err != nil {
+		return nil, err
 	}
 
-	if !IsValidChannelName(channel) {
-		return nil, errors.New("invalid channel name")
+	if err := ValidateChannelName(channel); err != nil {
+		return nil, err
 	}
 
 	r := &Consumer{
@@ -170,18 +377,31 @@ func NewConsumer(topic string, channel string, config *Config) (*Consumer, error
 
 		incomingMessages: make(chan *Message),
 
-		rdyRetryTimers:     make(map[string]*time.Timer),
-		pendingConnections: make(map[string]*Conn),
-		connections:        make(map[string]*Conn),
+		rdyRetryTimers:      make(map[string]*time.Timer),
+		deadLetterProducers: make(map[string]*Producer),
+		pendingConnections:  make(map[string]*Conn),
+		connections:         make(map[string]*Conn),
+		nsqdHTTPAddrs:       make(map[string]string),
+		inFlight:            make(map[MessageID]*inFlightMessage),
 
 		lookupdRecheckChan: make(chan int, 1),
 
+		errorChan: make(chan error, errorChanSize),
+
 		rng: rand.New(rand.NewSource(time.Now().UnixNano())),
 
 		StopChan: make(chan int),
 		exitChan: make(chan int),
 	}
 
+	r.liveConfig.Store(&r.config)
+	r.ctx, r.ctxCancel = context.WithCancel(
+		context.WithValue(context.Background(), subscriptionKey{}, Subscription{topic, channel}))
+
+	if config.MaxMessagesPerSecond > 0 {
+		r.rateLimiter = newRateLimiter(config.MaxMessagesPerSecond)
+	}
+
 	// Set default logger for all log levels
 	l := log.New(os.Stderr, "", log.Flags())
 	for index := range r.logger {
@@ -190,17 +410,111 @@ func NewConsumer(topic string, channel string, config *Config) (*Consumer, error
 
 	r.wg.Add(1)
 	go r.rdyLoop()
+	if config.AdaptiveMaxInFlight {
+		r.wg.Add(1)
+		go r.adaptiveMaxInFlightLoop()
+	}
+	if config.DepthMonitorInterval > 0 {
+		r.wg.Add(1)
+		go r.depthMonitorLoop()
+	}
 	return r, nil
 }
 
+// the number of asynchronous errors buffered for Errors() before new ones are dropped
+const errorChanSize = 100
+
+// Errors returns a channel on which failures that occur asynchronously (e.g. querying
+// nsqlookupd, or connecting to a discovered nsqd) are sent as ErrConsumer values
+//
+// These errors are also logged. Reading from the channel is optional; errors are
+// dropped when it is not drained.
+func (r *Consumer) Errors() <-chan error {
+	return r.errorChan
+}
+
+func (r *Consumer) reportError(op string, addr string, err error) {
+	select {
+	case r.errorChan <- ErrConsumer{Op: op, Addr: addr, Err: err}:
+	default:
+	}
+}
+
+// NewTransientConsumer creates a new instance of Consumer for the specified topic and an
+// ephemeral channel unique to this process (see TransientChannelName), for broadcast
+// style consumption
+func NewTransientConsumer(topic string, channelPrefix string, config *Config) (*Consumer, error) {
+	return NewConsumer(topic, TransientChannelName(channelPrefix), config)
+}
+
 // Stats retrieves the current connection and message statistics for a Consumer
 func (r *Consumer) Stats() *ConsumerStats {
 	return &ConsumerStats{
 		MessagesReceived: atomic.LoadUint64(&r.messagesReceived),
 		MessagesFinished: atomic.LoadUint64(&r.messagesFinished),
 		MessagesRequeued: atomic.LoadUint64(&r.messagesRequeued),
+		MessagesTimedOut: atomic.LoadUint64(&r.messagesTimedOut),
+		MessagesFiltered: atomic.LoadUint64(&r.messagesFiltered),
+		MessagesInFlight: r.numInFlight(),
+		InFlightBytes:    atomic.LoadInt64(&r.inFlightBytes),
+		MessagesExpiring: atomic.LoadUint64(&r.messagesExpiring),
+		SlowHandlers:     atomic.LoadUint64(&r.slowHandlers),
+		HandlerPanics:    atomic.LoadUint64(&r.handlerPanics),
+		DedupHits:        atomic.LoadUint64(&r.dedupHits),
+		DedupMisses:      atomic.LoadUint64(&r.dedupMisses),
 		Connections:      len(r.conns()),
+		BackoffLevel:     r.backoffLevel(),
+
+		MessagesAbandoned: atomic.LoadUint64(&r.msgsAbandoned),
+	}
+}
+
+// the global backoff level, or the highest of any connection with BackoffPerConnection
+func (r *Consumer) backoffLevel() int {
+	level := atomic.LoadInt32(&r.backoffCounter)
+	if r.config.BackoffPerConnection {
+		for _, c := range r.conns() {
+			if l := atomic.LoadInt32(&c.backoffCounter); l > level {
+				level = l
+			}
+		}
+	}
+	return int(level)
+}
+
+// ConnectionStats retrieves the current state of each nsqd connection of a Consumer
+// (ordered by address)
+func (r *Consumer) ConnectionStats() []ConnectionStats {
+	conns := r.conns()
+	stats := make([]ConnectionStats, 0, len(conns))
+	for _, c := range conns {
+		c.lastErrMtx.Lock()
+		lastErr, lastErrTime := c.lastErr, c.lastErrTime
+		c.lastErrMtx.Unlock()
+		stats = append(stats, ConnectionStats{
+			Addr:     c.String(),
+			ID:       c.ID(),
+			RDY:      c.RDY(),
+			InFlight: atomic.LoadInt64(&c.messagesInFlight),
+
+			MessagesReceived: atomic.LoadUint64(&c.messagesReceived),
+			MessagesFinished: atomic.LoadUint64(&c.messagesFinished),
+			MessagesRequeued: atomic.LoadUint64(&c.messagesRequeued),
+
+			LastHeartbeat: time.Unix(0, atomic.LoadInt64(&c.lastHeartbeatTimestamp)),
+			LastError:     lastErr,
+			LastErrorTime: lastErrTime,
+
+			IdentifyResponse: c.IdentifyResponse(),
+		})
 	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Addr < stats[j].Addr })
+	return stats
+}
+
+// Subscription returns the topic/channel this Consumer consumes
+func (r *Consumer) Subscription() Subscription {
+	return Subscription{r.topic, r.channel}
 }
 
 func (r *Consumer) conns() []*Conn {
@@ -265,6 +579,9 @@ func (r *Consumer) getLogLevel() LogLevel {
 // of the `Consumer`:
 //
 //    DiscoveryFilter
+//    DeadLetterNamer
+//    RetryTopicNamer
+//    DiscoveryPreference
 //
 func (r *Consumer) SetBehaviorDelegate(cb interface{}) {
 	matched := false
@@ -273,6 +590,18 @@ func (r *Consumer) SetBehaviorDelegate(cb interface{}) {
 		matched = true
 	}
 
+	if _, ok := cb.(DeadLetterNamer); ok {
+		matched = true
+	}
+
+	if _, ok := cb.(RetryTopicNamer); ok {
+		matched = true
+	}
+
+	if _, ok := cb.(DiscoveryPreference); ok {
+		matched = true
+	}
+
 	if !matched {
 		panic("behavior delegate does not have any recognized methods")
 	}
@@ -290,6 +619,57 @@ func (r *Consumer) perConnMaxInFlight() int64 {
 	return int64(math.Min(math.Max(1, s), b))
 }
 
+// Healthy returns nil when the Consumer is healthy, otherwise an error describing why
+// it is not, for use in health and readiness checks
+//
+// A Consumer is unhealthy when it:
+//
+//     * has been stopped
+//     * has no nsqd connections
+//     * has not successfully queried nsqlookupd within the last 3 LookupdPollIntervals
+//       (when connected via nsqlookupd)
+//     * has a connection that has not received a heartbeat within the last two
+//       HeartbeatIntervals
+//     * is in backoff
+func (r *Consumer) Healthy() error {
+	if atomic.LoadInt32(&r.stopFlag) == 1 {
+		return errors.New("consumer stopped")
+	}
+
+	conns := r.conns()
+	if len(conns) == 0 {
+		return errors.New("no nsqd connections")
+	}
+
+	r.mtx.RLock()
+	numLookupd := len(r.lookupdHTTPAddrs)
+	r.mtx.RUnlock()
+	if numLookupd > 0 {
+		last := atomic.LoadInt64(&r.lookupdSuccess)
+		if last == 0 {
+			return errors.New("nsqlookupd has never been queried successfully")
+		}
+		if since := time.Since(time.Unix(0, last)); since > 3*r.live().LookupdPollInterval {
+			return fmt.Errorf("nsqlookupd last queried successfully %s ago", since)
+		}
+	}
+
+	if interval := r.config.HeartbeatInterval; interval > 0 {
+		for _, c := range conns {
+			since := time.Since(time.Unix(0, atomic.LoadInt64(&c.lastHeartbeatTimestamp)))
+			if since > 2*interval {
+				return fmt.Errorf("(%s) no heartbeat received in %s", c.String(), since)
+			}
+		}
+	}
+
+	if inBackoff, duration, _ := r.BackoffState(); inBackoff {
+		return fmt.Errorf("in backoff (level %d, %s)", atomic.LoadInt32(&r.backoffCounter), duration)
+	}
+
+	return nil
+}
+
 // IsStarved indicates whether any connections for this consumer are blocked on processing
 // before being able to receive more messages (ie. RDY count of 0 and not exiting)
 func (r *Consumer) IsStarved() bool {
@@ -310,7 +690,7 @@ func (r *Consumer) getMaxInFlight() int32 {
 // ChangeMaxInFlight sets a new maximum number of messages this comsumer instance
 // will allow in-flight, and updates all existing connections as appropriate.
 //
-// For example, ChangeMaxInFlight(0) would pause message flow
+// For example, ChangeMaxInFlight(0) would pause message flow (see also Pause)
 //
 // If already connected, it updates the reader RDY state for each connection.
 func (r *Consumer) ChangeMaxInFlight(maxInFlight int) {
@@ -325,6 +705,70 @@ func (r *Consumer) ChangeMaxInFlight(maxInFlight int) {
 	}
 }
 
+// Pause stops message flow from all connections by setting their RDY count to 0,
+// without closing them. Messages already in flight continue to be processed and
+// responded to as usual.
+//
+// The Consumer remains paused (including for connections established while paused)
+// until Resume is called.
+func (r *Consumer) Pause() {
+	if !atomic.CompareAndSwapInt32(&r.pausedFlag, 0, 1) {
+		return
+	}
+
+	r.log(LogLevelInfo, "pausing, setting all to RDY 0")
+	for _, c := range r.conns() {
+		r.updateRDY(c, 0)
+	}
+	for _, c := range r.RetryConsumers() {
+		c.Pause()
+	}
+}
+
+// Resume restarts message flow after a call to Pause
+func (r *Consumer) Resume() {
+	if !atomic.CompareAndSwapInt32(&r.pausedFlag, 1, 0) {
+		return
+	}
+
+	r.log(LogLevelInfo, "resuming")
+	for _, c := range r.RetryConsumers() {
+		c.Resume()
+	}
+	if r.bytesThrottled() {
+		// RDY is restored once in-flight bytes fall below Config.MaxInFlightBytes
+		return
+	}
+	r.restoreRDY()
+}
+
+// restoreRDY sends RDY to all connections after it was withheld (see Pause and
+// Config.MaxInFlightBytes), according to the backoff state
+func (r *Consumer) restoreRDY() {
+	if r.inBackoffTimeout() {
+		// the pending backoff timeout will resume RDY
+		return
+	}
+	if r.inBackoff() {
+		// any RDY 1 sent to test the waters was cancelled by Pause, send another
+		r.resume()
+		return
+	}
+	for _, c := range r.conns() {
+		if c.inBackoff() && atomic.LoadInt64(&c.backoffDuration) == 0 {
+			// as above, for a connection in backoff (see BackoffPerConnection)
+			r.resumeConn(c)
+			continue
+		}
+		r.maybeUpdateRDY(c)
+	}
+}
+
+// IsPaused indicates whether message flow has been paused via Pause
+func (r *Consumer) IsPaused() bool {
+	return atomic.LoadInt32(&r.pausedFlag) == 1
+}
+
 // ConnectToNSQLookupd adds an nsqlookupd address to the list for this Consumer instance.
 //
 // If it is the first to be added, it initiates an HTTP request to discover nsqd
@@ -359,11 +803,47 @@ func (r *Consumer) ConnectToNSQLookupd(addr string) error {
 	// if this is the first one, kick off the go loop
 	if numLookupd == 1 {
 		r.queryLookupd()
-		r.wg.Add(1)
-		go r.lookupdLoop()
+		r.startLookupdLoop()
 	}
 
-	return nil
+	return r.connectRetryConsumers(func(c *Consumer) error {
+		return c.ConnectToNSQLookupd(addr)
+	})
+}
+
+// ConnectToDiscoverer adds a Discoverer used to discover the nsqd instances providing
+// the topic for this Consumer, alongside any nsqlookupd.
+//
+// Discovery is initiated immediately, after which the Discoverer is polled every
+// LookupdPollInterval (by the same goroutine polling nsqlookupd).
+func (r *Consumer) ConnectToDiscoverer(d Discoverer) error {
+	if atomic.LoadInt32(&r.stopFlag) == 1 {
+		return errors.New("consumer stopped")
+	}
+	if atomic.LoadInt32(&r.runningHandlers) == 0 {
+		return errors.New("no handlers")
+	}
+
+	atomic.StoreInt32(&r.connectedFlag, 1)
+
+	r.mtx.Lock()
+	r.discoverers = append(r.discoverers, d)
+	r.mtx.Unlock()
+
+	r.queryDiscoverer(d)
+	r.startLookupdLoop()
+
+	return r.connectRetryConsumers(func(c *Consumer) error {
+		return c.ConnectToDiscoverer(d)
+	})
+}
+
+func (r *Consumer) startLookupdLoop() {
+	if !atomic.CompareAndSwapInt32(&r.discoveryFlag, 0, 1) {
+		return
+	}
+	r.wg.Add(1)
+	go r.lookupdLoop()
 }
 
 // ConnectToNSQLookupds adds multiple nsqlookupd address to the list for this Consumer instance.
@@ -396,15 +876,17 @@ func validatedLookupAddr(addr string) error {
 	return nil
 }
 
-// poll all known lookup servers every LookupdPollInterval
+// poll all known lookup servers (and Discoverers) every LookupdPollInterval
 func (r *Consumer) lookupdLoop() {
 	// add some jitter so that multiple consumers discovering the same topic,
 	// when restarted at the same time, dont all connect at once.
 	r.rngMtx.Lock()
 	jitter := time.Duration(int64(r.rng.Float64() *
-		r.config.LookupdPollJitter * float64(r.config.LookupdPollInterval)))
+		r.config.LookupdPollJitter * float64(r.live().LookupdPollInterval)))
 	r.rngMtx.Unlock()
 	var ticker *time.Ticker
+	var interval time.Duration
+	var lastTopology *string
 
 	select {
 	case <-time.After(jitter):
@@ -412,17 +894,45 @@ func (r *Consumer) lookupdLoop() {
 		goto exit
 	}
 
-	ticker = time.NewTicker(r.config.LookupdPollInterval)
+	interval = r.live().LookupdPollInterval
+	ticker = time.NewTicker(interval)
 
 	for {
 		select {
 		case <-ticker.C:
-			r.queryLookupd()
 		case <-r.lookupdRecheckChan:
-			r.queryLookupd()
 		case <-r.exitChan:
 			goto exit
 		}
+
+		nsqdAddrs, complete := r.discover()
+		if !r.config.LookupdPollAdaptive {
+			// (changed by UpdateConfig)
+			if next := r.live().LookupdPollInterval; next != interval {
+				interval = next
+				ticker.Stop()
+				ticker = time.NewTicker(interval)
+			}
+			continue
+		}
+		if !complete {
+			continue
+		}
+		sort.Strings(nsqdAddrs)
+		topology := strings.Join(nsqdAddrs, ",")
+		changed := lastTopology != nil && *lastTopology != topology
+		lastTopology = &topology
+
+		interval = nextLookupdPollInterval(&r.config, interval, changed)
+		next := interval
+		if !changed {
+			r.rngMtx.Lock()
+			next += time.Duration(r.rng.Float64() * r.config.LookupdPollJitter * float64(interval))
+			r.rngMtx.Unlock()
+		}
+		r.log(LogLevelDebug, "polling lookupd in %s (topology changed: %v)", next, changed)
+		ticker.Stop()
+		ticker = time.NewTicker(next)
 	}
 
 exit:
@@ -433,6 +943,64 @@ exit:
 	r.wg.Done()
 }
 
+// nextLookupdPollInterval returns the duration until the next poll of lookupd when
+// LookupdPollAdaptive is enabled (without jitter)
+func nextLookupdPollInterval(c *Config, current time.Duration, changed bool) time.Duration {
+	if changed {
+		return c.LookupdPollMinInterval
+	}
+	next := current * 2
+	if next < c.LookupdPollMinInterval {
+		next = c.LookupdPollMinInterval
+	}
+	if next > c.LookupdPollMaxInterval {
+		next = c.LookupdPollMaxInterval
+	}
+	return next
+}
+
+// query lookupd and all Discoverers, returning the nsqd addresses discovered and
+// whether all of them were queried successfully
+func (r *Consumer) discover() ([]string, bool) {
+	r.mtx.RLock()
+	numLookupd := len(r.lookupdHTTPAddrs)
+	discoverers := make([]Discoverer, len(r.discoverers))
+	copy(discoverers, r.discoverers)
+	r.mtx.RUnlock()
+
+	var nsqdAddrs []string
+	complete := true
+	if numLookupd > 0 {
+		addrs, ok := r.queryLookupd()
+		nsqdAddrs = append(nsqdAddrs, addrs...)
+		complete = complete && ok
+	}
+	for _, d := range discoverers {
+		addrs, ok := r.queryDiscoverer(d)
+		nsqdAddrs = append(nsqdAddrs, addrs...)
+		complete = complete && ok
+	}
+	return nsqdAddrs, complete
+}
+
+// query a Discoverer for the nsqd's that provide the topic we are consuming,
+// initiating a connection to any new ones
+func (r *Consumer) queryDiscoverer(d Discoverer) ([]string, bool) {
+	ctx, cancel := context.WithTimeout(r.ctx, r.live().LookupdPollInterval)
+	defer cancel()
+
+	r.log(LogLevelInfo, "querying discoverer %s", d)
+
+	nsqdAddrs, err := d.Discover(ctx, r.topic)
+	if err != nil {
+		r.log(LogLevelError, "error querying discoverer (%s) - %s", d, err)
+		r.reportError("discover", fmt.Sprint(d), err)
+		return nil, false
+	}
+	r.connectToDiscovered(nsqdAddrs)
+	return nsqdAddrs, true
+}
+
 // return the next lookupd endpoint to query
 // keeping track of which one was last used
 func (r *Consumer) nextLookupdEndpoint() string {
@@ -445,6 +1013,12 @@ func (r *Consumer) nextLookupdEndpoint() string {
 	r.mtx.RUnlock()
 	r.lookupdQueryIndex = (r.lookupdQueryIndex + 1) % num
 
+	return lookupdEndpoint(addr, r.topic)
+}
+
+// the /lookup endpoint of an nsqlookupd address (which may include a path, in
+// which case it is used as-is) for topic
+func lookupdEndpoint(addr string, topic string) string {
 	urlString := addr
 	if !strings.Contains(urlString, "://") {
 		urlString = "http://" + addr
@@ -459,7 +1033,7 @@ func (r *Consumer) nextLookupdEndpoint() string {
 	}
 
 	v, err := url.ParseQuery(u.RawQuery)
-	v.Add("topic", r.topic)
+	v.Add("topic", topic)
 	u.RawQuery = v.Encode()
 	return u.String()
 }
@@ -468,6 +1042,10 @@ type lookupResp struct {
 	Channels  []string    `json:"channels"`
 	Producers []*peerInfo `json:"producers"`
 	Timestamp int64       `json:"timestamp"`
+
+	// the nsqd of each partition of the topic, by partition, listed by the nsqlookupd of
+	// partitioned NSQ forks (see Config.ExtendedProtocol)
+	Partitions map[string]*peerInfo `json:"partitions"`
 }
 
 type peerInfo struct {
@@ -483,7 +1061,7 @@ type peerInfo struct {
 // which nsqd's provide the topic we are consuming.
 //
 // initiate a connection to any new producers that are identified.
-func (r *Consumer) queryLookupd() {
+func (r *Consumer) queryLookupd() ([]string, bool) {
 	retries := 0
 
 retry:
@@ -492,17 +1070,49 @@ retry:
 	r.log(LogLevelInfo, "querying nsqlookupd %s", endpoint)
 
 	var data lookupResp
-	err := apiRequestNegotiateV1("GET", endpoint, nil, &data)
+	err := apiRequestNegotiateV1(r.config.lookupdHTTPClient(), r.config.LookupdHTTPHeader,
+		"GET", endpoint, nil, &data)
 	if err != nil {
 		r.log(LogLevelError, "error querying nsqlookupd (%s) - %s", endpoint, err)
+		r.reportError("lookupd", endpoint, err)
 		retries++
 		if retries < 3 {
 			r.log(LogLevelInfo, "retrying with next nsqlookupd")
 			goto retry
 		}
-		return
+		failures := atomic.AddInt32(&r.lookupdFailures, 1)
+		if r.config.MaxLookupdFailures > 0 && int(failures) >= r.config.MaxLookupdFailures {
+			r.terminate(ErrLookupdFailing, err)
+		}
+		return nil, false
+	}
+
+	atomic.StoreInt64(&r.lookupdSuccess, time.Now().UnixNano())
+	atomic.StoreInt32(&r.lookupdFailures, 0)
+
+	r.mtx.Lock()
+	for _, producer := range data.Producers {
+		tcpAddr := net.JoinHostPort(producer.BroadcastAddress, strconv.Itoa(producer.TCPPort))
+		r.nsqdHTTPAddrs[tcpAddr] = net.JoinHostPort(producer.BroadcastAddress, strconv.Itoa(producer.HTTPPort))
+	}
+	for id, producer := range data.Partitions {
+		if partition, err := strconv.Atoi(id); err == nil && producer != nil {
+			tcpAddr := net.JoinHostPort(producer.BroadcastAddress, strconv.Itoa(producer.TCPPort))
+			r.nsqdHTTPAddrs[PartitionAddress(tcpAddr, partition)] =
+				net.JoinHostPort(producer.BroadcastAddress, strconv.Itoa(producer.HTTPPort))
+		}
+	}
+	r.mtx.Unlock()
+
+	nsqdAddrs := data.nsqdAddrs()
+	if r.config.ExtendedProtocol && len(data.Partitions) > 0 {
+		nsqdAddrs = data.partitionAddrs()
 	}
+	r.connectToDiscovered(nsqdAddrs)
+	return nsqdAddrs, true
+}
 
+func (data *lookupResp) nsqdAddrs() []string {
 	var nsqdAddrs []string
 	for _, producer := range data.Producers {
 		broadcastAddress := producer.BroadcastAddress
@@ -510,17 +1120,36 @@ retry:
 		joined := net.JoinHostPort(broadcastAddress, strconv.Itoa(port))
 		nsqdAddrs = append(nsqdAddrs, joined)
 	}
+	return nsqdAddrs
+}
+
+// initiate a connection to any new discovered nsqd
+func (r *Consumer) connectToDiscovered(nsqdAddrs []string) {
 	// apply filter
 	if discoveryFilter, ok := r.behaviorDelegate.(DiscoveryFilter); ok {
 		nsqdAddrs = discoveryFilter.Filter(nsqdAddrs)
 	}
+	if preference, ok := r.behaviorDelegate.(DiscoveryPreference); ok {
+		r.connectToPreferred(preference, nsqdAddrs)
+		return
+	}
+	r.connectToNSQDs(nsqdAddrs)
+}
+
+// connectToNSQDs connects to discovered nsqdAddrs, returning the number connected
+func (r *Consumer) connectToNSQDs(nsqdAddrs []string) int {
+	connected := 0
 	for _, addr := range nsqdAddrs {
-		err = r.ConnectToNSQD(addr)
+		err := r.connectToNSQD(addr)
 		if err != nil && err != ErrAlreadyConnected {
 			r.log(LogLevelError, "(%s) error connecting to nsqd - %s", addr, err)
+			r.reportError("connect", addr, err)
+			r.connectFailed(err)
 			continue
 		}
+		connected++
 	}
+	return connected
 }
 
 // ConnectToNSQDs takes multiple nsqd addresses to connect directly to.
@@ -542,7 +1171,25 @@ func (r *Consumer) ConnectToNSQDs(addresses []string) error {
 // It is recommended to use ConnectToNSQLookupd so that topics are discovered
 // automatically.  This method is useful when you want to connect to a single, local,
 // instance.
+//
+// addr is either a TCP address (`host:port`), the path of a unix socket
+// (`unix:///path/to/nsqd.sock`) or a WebSocket endpoint relaying the TCP protocol to
+// nsqd (`ws://host/path` or `wss://host/path`, secured with Config.TlsConfig), for
+// clients without a TCP path to nsqd.
 func (r *Consumer) ConnectToNSQD(addr string) error {
+	if err := r.connectToNSQD(addr); err != nil {
+		return err
+	}
+	return r.connectRetryConsumers(func(c *Consumer) error {
+		err := c.ConnectToNSQD(addr)
+		if err == ErrAlreadyConnected {
+			return nil
+		}
+		return err
+	})
+}
+
+func (r *Consumer) connectToNSQD(addr string) error {
 	if atomic.LoadInt32(&r.stopFlag) == 1 {
 		return errors.New("consumer stopped")
 	}
@@ -588,6 +1235,7 @@ func (r *Consumer) ConnectToNSQD(addr string) error {
 	}
 
 	if resp != nil {
+		r.emit(Event{Type: EventIdentifyResponse, NSQDAddress: conn.String(), IdentifyResponse: resp})
 		if resp.MaxRdyCount < int64(r.getMaxInFlight()) {
 			r.log(LogLevelWarning,
 				"(%s) max RDY count %d < consumer max in flight %d, truncation possible",
@@ -595,7 +1243,7 @@ func (r *Consumer) ConnectToNSQD(addr string) error {
 		}
 	}
 
-	cmd := Subscribe(r.topic, r.channel)
+	cmd := r.subscribeCommand(addr)
 	err = conn.WriteCommand(cmd)
 	if err != nil {
 		cleanupConnection()
@@ -607,7 +1255,11 @@ func (r *Consumer) ConnectToNSQD(addr string) error {
 	delete(r.pendingConnections, addr)
 	r.connections[addr] = conn
 	r.mtx.Unlock()
+	atomic.StoreInt32(&r.connectFailures, 0)
 
+	r.emit(Event{Type: EventConnectionAdded, NSQDAddress: conn.String()})
+
+	r.startRDYRampUp(conn)
 	// pre-emptive signal to existing connections to lower their RDY count
 	for _, c := range r.conns() {
 		r.maybeUpdateRDY(c)
@@ -671,17 +1323,94 @@ func (r *Consumer) DisconnectFromNSQLookupd(addr string) error {
 	return nil
 }
 
-func (r *Consumer) onConnMessage(c *Conn, msg *Message) {
-	atomic.AddUint64(&r.messagesReceived, 1)
-	r.incomingMessages <- msg
-}
-
-func (r *Consumer) onConnMessageFinished(c *Conn, msg *Message) {
-	atomic.AddUint64(&r.messagesFinished, 1)
-}
+// SetNSQLookupdAddresses replaces the list of `nsqlookupd` addresses used for periodic
+// discovery, adding and removing addresses as needed.
+//
+// Newly added addresses trigger an immediate poll. If no nsqlookupd address was
+// previously configured this is equivalent to ConnectToNSQLookupds.
+//
+// NOTE: as with DisconnectFromNSQLookupd, connections to nsqd discovered via a
+// removed address are not closed.
+func (r *Consumer) SetNSQLookupdAddresses(addresses []string) error {
+	if atomic.LoadInt32(&r.stopFlag) == 1 {
+		return errors.New("consumer stopped")
+	}
+	if len(addresses) == 0 {
+		return errors.New("cannot remove all nsqlookupd HTTP addresses")
+	}
+	for _, addr := range addresses {
+		if err := validatedLookupAddr(addr); err != nil {
+			return err
+		}
+	}
 
-func (r *Consumer) onConnMessageRequeued(c *Conn, msg *Message) {
+	r.mtx.Lock()
+	if len(r.lookupdHTTPAddrs) == 0 {
+		r.mtx.Unlock()
+		return r.ConnectToNSQLookupds(addresses)
+	}
+
+	var added bool
+	lookupdHTTPAddrs := make([]string, 0, len(addresses))
+	for _, addr := range addresses {
+		if indexOf(addr, lookupdHTTPAddrs) != -1 {
+			continue
+		}
+		if indexOf(addr, r.lookupdHTTPAddrs) == -1 {
+			r.log(LogLevelInfo, "adding nsqlookupd %s", addr)
+			added = true
+		}
+		lookupdHTTPAddrs = append(lookupdHTTPAddrs, addr)
+	}
+	for _, addr := range r.lookupdHTTPAddrs {
+		if indexOf(addr, lookupdHTTPAddrs) == -1 {
+			r.log(LogLevelInfo, "removing nsqlookupd %s", addr)
+		}
+	}
+	r.lookupdHTTPAddrs = lookupdHTTPAddrs
+	r.mtx.Unlock()
+
+	if added {
+		// trigger a poll of the lookupd
+		select {
+		case r.lookupdRecheckChan <- 1:
+		default:
+		}
+	}
+	return r.connectRetryConsumers(func(c *Consumer) error {
+		return c.SetNSQLookupdAddresses(addresses)
+	})
+}
+
+func (r *Consumer) onConnMessage(c *Conn, msg *Message) {
+	atomic.AddUint64(&r.messagesReceived, 1)
+	if !r.shadowSampled(msg) || !r.filterMessage(msg) {
+		atomic.AddUint64(&r.messagesFiltered, 1)
+		msg.Finish()
+		return
+	}
+	if r.dedupMessage(msg) {
+		return
+	}
+	r.trackInFlight(msg)
+	r.incomingMessages <- msg
+}
+
+func (r *Consumer) onConnMessageFinished(c *Conn, msg *Message) {
+	atomic.AddUint64(&r.messagesFinished, 1)
+	atomic.AddUint64(&c.messagesFinished, 1)
+	r.untrackInFlight(msg)
+	if r.dedupCache != nil {
+		r.dedupCache.Add(r.dedupKey(msg))
+	}
+	r.emit(Event{Type: EventMessageFinished, NSQDAddress: c.String(), Message: msg})
+}
+
+func (r *Consumer) onConnMessageRequeued(c *Conn, msg *Message) {
 	atomic.AddUint64(&r.messagesRequeued, 1)
+	atomic.AddUint64(&c.messagesRequeued, 1)
+	r.untrackInFlight(msg)
+	r.emit(Event{Type: EventMessageRequeued, NSQDAddress: c.String(), Message: msg})
 }
 
 func (r *Consumer) onConnBackoff(c *Conn) {
@@ -707,11 +1436,26 @@ func (r *Consumer) onConnResponse(c *Conn, data []byte) {
 	}
 }
 
-func (r *Consumer) onConnError(c *Conn, data []byte) {}
+func (r *Consumer) onConnError(c *Conn, data []byte) {
+	err := ErrProtocol{string(data)}
+	c.setLastError(err)
+	r.reportError("protocol", c.String(), err)
+	if r.config.StopOnAuthFailure &&
+		(bytes.HasPrefix(data, []byte("E_UNAUTHORIZED")) || bytes.HasPrefix(data, []byte("E_AUTH_FAILED"))) {
+		r.terminate(ErrAuthRejected, err)
+	}
+}
 
-func (r *Consumer) onConnHeartbeat(c *Conn) {}
+func (r *Consumer) onConnHeartbeat(c *Conn) {
+	r.emit(Event{Type: EventHeartbeat, NSQDAddress: c.String(), HeartbeatInterval: c.HeartbeatInterval()})
+}
 
 func (r *Consumer) onConnIOError(c *Conn, err error) {
+	if atomic.LoadInt32(&r.stopFlag) == 0 {
+		c.setLastError(err)
+		r.reportError("io", c.String(), err)
+	}
+	r.emit(Event{Type: EventConnectionIOError, NSQDAddress: c.String(), Err: err})
 	c.Close()
 }
 
@@ -736,7 +1480,11 @@ func (r *Consumer) onConnClose(c *Conn) {
 	left := len(r.connections)
 	r.mtx.Unlock()
 
+	// messages received on this connection can no longer be responded to
+	r.untrackConnInFlight(c.String())
+
 	r.log(LogLevelWarning, "there are %d connections left alive", left)
+	r.emit(Event{Type: EventConnectionRemoved, NSQDAddress: c.String(), Err: c.CloseErr()})
 
 	if (hasRDYRetryTimer || rdyCount > 0) &&
 		(int32(left) == r.getMaxInFlight() || r.inBackoff()) {
@@ -757,11 +1505,11 @@ func (r *Consumer) onConnClose(c *Conn) {
 	}
 
 	r.mtx.RLock()
-	numLookupd := len(r.lookupdHTTPAddrs)
+	discovering := len(r.lookupdHTTPAddrs) > 0 || len(r.discoverers) > 0
 	reconnect := indexOf(c.String(), r.nsqdTCPAddrs) >= 0
 	r.mtx.RUnlock()
-	if numLookupd > 0 {
-		// trigger a poll of the lookupd
+	if discovering {
+		// trigger a poll of the lookupd (and Discoverers)
 		select {
 		case r.lookupdRecheckChan <- 1:
 		default:
@@ -771,8 +1519,9 @@ func (r *Consumer) onConnClose(c *Conn) {
 		// try to reconnect after a bit
 		go func(addr string) {
 			for {
-				r.log(LogLevelInfo, "(%s) re-connecting in %s", addr, r.config.LookupdPollInterval)
-				time.Sleep(r.config.LookupdPollInterval)
+				interval := r.live().LookupdPollInterval
+				r.log(LogLevelInfo, "(%s) re-connecting in %s", addr, interval)
+				time.Sleep(interval)
 				if atomic.LoadInt32(&r.stopFlag) == 1 {
 					break
 				}
@@ -783,9 +1532,11 @@ func (r *Consumer) onConnClose(c *Conn) {
 					r.log(LogLevelWarning, "(%s) skipped reconnect after removal...", addr)
 					return
 				}
-				err := r.ConnectToNSQD(addr)
+				err := r.connectToNSQD(addr)
 				if err != nil && err != ErrAlreadyConnected {
 					r.log(LogLevelError, "(%s) error connecting to nsqd - %s", addr, err)
+					r.reportError("connect", addr, err)
+					r.connectFailed(err)
 					continue
 				}
 				break
@@ -803,8 +1554,14 @@ func (r *Consumer) startStopContinueBackoff(conn *Conn, signal backoffSignal) {
 	if r.inBackoffTimeout() {
 		return
 	}
+	if r.config.BackoffPerConnection && !r.inBackoff() {
+		// (unless in a global backoff started by TriggerBackoff)
+		r.startStopContinueConnBackoff(conn, signal)
+		return
+	}
 
 	// update backoff state
+	cfg := r.live()
 	backoffUpdated := false
 	backoffCounter := atomic.LoadInt32(&r.backoffCounter)
 	switch signal {
@@ -814,8 +1571,8 @@ func (r *Consumer) startStopContinueBackoff(conn *Conn, signal backoffSignal) {
 			backoffUpdated = true
 		}
 	case backoffFlag:
-		nextBackoff := r.config.BackoffStrategy.Calculate(int(backoffCounter) + 1)
-		if nextBackoff <= r.config.MaxBackoffDuration {
+		nextBackoff := cfg.BackoffStrategy.Calculate(int(backoffCounter) + 1)
+		if nextBackoff <= cfg.MaxBackoffDuration {
 			backoffCounter++
 			backoffUpdated = true
 		}
@@ -827,14 +1584,16 @@ func (r *Consumer) startStopContinueBackoff(conn *Conn, signal backoffSignal) {
 		count := r.perConnMaxInFlight()
 		r.log(LogLevelWarning, "exiting backoff, returning all to RDY %d", count)
 		for _, c := range r.conns() {
-			r.updateRDY(c, count)
+			r.startRDYRampUp(c)
+			r.updateRDY(c, r.rampedRDY(c, count))
 		}
+		r.emit(Event{Type: EventBackoffEnded})
 	} else if r.backoffCounter > 0 {
 		// start or continue backoff
-		backoffDuration := r.config.BackoffStrategy.Calculate(int(backoffCounter))
+		backoffDuration := cfg.BackoffStrategy.Calculate(int(backoffCounter))
 
-		if backoffDuration > r.config.MaxBackoffDuration {
-			backoffDuration = r.config.MaxBackoffDuration
+		if backoffDuration > cfg.MaxBackoffDuration {
+			backoffDuration = cfg.MaxBackoffDuration
 		}
 
 		r.log(LogLevelWarning, "backing off for %s (backoff level %d), setting all to RDY 0",
@@ -846,12 +1605,193 @@ func (r *Consumer) startStopContinueBackoff(conn *Conn, signal backoffSignal) {
 		}
 
 		r.backoff(backoffDuration)
+		r.emit(Event{
+			Type:            EventBackoffStarted,
+			BackoffLevel:    int(backoffCounter),
+			BackoffDuration: backoffDuration,
+		})
+	}
+}
+
+// startStopContinueBackoff for a single connection when BackoffPerConnection is set
+//
+// must be called with backoffMtx held
+func (r *Consumer) startStopContinueConnBackoff(c *Conn, signal backoffSignal) {
+	if atomic.LoadInt64(&c.backoffDuration) > 0 {
+		return
+	}
+
+	// update backoff state
+	cfg := r.live()
+	backoffUpdated := false
+	backoffCounter := atomic.LoadInt32(&c.backoffCounter)
+	switch signal {
+	case resumeFlag:
+		if backoffCounter > 0 {
+			backoffCounter--
+			backoffUpdated = true
+		}
+	case backoffFlag:
+		nextBackoff := cfg.BackoffStrategy.Calculate(int(backoffCounter) + 1)
+		if nextBackoff <= cfg.MaxBackoffDuration {
+			backoffCounter++
+			backoffUpdated = true
+		}
+	}
+	atomic.StoreInt32(&c.backoffCounter, backoffCounter)
+
+	if backoffCounter == 0 && backoffUpdated {
+		// exit backoff
+		count := r.perConnMaxInFlight()
+		r.log(LogLevelWarning, "(%s) exiting backoff, returning to RDY %d", c.String(), count)
+		r.startRDYRampUp(c)
+		r.updateRDY(c, r.rampedRDY(c, count))
+		r.emit(Event{Type: EventBackoffEnded, NSQDAddress: c.String()})
+	} else if backoffCounter > 0 {
+		// start or continue backoff
+		backoffDuration := cfg.BackoffStrategy.Calculate(int(backoffCounter))
+
+		if backoffDuration > cfg.MaxBackoffDuration {
+			backoffDuration = cfg.MaxBackoffDuration
+		}
+
+		r.log(LogLevelWarning, "(%s) backing off for %s (backoff level %d), setting RDY 0",
+			c.String(), backoffDuration, backoffCounter)
+
+		r.updateRDY(c, 0)
+		r.backoffConn(c, backoffDuration)
+		r.emit(Event{
+			Type:            EventBackoffStarted,
+			NSQDAddress:     c.String(),
+			BackoffLevel:    int(backoffCounter),
+			BackoffDuration: backoffDuration,
+		})
+	}
+}
+
+func (r *Consumer) backoffConn(c *Conn, d time.Duration) {
+	atomic.StoreInt64(&c.backoffDuration, d.Nanoseconds())
+	gen := atomic.LoadInt32(&c.backoffGen)
+	time.AfterFunc(d, func() {
+		// superseded by ClearBackoff
+		if atomic.LoadInt32(&c.backoffGen) != gen {
+			return
+		}
+		r.resumeConn(c)
+	})
+}
+
+func (r *Consumer) resumeConn(c *Conn) {
+	if atomic.LoadInt32(&r.stopFlag) == 1 || c.IsClosing() {
+		atomic.StoreInt64(&c.backoffDuration, 0)
+		return
 	}
+
+	r.log(LogLevelWarning, "(%s) backoff timeout expired, sending RDY 1", c.String())
+
+	// while in backoff only ever let 1 message at a time through
+	err := r.updateRDY(c, 1)
+	if err != nil {
+		r.log(LogLevelWarning, "(%s) error resuming RDY 1 - %s", c.String(), err)
+		r.log(LogLevelWarning, "(%s) backing off for %s", c.String(), time.Second)
+		r.backoffConn(c, time.Second)
+		return
+	}
+
+	atomic.StoreInt64(&c.backoffDuration, 0)
+}
+
+// whether c is in backoff when BackoffPerConnection is set
+func (c *Conn) inBackoff() bool {
+	return atomic.LoadInt32(&c.backoffCounter) > 0 || atomic.LoadInt64(&c.backoffDuration) > 0
 }
 
 func (r *Consumer) backoff(d time.Duration) {
 	atomic.StoreInt64(&r.backoffDuration, d.Nanoseconds())
-	time.AfterFunc(d, r.resume)
+	gen := atomic.LoadInt32(&r.backoffGen)
+	time.AfterFunc(d, func() {
+		// superseded by ClearBackoff or TriggerBackoff
+		if atomic.LoadInt32(&r.backoffGen) != gen {
+			return
+		}
+		r.resume()
+	})
+}
+
+// BackoffState returns whether the Consumer is currently in backoff, the duration of
+// the pending backoff timeout (0 when a test message is being awaited, or not in backoff)
+// and the number of successfully processed messages needed to exit backoff.
+func (r *Consumer) BackoffState() (inBackoff bool, duration time.Duration, successesNeeded int) {
+	successesNeeded = int(atomic.LoadInt32(&r.backoffCounter))
+	duration = time.Duration(atomic.LoadInt64(&r.backoffDuration))
+	return successesNeeded > 0 || duration > 0, duration, successesNeeded
+}
+
+// ClearBackoff immediately exits backoff, returning all connections to their full RDY count
+//
+// This is useful to resume consumption as soon as a downstream incident (that caused
+// handlers to fail) is resolved, rather than waiting for backoff to run its course.
+func (r *Consumer) ClearBackoff() {
+	r.backoffMtx.Lock()
+	defer r.backoffMtx.Unlock()
+
+	atomic.AddInt32(&r.backoffGen, 1)
+	inBackoff := r.inBackoff() || r.inBackoffTimeout()
+	atomic.StoreInt32(&r.backoffCounter, 0)
+	atomic.StoreInt64(&r.backoffDuration, 0)
+
+	count := r.perConnMaxInFlight()
+	if inBackoff {
+		r.log(LogLevelWarning, "clearing backoff, returning all to RDY %d", count)
+	}
+	for _, c := range r.conns() {
+		connInBackoff := c.inBackoff()
+		if connInBackoff {
+			atomic.AddInt32(&c.backoffGen, 1)
+			atomic.StoreInt32(&c.backoffCounter, 0)
+			atomic.StoreInt64(&c.backoffDuration, 0)
+			if !inBackoff {
+				r.log(LogLevelWarning, "(%s) clearing backoff, returning to RDY %d", c.String(), count)
+			}
+		}
+		if inBackoff || connInBackoff {
+			r.updateRDY(c, count)
+		}
+		if connInBackoff && !inBackoff {
+			r.emit(Event{Type: EventBackoffEnded, NSQDAddress: c.String()})
+		}
+	}
+	if inBackoff {
+		r.emit(Event{Type: EventBackoffEnded})
+	}
+}
+
+// TriggerBackoff immediately enters backoff for duration d (setting all connections to
+// RDY 0), after which consumption resumes as though backoff was triggered by a failed
+// message, i.e. one message at a time until a message is processed successfully.
+//
+// Any pending backoff timeout is replaced.
+func (r *Consumer) TriggerBackoff(d time.Duration) {
+	r.backoffMtx.Lock()
+	defer r.backoffMtx.Unlock()
+
+	atomic.AddInt32(&r.backoffGen, 1)
+	backoffCounter := atomic.LoadInt32(&r.backoffCounter)
+	if backoffCounter == 0 {
+		backoffCounter = 1
+		atomic.StoreInt32(&r.backoffCounter, backoffCounter)
+	}
+
+	r.log(LogLevelWarning, "backing off for %s (triggered), setting all to RDY 0", d)
+	for _, c := range r.conns() {
+		r.updateRDY(c, 0)
+	}
+	r.backoff(d)
+	r.emit(Event{
+		Type:            EventBackoffStarted,
+		BackoffLevel:    int(backoffCounter),
+		BackoffDuration: d,
+	})
 }
 
 func (r *Consumer) resume() {
@@ -905,19 +1845,61 @@ func (r *Consumer) maybeUpdateRDY(conn *Conn) {
 			conn, inBackoff, inBackoffTimeout)
 		return
 	}
+	if conn.inBackoff() {
+		r.log(LogLevelDebug, "(%s) skip sending RDY connection inBackoff", conn)
+		return
+	}
 
-	count := r.perConnMaxInFlight()
+	count := r.rampedRDY(conn, r.perConnMaxInFlight())
 	r.log(LogLevelDebug, "(%s) sending RDY %d", conn, count)
 	r.updateRDY(conn, count)
 }
 
+// the number of steps RDY is raised in over Config.RDYRampUpDuration
+const rdyRampUpSteps = 10
+
+// startRDYRampUp (re)starts raising the RDY count of c gradually (see Config.RDYRampUpDuration)
+func (r *Consumer) startRDYRampUp(c *Conn) {
+	if r.config.RDYRampUpDuration > 0 {
+		atomic.StoreInt64(&c.rdyRampUpStart, time.Now().UnixNano())
+	}
+}
+
+// rampedRDY returns the RDY count of c given its target count, which is proportionally
+// lower while ramping up
+func (r *Consumer) rampedRDY(c *Conn, count int64) int64 {
+	start := atomic.LoadInt64(&c.rdyRampUpStart)
+	if start == 0 || count <= 1 {
+		return count
+	}
+	elapsed := time.Duration(time.Now().UnixNano() - start)
+	if elapsed >= r.config.RDYRampUpDuration {
+		atomic.CompareAndSwapInt64(&c.rdyRampUpStart, start, 0)
+		return count
+	}
+	return 1 + int64(float64(count-1)*float64(elapsed)/float64(r.config.RDYRampUpDuration))
+}
+
 func (r *Consumer) rdyLoop() {
 	redistributeTicker := time.NewTicker(r.config.RDYRedistributeInterval)
 
+	var rampUpChan <-chan time.Time
+	if r.config.RDYRampUpDuration > 0 {
+		rampUpTicker := time.NewTicker(r.config.RDYRampUpDuration / rdyRampUpSteps)
+		defer rampUpTicker.Stop()
+		rampUpChan = rampUpTicker.C
+	}
+
 	for {
 		select {
 		case <-redistributeTicker.C:
 			r.redistributeRDY()
+		case <-rampUpChan:
+			for _, c := range r.conns() {
+				if atomic.LoadInt64(&c.rdyRampUpStart) != 0 && c.RDY() > 0 {
+					r.maybeUpdateRDY(c)
+				}
+			}
 		case <-r.exitChan:
 			goto exit
 		}
@@ -934,6 +1916,11 @@ func (r *Consumer) updateRDY(c *Conn, count int64) error {
 		return ErrClosing
 	}
 
+	// nothing flows while paused, stopping, or over Config.MaxInFlightBytes
+	if r.IsPaused() || r.bytesThrottled() || atomic.LoadInt32(&r.stopFlag) == 1 {
+		count = 0
+	}
+
 	// never exceed the nsqd's configured max RDY count
 	if count > c.MaxRDY() {
 		count = c.MaxRDY()
@@ -1038,6 +2025,10 @@ func (r *Consumer) redistributeRDY() {
 				r.updateRDY(c, 0)
 			}
 		}
+		if c.inBackoff() {
+			// RDY is managed by its own backoff (see BackoffPerConnection)
+			continue
+		}
 		possibleConns = append(possibleConns, c)
 	}
 
@@ -1046,14 +2037,23 @@ func (r *Consumer) redistributeRDY() {
 		availableMaxInFlight = 1 - atomic.LoadInt64(&r.totalRdyCount)
 	}
 
-	for len(possibleConns) > 0 && availableMaxInFlight > 0 {
-		availableMaxInFlight--
-		r.rngMtx.Lock()
-		i := r.rng.Int() % len(possibleConns)
-		r.rngMtx.Unlock()
-		c := possibleConns[i]
-		// delete
-		possibleConns = append(possibleConns[:i], possibleConns[i+1:]...)
+	if len(possibleConns) == 0 || availableMaxInFlight <= 0 {
+		return
+	}
+	n := len(possibleConns)
+	if availableMaxInFlight < int64(n) {
+		n = int(availableMaxInFlight)
+	}
+
+	var strategy RDYStrategy = &RandomRDYStrategy{}
+	if r.config.RDYStrategy != nil {
+		strategy = r.config.RDYStrategy
+	}
+	selected := strategy.Select(possibleConns, n)
+	if len(selected) > n {
+		selected = selected[:n]
+	}
+	for _, c := range selected {
 		r.log(LogLevelDebug, "(%s) redistributing RDY", c.String())
 		r.updateRDY(c, 1)
 	}
@@ -1061,6 +2061,8 @@ func (r *Consumer) redistributeRDY() {
 
 // Stop will initiate a graceful stop of the Consumer (permanent)
 //
+// Hooks registered via OnStop are called before connections are closed.
+//
 // NOTE: receive on StopChan to block until this process completes
 func (r *Consumer) Stop() {
 	if !atomic.CompareAndSwapInt32(&r.stopFlag, 0, 1) {
@@ -1069,6 +2071,51 @@ func (r *Consumer) Stop() {
 
 	r.log(LogLevelInfo, "stopping...")
 
+	for _, c := range r.RetryConsumers() {
+		c.Stop()
+	}
+
+	r.stopHooksMtx.Lock()
+	hooks := r.stopHooks
+	r.stopHooksMtx.Unlock()
+	if len(hooks) == 0 {
+		r.closeConns()
+		return
+	}
+
+	// stop the flow of messages, but keep connections open so that hooks can
+	// still respond to messages
+	for _, c := range r.conns() {
+		r.updateRDY(c, 0)
+	}
+	go func() {
+		r.runStopHooks(hooks)
+		r.closeConns()
+	}()
+}
+
+// OnStop registers hook to be called when the Consumer is stopped, after RDY has been
+// set to 0 on all connections and before they are closed, e.g. to flush batches of
+// messages (and FIN them) or write checkpoints.
+//
+// Hooks are called in order, on a single goroutine. ctx is done once the Consumer
+// exits (e.g. the deadline passed to StopWithContext is exceeded) or after 30 seconds.
+func (r *Consumer) OnStop(hook func(ctx context.Context)) {
+	r.stopHooksMtx.Lock()
+	r.stopHooks = append(r.stopHooks, hook)
+	r.stopHooksMtx.Unlock()
+}
+
+func (r *Consumer) runStopHooks(hooks []func(ctx context.Context)) {
+	ctx, cancel := context.WithTimeout(r.ctx, 30*time.Second)
+	defer cancel()
+	for _, hook := range hooks {
+		hook(ctx)
+	}
+}
+
+// closeConns sends CLS to all connections, stopping handlers once they have closed
+func (r *Consumer) closeConns() {
 	if len(r.conns()) == 0 {
 		r.stopHandlers()
 	} else {
@@ -1079,28 +2126,143 @@ func (r *Consumer) Stop() {
 			}
 		}
 
-		time.AfterFunc(time.Second*30, func() {
+		if r.config.DrainTimeout <= 0 {
+			return
+		}
+		time.AfterFunc(r.config.DrainTimeout, func() {
+			select {
+			case <-r.StopChan:
+				return
+			default:
+			}
 			// if we've waited this long handlers are blocked on processing messages
 			// so we can't just stopHandlers (if any adtl. messages were pending processing
 			// we would cause a panic on channel close)
 			//
-			// instead, we just bypass handler closing and skip to the final exit
+			// instead, we close the connections, bypass handler closing and skip to
+			// the final exit
+			abandoned := r.abandonConns()
+			r.log(LogLevelWarning, "drain timeout exceeded with %d messages in flight, closing connections",
+				abandoned)
 			r.exit()
 		})
 	}
 }
 
+// abandonConns closes all connections immediately, returning the number of messages
+// in flight left to be redelivered by nsqd
+func (r *Consumer) abandonConns() int {
+	var inFlight int64
+	for _, c := range r.conns() {
+		if !c.ClosingAcknowledged() {
+			r.log(LogLevelWarning, "(%s) nsqd did not acknowledge CLS", c.String())
+		}
+		inFlight += atomic.LoadInt64(&c.messagesInFlight)
+		c.forceClose()
+	}
+	atomic.AddUint64(&r.msgsAbandoned, uint64(inFlight))
+	return int(inFlight)
+}
+
+// StopWithContext initiates a graceful stop of the Consumer (see Stop) and blocks
+// until either it completes or ctx is done.
+//
+// If ctx is done first, the number of messages still in flight (neither FINished nor
+// REQueued) is returned along with ctx.Err(), after which all connections are closed
+// immediately, leaving the outstanding messages to be redelivered by nsqd.
+func (r *Consumer) StopWithContext(ctx context.Context) (int, error) {
+	r.Stop()
+
+	select {
+	case <-r.StopChan:
+		return 0, nil
+	case <-ctx.Done():
+	}
+
+	inFlight := r.abandonConns()
+	r.log(LogLevelWarning, "stop deadline exceeded with %d messages in flight, closing connections",
+		inFlight)
+	r.exit()
+	return inFlight, ctx.Err()
+}
+
+// Wait blocks until the Consumer has stopped, or ctx is done (returning ctx.Err()).
+//
+// It returns nil when stopped via Stop, or an ErrTerminated describing the cause
+// when the Consumer stopped itself (see Config.MaxLookupdFailures,
+// Config.MaxReconnectAttempts and Config.StopOnAuthFailure).
+func (r *Consumer) Wait(ctx context.Context) error {
+	select {
+	case <-r.StopChan:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	r.terminateMtx.Lock()
+	defer r.terminateMtx.Unlock()
+	return r.terminateErr
+}
+
+// terminate stops the Consumer, recording cause (and the error that led to it)
+// to be returned from Wait
+func (r *Consumer) terminate(cause error, err error) {
+	r.terminateMtx.Lock()
+	if r.terminateErr != nil || atomic.LoadInt32(&r.stopFlag) == 1 {
+		r.terminateMtx.Unlock()
+		return
+	}
+	r.terminateErr = ErrTerminated{Cause: cause, Err: err}
+	r.terminateMtx.Unlock()
+
+	r.log(LogLevelError, "terminating: %s - %s", cause, err)
+	r.Stop()
+}
+
+// connectFailed counts consecutive failed attempts to connect to nsqd while no connection
+// is established, terminating the Consumer beyond Config.MaxReconnectAttempts
+func (r *Consumer) connectFailed(err error) {
+	if _, ok := err.(ErrAuth); ok && r.config.StopOnAuthFailure {
+		r.terminate(ErrAuthRejected, err)
+		return
+	}
+	if len(r.conns()) > 0 {
+		atomic.StoreInt32(&r.connectFailures, 0)
+		return
+	}
+	failures := atomic.AddInt32(&r.connectFailures, 1)
+	if r.config.MaxReconnectAttempts > 0 && int(failures) >= r.config.MaxReconnectAttempts {
+		r.terminate(ErrConnectionsLost, err)
+	}
+}
+
 func (r *Consumer) stopHandlers() {
 	r.stopHandler.Do(func() {
 		r.log(LogLevelInfo, "stopping handlers")
-		close(r.incomingMessages)
+		if len(r.RetryConsumers()) > 0 {
+			// retry Consumers relay messages to our handlers until they have stopped
+			go func() {
+				r.stopRetryConsumers()
+				r.closeIncomingMessages()
+			}()
+			return
+		}
+		r.closeIncomingMessages()
 	})
 }
 
+func (r *Consumer) closeIncomingMessages() {
+	r.workersMtx.Lock()
+	close(r.incomingMessages)
+	r.workers = nil
+	r.workersStopped = true
+	r.workersMtx.Unlock()
+}
+
 // AddHandler sets the Handler for messages received by this Consumer. This can be called
 // multiple times to add additional handlers. Handler will have a 1:1 ratio to message handling goroutines.
 //
-// This panics if called after connecting to NSQD or NSQ Lookupd
+// Handlers added after connecting to NSQD or NSQ Lookupd handle subsequently received messages
+// alongside those already added.
 //
 // (see Handler or HandlerFunc for details on implementing this interface)
 func (r *Consumer) AddHandler(handler Handler) {
@@ -1111,45 +2273,161 @@ func (r *Consumer) AddHandler(handler Handler) {
 // takes a second argument which indicates the number of goroutines to spawn for
 // message handling.
 //
-// This panics if called after connecting to NSQD or NSQ Lookupd
+// See AddConcurrentHandlersWithContext.
 //
 // (see Handler or HandlerFunc for details on implementing this interface)
 func (r *Consumer) AddConcurrentHandlers(handler Handler, concurrency int) {
-	if atomic.LoadInt32(&r.connectedFlag) == 1 {
-		panic("already connected")
-	}
+	r.AddConcurrentHandlersWithContext(handlerAdapter{handler}, concurrency)
+}
+
+// AddHandlerWithContext sets the HandlerWithContext for messages received by this Consumer.
+// This can be called multiple times to add additional handlers, including after connecting
+// to NSQD or NSQ Lookupd.
+//
+// (see HandlerWithContext or HandlerWithContextFunc for details on implementing this interface)
+func (r *Consumer) AddHandlerWithContext(handler HandlerWithContext) {
+	r.AddConcurrentHandlersWithContext(handler, 1)
+}
 
-	atomic.AddInt32(&r.runningHandlers, int32(concurrency))
+// AddConcurrentHandlersWithContext sets the HandlerWithContext for messages received by
+// this Consumer.  It takes a second argument which indicates the number of goroutines to
+// spawn for message handling.
+//
+// This can be called after connecting to NSQD or NSQ Lookupd, in which case the new
+// goroutines handle subsequently received messages alongside those already running.
+//
+// (see HandlerWithContext or HandlerWithContextFunc for details on implementing this interface)
+func (r *Consumer) AddConcurrentHandlersWithContext(handler HandlerWithContext, concurrency int) {
+	r.workersMtx.Lock()
+	defer r.workersMtx.Unlock()
+	if r.workersStopped {
+		return
+	}
 	for i := 0; i < concurrency; i++ {
-		go r.handlerLoop(handler)
+		r.startWorker(handler)
 	}
 }
 
-func (r *Consumer) handlerLoop(handler Handler) {
-	r.log(LogLevelDebug, "starting Handler")
+type handlerWorker struct {
+	handler  HandlerWithContext
+	quitChan chan struct{}
+}
 
-	for {
-		message, ok := <-r.incomingMessages
-		if !ok {
-			goto exit
-		}
+// must be called with workersMtx held
+func (r *Consumer) startWorker(handler HandlerWithContext) {
+	w := &handlerWorker{
+		handler:  handler,
+		quitChan: make(chan struct{}),
+	}
+	r.workers = append(r.workers, w)
+	atomic.AddInt32(&r.runningHandlers, 1)
+	go r.handlerLoop(w)
+}
 
-		if r.shouldFailMessage(message, handler) {
-			message.Finish()
-			continue
+// SetConcurrency grows or shrinks the number of goroutines running handlers added via
+// AddHandler, AddConcurrentHandlers, etc. to n, e.g. in response to queue depth.
+//
+// New goroutines run the most recently added handler. Excess goroutines, most recently
+// started first, exit after finishing the message they are handling (if any).
+// Goroutines of a BatchHandler or KeyedHandler are unaffected.
+//
+// This panics if n < 1 or no handler has been added
+func (r *Consumer) SetConcurrency(n int) {
+	if n < 1 {
+		panic("concurrency must be >= 1")
+	}
+
+	r.workersMtx.Lock()
+	defer r.workersMtx.Unlock()
+	if r.workersStopped {
+		return
+	}
+	if len(r.workers) == 0 {
+		panic("no handler added")
+	}
+
+	handler := r.workers[len(r.workers)-1].handler
+	for len(r.workers) < n {
+		r.startWorker(handler)
+	}
+	for _, w := range r.workers[n:] {
+		close(w.quitChan)
+	}
+	r.workers = r.workers[:n]
+	r.log(LogLevelInfo, "handler concurrency set to %d", n)
+}
+
+// Concurrency returns the number of goroutines running handlers added via AddHandler,
+// AddConcurrentHandlers, etc. (see SetConcurrency)
+func (r *Consumer) Concurrency() int {
+	r.workersMtx.Lock()
+	defer r.workersMtx.Unlock()
+	return len(r.workers)
+}
+
+// AddFilter adds a MessageFilter to this Consumer. Messages rejected by any filter
+// are FINished immediately, without being passed to a handler, and are counted in
+// ConsumerStats.MessagesFiltered.
+//
+// Filters run on the goroutine reading from the nsqd connection, so they should be fast.
+func (r *Consumer) AddFilter(filter MessageFilter) {
+	r.filtersMtx.Lock()
+	r.filters = append(r.filters, filter)
+	r.filtersMtx.Unlock()
+}
+
+func (r *Consumer) filterMessage(message *Message) bool {
+	r.filtersMtx.RLock()
+	defer r.filtersMtx.RUnlock()
+	for _, filter := range r.filters {
+		if !filter(message) {
+			return false
 		}
+	}
+	return true
+}
 
-		err := handler.HandleMessage(message)
-		if err != nil {
-			r.log(LogLevelError, "Handler returned error (%s) for msg %s", err, message.ID)
-			if !message.IsAutoResponseDisabled() {
-				message.Requeue(-1)
+// Use appends middleware to the chain wrapping every handler added to this Consumer
+// (via AddHandler, AddConcurrentHandlers, etc.).
+//
+// Middleware runs in registration order, i.e. the first middleware registered is the
+// outermost. It applies to all messages handled after Use returns.
+func (r *Consumer) Use(mw ...HandlerMiddleware) {
+	r.middlewareMtx.Lock()
+	r.middleware = append(r.middleware, mw...)
+	atomic.AddInt32(&r.middlewareVersion, 1)
+	r.middlewareMtx.Unlock()
+}
+
+// wrapHandler applies the registered middleware to handler, returning the
+// wrapped handler and the middleware version it was built from
+func (r *Consumer) wrapHandler(handler HandlerWithContext) (HandlerWithContext, int32) {
+	r.middlewareMtx.RLock()
+	defer r.middlewareMtx.RUnlock()
+
+	for i := len(r.middleware) - 1; i >= 0; i-- {
+		handler = r.middleware[i](handler)
+	}
+	return handler, atomic.LoadInt32(&r.middlewareVersion)
+}
+
+func (r *Consumer) handlerLoop(w *handlerWorker) {
+	r.log(LogLevelDebug, "starting Handler")
+
+	wrapped, version := r.wrapHandler(w.handler)
+	for {
+		select {
+		case <-w.quitChan:
+			goto exit
+		case message, ok := <-r.incomingMessages:
+			if !ok {
+				goto exit
 			}
-			continue
-		}
 
-		if !message.IsAutoResponseDisabled() {
-			message.Finish()
+			if atomic.LoadInt32(&r.middlewareVersion) != version {
+				wrapped, version = r.wrapHandler(w.handler)
+			}
+			r.handleMessage(w.handler, wrapped, message)
 		}
 	}
 
@@ -1160,26 +2438,300 @@ exit:
 	}
 }
 
+// handleMessage invokes wrapped (handler with middleware applied) for message
+// and responds to it according to the result
+func (r *Consumer) handleMessage(handler HandlerWithContext, wrapped HandlerWithContext, message *Message) {
+	if r.shouldFailMessage(message, unwrapHandler(handler)) {
+		message.Finish()
+		return
+	}
+	if !r.validMessage(message) {
+		return
+	}
+
+	var idempotencyKey string
+	if r.idempotencyStore != nil {
+		idempotencyKey = r.idempotencyKey(message)
+		if !r.acquireMessage(idempotencyKey, message) {
+			return
+		}
+	}
+
+	r.rateLimit(1)
+	start := time.Now()
+	err := r.callHandler(wrapped, message)
+	elapsed := time.Since(start)
+	atomic.StoreInt64(&message.handlerLatency, int64(elapsed))
+	r.observeHandler(elapsed, err)
+	r.checkSlowHandler(message, elapsed)
+	if r.idempotencyStore != nil {
+		r.releaseMessage(idempotencyKey, message, err == nil)
+	}
+	if perr, ok := err.(ErrHandlerPanic); ok {
+		r.handlerPanicked(perr, []*Message{message})
+		return
+	}
+	if err == errHandlerTimeout {
+		atomic.AddUint64(&r.messagesTimedOut, 1)
+		r.log(LogLevelError, "Handler timed out after %s for msg %s",
+			r.live().HandlerTimeout, message.ID)
+		if !message.IsAutoResponseDisabled() {
+			r.requeueFailed(message)
+		}
+		return
+	}
+	if err != nil {
+		r.log(LogLevelError, "Handler returned error (%s) for msg %s", err, message.ID)
+		if !message.IsAutoResponseDisabled() {
+			r.requeueFailed(message)
+		}
+		return
+	}
+
+	if !message.IsAutoResponseDisabled() {
+		message.Finish()
+	}
+}
+
+// validMessage validates the body of message per Config.SchemaValidator, responding to
+// it per the DecodeErrorHandler when it is rejected (unless auto-response is disabled)
+func (r *Consumer) validMessage(message *Message) bool {
+	if r.config.SchemaValidator == nil || message.Streamed() {
+		return true
+	}
+	headers, body, _ := message.Envelope()
+	err := r.config.SchemaValidator.Validate(r.topic, headers.Get(HeaderContentType), body)
+	if err == nil {
+		return true
+	}
+	r.log(LogLevelWarning, "msg %s rejected by schema validator - %s", message.ID, err)
+	err = r.onDecodeError(r.ctx, message, err)
+	if message.IsAutoResponseDisabled() {
+		return false
+	}
+	if err != nil {
+		r.requeueFailed(message)
+	} else {
+		message.Finish()
+	}
+	return false
+}
+
 func (r *Consumer) shouldFailMessage(message *Message, handler interface{}) bool {
 	// message passed the max number of attempts
 	if r.config.MaxAttempts > 0 && message.Attempts > r.config.MaxAttempts {
 		r.log(LogLevelWarning, "msg %s attempted %d times, giving up",
 			message.ID, message.Attempts)
+		r.emit(Event{Type: EventGiveUp, NSQDAddress: message.NSQDAddress, Message: message})
 
 		logger, ok := handler.(FailedMessageLogger)
 		if ok {
 			logger.LogFailedMessage(message)
 		}
 
+		if r.config.DeadLetter {
+			err := r.deadLetter(message)
+			if err != nil {
+				// the caller will FIN the message, which is a no-op after
+				// requeueing, so it will be retried rather than lost
+				r.log(LogLevelError, "msg %s failed to publish to dead-letter topic - %s",
+					message.ID, err)
+				message.RequeueWithoutBackoff(-1)
+			}
+		}
+
 		return true
 	}
 	return false
 }
 
+// checkSlowHandler reports handling message taking longer than Config.SlowHandlerThreshold
+func (r *Consumer) checkSlowHandler(message *Message, elapsed time.Duration) {
+	if r.config.SlowHandlerThreshold <= 0 || elapsed <= r.config.SlowHandlerThreshold {
+		return
+	}
+	atomic.AddUint64(&r.slowHandlers, 1)
+	r.log(LogLevelWarning, "slow handler: msg %s (attempts %d) on %s/%s took %s",
+		message.ID, message.Attempts, r.topic, r.channel, elapsed)
+	r.emit(Event{
+		Type:            EventSlowHandler,
+		NSQDAddress:     message.NSQDAddress,
+		Message:         message,
+		HandlerDuration: elapsed,
+	})
+}
+
+var errHandlerTimeout = errors.New("handler timeout")
+
+// callHandler invokes handler for message, returning errHandlerTimeout if it
+// does not return within Config.HandlerTimeout
+//
+// A timed out handler's context is cancelled but, since it cannot be forcibly
+// stopped, its goroutine is abandoned and its eventual result is ignored. In zero-copy
+// mode, the message is released once the abandoned handler returns.
+func (r *Consumer) callHandler(handler HandlerWithContext, message *Message) error {
+	ctx, cancel := r.messageContext(message)
+	defer cancel()
+	stopTouch := r.autoTouch(message)
+	defer stopTouch()
+
+	handlerTimeout := r.live().HandlerTimeout
+	if handlerTimeout <= 0 {
+		return r.invokeHandler(ctx, handler, message)
+	}
+
+	errChan := make(chan error, 1)
+	message.handlerDone = make(chan struct{})
+	go func() {
+		err := r.invokeHandler(ctx, handler, message)
+		if !atomic.CompareAndSwapInt32(&message.handlerState, 0, handlerReturned) {
+			// abandoned, the message was responded to on the handler's behalf
+			message.Release()
+		}
+		close(message.handlerDone)
+		errChan <- err
+	}()
+
+	timer := time.NewTimer(handlerTimeout)
+	defer timer.Stop()
+	select {
+	case err := <-errChan:
+		return err
+	case <-timer.C:
+		if !atomic.CompareAndSwapInt32(&message.handlerState, 0, handlerAbandoned) {
+			// the handler returned meanwhile
+			return <-errChan
+		}
+		return errHandlerTimeout
+	}
+}
+
+// invokeHandler calls handler for message, returning an ErrHandlerPanic if it panics
+// (when Config.RecoverPanics is enabled)
+func (r *Consumer) invokeHandler(ctx context.Context, handler HandlerWithContext, message *Message) (err error) {
+	if r.config.RecoverPanics {
+		defer func() {
+			if p := recover(); p != nil {
+				err = ErrHandlerPanic{Value: p, Stack: debug.Stack()}
+			}
+		}()
+	}
+	return handler.HandleMessage(ctx, message)
+}
+
+// handlerPanicked responds to messages after their handler panicked, dead-lettering
+// (when Config.DeadLetterOnPanic is enabled) or REQueueing them
+//
+// Auto-response is ignored, a panicking handler cannot have responded itself.
+func (r *Consumer) handlerPanicked(perr ErrHandlerPanic, messages []*Message) {
+	atomic.AddUint64(&r.handlerPanics, 1)
+	if len(messages) == 1 {
+		r.log(LogLevelError, "Handler panicked (%v) for msg %s\n%s",
+			perr.Value, messages[0].ID, perr.Stack)
+	} else {
+		r.log(LogLevelError, "BatchHandler panicked (%v) for %d messages\n%s",
+			perr.Value, len(messages), perr.Stack)
+	}
+
+	for _, message := range messages {
+		r.emit(Event{Type: EventHandlerPanic, NSQDAddress: message.NSQDAddress, Message: message})
+		if r.config.DeadLetterOnPanic {
+			err := r.deadLetter(message)
+			if err == nil {
+				message.Finish()
+				continue
+			}
+			r.log(LogLevelError, "msg %s failed to publish to dead-letter topic - %s",
+				message.ID, err)
+		}
+		if r.config.BackoffOnPanic {
+			message.Requeue(-1)
+		} else {
+			message.RequeueWithoutBackoff(-1)
+		}
+	}
+}
+
+// autoTouch periodically TOUCHes message (when Config.AutoTouch is enabled) until
+// the returned function is called
+func (r *Consumer) autoTouch(message *Message) func() {
+	timeout := message.msgTimeout
+	if timeout <= 0 {
+		timeout = r.config.MsgTimeout
+	}
+	if !r.config.AutoTouch || timeout <= 0 {
+		return func() {}
+	}
+
+	start := message.receivedAt
+	if start.IsZero() {
+		start = time.Now()
+	}
+	interval := time.Duration(float64(timeout) * r.config.AutoTouchFraction)
+	maxExtension := r.config.AutoTouchMaxExtension
+
+	stopChan := make(chan struct{})
+	doneChan := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer func() {
+			ticker.Stop()
+			close(doneChan)
+		}()
+		for {
+			select {
+			case <-stopChan:
+				return
+			case <-ticker.C:
+			}
+			if message.HasResponded() {
+				return
+			}
+			if maxExtension > 0 && time.Since(start) >= maxExtension {
+				r.log(LogLevelWarning, "msg %s reached auto_touch_max_extension (%s), no longer touching",
+					message.ID, maxExtension)
+				return
+			}
+			message.Touch()
+		}
+	}()
+
+	// wait for the touch loop to exit so that a TOUCH is never sent after the
+	// caller has responded to the message
+	return func() {
+		close(stopChan)
+		<-doneChan
+	}
+}
+
+// messageContext returns the context passed to handlers for the given message
+//
+// It is cancelled when the Consumer exits or when the message's negotiated msg_timeout
+// elapses (each Touch restarts the timeout).
+func (r *Consumer) messageContext(message *Message) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(r.ctx)
+	if message.msgTimeout <= 0 {
+		return ctx, cancel
+	}
+
+	remaining := message.msgTimeout - time.Since(message.receivedAt)
+	timer := time.AfterFunc(remaining, cancel)
+	message.setTouchHook(func() {
+		timer.Reset(message.msgTimeout)
+	})
+	return ctx, func() {
+		message.setTouchHook(nil)
+		timer.Stop()
+		cancel()
+	}
+}
+
 func (r *Consumer) exit() {
 	r.exitHandler.Do(func() {
+		r.ctxCancel()
 		close(r.exitChan)
 		r.wg.Wait()
+		r.stopDeadLetterProducers()
 		close(r.StopChan)
 	})
 }
@@ -0,0 +1,90 @@
+package nsq
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// the options that can be changed by Consumer.UpdateConfig
+var runtimeOptions = map[string]bool{
+	"max_in_flight":         true,
+	"lookupd_poll_interval": true,
+	"default_requeue_delay": true,
+	"max_requeue_delay":     true,
+	"backoff_multiplier":    true,
+	"max_backoff_duration":  true,
+	"handler_timeout":       true,
+}
+
+// UpdateConfig changes the options in delta (named and coerced as by Config.Set) while
+// the Consumer is running:
+//
+//	max_in_flight (see ChangeMaxInFlight)
+//	lookupd_poll_interval (from the next poll, unless lookupd_poll_adaptive)
+//	default_requeue_delay, max_requeue_delay
+//	backoff_multiplier, max_backoff_duration (from the next backoff)
+//	handler_timeout (for messages handled from now on)
+//
+// The changes are applied together or not at all: an ErrConfig lists every option that
+// cannot be changed, every invalid value and every violation of Config.Validate.
+func (r *Consumer) UpdateConfig(delta map[string]interface{}) error {
+	r.configMtx.Lock()
+	defer r.configMtx.Unlock()
+
+	cfg := r.live().Clone()
+	if err := updateConfig(cfg, delta, runtimeOptions); err != nil {
+		return err
+	}
+	r.liveConfig.Store(cfg)
+	r.log(LogLevelInfo, "updated config %s", strings.Join(sortedOptions(delta), ", "))
+
+	for option := range delta {
+		if strings.Replace(option, "-", "_", -1) == "max_in_flight" {
+			r.ChangeMaxInFlight(cfg.MaxInFlight)
+		}
+	}
+	return nil
+}
+
+// checkConfigUpdate returns the error UpdateConfig would return for delta, without
+// applying it
+func (r *Consumer) checkConfigUpdate(delta map[string]interface{}) error {
+	r.configMtx.Lock()
+	defer r.configMtx.Unlock()
+	return updateConfig(r.live().Clone(), delta, runtimeOptions)
+}
+
+// updateConfig sets the options in delta on cfg, which must all be in mutable, and
+// validates the result
+func updateConfig(cfg *Config, delta map[string]interface{}, mutable map[string]bool) error {
+	var violations []string
+	for _, option := range sortedOptions(delta) {
+		name := strings.Replace(option, "-", "_", -1)
+		if !mutable[name] {
+			violations = append(violations, fmt.Sprintf("option %s cannot be changed at runtime", name))
+			continue
+		}
+		if err := cfg.Set(name, delta[option]); err != nil {
+			violations = append(violations, err.Error())
+		}
+	}
+	if len(violations) > 0 {
+		return ErrConfig{violations}
+	}
+	return cfg.Validate()
+}
+
+func sortedOptions(options map[string]interface{}) []string {
+	names := make([]string, 0, len(options))
+	for option := range options {
+		names = append(names, option)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// live returns the Config of the options changed by UpdateConfig
+func (r *Consumer) live() *Config {
+	return r.liveConfig.Load().(*Config)
+}
@@ -0,0 +1,313 @@
+package nsq
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// ConsumerGroup manages many independent Consumers, each with its own handler, as a
+// single unit.
+//
+// Consumers share nsqlookupd (or nsqd) addresses, a logger, event handlers and a
+// Start/Stop lifecycle, and are created from a shared Config with optional per-topic
+// overrides (see SetTopicOverrides and SetTopicOptions), e.g. to tune the max-in-flight,
+// attempts, handler timeout or backoff of a single noisy topic. Subscriptions can be
+// added before or after Start.
+//
+// Unlike MultiConsumer, handlers and max-in-flight are not shared between subscriptions.
+type ConsumerGroup struct {
+	mtx sync.RWMutex
+
+	config    *Config
+	overrides topicOverrides
+	consumers map[Subscription]*Consumer
+
+	logger        logger
+	logLvl        LogLevel
+	eventHandlers []eventRegistration
+
+	lookupdAddrs []string
+	nsqdAddrs    []string
+
+	started  bool
+	stopFlag int32
+
+	// read from this channel to block until all consumers are cleanly stopped
+	StopChan chan int
+}
+
+// NewConsumerGroup creates a new instance of ConsumerGroup, whose Consumers are created
+// from (a copy of) config
+func NewConsumerGroup(config *Config) (*ConsumerGroup, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return &ConsumerGroup{
+		config:    config.Clone(),
+		overrides: newTopicOverrides(),
+		consumers: make(map[Subscription]*Consumer),
+		StopChan:  make(chan int),
+	}, nil
+}
+
+// SetTopicOverrides sets Config options (see Config.Set) overriding the shared Config
+// for subscriptions to topic added afterwards
+//
+// It returns an error for an invalid option or value.
+func (g *ConsumerGroup) SetTopicOverrides(topic string, options map[string]interface{}) error {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	return g.overrides.set(g.config, topic, options)
+}
+
+// SetTopicOptions sets typed options (see NewConfigWith), applied after those set by
+// SetTopicOverrides, overriding the shared Config for subscriptions to topic added
+// afterwards, e.g.
+//
+//	g.SetTopicOptions("clicks", WithMaxInFlight(1000), WithHandlerTimeout(time.Second))
+//
+// It returns an error when the resulting Config is invalid.
+func (g *ConsumerGroup) SetTopicOptions(topic string, opts ...Option) error {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	return g.overrides.setOpts(g.config, topic, opts)
+}
+
+// SetLogger assigns the logger to use as well as a level for all consumers, including
+// those added afterwards
+//
+// See Consumer.SetLogger for details.
+func (g *ConsumerGroup) SetLogger(l logger, lvl LogLevel) {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	g.logger = l
+	g.logLvl = lvl
+	for _, c := range g.consumers {
+		c.SetLogger(l, lvl)
+	}
+}
+
+// OnEvent registers handler to be called for lifecycle events of all consumers,
+// including those added afterwards (see Consumer.OnEvent)
+//
+// The Subscription of the Consumer is set on every Event.
+func (g *ConsumerGroup) OnEvent(handler EventHandler, types ...EventType) {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	g.eventHandlers = append(g.eventHandlers, eventRegistration{handler, types})
+	for _, c := range g.consumers {
+		c.OnEvent(handler, types...)
+	}
+}
+
+// SetNSQLookupdAddresses sets the nsqlookupd addresses that consumers connect to
+//
+// This panics if called after Start
+func (g *ConsumerGroup) SetNSQLookupdAddresses(addresses []string) {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	if g.started {
+		panic("already started")
+	}
+	g.lookupdAddrs = addresses
+}
+
+// SetNSQDAddresses sets the nsqd addresses that consumers connect to directly
+//
+// This panics if called after Start
+func (g *ConsumerGroup) SetNSQDAddresses(addresses []string) {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	if g.started {
+		panic("already started")
+	}
+	g.nsqdAddrs = addresses
+}
+
+// Add adds a subscription to topic/channel whose messages are handled by handler
+//
+// See AddWithContext.
+func (g *ConsumerGroup) Add(topic string, channel string, handler Handler, concurrency int) error {
+	return g.AddWithContext(topic, channel, handlerAdapter{handler}, concurrency)
+}
+
+// AddWithContext adds a subscription to topic/channel whose messages are handled by
+// handler, on concurrency goroutines (see Consumer.AddConcurrentHandlersWithContext)
+//
+// When the ConsumerGroup has already been started, the new Consumer connects immediately
+// and is removed again if that fails.
+func (g *ConsumerGroup) AddWithContext(topic string, channel string, handler HandlerWithContext, concurrency int) error {
+	g.mtx.Lock()
+	if atomic.LoadInt32(&g.stopFlag) == 1 {
+		g.mtx.Unlock()
+		return errors.New("consumer group stopped")
+	}
+	s := Subscription{topic, channel}
+	if _, ok := g.consumers[s]; ok {
+		g.mtx.Unlock()
+		return fmt.Errorf("already subscribed to %s/%s", topic, channel)
+	}
+
+	config, err := g.overrides.config(g.config, topic)
+	if err != nil {
+		g.mtx.Unlock()
+		return err
+	}
+	c, err := NewConsumer(topic, channel, config)
+	if err != nil {
+		g.mtx.Unlock()
+		return err
+	}
+	if g.logger != nil {
+		c.SetLogger(g.logger, g.logLvl)
+	}
+	for _, reg := range g.eventHandlers {
+		c.OnEvent(reg.handler, reg.types...)
+	}
+	c.AddConcurrentHandlersWithContext(handler, concurrency)
+
+	// the Consumer is registered before connecting so that it is stopped by a concurrent
+	// Stop, and connects without holding mtx, since that queries nsqlookupd
+	g.consumers[s] = c
+	started := g.started
+	g.mtx.Unlock()
+	if !started {
+		return nil
+	}
+
+	if err := g.connect(c); err != nil {
+		g.mtx.Lock()
+		if g.consumers[s] == c {
+			delete(g.consumers, s)
+		}
+		g.mtx.Unlock()
+		c.Stop()
+		return err
+	}
+	return nil
+}
+
+// Start connects all consumers to the configured nsqlookupd and/or nsqd addresses
+//
+// An invalid nsqlookupd address is reported without starting, so Start can be retried
+// after SetNSQLookupdAddresses. Since a connected Consumer cannot be disconnected, the
+// ConsumerGroup is stopped when any consumer then fails to connect.
+func (g *ConsumerGroup) Start() error {
+	g.mtx.Lock()
+	if atomic.LoadInt32(&g.stopFlag) == 1 {
+		g.mtx.Unlock()
+		return errors.New("consumer group stopped")
+	}
+	if g.started {
+		g.mtx.Unlock()
+		return errors.New("already started")
+	}
+	if len(g.lookupdAddrs) == 0 && len(g.nsqdAddrs) == 0 {
+		g.mtx.Unlock()
+		return errors.New("no nsqlookupd or nsqd addresses")
+	}
+	for _, addr := range g.lookupdAddrs {
+		if err := validatedLookupAddr(addr); err != nil {
+			g.mtx.Unlock()
+			return err
+		}
+	}
+
+	// consumers added from here on connect themselves (see AddWithContext)
+	g.started = true
+	consumers := make([]*Consumer, 0, len(g.consumers))
+	for _, c := range g.consumers {
+		consumers = append(consumers, c)
+	}
+	g.mtx.Unlock()
+
+	// consumers are connected without holding mtx, since that queries nsqlookupd
+	for _, c := range consumers {
+		if err := g.connect(c); err != nil {
+			g.Stop()
+			return err
+		}
+	}
+	return nil
+}
+
+// connect connects c to the nsqlookupd and/or nsqd addresses, which are not modified
+// after Start
+func (g *ConsumerGroup) connect(c *Consumer) error {
+	if len(g.lookupdAddrs) > 0 {
+		if err := c.ConnectToNSQLookupds(g.lookupdAddrs); err != nil {
+			return err
+		}
+	}
+	if len(g.nsqdAddrs) > 0 {
+		if err := c.ConnectToNSQDs(g.nsqdAddrs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Consumer returns the Consumer of topic/channel, or nil if it has not been added
+func (g *ConsumerGroup) Consumer(topic string, channel string) *Consumer {
+	g.mtx.RLock()
+	defer g.mtx.RUnlock()
+	return g.consumers[Subscription{topic, channel}]
+}
+
+// Subscriptions returns the subscriptions of all consumers, sorted by topic and channel
+func (g *ConsumerGroup) Subscriptions() []Subscription {
+	g.mtx.RLock()
+	subscriptions := make([]Subscription, 0, len(g.consumers))
+	for s := range g.consumers {
+		subscriptions = append(subscriptions, s)
+	}
+	g.mtx.RUnlock()
+
+	sort.Slice(subscriptions, func(i, j int) bool {
+		if subscriptions[i].Topic != subscriptions[j].Topic {
+			return subscriptions[i].Topic < subscriptions[j].Topic
+		}
+		return subscriptions[i].Channel < subscriptions[j].Channel
+	})
+	return subscriptions
+}
+
+// Stats retrieves the aggregated connection and message statistics of all consumers
+func (g *ConsumerGroup) Stats() *ConsumerStats {
+	stats := &ConsumerStats{}
+	g.mtx.RLock()
+	defer g.mtx.RUnlock()
+	for _, c := range g.consumers {
+		stats.add(c.Stats())
+	}
+	return stats
+}
+
+// Stop will initiate a graceful stop of all consumers (permanent)
+//
+// NOTE: receive on StopChan to block until this process completes
+func (g *ConsumerGroup) Stop() {
+	if !atomic.CompareAndSwapInt32(&g.stopFlag, 0, 1) {
+		return
+	}
+
+	g.mtx.RLock()
+	consumers := make([]*Consumer, 0, len(g.consumers))
+	for _, c := range g.consumers {
+		consumers = append(consumers, c)
+	}
+	g.mtx.RUnlock()
+
+	for _, c := range consumers {
+		c.Stop()
+	}
+	go func() {
+		for _, c := range consumers {
+			<-c.StopChan
+		}
+		close(g.StopChan)
+	}()
+}
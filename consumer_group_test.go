@@ -0,0 +1,133 @@
+package nsq
+
+import (
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestConsumerGroup(t *testing.T) {
+	config := NewConfig()
+	config.LookupdPollInterval = time.Minute
+	g, err := NewConsumerGroup(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.SetLogger(nullLogger, LogLevelInfo)
+
+	if err := g.SetTopicOverrides("group_big", map[string]interface{}{"max_in_flight": 50}); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.SetTopicOverrides("group_big", map[string]interface{}{"max_in_flight": -1}); err == nil {
+		t.Fatal("expected an error for an invalid override")
+	}
+	if err := g.SetTopicOptions("group_big", WithMaxAttempts(20), WithHandlerTimeout(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.SetTopicOptions("group_small", WithRequeueDelay(time.Hour, time.Minute)); err == nil {
+		t.Fatal("expected an error for invalid options")
+	}
+	if err := g.Add("group_big", "ch", &testHandler{}, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Add("group_small", "ch", &testHandler{}, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Add("group_small", "ch", &testHandler{}, 1); err == nil {
+		t.Fatal("expected an error for a duplicate subscription")
+	}
+	if err := g.Add("group small", "ch", &testHandler{}, 1); err == nil {
+		t.Fatal("expected an error for an invalid topic name")
+	}
+
+	if n := g.Consumer("group_big", "ch").getMaxInFlight(); n != 50 {
+		t.Fatalf("unexpected max_in_flight %d for overridden topic", n)
+	}
+	if c := g.Consumer("group_big", "ch").config; c.MaxAttempts != 20 || c.HandlerTimeout != time.Second {
+		t.Fatalf("unexpected options %d/%s for overridden topic", c.MaxAttempts, c.HandlerTimeout)
+	}
+	if n := g.Consumer("group_small", "ch").getMaxInFlight(); n != 1 {
+		t.Fatalf("unexpected max_in_flight %d", n)
+	}
+
+	if err := g.Start(); err == nil {
+		t.Fatal("expected an error starting without addresses")
+	}
+	g.SetNSQLookupdAddresses([]string{"127.0.0.1:1"})
+	if err := g.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Add("group_late", "ch", &testHandler{}, 1); err != nil {
+		t.Fatal(err)
+	}
+	subscriptions := g.Subscriptions()
+	if len(subscriptions) != 3 || subscriptions[0].Topic != "group_big" || subscriptions[2].Topic != "group_small" {
+		t.Fatalf("unexpected subscriptions %v", subscriptions)
+	}
+	for _, s := range subscriptions {
+		if atomic.LoadInt32(&g.Consumer(s.Topic, s.Channel).connectedFlag) != 1 {
+			t.Fatalf("%s/%s not connected", s.Topic, s.Channel)
+		}
+	}
+	if stats := g.Stats(); stats.Connections != 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	g.Stop()
+	select {
+	case <-g.StopChan:
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for ConsumerGroup to stop")
+	}
+	if err := g.Add("group_stopped", "ch", &testHandler{}, 1); err == nil {
+		t.Fatal("expected an error adding to a stopped group")
+	}
+}
+
+func TestConsumerGroupSlowLookupd(t *testing.T) {
+	lookups, unblock := make(chan struct{}, 16), make(chan struct{})
+	lookupd := &mockLookupd{slowTopic: "group_slow", lookups: lookups, unblock: unblock}
+	srv := httptest.NewServer(lookupd)
+	defer srv.Close()
+
+	config := NewConfig()
+	config.LookupdPollInterval = time.Minute
+	g, _ := NewConsumerGroup(config)
+	g.SetLogger(nullLogger, LogLevelInfo)
+	if err := g.Add("group_slow", "ch", &testHandler{}, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	g.SetNSQLookupdAddresses([]string{"no-port"})
+	if err := g.Start(); err == nil {
+		t.Fatal("expected an error starting with an invalid address")
+	}
+	g.SetNSQLookupdAddresses([]string{srv.URL})
+
+	started := make(chan error, 1)
+	go func() { started <- g.Start() }()
+	<-lookups
+
+	// the group is not locked while its consumers query nsqlookupd
+	done := make(chan struct{})
+	go func() {
+		g.Stats()
+		g.Subscriptions()
+		g.Consumer("group_slow", "ch")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		close(unblock)
+		t.Fatal("ConsumerGroup blocked while a Consumer was connecting")
+	}
+
+	close(unblock)
+	if err := <-started; err != nil {
+		t.Fatal(err)
+	}
+	g.Stop()
+	<-g.StopChan
+}
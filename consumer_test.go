@@ -2,6 +2,7 @@ package nsq
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"errors"
@@ -10,8 +11,10 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -134,6 +137,36 @@ func TestConsumerTLSClientCertViaSet(t *testing.T) {
 	})
 }
 
+func TestConsumerMiddlewareOrder(t *testing.T) {
+	q, _ := NewConsumer("mw_test", "ch", NewConfig())
+	q.SetLogger(nullLogger, LogLevelInfo)
+
+	var order []string
+	record := func(name string) HandlerMiddleware {
+		return func(next HandlerWithContext) HandlerWithContext {
+			return HandlerWithContextFunc(func(ctx context.Context, m *Message) error {
+				order = append(order, name+":before")
+				err := next.HandleMessage(ctx, m)
+				order = append(order, name+":after")
+				return err
+			})
+		}
+	}
+	q.Use(record("a"), record("b"))
+	q.Use(record("c"))
+
+	h, _ := q.wrapHandler(handlerAdapter{HandlerFunc(func(m *Message) error {
+		order = append(order, "handler")
+		return nil
+	})})
+	h.HandleMessage(context.Background(), &Message{})
+
+	expected := []string{"a:before", "b:before", "c:before", "handler", "c:after", "b:after", "a:after"}
+	if strings.Join(order, ",") != strings.Join(expected, ",") {
+		t.Fatalf("middleware ran in wrong order %v (expected %v)", order, expected)
+	}
+}
+
 func consumerTest(t *testing.T, cb func(c *Config)) {
 	config := NewConfig()
 	laddr := "127.0.0.1"
@@ -227,3 +260,562 @@ func consumerTest(t *testing.T, cb func(c *Config)) {
 		t.Fatal("failed message not done")
 	}
 }
+
+func TestAdaptiveMaxInFlight(t *testing.T) {
+	config := NewConfig()
+	config.MaxInFlight = 16
+	config.AdaptiveMaxInFlightMin = 2
+	config.AdaptiveMaxInFlightLatency = 100 * time.Millisecond
+
+	tests := []struct {
+		current    int
+		avgLatency time.Duration
+		errorRate  float64
+		starved    bool
+		expected   int
+	}{
+		{8, 10 * time.Millisecond, 0, true, 9},
+		{8, 10 * time.Millisecond, 0, false, 8},
+		{16, 10 * time.Millisecond, 0, true, 16},
+		{8, 200 * time.Millisecond, 0, true, 4},
+		{8, 10 * time.Millisecond, 0.5, true, 4},
+		{3, 10 * time.Millisecond, 0.5, false, 2},
+	}
+	for _, tt := range tests {
+		next := nextAdaptiveMaxInFlight(config, tt.current, tt.avgLatency, tt.errorRate, tt.starved)
+		if next != tt.expected {
+			t.Errorf("nextAdaptiveMaxInFlight(%d, %s, %.2f, %v) = %d, expected %d",
+				tt.current, tt.avgLatency, tt.errorRate, tt.starved, next, tt.expected)
+		}
+	}
+
+	config.AdaptiveMaxInFlight = true
+	q, _ := NewConsumer("adaptive_test", "ch", config)
+	q.SetLogger(nullLogger, LogLevelInfo)
+	for i := 0; i < 10; i++ {
+		var err error
+		if i%2 == 0 {
+			err = errors.New("boom")
+		}
+		q.observeHandler(time.Millisecond, err)
+	}
+	q.adaptMaxInFlight()
+	if q.getMaxInFlight() != 8 {
+		t.Fatalf("expected max-in-flight to be halved to 8, got %d", q.getMaxInFlight())
+	}
+	// no observations, no change
+	q.adaptMaxInFlight()
+	if q.getMaxInFlight() != 8 {
+		t.Fatalf("expected max-in-flight to remain 8, got %d", q.getMaxInFlight())
+	}
+	q.exit()
+}
+
+func TestConsumerSetNSQLookupdAddresses(t *testing.T) {
+	var servers []string
+	for i := 0; i < 3; i++ {
+		srv := httptest.NewServer(&mockLookupd{})
+		defer srv.Close()
+		servers = append(servers, srv.URL)
+	}
+
+	q, _ := NewConsumer("set_lookupd_test", "ch", NewConfig())
+	q.SetLogger(nullLogger, LogLevelInfo)
+	q.AddHandler(&MyTestHandler{})
+
+	if err := q.SetNSQLookupdAddresses(servers[:1]); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.SetNSQLookupdAddresses([]string{servers[1], servers[2], servers[1]}); err != nil {
+		t.Fatal(err)
+	}
+	q.mtx.RLock()
+	addrs := strings.Join(q.lookupdHTTPAddrs, ",")
+	q.mtx.RUnlock()
+	if addrs != servers[1]+","+servers[2] {
+		t.Fatalf("unexpected nsqlookupd addresses %s", addrs)
+	}
+
+	if err := q.SetNSQLookupdAddresses(nil); err == nil {
+		t.Fatal("expected an error removing all nsqlookupd addresses")
+	}
+	if err := q.SetNSQLookupdAddresses([]string{"nope"}); err == nil {
+		t.Fatal("expected an error for an invalid address")
+	}
+
+	q.Stop()
+	<-q.StopChan
+}
+
+func TestConsumerLookupdHTTPClient(t *testing.T) {
+	lookupd := &mockLookupd{}
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(401)
+			return
+		}
+		lookupd.ServeHTTP(w, req)
+	}))
+	defer srv.Close()
+
+	config := NewConfig()
+	config.LookupdHTTPClient = srv.Client()
+	config.LookupdHTTPHeader = http.Header{"Authorization": []string{"Bearer secret"}}
+	q, _ := NewConsumer("lookupd_http_client_test", "ch", config)
+	q.SetLogger(nullLogger, LogLevelInfo)
+	q.AddHandler(&MyTestHandler{})
+
+	if err := q.ConnectToNSQLookupd(srv.URL); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt64(&q.lookupdSuccess) == 0 {
+		select {
+		case err := <-q.Errors():
+			t.Fatalf("nsqlookupd query failed - %s", err)
+		default:
+			t.Fatal("nsqlookupd query failed")
+		}
+	}
+
+	q.Stop()
+	<-q.StopChan
+}
+
+func TestNextLookupdPollInterval(t *testing.T) {
+	config := NewConfig()
+	config.LookupdPollMinInterval = time.Second
+	config.LookupdPollMaxInterval = 10 * time.Second
+
+	tests := []struct {
+		current  time.Duration
+		changed  bool
+		expected time.Duration
+	}{
+		{4 * time.Second, true, time.Second},
+		{time.Second, false, 2 * time.Second},
+		{4 * time.Second, false, 8 * time.Second},
+		{8 * time.Second, false, 10 * time.Second},
+		{100 * time.Millisecond, false, time.Second},
+	}
+	for _, tt := range tests {
+		next := nextLookupdPollInterval(config, tt.current, tt.changed)
+		if next != tt.expected {
+			t.Errorf("nextLookupdPollInterval(%s, %v) = %s, expected %s",
+				tt.current, tt.changed, next, tt.expected)
+		}
+	}
+
+	config.LookupdPollMinInterval = time.Minute
+	if err := config.Validate(); err == nil {
+		t.Error("expected an error for LookupdPollMinInterval > LookupdPollMaxInterval")
+	}
+}
+
+func TestConsumerRDYRampUp(t *testing.T) {
+	config := NewConfig()
+	config.RDYRampUpDuration = time.Second
+	q, _ := NewConsumer("rdy_ramp_up_test", "ch", config)
+	q.SetLogger(nullLogger, LogLevelInfo)
+	defer q.Stop()
+
+	c := &Conn{}
+	if n := q.rampedRDY(c, 101); n != 101 {
+		t.Fatalf("RDY %d != 101 when not ramping up", n)
+	}
+
+	q.startRDYRampUp(c)
+	if n := q.rampedRDY(c, 101); n != 1 {
+		t.Fatalf("RDY %d != 1 at the start of ramp up", n)
+	}
+
+	atomic.StoreInt64(&c.rdyRampUpStart, time.Now().Add(-500*time.Millisecond).UnixNano())
+	if n := q.rampedRDY(c, 101); n < 51 || n > 55 {
+		t.Fatalf("RDY %d not ~51 halfway through ramp up", n)
+	}
+
+	atomic.StoreInt64(&c.rdyRampUpStart, time.Now().Add(-2*time.Second).UnixNano())
+	if n := q.rampedRDY(c, 101); n != 101 {
+		t.Fatalf("RDY %d != 101 after ramp up", n)
+	}
+	if atomic.LoadInt64(&c.rdyRampUpStart) != 0 {
+		t.Fatal("ramp up should have completed")
+	}
+}
+
+func TestConsumerWait(t *testing.T) {
+	q, _ := NewConsumer("wait_test", "ch", NewConfig())
+	q.SetLogger(nullLogger, LogLevelInfo)
+	q.AddHandler(&MyTestHandler{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := q.Wait(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+
+	q.Stop()
+	if err := q.Wait(context.Background()); err != nil {
+		t.Fatalf("expected nil after Stop, got %v", err)
+	}
+}
+
+func TestConsumerWaitLookupdFailing(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(500)
+	}))
+	defer srv.Close()
+
+	config := NewConfig()
+	config.LookupdPollInterval = 10 * time.Millisecond
+	config.MaxLookupdFailures = 2
+	q, _ := NewConsumer("wait_lookupd_test", "ch", config)
+	q.SetLogger(nullLogger, LogLevelInfo)
+	q.AddHandler(&MyTestHandler{})
+
+	if err := q.ConnectToNSQLookupd(srv.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := q.Wait(ctx)
+	terr, ok := err.(ErrTerminated)
+	if !ok || terr.Cause != ErrLookupdFailing {
+		t.Fatalf("expected ErrTerminated caused by ErrLookupdFailing, got %v", err)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(10)
+	l.last = l.last.Add(-time.Second)
+
+	// a full bucket holds one second's worth
+	for i := 0; i < 10; i++ {
+		if d := l.reserve(1); d != 0 {
+			t.Fatalf("reserve %d should not wait, got %s", i, d)
+		}
+	}
+	if d := l.reserve(1); d < 90*time.Millisecond || d > 100*time.Millisecond {
+		t.Fatalf("reserve should wait ~100ms, got %s", d)
+	}
+	if d := l.reserve(5); d < 590*time.Millisecond || d > 600*time.Millisecond {
+		t.Fatalf("reserve should wait ~600ms, got %s", d)
+	}
+
+	// tokens don't accumulate beyond the burst while idle
+	l.last = l.last.Add(-time.Minute)
+	for i := 0; i < 10; i++ {
+		l.reserve(1)
+	}
+	if d := l.reserve(1); d == 0 {
+		t.Fatal("reserve should wait after the burst is exhausted")
+	}
+}
+
+func TestConsumerSlowHandler(t *testing.T) {
+	config := NewConfig()
+	config.SlowHandlerThreshold = 100 * time.Millisecond
+	q, _ := NewConsumer("slow_handler_test", "ch", config)
+	q.SetLogger(nullLogger, LogLevelInfo)
+	defer q.Stop()
+
+	var events []Event
+	q.OnEvent(func(e Event) {
+		events = append(events, e)
+	}, EventSlowHandler)
+
+	msg := NewMessage(MessageID{'s', 'l', 'o', 'w'}, []byte("poison"))
+	msg.Attempts = 3
+	q.checkSlowHandler(msg, 50*time.Millisecond)
+	q.checkSlowHandler(msg, 150*time.Millisecond)
+
+	if len(events) != 1 || events[0].Message != msg || events[0].HandlerDuration != 150*time.Millisecond {
+		t.Fatalf("unexpected events %+v", events)
+	}
+	if s := events[0].Subscription; s.Topic != "slow_handler_test" || s.Channel != "ch" {
+		t.Fatalf("unexpected subscription %+v", s)
+	}
+	if stats := q.Stats(); stats.SlowHandlers != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+type recordingMessageDelegate struct {
+	finished int
+	requeued int
+	delay    time.Duration
+	backoff  bool
+}
+
+func (d *recordingMessageDelegate) OnFinish(m *Message) { d.finished++ }
+func (d *recordingMessageDelegate) OnRequeue(m *Message, t time.Duration, b bool) {
+	d.requeued++
+	d.delay = t
+	d.backoff = b
+}
+func (d *recordingMessageDelegate) OnTouch(m *Message) {}
+
+func TestConsumerRecoverPanics(t *testing.T) {
+	config := NewConfig()
+	config.RecoverPanics = true
+	q, _ := NewConsumer("recover_panics_test", "ch", config)
+	q.SetLogger(nullLogger, LogLevelInfo)
+	defer q.Stop()
+
+	var events []Event
+	q.OnEvent(func(e Event) {
+		events = append(events, e)
+	}, EventHandlerPanic)
+
+	handler := HandlerWithContextFunc(func(ctx context.Context, m *Message) error {
+		panic("boom")
+	})
+	for _, backoff := range []bool{false, true} {
+		q.config.BackoffOnPanic = backoff
+		delegate := &recordingMessageDelegate{}
+		msg := NewMessage(MessageID{'p', 'a', 'n', 'i', 'c'}, []byte("poison"))
+		msg.Delegate = delegate
+		q.handleMessage(handler, handler, msg)
+		if delegate.finished != 0 || delegate.requeued != 1 || delegate.backoff != backoff {
+			t.Fatalf("unexpected response %+v (backoff on panic %v)", delegate, backoff)
+		}
+	}
+
+	if len(events) != 2 || events[0].Type != EventHandlerPanic {
+		t.Fatalf("unexpected events %+v", events)
+	}
+	if stats := q.Stats(); stats.HandlerPanics != 2 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	q.config.HandlerTimeout = time.Second
+	err := q.callHandler(handler, NewMessage(MessageID{}, nil))
+	if perr, ok := err.(ErrHandlerPanic); !ok || perr.Value != "boom" || len(perr.Stack) == 0 {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestConsumerSetConcurrency(t *testing.T) {
+	q, _ := NewConsumer("set_concurrency_test", "ch", NewConfig())
+	q.SetLogger(nullLogger, LogLevelInfo)
+
+	var active int32
+	release := make(chan struct{})
+	q.AddConcurrentHandlers(HandlerFunc(func(m *Message) error {
+		atomic.AddInt32(&active, 1)
+		<-release
+		return nil
+	}), 2)
+
+	q.SetConcurrency(5)
+	if n := q.Concurrency(); n != 5 {
+		t.Fatalf("unexpected concurrency %d", n)
+	}
+	// each message is received by a separate goroutine, blocked in the handler
+	for i := 0; i < 5; i++ {
+		msg := NewMessage(MessageID{'c', byte(i)}, nil)
+		msg.Delegate = &recordingMessageDelegate{}
+		q.incomingMessages <- msg
+	}
+	for atomic.LoadInt32(&active) != 5 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// excess goroutines exit once their handler returns
+	q.SetConcurrency(1)
+	if n := q.Concurrency(); n != 1 {
+		t.Fatalf("unexpected concurrency %d", n)
+	}
+	close(release)
+	for atomic.LoadInt32(&q.runningHandlers) != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	q.Stop()
+	<-q.StopChan
+	q.SetConcurrency(3)
+	if n := q.Concurrency(); n != 0 {
+		t.Fatalf("unexpected concurrency %d after stop", n)
+	}
+}
+
+func TestConsumerUpdateConfig(t *testing.T) {
+	q, _ := NewConsumer("update_config_test", "ch", NewConfig())
+	q.SetLogger(nullLogger, LogLevelInfo)
+	defer q.Stop()
+
+	release := make(chan struct{})
+	defer close(release)
+	q.AddHandler(HandlerFunc(func(m *Message) error {
+		<-release
+		return nil
+	}))
+
+	err := q.UpdateConfig(map[string]interface{}{
+		"max-in-flight":      10,
+		"handler_timeout":    "20ms",
+		"backoff_multiplier": 2 * time.Second,
+		"max_requeue_delay":  "5m",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := q.getMaxInFlight(); n != 10 {
+		t.Fatalf("unexpected max in flight %d", n)
+	}
+	if d := q.live().BackoffStrategy.Calculate(1); d != 4*time.Second {
+		t.Fatalf("unexpected backoff %s", d)
+	}
+	if _, max := (&consumerConnDelegate{q}).requeueDelays(); max != 5*time.Minute {
+		t.Fatalf("unexpected max requeue delay %s", max)
+	}
+
+	// nothing is changed when any option is rejected
+	err = q.UpdateConfig(map[string]interface{}{
+		"msg_timeout":       "10s",
+		"handler_timeout":   "10ms",
+		"max_requeue_delay": "10s",
+	})
+	if cfgErr, ok := err.(ErrConfig); !ok || len(cfgErr.Violations) != 1 ||
+		!strings.Contains(cfgErr.Violations[0], "msg_timeout") {
+		t.Fatalf("unexpected error %v", err)
+	}
+	err = q.UpdateConfig(map[string]interface{}{"max_requeue_delay": "10s"})
+	if _, ok := err.(ErrConfig); !ok {
+		t.Fatalf("expected a validation error, got %v", err)
+	}
+	if d := q.live().HandlerTimeout; d != 20*time.Millisecond {
+		t.Fatalf("unexpected handler timeout %s", d)
+	}
+
+	msg := NewMessage(MessageID{'u'}, nil)
+	msg.Delegate = &recordingMessageDelegate{}
+	q.incomingMessages <- msg
+	for atomic.LoadUint64(&q.messagesTimedOut) != 1 {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestConsumerAddHandlerAfterConnect(t *testing.T) {
+	q, _ := NewConsumer("add_handler_test", "ch", NewConfig())
+	q.SetLogger(nullLogger, LogLevelInfo)
+
+	release := make(chan struct{})
+	handled := make(chan string, 2)
+	q.AddHandler(HandlerFunc(func(m *Message) error {
+		handled <- "a"
+		<-release
+		return nil
+	}))
+	atomic.StoreInt32(&q.connectedFlag, 1)
+
+	msg := NewMessage(MessageID{'a'}, nil)
+	msg.Delegate = &recordingMessageDelegate{}
+	q.incomingMessages <- msg
+	if h := <-handled; h != "a" {
+		t.Fatalf("unexpected handler %s", h)
+	}
+
+	// the first handler is busy, so only the new one can receive the next message
+	q.AddHandler(HandlerFunc(func(m *Message) error {
+		handled <- "b"
+		return nil
+	}))
+	var filtered int32
+	q.AddFilter(func(m *Message) bool {
+		atomic.AddInt32(&filtered, 1)
+		return true
+	})
+	msg = NewMessage(MessageID{'b'}, nil)
+	msg.Delegate = &recordingMessageDelegate{}
+	q.incomingMessages <- msg
+	if h := <-handled; h != "b" {
+		t.Fatalf("unexpected handler %s", h)
+	}
+	if n := q.Concurrency(); n != 2 {
+		t.Fatalf("unexpected concurrency %d", n)
+	}
+	if !q.filterMessage(msg) || atomic.LoadInt32(&filtered) != 1 {
+		t.Fatal("filter added after connecting was not applied")
+	}
+
+	close(release)
+	q.Stop()
+	<-q.StopChan
+}
+
+type requeueDelaysDelegate struct {
+	recordingMessageDelegate
+	defaultDelay, maxDelay time.Duration
+}
+
+func (d *requeueDelaysDelegate) requeueDelays() (time.Duration, time.Duration) {
+	return d.defaultDelay, d.maxDelay
+}
+
+func TestMessageRequeueWithBackoff(t *testing.T) {
+	tests := []struct {
+		attempts               uint16
+		defaultDelay, maxDelay time.Duration
+		strategy               RequeueDelayStrategy
+		min, max               time.Duration
+	}{
+		{1, time.Second, time.Minute, nil, 500 * time.Millisecond, time.Second},
+		{4, time.Second, time.Minute, nil, 4 * time.Second, 8 * time.Second},
+		{20, time.Second, time.Minute, nil, 30 * time.Second, time.Minute},
+		{3, time.Second, time.Minute, &ExponentialRequeueStrategy{}, 4 * time.Second, 4 * time.Second},
+		// bounded by the max requeue timeout of nsqd
+		{3, 2 * time.Hour, 3 * time.Hour, &LinearRequeueStrategy{}, time.Hour, time.Hour},
+	}
+	for _, tt := range tests {
+		d := &requeueDelaysDelegate{defaultDelay: tt.defaultDelay, maxDelay: tt.maxDelay}
+		msg := NewMessage(MessageID{}, nil)
+		msg.Attempts = tt.attempts
+		msg.Delegate = d
+		msg.RequeueWithBackoff(tt.strategy)
+		if d.requeued != 1 || !d.backoff {
+			t.Fatalf("message should be requeued with backoff")
+		}
+		if d.delay < tt.min || d.delay > tt.max {
+			t.Fatalf("requeue delay %v for attempt %d out of range [%v, %v]", d.delay, tt.attempts, tt.min, tt.max)
+		}
+	}
+}
+
+func TestMessageAttempts(t *testing.T) {
+	config := NewConfig()
+	config.MaxAttempts = 3
+	unlimited := NewConfig()
+	unlimited.MaxAttempts = 0
+
+	tests := []struct {
+		attempts  uint16
+		last      bool
+		remaining int
+	}{
+		{1, false, 2},
+		{2, false, 1},
+		{3, true, 0},
+		{4, true, 0},
+	}
+	for _, tt := range tests {
+		msg := NewMessage(MessageID{}, nil)
+		msg.Attempts = tt.attempts
+		if msg.IsLastAttempt(config) != tt.last || msg.RemainingAttempts(config) != tt.remaining {
+			t.Fatalf("attempt %d: last %v, remaining %d", tt.attempts, msg.IsLastAttempt(config),
+				msg.RemainingAttempts(config))
+		}
+		if msg.IsLastAttempt(unlimited) || msg.RemainingAttempts(unlimited) != -1 {
+			t.Fatalf("attempt %d should not be the last with unlimited attempts", tt.attempts)
+		}
+	}
+
+	msg := NewMessage(MessageID{}, nil)
+	msg.Timestamp = time.Now().Add(-time.Minute).UnixNano()
+	if age := msg.Age(); age < time.Minute || age > 2*time.Minute {
+		t.Fatalf("unexpected age %s", age)
+	}
+	if msg.PublishedAt().UnixNano() != msg.Timestamp {
+		t.Fatalf("unexpected publish time %s", msg.PublishedAt())
+	}
+}
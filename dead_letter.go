@@ -0,0 +1,84 @@
+package nsq
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DeadLetterNamer is an interface accepted by `SetBehaviorDelegate()`
+// for customizing the name of the topic that messages exceeding
+// MaxAttempts are republished to (when Config.DeadLetter is enabled)
+type DeadLetterNamer interface {
+	DeadLetterTopic(topic string, channel string) string
+}
+
+// defaultDeadLetterTopic returns `<topic>.<channel>.dlq` (ephemeral suffixes removed)
+func defaultDeadLetterTopic(topic string, channel string) string {
+	topic = strings.TrimSuffix(topic, "#ephemeral")
+	channel = strings.TrimSuffix(channel, "#ephemeral")
+	return fmt.Sprintf("%s.%s.dlq", topic, channel)
+}
+
+func (r *Consumer) deadLetterTopic() string {
+	if namer, ok := r.behaviorDelegate.(DeadLetterNamer); ok {
+		return namer.DeadLetterTopic(r.topic, r.channel)
+	}
+	return defaultDeadLetterTopic(r.topic, r.channel)
+}
+
+// deadLetter republishes message, wrapped in an envelope with failure metadata,
+// to the dead-letter topic via the nsqd it was received from
+func (r *Consumer) deadLetter(message *Message) error {
+	topic := r.deadLetterTopic()
+	if !IsValidTopicName(topic) {
+		return fmt.Errorf("invalid dead-letter topic name %q", topic)
+	}
+
+	headers, body, _ := message.Envelope()
+	headers = headers.clone()
+	headers[HeaderOriginalTopic] = r.topic
+	headers[HeaderOriginalChannel] = r.channel
+	headers[HeaderMessageID] = string(message.ID[:])
+	headers[HeaderAttempts] = strconv.Itoa(int(message.Attempts))
+	headers[HeaderNSQDAddress] = message.NSQDAddress
+	headers[HeaderFailedAt] = time.Now().UTC().Format(time.RFC3339Nano)
+
+	producer, err := r.deadLetterProducer(message.NSQDAddress)
+	if err != nil {
+		return err
+	}
+	return producer.Publish(topic, EncodeEnvelope(headers, body))
+}
+
+func (r *Consumer) deadLetterProducer(addr string) (*Producer, error) {
+	r.deadLetterMtx.Lock()
+	defer r.deadLetterMtx.Unlock()
+
+	if p, ok := r.deadLetterProducers[addr]; ok {
+		return p, nil
+	}
+
+	p, err := NewProducer(addr, &r.config)
+	if err != nil {
+		return nil, err
+	}
+	p.SetLoggerLevel(r.getLogLevel())
+	for index := range r.logger {
+		l, _ := r.getLogger(LogLevel(index))
+		p.SetLoggerForLevel(l, LogLevel(index))
+	}
+	r.deadLetterProducers[addr] = p
+	return p, nil
+}
+
+func (r *Consumer) stopDeadLetterProducers() {
+	r.deadLetterMtx.Lock()
+	defer r.deadLetterMtx.Unlock()
+
+	for addr, p := range r.deadLetterProducers {
+		p.Stop()
+		delete(r.deadLetterProducers, addr)
+	}
+}
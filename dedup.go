@@ -0,0 +1,160 @@
+package nsq
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// HeaderIdempotencyKey is the header holding the idempotency key of a message,
+// identifying it across publishes (see EnvelopeIdempotencyKey)
+const HeaderIdempotencyKey = "nsq-idempotency-key"
+
+// EnvelopeIdempotencyKey is a MessageKeyFunc returning the HeaderIdempotencyKey header
+// of messages published in an envelope (see EncodeEnvelope)
+func EnvelopeIdempotencyKey(message *Message) string {
+	headers, _, ok := message.Envelope()
+	if !ok {
+		return ""
+	}
+	return headers[HeaderIdempotencyKey]
+}
+
+// DedupCache records the keys of messages that have been processed by a Consumer
+// (see Consumer.SetDedupCache)
+//
+// Implementations must be safe for concurrent use, and may be shared between
+// Consumers (e.g. backed by an external store to suppress duplicates across processes).
+type DedupCache interface {
+	// Contains returns true if key has been added (and not yet expired or evicted)
+	Contains(key string) bool
+	// Add records key as processed
+	Add(key string)
+}
+
+// LRUDedupCache is an in-memory DedupCache holding up to a fixed number of keys,
+// evicting the least recently added first, where each key expires after a TTL
+type LRUDedupCache struct {
+	mtx   sync.Mutex
+	size  int
+	ttl   time.Duration
+	order *list.List
+	keys  map[string]*list.Element
+}
+
+type dedupEntry struct {
+	key     string
+	expires time.Time
+}
+
+// NewLRUDedupCache returns an LRUDedupCache holding up to size keys, each for at most ttl
+// (indefinitely when ttl is 0)
+func NewLRUDedupCache(size int, ttl time.Duration) *LRUDedupCache {
+	if size < 1 {
+		panic("size must be >= 1")
+	}
+	return &LRUDedupCache{
+		size:  size,
+		ttl:   ttl,
+		order: list.New(),
+		keys:  make(map[string]*list.Element),
+	}
+}
+
+// Contains implements the DedupCache interface
+func (c *LRUDedupCache) Contains(key string) bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	e, ok := c.keys[key]
+	if !ok {
+		return false
+	}
+	if c.expired(e.Value.(*dedupEntry), time.Now()) {
+		c.order.Remove(e)
+		delete(c.keys, key)
+		return false
+	}
+	return true
+}
+
+// Add implements the DedupCache interface
+func (c *LRUDedupCache) Add(key string) {
+	now := time.Now()
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if e, ok := c.keys[key]; ok {
+		e.Value.(*dedupEntry).expires = now.Add(c.ttl)
+		c.order.MoveToFront(e)
+		return
+	}
+	c.keys[key] = c.order.PushFront(&dedupEntry{key: key, expires: now.Add(c.ttl)})
+	for c.order.Len() > c.size {
+		c.removeOldest()
+	}
+	// drop expired keys from the back, they are the oldest
+	for c.order.Len() > 0 && c.expired(c.order.Back().Value.(*dedupEntry), now) {
+		c.removeOldest()
+	}
+}
+
+// Len returns the number of keys currently held (including any not yet pruned after expiring)
+func (c *LRUDedupCache) Len() int {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.order.Len()
+}
+
+func (c *LRUDedupCache) expired(entry *dedupEntry, now time.Time) bool {
+	return c.ttl > 0 && now.After(entry.expires)
+}
+
+func (c *LRUDedupCache) removeOldest() {
+	e := c.order.Back()
+	c.order.Remove(e)
+	delete(c.keys, e.Value.(*dedupEntry).key)
+}
+
+// SetDedupCache enables client-side suppression of duplicate messages.
+//
+// The key of every message FINished by this Consumer is added to cache, and received
+// messages whose key is already present are FINished without being passed to a handler
+// (counted in ConsumerStats.DedupHits). This prevents reprocessing a message that is
+// redelivered because it timed out, or whose FIN was lost, after being handled.
+//
+// keyFunc returns the key of a message, e.g. EnvelopeIdempotencyKey to also suppress
+// duplicates published more than once. When nil, or when it returns an empty key,
+// the message ID is used.
+//
+// This panics if called after connecting to NSQD or NSQ Lookupd
+func (r *Consumer) SetDedupCache(cache DedupCache, keyFunc MessageKeyFunc) {
+	if atomic.LoadInt32(&r.connectedFlag) == 1 {
+		panic("already connected")
+	}
+	r.dedupCache = cache
+	r.dedupKeyFunc = keyFunc
+}
+
+func (r *Consumer) dedupKey(message *Message) string {
+	if r.dedupKeyFunc != nil {
+		if key := r.dedupKeyFunc(message); key != "" {
+			return key
+		}
+	}
+	return string(message.ID[:])
+}
+
+// returns true (after FINishing the message) if the message has already been processed
+func (r *Consumer) dedupMessage(message *Message) bool {
+	if r.dedupCache == nil {
+		return false
+	}
+	if !r.dedupCache.Contains(r.dedupKey(message)) {
+		atomic.AddUint64(&r.dedupMisses, 1)
+		return false
+	}
+	atomic.AddUint64(&r.dedupHits, 1)
+	r.log(LogLevelDebug, "duplicate message %s, finishing", message.ID)
+	message.Finish()
+	return true
+}
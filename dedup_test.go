@@ -0,0 +1,111 @@
+package nsq
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLRUDedupCache(t *testing.T) {
+	c := NewLRUDedupCache(2, 0)
+	c.Add("a")
+	c.Add("b")
+	if !c.Contains("a") || !c.Contains("b") {
+		t.Fatal("cache should contain a and b")
+	}
+	c.Add("c")
+	if c.Contains("a") {
+		t.Fatal("a should have been evicted")
+	}
+	if !c.Contains("b") || !c.Contains("c") || c.Len() != 2 {
+		t.Fatal("cache should contain b and c")
+	}
+
+	c = NewLRUDedupCache(10, 20*time.Millisecond)
+	c.Add("a")
+	time.Sleep(30 * time.Millisecond)
+	if c.Contains("a") {
+		t.Fatal("a should have expired")
+	}
+	c.Add("b")
+	time.Sleep(30 * time.Millisecond)
+	c.Add("c")
+	if c.Len() != 1 {
+		t.Fatalf("expired keys should have been pruned, got %d keys", c.Len())
+	}
+}
+
+func TestConsumerDedup(t *testing.T) {
+	msgID1 := MessageID{'d', 'u', 'p', '1', '5', '6', '7', '8', '9', '0', 'a', 's', 'd', 'f', 'g', 'h'}
+	msgID2 := MessageID{'d', 'u', 'p', '2', '5', '6', '7', '8', '9', '0', 'a', 's', 'd', 'f', 'g', 'h'}
+	msgID3 := MessageID{'d', 'u', 'p', '3', '5', '6', '7', '8', '9', '0', 'a', 's', 'd', 'f', 'g', 'h'}
+	keyed := EncodeEnvelope(Headers{HeaderIdempotencyKey: "order-1"}, []byte("order"))
+
+	script := []instruction{
+		// IDENTIFY
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		// SUB
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		instruction{20 * time.Millisecond, FrameTypeMessage, frameMessage(NewMessage(msgID1, keyed))},
+		// redelivered
+		instruction{20 * time.Millisecond, FrameTypeMessage, frameMessage(NewMessage(msgID1, keyed))},
+		// published again
+		instruction{20 * time.Millisecond, FrameTypeMessage, frameMessage(NewMessage(msgID2, keyed))},
+		// without a key
+		instruction{20 * time.Millisecond, FrameTypeMessage, frameMessage(NewMessage(msgID3, []byte("plain")))},
+		// needed to exit test
+		instruction{100 * time.Millisecond, -1, []byte("exit")},
+	}
+
+	addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	n := newMockNSQD(t, script, addr.String())
+
+	topicName := "test_dedup" + strconv.Itoa(int(time.Now().Unix()))
+	config := NewConfig()
+	config.MaxInFlight = 4
+	q, _ := NewConsumer(topicName, "ch", config)
+	q.SetLogger(newTestLogger(t), LogLevelDebug)
+
+	var handled []MessageID
+	q.AddHandler(HandlerFunc(func(m *Message) error {
+		handled = append(handled, m.ID)
+		return nil
+	}))
+	q.SetDedupCache(NewLRUDedupCache(100, time.Minute), EnvelopeIdempotencyKey)
+	err := q.ConnectToNSQD(n.tcpAddr.String())
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	<-n.exitChan
+
+	var responses []string
+	for _, r := range n.got {
+		if bytes.HasPrefix(r, []byte("FIN")) || bytes.HasPrefix(r, []byte("REQ")) {
+			responses = append(responses, string(r))
+		}
+	}
+	expected := []string{
+		fmt.Sprintf("FIN %s", msgID1),
+		fmt.Sprintf("FIN %s", msgID1),
+		fmt.Sprintf("FIN %s", msgID2),
+		fmt.Sprintf("FIN %s", msgID3),
+	}
+	if strings.Join(responses, ",") != strings.Join(expected, ",") {
+		t.Fatalf("responses %v != %v", responses, expected)
+	}
+	if len(handled) != 2 || handled[0] != msgID1 || handled[1] != msgID3 {
+		t.Fatalf("unexpected handled messages %v", handled)
+	}
+	if stats := q.Stats(); stats.DedupHits != 2 || stats.DedupMisses != 2 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	q.SetLogger(nullLogger, LogLevelInfo)
+	q.Stop()
+	<-q.StopChan
+}
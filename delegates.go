@@ -56,6 +56,17 @@ func (d *connMessageDelegate) OnRequeue(m *Message, t time.Duration, b bool) {
 	d.c.onMessageRequeue(m, t, b)
 }
 func (d *connMessageDelegate) OnTouch(m *Message) { d.c.onMessageTouch(m) }
+func (d *connMessageDelegate) requeueDelays() (time.Duration, time.Duration) {
+	return d.c.requeueDelays()
+}
+
+// detachedMessageDelegate is the MessageDelegate of copies of messages (see
+// Message.Copy), whose responses are ignored
+type detachedMessageDelegate struct{}
+
+func (detachedMessageDelegate) OnFinish(m *Message)                           {}
+func (detachedMessageDelegate) OnRequeue(m *Message, t time.Duration, b bool) {}
+func (detachedMessageDelegate) OnTouch(m *Message)                            {}
 
 // ConnDelegate is an interface of methods that are used as
 // callbacks in Conn
@@ -120,6 +131,15 @@ func (d *consumerConnDelegate) OnIOError(c *Conn, err error)          { d.r.onCo
 func (d *consumerConnDelegate) OnHeartbeat(c *Conn)                   { d.r.onConnHeartbeat(c) }
 func (d *consumerConnDelegate) OnClose(c *Conn)                       { d.r.onConnClose(c) }
 
+func (d *consumerConnDelegate) onResponseWritten(c *Conn, m *Message, success bool, err error) {
+	d.r.onConnResponseWritten(c, m, success, err)
+}
+
+func (d *consumerConnDelegate) requeueDelays() (time.Duration, time.Duration) {
+	cfg := d.r.live()
+	return cfg.DefaultRequeueDelay, cfg.MaxRequeueDelay
+}
+
 // keeps the exported Producer struct clean of the exported methods
 // required to implement the ConnDelegate interface
 type producerConnDelegate struct {
@@ -0,0 +1,105 @@
+package nsq
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// lookupIPAddr resolves host names for dialMultiAddr (replaced in tests)
+var lookupIPAddr = net.DefaultResolver.LookupIPAddr
+
+// dialRotation rotates the order in which the addresses of a host are dialed
+var dialRotation uint32
+
+// dialMultiAddr returns a DialContextFunc that resolves the host of a TCP address on
+// every call (rather than once), and dials its IPs via dial in a rotating order, starting
+// the next attempt whenever one fails or fallbackDelay passes without a connection
+// (Happy Eyeballs, RFC 8305), so that DNS based failover works on reconnect
+func dialMultiAddr(dial DialContextFunc, fallbackDelay time.Duration) DialContextFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil || network != "tcp" || net.ParseIP(host) != nil {
+			return dial(ctx, network, addr)
+		}
+		ips, err := lookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		addrs := make([]string, len(ips))
+		offset := int(atomic.AddUint32(&dialRotation, 1))
+		for i := range ips {
+			addrs[i] = net.JoinHostPort(ips[(i+offset)%len(ips)].String(), port)
+		}
+		if len(addrs) == 1 {
+			return dial(ctx, network, addrs[0])
+		}
+		return dialParallel(ctx, dial, network, addrs, fallbackDelay)
+	}
+}
+
+// dialParallel races dialing addrs, staggered by fallbackDelay, returning the first
+// connection made (and closing any others)
+func dialParallel(ctx context.Context, dial DialContextFunc, network string, addrs []string,
+	fallbackDelay time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, len(addrs))
+	var next, pending int
+	start := func() {
+		addr := addrs[next]
+		next++
+		pending++
+		go func() {
+			conn, err := dial(ctx, network, addr)
+			results <- result{conn, err}
+		}()
+	}
+
+	start()
+	var firstErr error
+	for pending > 0 {
+		var fallback <-chan time.Time
+		var timer *time.Timer
+		if next < len(addrs) {
+			timer = time.NewTimer(fallbackDelay)
+			fallback = timer.C
+		}
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				if timer != nil {
+					timer.Stop()
+				}
+				// close the connections of attempts that succeed regardless
+				go func(pending int) {
+					for i := 0; i < pending; i++ {
+						if r := <-results; r.conn != nil {
+							r.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if next < len(addrs) {
+				start()
+			}
+		case <-fallback:
+			start()
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+	return nil, firstErr
+}
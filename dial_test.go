@@ -0,0 +1,82 @@
+package nsq
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDialMultiAddr(t *testing.T) {
+	defer func(lookup func(context.Context, string) ([]net.IPAddr, error)) {
+		lookupIPAddr = lookup
+	}(lookupIPAddr)
+	var lookups int
+	lookupIPAddr = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		lookups++
+		return []net.IPAddr{
+			{IP: net.ParseIP("10.0.0.1")},
+			{IP: net.ParseIP("10.0.0.2")},
+			{IP: net.ParseIP("10.0.0.3")},
+		}, nil
+	}
+
+	var mtx sync.Mutex
+	var dialed []string
+	cancelled := make(chan struct{})
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		mtx.Lock()
+		dialed = append(dialed, addr)
+		mtx.Unlock()
+		switch addr {
+		case "10.0.0.1:4150":
+			return nil, errors.New("connection refused")
+		case "10.0.0.2:4150":
+			// unreachable, until the attempt is cancelled
+			<-ctx.Done()
+			close(cancelled)
+			return nil, ctx.Err()
+		}
+		client, server := net.Pipe()
+		server.Close()
+		return client, nil
+	}
+
+	dialRotation = 0
+	conn, err := dialMultiAddr(dial, 20*time.Millisecond)(context.Background(), "tcp", "nsqd.test:4150")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("pending attempt was not cancelled")
+	}
+	mtx.Lock()
+	// the first IP in rotation is pending when the fallback delay passes
+	if len(dialed) != 2 || dialed[0] != "10.0.0.2:4150" || dialed[1] != "10.0.0.3:4150" {
+		t.Fatalf("unexpected dial order %v", dialed)
+	}
+	dialed = nil
+	mtx.Unlock()
+
+	// host names are resolved again, and IPs tried from the next in rotation
+	conn, err = dialMultiAddr(dial, 20*time.Millisecond)(context.Background(), "tcp", "nsqd.test:4150")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if lookups != 2 || dialed[0] != "10.0.0.3:4150" {
+		t.Fatalf("unexpected lookups %d and dial order %v", lookups, dialed)
+	}
+
+	// IPs are dialed as is
+	dialed = nil
+	dialMultiAddr(dial, 0)(context.Background(), "tcp", "10.0.0.1:4150")
+	if lookups != 2 || len(dialed) != 1 {
+		t.Fatalf("unexpected lookups %d and dial order %v", lookups, dialed)
+	}
+}
@@ -0,0 +1,361 @@
+package nsq
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Discoverer discovers the addresses of the nsqd instances that provide a topic
+// (see Consumer.ConnectToDiscoverer)
+//
+// Implementations are provided for nsqlookupd (LookupdDiscoverer), DNS SRV records
+// (DNSSRVDiscoverer), the Consul health API (ConsulDiscoverer) and the Endpoints of
+// a Kubernetes Service (KubernetesDiscoverer).
+type Discoverer interface {
+	Discover(ctx context.Context, topic string) ([]string, error)
+}
+
+// DiscovererFunc is a convenience type to avoid having to declare a struct
+// to implement the Discoverer interface, it can be used like this:
+//
+//	consumer.ConnectToDiscoverer(nsq.DiscovererFunc(func(ctx context.Context, topic string) ([]string, error) {
+//		// return the nsqd TCP addresses for topic
+//	}))
+type DiscovererFunc func(ctx context.Context, topic string) ([]string, error)
+
+// Discover implements the Discoverer interface
+func (f DiscovererFunc) Discover(ctx context.Context, topic string) ([]string, error) {
+	return f(ctx, topic)
+}
+
+func (f DiscovererFunc) String() string {
+	return "DiscovererFunc"
+}
+
+// LookupdDiscoverer discovers nsqd via the /lookup endpoint of nsqlookupd
+//
+// Every address is queried and the results combined, an error is only returned
+// when all of them fail.
+type LookupdDiscoverer struct {
+	Addresses []string
+
+	// optional, see Config.LookupdHTTPClient and Config.LookupdHTTPHeader
+	Client *http.Client
+	Header http.Header
+
+	// Discover the address of each partition of the topic (see PartitionAddress), when
+	// listed by the nsqlookupd of a partitioned NSQ fork (see Config.ExtendedProtocol)
+	Partitions bool
+}
+
+// Discover implements the Discoverer interface
+func (d *LookupdDiscoverer) Discover(ctx context.Context, topic string) ([]string, error) {
+	var nsqdAddrs []string
+	var lastErr error
+	for _, addr := range d.Addresses {
+		if err := validatedLookupAddr(addr); err != nil {
+			return nil, err
+		}
+		var data lookupResp
+		err := apiRequestNegotiateV1(d.Client, d.Header, "GET", lookupdEndpoint(addr, topic), nil, &data)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		addrs := data.nsqdAddrs()
+		if d.Partitions && len(data.Partitions) > 0 {
+			addrs = data.partitionAddrs()
+		}
+		for _, nsqdAddr := range addrs {
+			if indexOf(nsqdAddr, nsqdAddrs) == -1 {
+				nsqdAddrs = append(nsqdAddrs, nsqdAddr)
+			}
+		}
+		lastErr = nil
+	}
+	if nsqdAddrs == nil && lastErr != nil {
+		return nil, lastErr
+	}
+	return nsqdAddrs, nil
+}
+
+func (d *LookupdDiscoverer) String() string {
+	return "nsqlookupd " + strings.Join(d.Addresses, ",")
+}
+
+// DNSSRVDiscoverer discovers nsqd via the DNS SRV records of _Service._Proto.Name
+// (or Name directly, when Service and Proto are empty)
+//
+// The topic is not considered, every nsqd is assumed to provide it.
+type DNSSRVDiscoverer struct {
+	Service string
+	Proto   string
+	Name    string
+
+	// net.DefaultResolver when nil
+	Resolver *net.Resolver
+}
+
+// Discover implements the Discoverer interface
+func (d *DNSSRVDiscoverer) Discover(ctx context.Context, topic string) ([]string, error) {
+	resolver := d.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	_, srvs, err := resolver.LookupSRV(ctx, d.Service, d.Proto, d.Name)
+	if err != nil {
+		return nil, err
+	}
+	nsqdAddrs := make([]string, 0, len(srvs))
+	for _, srv := range srvs {
+		host := strings.TrimSuffix(srv.Target, ".")
+		nsqdAddrs = append(nsqdAddrs, net.JoinHostPort(host, strconv.Itoa(int(srv.Port))))
+	}
+	return nsqdAddrs, nil
+}
+
+func (d *DNSSRVDiscoverer) String() string {
+	if d.Service == "" && d.Proto == "" {
+		return "SRV " + d.Name
+	}
+	return fmt.Sprintf("SRV _%s._%s.%s", d.Service, d.Proto, d.Name)
+}
+
+// ConsulDiscoverer discovers nsqd via the passing instances of a service registered
+// in the Consul catalog (using the /v1/health/service endpoint)
+//
+// The topic is not considered, every nsqd is assumed to provide it.
+type ConsulDiscoverer struct {
+	// the Consul HTTP API address, http://127.0.0.1:8500 when empty
+	Address string
+	// the name of the nsqd service, and optionally a tag to filter instances on
+	Service string
+	Tag     string
+	// an optional ACL token
+	Token string
+
+	// http.DefaultClient when nil
+	Client *http.Client
+}
+
+type consulServiceEntry struct {
+	Node struct {
+		Address string
+	}
+	Service struct {
+		Address string
+		Port    int
+	}
+}
+
+// Discover implements the Discoverer interface
+func (d *ConsulDiscoverer) Discover(ctx context.Context, topic string) ([]string, error) {
+	addr := d.Address
+	if addr == "" {
+		addr = "http://127.0.0.1:8500"
+	}
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+
+	v := url.Values{}
+	v.Set("passing", "1")
+	if d.Tag != "" {
+		v.Set("tag", d.Tag)
+	}
+	endpoint := fmt.Sprintf("%s/v1/health/service/%s?%s",
+		strings.TrimSuffix(addr, "/"), url.PathEscape(d.Service), v.Encode())
+
+	header := http.Header{}
+	if d.Token != "" {
+		header.Set("X-Consul-Token", d.Token)
+	}
+
+	var entries []consulServiceEntry
+	err := discoveryRequest(ctx, d.Client, endpoint, header, &entries)
+	if err != nil {
+		return nil, err
+	}
+
+	nsqdAddrs := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		host := entry.Service.Address
+		if host == "" {
+			host = entry.Node.Address
+		}
+		nsqdAddrs = append(nsqdAddrs, net.JoinHostPort(host, strconv.Itoa(entry.Service.Port)))
+	}
+	return nsqdAddrs, nil
+}
+
+func (d *ConsulDiscoverer) String() string {
+	return "consul " + d.Service
+}
+
+const kubernetesServiceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// KubernetesDiscoverer discovers nsqd via the ready addresses of the Endpoints of
+// a Kubernetes Service (typically a headless Service selecting nsqd pods)
+//
+// The topic is not considered, every nsqd is assumed to provide it.
+//
+// Use NewInClusterKubernetesDiscoverer when running inside a pod.
+type KubernetesDiscoverer struct {
+	Namespace string
+	Service   string
+	// the name of the Service port of the nsqd TCP address (may be empty when the
+	// Service exposes a single port)
+	PortName string
+
+	// the Kubernetes API server, https://kubernetes.default.svc when empty
+	APIServer string
+	// the bearer token to authenticate with, or a file it is read from on every
+	// request (for tokens that are rotated)
+	Token     string
+	TokenFile string
+
+	// http.DefaultClient when nil
+	Client *http.Client
+}
+
+// NewInClusterKubernetesDiscoverer returns a KubernetesDiscoverer authenticating with
+// the service account token and CA certificate mounted in a pod
+//
+// When namespace is empty the namespace of the pod is used.
+func NewInClusterKubernetesDiscoverer(namespace string, service string, portName string) (*KubernetesDiscoverer, error) {
+	if namespace == "" {
+		data, err := ioutil.ReadFile(kubernetesServiceAccountDir + "/namespace")
+		if err != nil {
+			return nil, err
+		}
+		namespace = strings.TrimSpace(string(data))
+	}
+
+	caCert, err := ioutil.ReadFile(kubernetesServiceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caCert) {
+		return nil, errors.New("failed to parse service account CA certificate")
+	}
+
+	return &KubernetesDiscoverer{
+		Namespace: namespace,
+		Service:   service,
+		PortName:  portName,
+		TokenFile: kubernetesServiceAccountDir + "/token",
+		Client: &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{RootCAs: pool},
+			},
+		},
+	}, nil
+}
+
+type kubernetesEndpoints struct {
+	Subsets []struct {
+		Addresses []struct {
+			IP string `json:"ip"`
+		} `json:"addresses"`
+		Ports []struct {
+			Name string `json:"name"`
+			Port int    `json:"port"`
+		} `json:"ports"`
+	} `json:"subsets"`
+}
+
+// Discover implements the Discoverer interface
+func (d *KubernetesDiscoverer) Discover(ctx context.Context, topic string) ([]string, error) {
+	apiServer := d.APIServer
+	if apiServer == "" {
+		apiServer = "https://kubernetes.default.svc"
+	}
+	endpoint := fmt.Sprintf("%s/api/v1/namespaces/%s/endpoints/%s",
+		strings.TrimSuffix(apiServer, "/"), url.PathEscape(d.Namespace), url.PathEscape(d.Service))
+
+	token := d.Token
+	if d.TokenFile != "" {
+		data, err := ioutil.ReadFile(d.TokenFile)
+		if err != nil {
+			return nil, err
+		}
+		token = strings.TrimSpace(string(data))
+	}
+	header := http.Header{}
+	if token != "" {
+		header.Set("Authorization", "Bearer "+token)
+	}
+
+	var data kubernetesEndpoints
+	err := discoveryRequest(ctx, d.Client, endpoint, header, &data)
+	if err != nil {
+		return nil, err
+	}
+
+	var nsqdAddrs []string
+	for _, subset := range data.Subsets {
+		port := 0
+		for _, p := range subset.Ports {
+			if p.Name == d.PortName || (d.PortName == "" && len(subset.Ports) == 1) {
+				port = p.Port
+				break
+			}
+		}
+		if port == 0 {
+			return nil, fmt.Errorf("no port named %q in endpoints of %s/%s",
+				d.PortName, d.Namespace, d.Service)
+		}
+		for _, addr := range subset.Addresses {
+			nsqdAddrs = append(nsqdAddrs, net.JoinHostPort(addr.IP, strconv.Itoa(port)))
+		}
+	}
+	return nsqdAddrs, nil
+}
+
+func (d *KubernetesDiscoverer) String() string {
+	return fmt.Sprintf("kubernetes %s/%s", d.Namespace, d.Service)
+}
+
+// make a GET request to endpoint, storing the JSON response in the value pointed to by ret
+func discoveryRequest(ctx context.Context, client *http.Client, endpoint string, header http.Header, ret interface{}) error {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	req, err := http.NewRequest("GET", endpoint, nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("got response %s %q", resp.Status, respBody)
+	}
+
+	return json.Unmarshal(respBody, ret)
+}
@@ -0,0 +1,171 @@
+package nsq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLookupdDiscoverer(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/lookup" || req.URL.Query().Get("topic") != "orders" {
+			w.WriteHeader(404)
+			return
+		}
+		w.Header().Set("X-NSQ-Content-Type", "nsq; version=1.0")
+		fmt.Fprint(w, `{"producers":[{"broadcast_address":"10.0.0.1","tcp_port":4150},`+
+			`{"broadcast_address":"10.0.0.2","tcp_port":4150}]}`)
+	}))
+	defer srv.Close()
+
+	d := &LookupdDiscoverer{Addresses: []string{srv.URL, srv.URL, "127.0.0.1:1"}}
+	addrs, err := d.Discover(context.Background(), "orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(addrs, ",") != "10.0.0.1:4150,10.0.0.2:4150" {
+		t.Fatalf("unexpected addresses %v", addrs)
+	}
+
+	d = &LookupdDiscoverer{Addresses: []string{"127.0.0.1:1"}}
+	if _, err := d.Discover(context.Background(), "orders"); err == nil {
+		t.Fatal("expected an error when all nsqlookupd fail")
+	}
+}
+
+func TestConsulDiscoverer(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/v1/health/service/nsqd" || req.URL.Query().Get("passing") != "1" ||
+			req.URL.Query().Get("tag") != "prod" || req.Header.Get("X-Consul-Token") != "secret" {
+			w.WriteHeader(403)
+			return
+		}
+		fmt.Fprint(w, `[{"Node":{"Address":"10.0.0.1"},"Service":{"Address":"","Port":4150}},`+
+			`{"Node":{"Address":"10.0.0.2"},"Service":{"Address":"10.1.0.2","Port":4151}}]`)
+	}))
+	defer srv.Close()
+
+	d := &ConsulDiscoverer{Address: srv.URL, Service: "nsqd", Tag: "prod", Token: "secret"}
+	addrs, err := d.Discover(context.Background(), "orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(addrs, ",") != "10.0.0.1:4150,10.1.0.2:4151" {
+		t.Fatalf("unexpected addresses %v", addrs)
+	}
+}
+
+func TestKubernetesDiscoverer(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/api/v1/namespaces/queue/endpoints/nsqd" ||
+			req.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(403)
+			return
+		}
+		fmt.Fprint(w, `{"subsets":[{"addresses":[{"ip":"10.0.0.1"},{"ip":"10.0.0.2"}],`+
+			`"ports":[{"name":"http","port":4151},{"name":"tcp","port":4150}]}]}`)
+	}))
+	defer srv.Close()
+
+	d := &KubernetesDiscoverer{
+		Namespace: "queue",
+		Service:   "nsqd",
+		PortName:  "tcp",
+		APIServer: srv.URL,
+		Token:     "secret",
+	}
+	addrs, err := d.Discover(context.Background(), "orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(addrs, ",") != "10.0.0.1:4150,10.0.0.2:4150" {
+		t.Fatalf("unexpected addresses %v", addrs)
+	}
+
+	d.PortName = "bogus"
+	if _, err := d.Discover(context.Background(), "orders"); err == nil {
+		t.Fatal("expected an error for a missing port")
+	}
+}
+
+func TestConsumerDiscoverer(t *testing.T) {
+	q, _ := NewConsumer("discoverer_test", "ch", NewConfig())
+	q.SetLogger(nullLogger, LogLevelInfo)
+	q.AddHandler(&testHandler{})
+
+	var topics []string
+	err := q.ConnectToDiscoverer(DiscovererFunc(func(ctx context.Context, topic string) ([]string, error) {
+		topics = append(topics, topic)
+		return nil, errors.New("boom")
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-q.Errors():
+		if e, ok := err.(ErrConsumer); !ok || e.Op != "discover" {
+			t.Fatalf("unexpected error %#v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for error")
+	}
+	if len(topics) != 1 || topics[0] != "discoverer_test" {
+		t.Fatalf("unexpected topics %v", topics)
+	}
+
+	q.Stop()
+	<-q.StopChan
+}
+
+type testDiscoveryPreference struct {
+	local string
+}
+
+func (p testDiscoveryPreference) Preference(addr string) int {
+	if strings.HasPrefix(addr, p.local) {
+		return 0
+	}
+	return 1
+}
+
+func TestConsumerDiscoveryPreference(t *testing.T) {
+	preference := testDiscoveryPreference{"10.0.0."}
+	tiers := preferenceTiers(preference, []string{"10.1.0.1:4150", "10.0.0.1:4150", "10.1.0.2:4150", "10.0.0.2:4150"})
+	if len(tiers) != 2 || strings.Join(tiers[0], ",") != "10.0.0.1:4150,10.0.0.2:4150" ||
+		strings.Join(tiers[1], ",") != "10.1.0.1:4150,10.1.0.2:4150" {
+		t.Fatalf("unexpected tiers %v", tiers)
+	}
+
+	script := []instruction{
+		// IDENTIFY
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		// SUB
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		// needed to exit test
+		instruction{100 * time.Millisecond, -1, []byte("exit")},
+	}
+	n := newMockNSQD(t, script, "127.0.0.1:0")
+
+	config := NewConfig()
+	config.DialTimeout = 100 * time.Millisecond
+	q, _ := NewConsumer("preference_test", "ch", config)
+	q.SetLogger(nullLogger, LogLevelInfo)
+	q.AddHandler(HandlerFunc(func(m *Message) error { return nil }))
+	// the preferred nsqd is unreachable, so the remote one is connected
+	q.SetBehaviorDelegate(testDiscoveryPreference{"127.0.0.1:1"})
+	q.connectToDiscovered([]string{n.tcpAddr.String(), "127.0.0.1:1"})
+
+	conns := q.conns()
+	if len(conns) != 1 || conns[0].String() != n.tcpAddr.String() {
+		t.Fatalf("unexpected connections %v", conns)
+	}
+	<-n.exitChan
+	q.Stop()
+	<-q.StopChan
+}
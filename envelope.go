@@ -0,0 +1,202 @@
+package nsq
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Headers is a set of key/value metadata carried alongside a message body
+// in an envelope (see EncodeEnvelope)
+type Headers map[string]string
+
+// Well-known header keys describing the body of a message
+const (
+	HeaderContentType   = "content-type"
+	HeaderSchemaVersion = "schema-version"
+	HeaderTenantID      = "tenant-id"
+)
+
+// Get returns the value of key, or "" when it is not set
+func (h Headers) Get(key string) string {
+	return h[key]
+}
+
+// Set sets key to value
+func (h Headers) Set(key string, value string) {
+	h[key] = value
+}
+
+// Del removes key
+func (h Headers) Del(key string) {
+	delete(h, key)
+}
+
+// GetInt returns the value of key as an integer, and false when it is not set or not
+// an integer
+func (h Headers) GetInt(key string) (int64, bool) {
+	n, err := strconv.ParseInt(h[key], 10, 64)
+	return n, err == nil
+}
+
+// SetInt sets key to the decimal form of n
+func (h Headers) SetInt(key string, n int64) {
+	h[key] = strconv.FormatInt(n, 10)
+}
+
+// GetBool returns the value of key as a boolean, and false when it is not set or not
+// a boolean
+func (h Headers) GetBool(key string) (value bool, ok bool) {
+	b, err := strconv.ParseBool(h[key])
+	return b, err == nil
+}
+
+// SetBool sets key to "true" or "false"
+func (h Headers) SetBool(key string, b bool) {
+	h[key] = strconv.FormatBool(b)
+}
+
+// GetTime returns the value of key as a time, and false when it is not set or not
+// formatted as by SetTime
+func (h Headers) GetTime(key string) (time.Time, bool) {
+	t, err := time.Parse(time.RFC3339Nano, h[key])
+	return t, err == nil
+}
+
+// SetTime sets key to t, formatted as RFC 3339 (with nanoseconds)
+func (h Headers) SetTime(key string, t time.Time) {
+	h[key] = t.Format(time.RFC3339Nano)
+}
+
+// GetDuration returns the value of key as a duration, and false when it is not set or
+// not a duration (see time.ParseDuration)
+func (h Headers) GetDuration(key string) (time.Duration, bool) {
+	d, err := time.ParseDuration(h[key])
+	return d, err == nil
+}
+
+// SetDuration sets key to the string form of d
+func (h Headers) SetDuration(key string, d time.Duration) {
+	h[key] = d.String()
+}
+
+// clone returns a copy of h, which is never nil
+func (h Headers) clone() Headers {
+	c := make(Headers, len(h))
+	for k, v := range h {
+		c[k] = v
+	}
+	return c
+}
+
+// HeaderKey is the header holding the ordering key of a message (see Consumer.AddKeyedHandlers)
+const HeaderKey = "nsq-key"
+
+// Header keys set on messages republished by a Consumer to a dead-letter topic
+const (
+	HeaderOriginalTopic   = "nsq-original-topic"
+	HeaderOriginalChannel = "nsq-original-channel"
+	HeaderMessageID       = "nsq-message-id"
+	HeaderAttempts        = "nsq-attempts"
+	HeaderNSQDAddress     = "nsq-nsqd-address"
+	HeaderFailedAt        = "nsq-failed-at"
+)
+
+// Header keys set on messages republished by a Consumer to a retry topic (see Config.RetryTiers),
+// along with HeaderOriginalTopic, HeaderOriginalChannel and HeaderMessageID
+const (
+	// the retry tier, from 1
+	HeaderRetryTier = "nsq-retry-tier"
+	// the number of attempts to handle the message before it was republished
+	HeaderRetryAttempts = "nsq-retry-attempts"
+)
+
+// envelopeMagic prefixes every encoded envelope, followed by a version byte
+var envelopeMagic = []byte{0x00, 'N', 'E', 'V'}
+
+const envelopeVersion = 1
+
+var errInvalidEnvelope = errors.New("invalid envelope")
+
+// EncodeEnvelope serializes headers and body into a single message body
+// that can be published like any other.
+//
+// envelope format:
+//  [0x00 N E V][v][count]([key len][key][value len][value])...[body]
+//  |  4-byte  |1b| uint16|  uint16      N     uint32      N  | N-byte
+//
+// Messages received by a Consumer that carry an envelope can be decoded
+// with DecodeEnvelope.
+func EncodeEnvelope(headers Headers, body []byte) []byte {
+	size := len(envelopeMagic) + 1 + 2 + len(body)
+	keys := make([]string, 0, len(headers))
+	for k, v := range headers {
+		keys = append(keys, k)
+		size += 2 + len(k) + 4 + len(v)
+	}
+	// deterministic output
+	sort.Strings(keys)
+
+	buf := bytes.NewBuffer(make([]byte, 0, size))
+	buf.Write(envelopeMagic)
+	buf.WriteByte(envelopeVersion)
+	binary.Write(buf, binary.BigEndian, uint16(len(keys)))
+	for _, k := range keys {
+		v := headers[k]
+		binary.Write(buf, binary.BigEndian, uint16(len(k)))
+		buf.WriteString(k)
+		binary.Write(buf, binary.BigEndian, uint32(len(v)))
+		buf.WriteString(v)
+	}
+	buf.Write(body)
+	return buf.Bytes()
+}
+
+// DecodeEnvelope parses data produced by EncodeEnvelope, returning the headers
+// and the enclosed body.
+//
+// When data is not a valid envelope ok is false and body is data, unmodified.
+func DecodeEnvelope(data []byte) (headers Headers, body []byte, ok bool) {
+	headers, body, err := decodeEnvelope(data)
+	if err != nil {
+		return nil, data, false
+	}
+	return headers, body, true
+}
+
+func decodeEnvelope(data []byte) (Headers, []byte, error) {
+	if len(data) < len(envelopeMagic)+3 || !bytes.Equal(data[:len(envelopeMagic)], envelopeMagic) {
+		return nil, nil, errInvalidEnvelope
+	}
+	b := data[len(envelopeMagic):]
+	if b[0] != envelopeVersion {
+		return nil, nil, errInvalidEnvelope
+	}
+	count := int(binary.BigEndian.Uint16(b[1:3]))
+	b = b[3:]
+
+	headers := make(Headers, count)
+	for i := 0; i < count; i++ {
+		if len(b) < 2 {
+			return nil, nil, errInvalidEnvelope
+		}
+		klen := int(binary.BigEndian.Uint16(b))
+		b = b[2:]
+		if len(b) < klen+4 {
+			return nil, nil, errInvalidEnvelope
+		}
+		k := string(b[:klen])
+		b = b[klen:]
+		vlen := int(binary.BigEndian.Uint32(b))
+		b = b[4:]
+		if vlen < 0 || len(b) < vlen {
+			return nil, nil, errInvalidEnvelope
+		}
+		headers[k] = string(b[:vlen])
+		b = b[vlen:]
+	}
+	return headers, b, nil
+}
@@ -0,0 +1,136 @@
+package nsq
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestEnvelopeRoundTrip(t *testing.T) {
+	headers := Headers{
+		"content-type": "application/json",
+		"tenant":       "acme",
+		"empty":        "",
+	}
+	body := []byte(`{"hello":"world"}`)
+
+	h, b, ok := DecodeEnvelope(EncodeEnvelope(headers, body))
+	if !ok {
+		t.Fatal("failed to decode envelope")
+	}
+	if !bytes.Equal(b, body) {
+		t.Fatalf("body %q != %q", b, body)
+	}
+	if len(h) != len(headers) {
+		t.Fatalf("got %d headers, expected %d", len(h), len(headers))
+	}
+	for k, v := range headers {
+		if h[k] != v {
+			t.Fatalf("header %s = %q, expected %q", k, h[k], v)
+		}
+	}
+}
+
+func TestEnvelopeDecodeRaw(t *testing.T) {
+	for _, data := range [][]byte{
+		nil,
+		[]byte("plain body"),
+		// valid magic, truncated headers
+		append(append([]byte{}, envelopeMagic...), envelopeVersion, 0, 1, 0, 5, 'a'),
+	} {
+		h, b, ok := DecodeEnvelope(data)
+		if ok || h != nil || !bytes.Equal(b, data) {
+			t.Fatalf("%q should not decode as an envelope", data)
+		}
+	}
+}
+
+type testDeadLetterNamer struct{}
+
+func (testDeadLetterNamer) DeadLetterTopic(topic string, channel string) string {
+	return "dead." + topic
+}
+
+func TestConsumerDeadLetterTopic(t *testing.T) {
+	q, _ := NewConsumer("orders", "billing#ephemeral", NewConfig())
+	if topic := q.deadLetterTopic(); topic != "orders.billing.dlq" {
+		t.Fatalf("unexpected default dead-letter topic %s", topic)
+	}
+
+	q.SetBehaviorDelegate(testDeadLetterNamer{})
+	if topic := q.deadLetterTopic(); topic != "dead.orders" {
+		t.Fatalf("unexpected custom dead-letter topic %s", topic)
+	}
+}
+
+func TestHeaders(t *testing.T) {
+	h := Headers{}
+	h.Set(HeaderContentType, "application/json")
+	h.SetInt(HeaderSchemaVersion, 3)
+	h.SetBool("sampled", true)
+	at := time.Date(2024, 1, 2, 3, 4, 5, 6, time.UTC)
+	h.SetTime("sent-at", at)
+	h.SetDuration("deadline", 1500*time.Millisecond)
+
+	if v := h.Get(HeaderContentType); v != "application/json" {
+		t.Fatalf("unexpected content type %q", v)
+	}
+	if n, ok := h.GetInt(HeaderSchemaVersion); !ok || n != 3 {
+		t.Fatalf("unexpected schema version %d (%v)", n, ok)
+	}
+	if b, ok := h.GetBool("sampled"); !ok || !b {
+		t.Fatalf("unexpected sampled %v (%v)", b, ok)
+	}
+	if v, ok := h.GetTime("sent-at"); !ok || !v.Equal(at) {
+		t.Fatalf("unexpected time %s (%v)", v, ok)
+	}
+	if d, ok := h.GetDuration("deadline"); !ok || d != 1500*time.Millisecond {
+		t.Fatalf("unexpected duration %s (%v)", d, ok)
+	}
+	h.Del(HeaderContentType)
+	if _, ok := h.GetInt(HeaderContentType); ok || h.Get(HeaderContentType) != "" {
+		t.Fatal("expected a deleted header")
+	}
+}
+
+func TestConsumerDecodeEnvelopes(t *testing.T) {
+	headers := Headers{HeaderTenantID: "acme", HeaderKey: "k1"}
+	msg := NewMessage(MessageID{'e', 'n', 'v'}, EncodeEnvelope(headers, []byte("body")))
+
+	script := []instruction{
+		// IDENTIFY
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		// SUB
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		instruction{20 * time.Millisecond, FrameTypeMessage, frameMessage(msg)},
+		// needed to exit test
+		instruction{50 * time.Millisecond, -1, []byte("exit")},
+	}
+	addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	n := newMockNSQD(t, script, addr.String())
+
+	config := NewConfig()
+	config.DecodeEnvelopes = true
+	q, _ := NewConsumer("test_decode_envelopes", "ch", config)
+	q.SetLogger(nullLogger, LogLevelInfo)
+	handled := make(chan *Message, 1)
+	q.AddHandler(HandlerFunc(func(m *Message) error {
+		handled <- m
+		return nil
+	}))
+	if err := q.ConnectToNSQD(n.tcpAddr.String()); err != nil {
+		t.Fatal(err)
+	}
+	m := <-handled
+	<-n.exitChan
+	q.Stop()
+	<-q.StopChan
+
+	if string(m.Body) != "body" || m.Headers.Get(HeaderTenantID) != "acme" {
+		t.Fatalf("unexpected message %q with headers %v", m.Body, m.Headers)
+	}
+	if key := EnvelopeKey(m); key != "k1" {
+		t.Fatalf("unexpected key %q of a decoded message", key)
+	}
+}
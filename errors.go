@@ -3,6 +3,7 @@ package nsq
 import (
 	"errors"
 	"fmt"
+	"strings"
 )
 
 // ErrNotConnected is returned when a publish command is made
@@ -22,6 +23,10 @@ var ErrAlreadyConnected = errors.New("already connected")
 // ErrOverMaxInFlight is returned from Consumer if over max-in-flight
 var ErrOverMaxInFlight = errors.New("over configure max-inflight")
 
+// ErrBackpressure is returned when publishing to a Producer with Config.MaxPendingCommands
+// commands awaiting a response from nsqd
+var ErrBackpressure = errors.New("too many pending commands")
+
 // ErrIdentify is returned from Conn as part of the IDENTIFY handshake
 type ErrIdentify struct {
 	Reason string
@@ -32,6 +37,43 @@ func (e ErrIdentify) Error() string {
 	return fmt.Sprintf("failed to IDENTIFY - %s", e.Reason)
 }
 
+// ErrAuth is returned from Conn when nsqd requires authentication and either no
+// AuthSecret is configured or it is rejected
+type ErrAuth struct {
+	Reason string
+}
+
+// Error returns a stringified error
+func (e ErrAuth) Error() string {
+	return fmt.Sprintf("failed to AUTH - %s", e.Reason)
+}
+
+// ErrConfig is returned from Config.Validate (and the constructors validating a Config),
+// listing every invalid option and inconsistency between options
+type ErrConfig struct {
+	Violations []string
+}
+
+// Error returns a stringified error
+func (e ErrConfig) Error() string {
+	return strings.Join(e.Violations, "; ")
+}
+
+// ErrUnknownOption is returned from Config.Set for an option that does not exist
+type ErrUnknownOption struct {
+	Option string
+	// the nearest valid options, each followed by its type, e.g. "max_in_flight (int)"
+	Suggestions []string
+}
+
+// Error returns a stringified error
+func (e ErrUnknownOption) Error() string {
+	if len(e.Suggestions) == 0 {
+		return fmt.Sprintf("invalid option %s", e.Option)
+	}
+	return fmt.Sprintf("invalid option %s - did you mean %s?", e.Option, strings.Join(e.Suggestions, " or "))
+}
+
 // ErrProtocol is returned from Producer when encountering
 // an NSQ protocol level error
 type ErrProtocol struct {
@@ -42,3 +84,85 @@ type ErrProtocol struct {
 func (e ErrProtocol) Error() string {
 	return e.Reason
 }
+
+// ErrConsumer is sent on Consumer.Errors() for failures that occur
+// asynchronously, i.e. that are not returned to the caller of a method
+type ErrConsumer struct {
+	// the operation that failed, one of:
+	//
+	//     "lookupd"     - querying nsqlookupd (Addr is the lookupd endpoint)
+	//     "discover"    - querying a Discoverer (Addr is the Discoverer)
+	//     "connect"     - connecting to a discovered nsqd (Err may be an ErrIdentify)
+	//     "protocol"    - nsqd responded with an error frame (Err is an ErrProtocol)
+	//     "io"          - reading from or writing to nsqd failed
+	//     "stats"       - querying the /stats endpoint of nsqd (see Config.DepthMonitorInterval)
+	//     "idempotency" - accessing the IdempotencyStore (Addr is the nsqd of the message)
+	Op   string
+	Addr string
+	Err  error
+}
+
+// Error returns a stringified error
+func (e ErrConsumer) Error() string {
+	return fmt.Sprintf("%s (%s) - %s", e.Op, e.Addr, e.Err)
+}
+
+// Unwrap returns the underlying error
+func (e ErrConsumer) Unwrap() error {
+	return e.Err
+}
+
+// Causes of a Consumer stopping itself, see ErrTerminated
+var (
+	ErrLookupdFailing  = errors.New("all nsqlookupd queries failing")
+	ErrAuthRejected    = errors.New("authentication rejected by nsqd")
+	ErrConnectionsLost = errors.New("all nsqd connections lost")
+)
+
+// ErrTerminated is returned from Consumer.Wait when the Consumer stopped itself,
+// see Config.MaxLookupdFailures, Config.MaxReconnectAttempts and Config.StopOnAuthFailure
+type ErrTerminated struct {
+	// one of ErrLookupdFailing, ErrAuthRejected or ErrConnectionsLost
+	Cause error
+	// the last error encountered
+	Err error
+}
+
+// Error returns a stringified error
+func (e ErrTerminated) Error() string {
+	return fmt.Sprintf("consumer terminated: %s - %s", e.Cause, e.Err)
+}
+
+// Unwrap returns the cause
+func (e ErrTerminated) Unwrap() error {
+	return e.Cause
+}
+
+// ErrHandlerPanic is the result of a handler that panicked, see Config.RecoverPanics
+type ErrHandlerPanic struct {
+	// the value passed to panic
+	Value interface{}
+	// the stack trace of the goroutine that panicked
+	Stack []byte
+}
+
+// Error returns a stringified error
+func (e ErrHandlerPanic) Error() string {
+	return fmt.Sprintf("handler panic: %v", e.Value)
+}
+
+// ErrSchemaValidation is returned when publishing, and passed to the DecodeErrorHandler of a
+// Consumer (see Consumer.SetDecodeErrorHandler) when receiving, a message body rejected by
+// the Config.SchemaValidator
+type ErrSchemaValidation struct {
+	Topic       string
+	ContentType string
+	// the reasons the body was rejected, e.g. "/items/0/name: is required"
+	Violations []string
+}
+
+// Error returns a stringified error
+func (e ErrSchemaValidation) Error() string {
+	return fmt.Sprintf("invalid body for topic %s (%s) - %s",
+		e.Topic, e.ContentType, strings.Join(e.Violations, "; "))
+}
@@ -0,0 +1,154 @@
+package nsq
+
+import (
+	"time"
+)
+
+// EventType identifies a Consumer lifecycle event (see Consumer.OnEvent)
+type EventType int
+
+// Consumer lifecycle events
+const (
+	// a message was FINished (Event.Message, Event.NSQDAddress)
+	EventMessageFinished EventType = iota
+	// a message was REQueued (Event.Message, Event.NSQDAddress)
+	EventMessageRequeued
+	// a message exceeded MaxAttempts and was given up on (Event.Message, Event.NSQDAddress)
+	EventGiveUp
+	// the Consumer entered (or escalated) backoff (Event.BackoffLevel, Event.BackoffDuration)
+	EventBackoffStarted
+	// the Consumer exited backoff
+	EventBackoffEnded
+	// a connection to nsqd was established (Event.NSQDAddress)
+	EventConnectionAdded
+	// a connection to nsqd was closed (Event.NSQDAddress, Event.Err)
+	EventConnectionRemoved
+	// a message was neither touched nor responded to within Config.ExpiringMessageFraction
+	// of its msg_timeout (Event.Message, Event.NSQDAddress)
+	EventMessageExpiring
+	// a handler took longer than Config.SlowHandlerThreshold to process a message
+	// (Event.Message, Event.NSQDAddress, Event.HandlerDuration)
+	EventSlowHandler
+	// a handler panicked processing a message, see Config.RecoverPanics
+	// (Event.Message, Event.NSQDAddress)
+	EventHandlerPanic
+	// nsqd responded to IDENTIFY with the features negotiated for a new connection
+	// (Event.NSQDAddress, Event.IdentifyResponse)
+	EventIdentifyResponse
+	// a heartbeat was received (Event.NSQDAddress, Event.HeartbeatInterval)
+	EventHeartbeat
+	// reading from or writing to a connection failed, which is then closed
+	// (Event.NSQDAddress, Event.Err)
+	EventConnectionIOError
+	// a ConfigWatcher reloaded its file (Event.ConfigReload, and Event.Err when the file
+	// could not be loaded)
+	EventConfigReloaded
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventMessageFinished:
+		return "MessageFinished"
+	case EventMessageRequeued:
+		return "MessageRequeued"
+	case EventGiveUp:
+		return "GiveUp"
+	case EventBackoffStarted:
+		return "BackoffStarted"
+	case EventBackoffEnded:
+		return "BackoffEnded"
+	case EventConnectionAdded:
+		return "ConnectionAdded"
+	case EventConnectionRemoved:
+		return "ConnectionRemoved"
+	case EventMessageExpiring:
+		return "MessageExpiring"
+	case EventSlowHandler:
+		return "SlowHandler"
+	case EventHandlerPanic:
+		return "HandlerPanic"
+	case EventIdentifyResponse:
+		return "IdentifyResponse"
+	case EventHeartbeat:
+		return "Heartbeat"
+	case EventConnectionIOError:
+		return "ConnectionIOError"
+	case EventConfigReloaded:
+		return "ConfigReloaded"
+	}
+	return "Unknown"
+}
+
+// Event describes a Consumer lifecycle event
+//
+// Only the fields relevant to the event's Type are set.
+type Event struct {
+	Type         EventType
+	Time         time.Time
+	Subscription Subscription
+
+	NSQDAddress string
+	Message     *Message
+
+	BackoffLevel    int
+	BackoffDuration time.Duration
+
+	HandlerDuration time.Duration
+
+	IdentifyResponse *IdentifyResponse
+
+	// the time since the previous heartbeat (or since connecting, for the first)
+	HeartbeatInterval time.Duration
+
+	ConfigReload *ConfigReload
+
+	// the error of EventConnectionIOError, and the reason for EventConnectionRemoved
+	// (nil when the connection was closed by the Consumer, e.g. by Stop, or cleanly
+	// by nsqd)
+	Err error
+}
+
+// EventHandler is called for Consumer lifecycle events (see Consumer.OnEvent)
+type EventHandler func(event Event)
+
+type eventRegistration struct {
+	handler EventHandler
+	types   []EventType
+}
+
+// OnEvent registers handler to be called for the given types of lifecycle event
+// (or all events, when no types are given).
+//
+// Handlers are called synchronously, on the goroutine on which the event occurred,
+// so they must be fast and must not block.
+func (r *Consumer) OnEvent(handler EventHandler, types ...EventType) {
+	r.eventMtx.Lock()
+	r.eventHandlers = append(r.eventHandlers, eventRegistration{handler, types})
+	r.eventMtx.Unlock()
+}
+
+func (r *Consumer) emit(event Event) {
+	r.eventMtx.RLock()
+	defer r.eventMtx.RUnlock()
+	if len(r.eventHandlers) == 0 {
+		return
+	}
+
+	event.Time = time.Now()
+	event.Subscription = Subscription{r.topic, r.channel}
+	for _, reg := range r.eventHandlers {
+		if len(reg.types) > 0 && !hasEventType(reg.types, event.Type) {
+			continue
+		}
+		reg.handler(event)
+	}
+}
+
+func hasEventType(types []EventType, t EventType) bool {
+	for _, x := range types {
+		if x == t {
+			return true
+		}
+	}
+	return false
+}
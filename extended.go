@@ -0,0 +1,118 @@
+package nsq
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Support for the protocol extensions of partitioned NSQ forks (such as youzan/nsq), see
+// Config.ExtendedProtocol
+
+// PartitionAddress returns the address of a partition of the topic on the nsqd at addr,
+// to connect to with Consumer.ConnectToNSQD when Config.ExtendedProtocol is set
+func PartitionAddress(addr string, partition int) string {
+	return addr + "#" + strconv.Itoa(partition)
+}
+
+// splitPartitionAddress returns the nsqd address and partition of a partition address,
+// or addr and -1 for any other address
+func splitPartitionAddress(addr string) (string, int) {
+	i := strings.LastIndexByte(addr, '#')
+	if i == -1 {
+		return addr, -1
+	}
+	partition, err := strconv.Atoi(addr[i+1:])
+	if err != nil || partition < 0 {
+		return addr, -1
+	}
+	return addr[:i], partition
+}
+
+// nsqdAddr returns the address of the nsqd to dial, without the partition of a partition
+// address
+func (c *Conn) nsqdAddr() string {
+	if !c.config.ExtendedProtocol {
+		return c.addr
+	}
+	addr, _ := splitPartitionAddress(c.addr)
+	return addr
+}
+
+// SubscribePartition creates a new Command to subscribe to the given topic/channel on a
+// partition (-1 == any), with SUB_ORDERED when ordered, as partitioned NSQ forks support
+func SubscribePartition(topic string, channel string, partition int, ordered bool) *Command {
+	var params = [][]byte{[]byte(topic), []byte(channel)}
+	if partition >= 0 {
+		params = append(params, []byte(strconv.Itoa(partition)))
+	}
+	name := "SUB"
+	if ordered {
+		name = "SUB_ORDERED"
+	}
+	return &Command{[]byte(name), params, nil}
+}
+
+// PublishTrace creates a new Command to write a message with a trace ID to a partition
+// of the given topic (-1 == any), as partitioned NSQ forks support (PUB_TRACE)
+func PublishTrace(topic string, partition int, traceID uint64, body []byte) *Command {
+	var params = [][]byte{[]byte(topic)}
+	if partition >= 0 {
+		params = append(params, []byte(strconv.Itoa(partition)))
+	}
+	buf := make([]byte, 8+len(body))
+	binary.BigEndian.PutUint64(buf[:8], traceID)
+	copy(buf[8:], body)
+	return &Command{[]byte("PUB_TRACE"), params, buf}
+}
+
+// PublishWithTrace synchronously publishes a message body with a trace ID to a partition
+// of the specified topic (-1 == any), returning an error if publish failed
+//
+// It requires Config.ExtendedProtocol, and an nsqd supporting PUB_TRACE. Use SendCommand
+// with PublishTrace for the data of its response.
+func (w *Producer) PublishWithTrace(topic string, partition int, traceID uint64, body []byte) error {
+	if !w.config.ExtendedProtocol {
+		return errors.New("PublishWithTrace requires Config.ExtendedProtocol")
+	}
+	if err := ValidateTopicName(topic); err != nil {
+		return err
+	}
+	return w.sendCommand(PublishTrace(topic, partition, traceID, body))
+}
+
+// subscribeCommand returns the command subscribing to the topic/channel on the nsqd (or
+// partition) at addr
+func (r *Consumer) subscribeCommand(addr string) *Command {
+	if !r.config.ExtendedProtocol {
+		return Subscribe(r.topic, r.channel)
+	}
+	_, partition := splitPartitionAddress(addr)
+	if partition == -1 {
+		partition = r.config.Partition
+	}
+	return SubscribePartition(r.topic, r.channel, partition, r.config.OrderedSubscribe)
+}
+
+// partitionAddrs returns the address of each partition listed by the nsqlookupd of a
+// partitioned NSQ fork (see PartitionAddress), ordered by partition
+func (data *lookupResp) partitionAddrs() []string {
+	var partitions []int
+	for id := range data.Partitions {
+		if p, err := strconv.Atoi(id); err == nil && p >= 0 && data.Partitions[id] != nil {
+			partitions = append(partitions, p)
+		}
+	}
+	sort.Ints(partitions)
+
+	var addrs []string
+	for _, p := range partitions {
+		producer := data.Partitions[strconv.Itoa(p)]
+		addr := net.JoinHostPort(producer.BroadcastAddress, strconv.Itoa(producer.TCPPort))
+		addrs = append(addrs, PartitionAddress(addr, p))
+	}
+	return addrs
+}
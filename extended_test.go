@@ -0,0 +1,79 @@
+package nsq
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestExtendedCommands(t *testing.T) {
+	var buf bytes.Buffer
+	SubscribePartition("t", "ch", 2, true).WriteTo(&buf)
+	SubscribePartition("t", "ch", -1, false).WriteTo(&buf)
+	PublishTrace("t", 1, 42, []byte("body")).WriteTo(&buf)
+	expected := "SUB_ORDERED t ch 2\nSUB t ch\nPUB_TRACE t 1\n" +
+		"\x00\x00\x00\x0c" + "\x00\x00\x00\x00\x00\x00\x00\x2a" + "body"
+	if buf.String() != expected {
+		t.Fatalf("unexpected commands %q", buf.String())
+	}
+
+	for addr, expected := range map[string][]interface{}{
+		PartitionAddress("127.0.0.1:4150", 3): {"127.0.0.1:4150", 3},
+		"127.0.0.1:4150":                      {"127.0.0.1:4150", -1},
+		"ws://host/nsq#x":                     {"ws://host/nsq#x", -1},
+	} {
+		addr, partition := splitPartitionAddress(addr)
+		if addr != expected[0] || partition != expected[1] {
+			t.Fatalf("unexpected partition address %s/%d, expected %v", addr, partition, expected)
+		}
+	}
+
+	var data lookupResp
+	json.Unmarshal([]byte(`{"producers":[],"partitions":{
+		"1":{"broadcast_address":"b","tcp_port":4150},
+		"0":{"broadcast_address":"a","tcp_port":4150}}}`), &data)
+	addrs := data.partitionAddrs()
+	if !reflect.DeepEqual(addrs, []string{"a:4150#0", "b:4150#1"}) {
+		t.Fatalf("unexpected partition addresses %v", addrs)
+	}
+}
+
+func TestConsumerExtendedProtocol(t *testing.T) {
+	script := []instruction{
+		// IDENTIFY
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		// SUB_ORDERED
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		// needed to exit test
+		instruction{100 * time.Millisecond, -1, []byte("exit")},
+	}
+
+	addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	n := newMockNSQD(t, script, addr.String())
+
+	config := NewConfig()
+	config.ExtendedProtocol = true
+	config.OrderedSubscribe = true
+	q, _ := NewConsumer("test_extended", "ch", config)
+	q.SetLogger(nullLogger, LogLevelInfo)
+	q.AddHandler(&MyTestHandler{})
+	partitionAddr := PartitionAddress(n.tcpAddr.String(), 3)
+	err := q.ConnectToNSQD(partitionAddr)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if conns := q.conns(); len(conns) != 1 || conns[0].String() != partitionAddr {
+		t.Fatalf("unexpected connections %v", conns)
+	}
+
+	<-n.exitChan
+	q.Stop()
+	<-q.StopChan
+
+	if len(n.got) < 2 || string(n.got[1]) != "SUB_ORDERED test_extended ch 3" {
+		t.Fatalf("unexpected commands %q", n.got)
+	}
+}
@@ -0,0 +1,79 @@
+package nsq
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// ErrFanOut is returned by the handler returned from FanOut when any of its pipelines
+// failed
+type ErrFanOut struct {
+	// the error of each pipeline, in order (nil for pipelines that succeeded)
+	Errors []error
+}
+
+// Error returns a stringified error
+func (e ErrFanOut) Error() string {
+	var failed []string
+	for i, err := range e.Errors {
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("pipeline %d: %s", i, err))
+		}
+	}
+	return fmt.Sprintf("%d of %d fan-out pipelines failed - %s",
+		len(failed), len(e.Errors), strings.Join(failed, "; "))
+}
+
+// FanOut returns a HandlerWithContext delivering each message to all of pipelines
+// concurrently, each receiving its own copy of the message (see Message.Copy), e.g. for
+// several independent projections of the same stream:
+//
+//	consumer.AddHandlerWithContext(nsq.FanOut(searchIndexer, auditLog, cacheWarmer))
+//
+// It returns nil (so the message is FINished) only once every pipeline succeeded, and
+// an ErrFanOut (so the message is REQueued) if any failed. As all pipelines are called
+// again when the message is redelivered, they should be idempotent.
+//
+// A panic in a pipeline is re-raised (once all pipelines returned) in the calling
+// goroutine, see Config.RecoverPanics.
+func FanOut(pipelines ...HandlerWithContext) HandlerWithContext {
+	return &fanOutHandler{pipelines: pipelines}
+}
+
+type fanOutHandler struct {
+	pipelines []HandlerWithContext
+}
+
+func (h *fanOutHandler) HandleMessage(ctx context.Context, message *Message) error {
+	errs := make([]error, len(h.pipelines))
+	panics := make([]interface{}, len(h.pipelines))
+
+	var wg sync.WaitGroup
+	for i, pipeline := range h.pipelines {
+		wg.Add(1)
+		go func(i int, pipeline HandlerWithContext, message *Message) {
+			defer func() {
+				if p := recover(); p != nil {
+					panics[i] = p
+				}
+				wg.Done()
+			}()
+			errs[i] = pipeline.HandleMessage(ctx, message)
+		}(i, pipeline, message.Copy())
+	}
+	wg.Wait()
+
+	for _, p := range panics {
+		if p != nil {
+			panic(p)
+		}
+	}
+	for _, err := range errs {
+		if err != nil {
+			return ErrFanOut{Errors: errs}
+		}
+	}
+	return nil
+}
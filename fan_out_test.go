@@ -0,0 +1,77 @@
+package nsq
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+)
+
+func TestMessageCopy(t *testing.T) {
+	msg := NewMessage(MessageID{'a'}, []byte("body"))
+	msg.Attempts = 2
+	msg.Headers = Headers{"k": "v"}
+	d := &recordingMessageDelegate{}
+	msg.Delegate = d
+
+	c := msg.Copy()
+	c.Body[0] = 'B'
+	c.Headers.Set("k", "changed")
+	c.Finish()
+	c.Requeue(0)
+	if string(msg.Body) != "body" || msg.Headers.Get("k") != "v" {
+		t.Fatalf("copy should not share body or headers, got %q %v", msg.Body, msg.Headers)
+	}
+	if c.ID != msg.ID || c.Attempts != 2 || c.Timestamp != msg.Timestamp {
+		t.Fatalf("unexpected copy %+v", c)
+	}
+	if d.finished != 0 || d.requeued != 0 || msg.HasResponded() {
+		t.Fatalf("responding to the copy should not respond to the message")
+	}
+}
+
+func TestFanOut(t *testing.T) {
+	var mtx sync.Mutex
+	var bodies []string
+	record := HandlerWithContextFunc(func(ctx context.Context, m *Message) error {
+		mtx.Lock()
+		bodies = append(bodies, string(m.Body))
+		mtx.Unlock()
+		m.Body[0] = 'X'
+		m.Finish()
+		return nil
+	})
+	fail := HandlerWithContextFunc(func(ctx context.Context, m *Message) error {
+		return errors.New("boom")
+	})
+
+	msg := NewMessage(MessageID{}, []byte("body"))
+	msg.Delegate = &recordingMessageDelegate{}
+	if err := FanOut(record, record).HandleMessage(context.Background(), msg); err != nil {
+		t.Fatal(err)
+	}
+	if len(bodies) != 2 || bodies[0] != "body" || bodies[1] != "body" || string(msg.Body) != "body" {
+		t.Fatalf("each pipeline should receive its own copy, got %v %q", bodies, msg.Body)
+	}
+	if msg.HasResponded() {
+		t.Fatalf("pipelines should not respond to the message")
+	}
+
+	err := FanOut(record, fail).HandleMessage(context.Background(), msg)
+	ferr, ok := err.(ErrFanOut)
+	if !ok || len(ferr.Errors) != 2 || ferr.Errors[0] != nil || ferr.Errors[1] == nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if ferr.Error() != "1 of 2 fan-out pipelines failed - pipeline 1: boom" {
+		t.Fatalf("unexpected error message %q", ferr.Error())
+	}
+
+	defer func() {
+		if p := recover(); p != "pipeline panic" {
+			t.Fatalf("unexpected panic %v", p)
+		}
+	}()
+	FanOut(record, HandlerWithContextFunc(func(ctx context.Context, m *Message) error {
+		panic("pipeline panic")
+	})).HandleMessage(context.Background(), msg)
+}
@@ -0,0 +1,193 @@
+package nsq
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// IdempotencyStatus is the result of IdempotencyStore.SetIfAbsent
+type IdempotencyStatus int
+
+// IdempotencyStatus values
+const (
+	// the key was absent and is now held as pending, the message should be processed
+	IdempotencyAcquired IdempotencyStatus = iota
+	// the key is held as pending, the message is being processed elsewhere
+	IdempotencyPending
+	// the key is held as done, the message has already been processed
+	IdempotencyDone
+)
+
+func (s IdempotencyStatus) String() string {
+	switch s {
+	case IdempotencyAcquired:
+		return "acquired"
+	case IdempotencyPending:
+		return "pending"
+	case IdempotencyDone:
+		return "done"
+	}
+	return "unknown"
+}
+
+// IdempotencyStore records which messages are being, or have been, processed across
+// every Consumer sharing it, to build effectively-once processing on top of NSQ's
+// at-least-once delivery (see Consumer.SetIdempotencyStore)
+//
+// MemoryIdempotencyStore is provided for a single process, implementations backed by
+// a shared store (e.g. Redis SET NX PX, or a SQL table with a unique key) extend this
+// across processes.
+type IdempotencyStore interface {
+	// SetIfAbsent atomically sets key as pending for ttl when it is absent (returning
+	// IdempotencyAcquired), otherwise returns its current status
+	SetIfAbsent(ctx context.Context, key string, ttl time.Duration) (IdempotencyStatus, error)
+	// MarkDone sets key as done for ttl
+	MarkDone(ctx context.Context, key string, ttl time.Duration) error
+	// Release removes a pending key, after processing failed, so the message can be retried
+	Release(ctx context.Context, key string) error
+}
+
+// MemoryIdempotencyStore is an in-memory IdempotencyStore
+type MemoryIdempotencyStore struct {
+	mtx  sync.Mutex
+	keys map[string]idempotencyEntry
+
+	// the number of SetIfAbsent calls since expired keys were last pruned
+	ops int
+}
+
+type idempotencyEntry struct {
+	done    bool
+	expires time.Time
+}
+
+// NewMemoryIdempotencyStore returns an empty MemoryIdempotencyStore
+func NewMemoryIdempotencyStore() *MemoryIdempotencyStore {
+	return &MemoryIdempotencyStore{
+		keys: make(map[string]idempotencyEntry),
+	}
+}
+
+// SetIfAbsent implements the IdempotencyStore interface
+func (s *MemoryIdempotencyStore) SetIfAbsent(ctx context.Context, key string, ttl time.Duration) (IdempotencyStatus, error) {
+	now := time.Now()
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.ops++
+	if s.ops >= len(s.keys) {
+		// amortize pruning expired keys over at least as many calls as there are keys
+		s.ops = 0
+		for k, e := range s.keys {
+			if now.After(e.expires) {
+				delete(s.keys, k)
+			}
+		}
+	}
+
+	if e, ok := s.keys[key]; ok && !now.After(e.expires) {
+		if e.done {
+			return IdempotencyDone, nil
+		}
+		return IdempotencyPending, nil
+	}
+	s.keys[key] = idempotencyEntry{expires: now.Add(ttl)}
+	return IdempotencyAcquired, nil
+}
+
+// MarkDone implements the IdempotencyStore interface
+func (s *MemoryIdempotencyStore) MarkDone(ctx context.Context, key string, ttl time.Duration) error {
+	s.mtx.Lock()
+	s.keys[key] = idempotencyEntry{done: true, expires: time.Now().Add(ttl)}
+	s.mtx.Unlock()
+	return nil
+}
+
+// Release implements the IdempotencyStore interface
+func (s *MemoryIdempotencyStore) Release(ctx context.Context, key string) error {
+	s.mtx.Lock()
+	if e, ok := s.keys[key]; ok && !e.done {
+		delete(s.keys, key)
+	}
+	s.mtx.Unlock()
+	return nil
+}
+
+// SetIdempotencyStore enables effectively-once processing of messages by handlers.
+//
+// Before a message is passed to a handler, its key is set as pending in store (for
+// Config.IdempotencyPendingTTL):
+//
+//   - when already done, the message is FINished without being handled (counted in
+//     ConsumerStats.DedupHits)
+//   - when pending, i.e. being handled by another Consumer, the message is REQueued
+//     (without backoff)
+//
+// When the handler succeeds the key is marked as done (for Config.IdempotencyDoneTTL)
+// before the message is FINished, otherwise it is released. For messages whose
+// auto-response has been disabled, the result returned by the handler is used.
+//
+// keyFunc returns the key of a message, e.g. EnvelopeIdempotencyKey. When nil, or when
+// it returns an empty key, the message ID is used.
+//
+// This panics if called after connecting to NSQD or NSQ Lookupd
+func (r *Consumer) SetIdempotencyStore(store IdempotencyStore, keyFunc MessageKeyFunc) {
+	if atomic.LoadInt32(&r.connectedFlag) == 1 {
+		panic("already connected")
+	}
+	r.idempotencyStore = store
+	r.idempotencyKeyFunc = keyFunc
+}
+
+func (r *Consumer) idempotencyKey(message *Message) string {
+	if r.idempotencyKeyFunc != nil {
+		if key := r.idempotencyKeyFunc(message); key != "" {
+			return key
+		}
+	}
+	return string(message.ID[:])
+}
+
+// acquireMessage sets the key of message as pending, returning false (after responding
+// to the message) if it should not be handled
+func (r *Consumer) acquireMessage(key string, message *Message) bool {
+	status, err := r.idempotencyStore.SetIfAbsent(r.ctx, key, r.config.IdempotencyPendingTTL)
+	if err != nil {
+		r.log(LogLevelError, "failed to acquire idempotency key for msg %s - %s", message.ID, err)
+		r.reportError("idempotency", message.NSQDAddress, err)
+		message.RequeueWithoutBackoff(-1)
+		return false
+	}
+	switch status {
+	case IdempotencyDone:
+		atomic.AddUint64(&r.dedupHits, 1)
+		r.log(LogLevelDebug, "msg %s already processed, finishing", message.ID)
+		message.Finish()
+		return false
+	case IdempotencyPending:
+		r.log(LogLevelDebug, "msg %s is being processed elsewhere, requeueing", message.ID)
+		message.RequeueWithoutBackoff(-1)
+		return false
+	}
+	atomic.AddUint64(&r.dedupMisses, 1)
+	return true
+}
+
+// releaseMessage marks the key of message as done if it was handled successfully,
+// otherwise removes it
+func (r *Consumer) releaseMessage(key string, message *Message, success bool) {
+	// not r.ctx, which is cancelled on exit even if handlers are still running
+	ctx := context.Background()
+	var err error
+	if success {
+		err = r.idempotencyStore.MarkDone(ctx, key, r.config.IdempotencyDoneTTL)
+	} else {
+		err = r.idempotencyStore.Release(ctx, key)
+	}
+	if err != nil {
+		r.log(LogLevelError, "failed to update idempotency key for msg %s - %s", message.ID, err)
+		r.reportError("idempotency", message.NSQDAddress, err)
+	}
+}
@@ -0,0 +1,127 @@
+package nsq
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMemoryIdempotencyStore(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryIdempotencyStore()
+
+	for _, tc := range []struct {
+		key      string
+		expected IdempotencyStatus
+	}{
+		{"a", IdempotencyAcquired},
+		{"a", IdempotencyPending},
+		{"b", IdempotencyAcquired},
+	} {
+		status, err := s.SetIfAbsent(ctx, tc.key, time.Minute)
+		if err != nil || status != tc.expected {
+			t.Fatalf("SetIfAbsent(%s) = %s, %v (expected %s)", tc.key, status, err, tc.expected)
+		}
+	}
+
+	s.MarkDone(ctx, "a", time.Minute)
+	s.Release(ctx, "a")
+	if status, _ := s.SetIfAbsent(ctx, "a", time.Minute); status != IdempotencyDone {
+		t.Fatalf("a should be done, got %s", status)
+	}
+	s.Release(ctx, "b")
+	if status, _ := s.SetIfAbsent(ctx, "b", time.Minute); status != IdempotencyAcquired {
+		t.Fatalf("b should have been released, got %s", status)
+	}
+
+	s.SetIfAbsent(ctx, "c", 10*time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	if status, _ := s.SetIfAbsent(ctx, "c", time.Minute); status != IdempotencyAcquired {
+		t.Fatalf("c should have expired, got %s", status)
+	}
+}
+
+func TestConsumerIdempotencyStore(t *testing.T) {
+	msgIDNew := MessageID{'i', 'd', 'n', 'e', 'w', '6', '7', '8', '9', '0', 'a', 's', 'd', 'f', 'g', 'h'}
+	msgIDDone := MessageID{'i', 'd', 'd', 'o', 'n', 'e', '7', '8', '9', '0', 'a', 's', 'd', 'f', 'g', 'h'}
+	msgIDPending := MessageID{'i', 'd', 'p', 'e', 'n', 'd', '7', '8', '9', '0', 'a', 's', 'd', 'f', 'g', 'h'}
+	msgIDBad := MessageID{'i', 'd', 'b', 'a', 'd', '6', '7', '8', '9', '0', 'a', 's', 'd', 'f', 'g', 'h'}
+
+	script := []instruction{
+		// IDENTIFY
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		// SUB
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		instruction{20 * time.Millisecond, FrameTypeMessage, frameMessage(NewMessage(msgIDNew, []byte("new")))},
+		instruction{20 * time.Millisecond, FrameTypeMessage, frameMessage(NewMessage(msgIDDone, []byte("done")))},
+		instruction{20 * time.Millisecond, FrameTypeMessage, frameMessage(NewMessage(msgIDPending, []byte("pending")))},
+		instruction{20 * time.Millisecond, FrameTypeMessage, frameMessage(NewMessage(msgIDBad, []byte("bad")))},
+		// needed to exit test
+		instruction{100 * time.Millisecond, -1, []byte("exit")},
+	}
+
+	addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	n := newMockNSQD(t, script, addr.String())
+
+	ctx := context.Background()
+	store := NewMemoryIdempotencyStore()
+	store.MarkDone(ctx, string(msgIDDone[:]), time.Minute)
+	store.SetIfAbsent(ctx, string(msgIDPending[:]), time.Minute)
+
+	topicName := "test_idempotency" + strconv.Itoa(int(time.Now().Unix()))
+	config := NewConfig()
+	config.MaxInFlight = 4
+	q, _ := NewConsumer(topicName, "ch", config)
+	q.SetLogger(newTestLogger(t), LogLevelDebug)
+
+	var handled []string
+	q.AddHandler(HandlerFunc(func(m *Message) error {
+		handled = append(handled, string(m.Body))
+		if string(m.Body) == "bad" {
+			return errors.New("bad")
+		}
+		return nil
+	}))
+	q.SetIdempotencyStore(store, nil)
+	err := q.ConnectToNSQD(n.tcpAddr.String())
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	<-n.exitChan
+
+	var responses []string
+	for _, r := range n.got {
+		if bytes.HasPrefix(r, []byte("FIN")) || bytes.HasPrefix(r, []byte("REQ")) {
+			// drop the REQ delay
+			responses = append(responses, string(bytes.Join(bytes.Fields(r)[:2], []byte(" "))))
+		}
+	}
+	expected := []string{
+		"FIN " + string(msgIDNew[:]),
+		"FIN " + string(msgIDDone[:]),
+		"REQ " + string(msgIDPending[:]),
+		"REQ " + string(msgIDBad[:]),
+	}
+	if strings.Join(responses, ",") != strings.Join(expected, ",") {
+		t.Fatalf("responses %v != %v", responses, expected)
+	}
+	if strings.Join(handled, ",") != "new,bad" {
+		t.Fatalf("unexpected handled messages %v", handled)
+	}
+	if status, _ := store.SetIfAbsent(ctx, string(msgIDNew[:]), time.Minute); status != IdempotencyDone {
+		t.Fatalf("handled message should be done, got %s", status)
+	}
+	if status, _ := store.SetIfAbsent(ctx, string(msgIDBad[:]), time.Minute); status != IdempotencyAcquired {
+		t.Fatalf("failed message should have been released, got %s", status)
+	}
+
+	q.SetLogger(nullLogger, LogLevelInfo)
+	q.Stop()
+	<-q.StopChan
+}
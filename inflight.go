@@ -0,0 +1,164 @@
+package nsq
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+type inFlightMessage struct {
+	msg   *Message
+	bytes int64
+	timer *time.Timer
+}
+
+// InFlightMessages returns the messages received by this Consumer that are still in
+// flight, i.e. have been neither FINished nor REQueued (ordered by receipt)
+//
+// This is primarily useful for messages whose auto-response has been disabled, to
+// find those that are never responded to (see also Config.ExpiringMessageFraction).
+func (r *Consumer) InFlightMessages() []*Message {
+	r.inFlightMtx.Lock()
+	msgs := make([]*Message, 0, len(r.inFlight))
+	for _, m := range r.inFlight {
+		msgs = append(msgs, m.msg)
+	}
+	r.inFlightMtx.Unlock()
+
+	sort.Slice(msgs, func(i, j int) bool {
+		return msgs[i].receivedAt.Before(msgs[j].receivedAt)
+	})
+	return msgs
+}
+
+func (r *Consumer) numInFlight() int {
+	r.inFlightMtx.Lock()
+	defer r.inFlightMtx.Unlock()
+	return len(r.inFlight)
+}
+
+func (r *Consumer) trackInFlight(msg *Message) {
+	bytes := int64(len(msg.Body))
+	m := &inFlightMessage{msg: msg, bytes: bytes}
+	r.inFlightMtx.Lock()
+	if old, ok := r.inFlight[msg.ID]; ok {
+		// redelivered after timing out
+		bytes -= r.removeInFlight(old)
+	}
+	r.inFlight[msg.ID] = m
+	if r.config.ExpiringMessageFraction > 0 && msg.msgTimeout > 0 {
+		m.timer = time.AfterFunc(r.expiryTimeout(msg), func() {
+			r.checkExpiring(m)
+		})
+	}
+	r.inFlightMtx.Unlock()
+	r.addInFlightBytes(bytes)
+}
+
+func (r *Consumer) untrackInFlight(msg *Message) {
+	var bytes int64
+	r.inFlightMtx.Lock()
+	if m, ok := r.inFlight[msg.ID]; ok && m.msg == msg {
+		bytes = r.removeInFlight(m)
+	}
+	r.inFlightMtx.Unlock()
+	r.addInFlightBytes(-bytes)
+}
+
+func (r *Consumer) untrackConnInFlight(addr string) {
+	var bytes int64
+	r.inFlightMtx.Lock()
+	for _, m := range r.inFlight {
+		if m.msg.NSQDAddress == addr {
+			bytes += r.removeInFlight(m)
+		}
+	}
+	r.inFlightMtx.Unlock()
+	r.addInFlightBytes(-bytes)
+}
+
+// removeInFlight stops tracking m, returning its body size (which the caller must
+// subtract with addInFlightBytes, after releasing inFlightMtx)
+//
+// must be called with inFlightMtx held
+func (r *Consumer) removeInFlight(m *inFlightMessage) int64 {
+	if m.timer != nil {
+		m.timer.Stop()
+	}
+	delete(r.inFlight, m.msg.ID)
+	return m.bytes
+}
+
+// addInFlightBytes adjusts the summed body size of messages in flight, withholding
+// RDY from all connections while it is at or above Config.MaxInFlightBytes
+func (r *Consumer) addInFlightBytes(delta int64) {
+	if delta == 0 {
+		return
+	}
+	n := atomic.AddInt64(&r.inFlightBytes, delta)
+	limit := r.config.MaxInFlightBytes
+	if limit <= 0 {
+		return
+	}
+
+	if n >= limit && atomic.CompareAndSwapInt32(&r.throttledFlag, 0, 1) {
+		r.log(LogLevelWarning, "%d bytes in flight exceeds max_in_flight_bytes %d, setting all to RDY 0",
+			n, limit)
+		for _, c := range r.conns() {
+			r.updateRDY(c, 0)
+		}
+	} else if n < limit && atomic.CompareAndSwapInt32(&r.throttledFlag, 1, 0) {
+		r.log(LogLevelInfo, "%d bytes in flight below max_in_flight_bytes %d, resuming", n, limit)
+		if !r.IsPaused() {
+			r.restoreRDY()
+		}
+	}
+}
+
+func (r *Consumer) bytesThrottled() bool {
+	return atomic.LoadInt32(&r.throttledFlag) == 1
+}
+
+// expiryTimeout returns the duration until msg expires, measured from when it was
+// received or last touched
+func (r *Consumer) expiryTimeout(msg *Message) time.Duration {
+	msg.touchMtx.Lock()
+	last := msg.touchedAt
+	msg.touchMtx.Unlock()
+	if last.Before(msg.receivedAt) {
+		last = msg.receivedAt
+	}
+	d := time.Duration(r.config.ExpiringMessageFraction * float64(msg.msgTimeout))
+	return d - time.Since(last)
+}
+
+func (r *Consumer) checkExpiring(m *inFlightMessage) {
+	msg := m.msg
+	if msg.HasResponded() {
+		return
+	}
+
+	r.inFlightMtx.Lock()
+	if r.inFlight[msg.ID] != m {
+		r.inFlightMtx.Unlock()
+		return
+	}
+	if d := r.expiryTimeout(msg); d > 0 {
+		// touched since the timer was set
+		m.timer.Reset(d)
+		r.inFlightMtx.Unlock()
+		return
+	}
+	r.inFlightMtx.Unlock()
+
+	atomic.AddUint64(&r.messagesExpiring, 1)
+	r.emit(Event{Type: EventMessageExpiring, NSQDAddress: msg.NSQDAddress, Message: msg})
+	if r.config.RequeueExpiringMessages {
+		r.log(LogLevelWarning, "msg %s about to time out (received %s ago), requeueing",
+			msg.ID, time.Since(msg.receivedAt))
+		msg.RequeueWithoutBackoff(-1)
+		return
+	}
+	r.log(LogLevelWarning, "msg %s about to time out (received %s ago) without being touched or responded to",
+		msg.ID, time.Since(msg.receivedAt))
+}
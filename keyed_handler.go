@@ -0,0 +1,103 @@
+package nsq
+
+import (
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+)
+
+// MessageKeyFunc returns the ordering key of a message (see Consumer.AddKeyedHandlers)
+type MessageKeyFunc func(message *Message) string
+
+// EnvelopeKey is the default MessageKeyFunc, returning the HeaderKey header of
+// messages published in an envelope (see EncodeEnvelope)
+func EnvelopeKey(message *Message) string {
+	headers, _, ok := message.Envelope()
+	if !ok {
+		return ""
+	}
+	return headers[HeaderKey]
+}
+
+// AddKeyedHandlers sets the HandlerWithContext for messages received by this Consumer,
+// processing messages with the same key sequentially while messages with different keys
+// are processed concurrently.
+//
+// Each message is assigned to one of lanes goroutines by hashing the key returned by
+// keyFunc (EnvelopeKey when nil), so messages sharing a key are handled in the order
+// they were received. Messages without a key are assigned by ID.
+//
+// NOTE: ordering is only preserved among delivered messages; a REQueued message is
+// redelivered later, after messages with the same key that were received after it. A
+// message whose handler timed out (see Config.HandlerTimeout) is REQueued immediately,
+// but the next message of its lane waits for the handler to return.
+//
+// This can be called after connecting to NSQD or NSQ Lookupd, although ordering is then
+// only preserved among messages received by these lanes.
+func (r *Consumer) AddKeyedHandlers(handler HandlerWithContext, lanes int, keyFunc MessageKeyFunc) {
+	if lanes < 1 {
+		panic("lanes must be >= 1")
+	}
+	if keyFunc == nil {
+		keyFunc = EnvelopeKey
+	}
+
+	atomic.AddInt32(&r.runningHandlers, 1)
+	go r.keyedDispatchLoop(handler, lanes, keyFunc)
+}
+
+func (r *Consumer) keyedDispatchLoop(handler HandlerWithContext, lanes int, keyFunc MessageKeyFunc) {
+	r.log(LogLevelDebug, "starting keyed Handler (%d lanes)", lanes)
+
+	// buffer up to max-in-flight so that a busy lane doesn't block the others
+	size := int(r.getMaxInFlight())
+	if size < 1 {
+		size = 1
+	}
+
+	var wg sync.WaitGroup
+	laneChans := make([]chan *Message, lanes)
+	for i := range laneChans {
+		laneChans[i] = make(chan *Message, size)
+		wg.Add(1)
+		go func(lane chan *Message) {
+			r.keyedLaneLoop(handler, lane)
+			wg.Done()
+		}(laneChans[i])
+	}
+
+	for message := range r.incomingMessages {
+		key := keyFunc(message)
+		if key == "" {
+			key = string(message.ID[:])
+		}
+		h := fnv.New32a()
+		h.Write([]byte(key))
+		laneChans[h.Sum32()%uint32(lanes)] <- message
+	}
+
+	for _, lane := range laneChans {
+		close(lane)
+	}
+	wg.Wait()
+
+	r.log(LogLevelDebug, "stopping keyed Handler")
+	if atomic.AddInt32(&r.runningHandlers, -1) == 0 {
+		r.exit()
+	}
+}
+
+func (r *Consumer) keyedLaneLoop(handler HandlerWithContext, lane chan *Message) {
+	wrapped, version := r.wrapHandler(handler)
+	for message := range lane {
+		if atomic.LoadInt32(&r.middlewareVersion) != version {
+			wrapped, version = r.wrapHandler(handler)
+		}
+		r.handleMessage(handler, wrapped, message)
+		// a timed out handler (see Config.HandlerTimeout) is still running once its
+		// message has been requeued, the next message with the same key must wait for it
+		if message.handlerDone != nil {
+			<-message.handlerDone
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package nsq
+
+import (
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// ChannelDepth is the number of messages of a channel that are queued (Depth),
+// in-flight to a consumer (InFlight) and deferred (Deferred) on nsqd
+type ChannelDepth struct {
+	Depth    int64
+	InFlight int64
+	Deferred int64
+}
+
+// ConsumerLag is the depth of the channel being consumed, aggregated over all of
+// the connected nsqd (see Config.DepthMonitorInterval)
+type ConsumerLag struct {
+	ChannelDepth
+
+	// the depth on each nsqd, keyed by TCP address (nsqd whose /stats could not be
+	// retrieved are omitted)
+	Nodes map[string]ChannelDepth
+
+	// when the depth was last polled (the zero Time until the first poll)
+	Time time.Time
+}
+
+type lagThreshold struct {
+	depth    int64
+	cb       func(lag ConsumerLag, exceeded bool)
+	exceeded bool
+}
+
+// Lag returns the depth of the channel being consumed as of the last poll
+//
+// This requires Config.DepthMonitorInterval to be set.
+func (r *Consumer) Lag() ConsumerLag {
+	r.lagMtx.RLock()
+	defer r.lagMtx.RUnlock()
+	return r.lag
+}
+
+// OnLagThreshold registers a callback that is invoked (with exceeded true) when the
+// aggregate depth of the channel being consumed rises to or above depth, and (with
+// exceeded false) when it subsequently falls below it again
+//
+// This requires Config.DepthMonitorInterval to be set.
+func (r *Consumer) OnLagThreshold(depth int64, cb func(lag ConsumerLag, exceeded bool)) {
+	r.lagMtx.Lock()
+	r.lagThresholds = append(r.lagThresholds, &lagThreshold{depth: depth, cb: cb})
+	r.lagMtx.Unlock()
+}
+
+func (r *Consumer) depthMonitorLoop() {
+	ticker := time.NewTicker(r.config.DepthMonitorInterval)
+
+	for {
+		select {
+		case <-ticker.C:
+			r.updateLag()
+		case <-r.exitChan:
+			goto exit
+		}
+	}
+
+exit:
+	ticker.Stop()
+	r.log(LogLevelInfo, "depthMonitorLoop exiting")
+	r.wg.Done()
+}
+
+type statsResp struct {
+	Topics []struct {
+		TopicName string `json:"topic_name"`
+		Channels  []struct {
+			ChannelName   string `json:"channel_name"`
+			Depth         int64  `json:"depth"`
+			InFlightCount int64  `json:"in_flight_count"`
+			DeferredCount int64  `json:"deferred_count"`
+		} `json:"channels"`
+	} `json:"topics"`
+}
+
+// poll the /stats endpoint of every connected nsqd, updating Lag and invoking
+// threshold callbacks as needed
+func (r *Consumer) updateLag() {
+	lag := ConsumerLag{
+		Nodes: make(map[string]ChannelDepth),
+		Time:  time.Now(),
+	}
+
+	conns := r.conns()
+	sort.Slice(conns, func(i, j int) bool { return conns[i].String() < conns[j].String() })
+	for _, c := range conns {
+		addr := c.String()
+		_, isUnix := unixSocketPath(addr)
+		_, isWebSocket := webSocketURL(addr)
+		if isUnix || isWebSocket {
+			// the HTTP address of an nsqd behind a unix socket or WebSocket is unknown
+			continue
+		}
+		endpoint := r.statsEndpoint(addr)
+		var data statsResp
+		err := apiRequestNegotiateV1(r.config.dialHTTPClient(), nil, "GET", endpoint, nil, &data)
+		if err != nil {
+			r.log(LogLevelError, "(%s) error querying nsqd stats (%s) - %s", addr, endpoint, err)
+			r.reportError("stats", addr, err)
+			continue
+		}
+
+		var depth ChannelDepth
+		for _, topic := range data.Topics {
+			if topic.TopicName != r.topic {
+				continue
+			}
+			for _, channel := range topic.Channels {
+				if channel.ChannelName != r.channel {
+					continue
+				}
+				depth.Depth += channel.Depth
+				depth.InFlight += channel.InFlightCount
+				depth.Deferred += channel.DeferredCount
+			}
+		}
+		atomic.StoreInt64(&c.channelDepth, depth.Depth)
+		lag.Nodes[addr] = depth
+		lag.Depth += depth.Depth
+		lag.InFlight += depth.InFlight
+		lag.Deferred += depth.Deferred
+	}
+
+	type trigger struct {
+		cb       func(lag ConsumerLag, exceeded bool)
+		exceeded bool
+	}
+	var triggers []trigger
+
+	r.lagMtx.Lock()
+	r.lag = lag
+	for _, t := range r.lagThresholds {
+		exceeded := lag.Depth >= t.depth
+		if exceeded != t.exceeded {
+			t.exceeded = exceeded
+			triggers = append(triggers, trigger{t.cb, exceeded})
+		}
+	}
+	r.lagMtx.Unlock()
+
+	for _, t := range triggers {
+		t.cb(lag, t.exceeded)
+	}
+}
+
+// the /stats endpoint of the nsqd at TCP address addr
+func (r *Consumer) statsEndpoint(addr string) string {
+	r.mtx.RLock()
+	httpAddr, ok := r.nsqdHTTPAddrs[addr]
+	r.mtx.RUnlock()
+	if !ok {
+		httpAddr = addr
+		host, port, err := net.SplitHostPort(addr)
+		if n, perr := strconv.Atoi(port); err == nil && perr == nil {
+			httpAddr = net.JoinHostPort(host, strconv.Itoa(n+1))
+		}
+	}
+
+	v := url.Values{}
+	v.Set("format", "json")
+	v.Set("topic", r.topic)
+	v.Set("channel", r.channel)
+	return "http://" + httpAddr + "/stats?" + v.Encode()
+}
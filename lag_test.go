@@ -0,0 +1,70 @@
+package nsq
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConsumerLag(t *testing.T) {
+	var depth int64 = 50
+	stats := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("X-NSQ-Content-Type", "nsq; version=1.0")
+		topic := req.URL.Query().Get("topic")
+		fmt.Fprintf(w, `{"topics":[{"topic_name":%q,"channels":[`+
+			`{"channel_name":"ch","depth":%d,"in_flight_count":2,"deferred_count":1},`+
+			`{"channel_name":"other","depth":1000}]}]}`, topic, depth)
+	}))
+	defer stats.Close()
+
+	script := []instruction{
+		// IDENTIFY
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		// SUB
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		// needed to exit test
+		instruction{100 * time.Millisecond, -1, []byte("exit")},
+	}
+	addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	n := newMockNSQD(t, script, addr.String())
+
+	topicName := "test_lag" + strconv.Itoa(int(time.Now().Unix()))
+	q, _ := NewConsumer(topicName, "ch", NewConfig())
+	q.SetLogger(nullLogger, LogLevelInfo)
+	q.AddHandler(&testHandler{})
+	q.nsqdHTTPAddrs[n.tcpAddr.String()] = strings.TrimPrefix(stats.URL, "http://")
+
+	var events []bool
+	q.OnLagThreshold(100, func(lag ConsumerLag, exceeded bool) {
+		events = append(events, exceeded)
+	})
+
+	err := q.ConnectToNSQD(n.tcpAddr.String())
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	q.updateLag()
+	lag := q.Lag()
+	if lag.Depth != 50 || lag.InFlight != 2 || lag.Deferred != 1 || len(lag.Nodes) != 1 {
+		t.Fatalf("unexpected lag %+v", lag)
+	}
+
+	depth = 150
+	q.updateLag()
+	q.updateLag()
+	depth = 10
+	q.updateLag()
+	if fmt.Sprint(events) != "[true false]" {
+		t.Fatalf("unexpected threshold events %v", events)
+	}
+
+	<-n.exitChan
+	q.Stop()
+	<-q.StopChan
+}
@@ -0,0 +1,70 @@
+package nsq
+
+import "sort"
+
+// DiscoveryPreference is an interface accepted by `SetBehaviorDelegate()` for preferring
+// some discovered nsqds over others, e.g. those on the same host or in the same
+// availability zone as the Consumer
+//
+// Preference returns the tier of the nsqd at addr, lower tiers being preferred. Of the
+// nsqds discovered via nsqlookupd (or a Discoverer), the Consumer connects only to those
+// of the most preferred tier it can connect to, falling back to the next tier when none
+// of them are discovered or reachable. Connections to less preferred tiers are closed
+// once a more preferred tier is connected again.
+type DiscoveryPreference interface {
+	Preference(addr string) int
+}
+
+// preferenceTiers groups addrs by preference, most preferred first (keeping the order
+// of addrs within each tier)
+func preferenceTiers(preference DiscoveryPreference, addrs []string) [][]string {
+	byTier := make(map[int][]string)
+	var tiers []int
+	for _, addr := range addrs {
+		tier := preference.Preference(addr)
+		if _, ok := byTier[tier]; !ok {
+			tiers = append(tiers, tier)
+		}
+		byTier[tier] = append(byTier[tier], addr)
+	}
+	sort.Ints(tiers)
+
+	grouped := make([][]string, 0, len(tiers))
+	for _, tier := range tiers {
+		grouped = append(grouped, byTier[tier])
+	}
+	return grouped
+}
+
+// connectToPreferred connects to the most preferred tier of nsqdAddrs it can connect to,
+// closing connections to less preferred tiers
+func (r *Consumer) connectToPreferred(preference DiscoveryPreference, nsqdAddrs []string) {
+	tiers := preferenceTiers(preference, nsqdAddrs)
+	for i, tier := range tiers {
+		if r.connectToNSQDs(tier) == 0 {
+			if i < len(tiers)-1 {
+				r.log(LogLevelWarning, "no preferred nsqd reachable (%v), falling back", tier)
+			}
+			continue
+		}
+		for _, addrs := range tiers[i+1:] {
+			for _, addr := range addrs {
+				r.closeDiscovered(addr)
+			}
+		}
+		return
+	}
+}
+
+// closeDiscovered closes the connection to the discovered nsqd at addr (if any)
+func (r *Consumer) closeDiscovered(addr string) {
+	r.mtx.RLock()
+	conn, ok := r.connections[addr]
+	direct := indexOf(addr, r.nsqdTCPAddrs) >= 0
+	r.mtx.RUnlock()
+	if !ok || direct {
+		return
+	}
+	r.log(LogLevelInfo, "(%s) closing connection to less preferred nsqd", addr)
+	conn.Close()
+}
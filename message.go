@@ -2,14 +2,16 @@ package nsq
 
 import (
 	"encoding/binary"
-	"errors"
 	"io"
+	"sync"
 	"sync/atomic"
 	"time"
+
+	"github.com/nsqio/go-nsq/protocol"
 )
 
 // The number of bytes for a Message.ID
-const MsgIDLength = 16
+const MsgIDLength = protocol.MsgIDLength
 
 // MessageID is the ASCII encoded hexadecimal message ID
 type MessageID [MsgIDLength]byte
@@ -24,10 +26,51 @@ type Message struct {
 
 	NSQDAddress string
 
+	// the headers of the envelope of a received message, when decoded (see
+	// Config.DecodeEnvelopes and Envelope)
+	Headers Headers
+
 	Delegate MessageDelegate
 
 	autoResponseDisabled int32
 	responded            int32
+
+	// local receipt time and the negotiated msg_timeout of the connection
+	// this message was received on
+	receivedAt time.Time
+	msgTimeout time.Duration
+	connID     int64
+
+	touchMtx  sync.Mutex
+	touchHook func()
+	touchedAt time.Time
+
+	// called once the message is responded to (see Context)
+	respondedHooks []func()
+
+	// extracts the values of the headers in Context (see Config.Propagator)
+	propagator Propagator
+	// decodes bodies without content type in Decode (see Config.Codec)
+	codec Codec
+
+	// the time taken by the handler, in nanoseconds (see DeliveryRecord)
+	handlerLatency int64
+
+	// the pooled buffer Body aliases in zero-copy mode (see Config.ZeroCopy)
+	frameBuf *[]byte
+	released int32
+	// set once the handler has returned, or was abandoned after Config.HandlerTimeout,
+	// in which case it releases the message when it eventually returns, closing
+	// handlerDone
+	handlerState int32
+	handlerDone  chan struct{}
+
+	// the body streamed from the connection (see Config.StreamBodyThreshold)
+	stream *bodyStream
+
+	// the envelope headers of a message delivered via a retry topic, whose original
+	// body was not an envelope (see Config.RetryTiers)
+	retryHeaders Headers
 }
 
 // NewMessage creates a Message, initializes some metadata,
@@ -40,6 +83,63 @@ func NewMessage(id MessageID, body []byte) *Message {
 	}
 }
 
+// Copy returns an independent copy of the message, with its own Body (and Headers),
+// detached from the connection it was received on: responding to (or touching) the
+// copy has no effect on the message, which must still be responded to itself.
+//
+// The copy keeps the receipt metadata of the message (see Deadline) and outlives its
+// Release.
+func (m *Message) Copy() *Message {
+	c := &Message{
+		ID:          m.ID,
+		Body:        append([]byte(nil), m.Body...),
+		Timestamp:   m.Timestamp,
+		Attempts:    m.Attempts,
+		NSQDAddress: m.NSQDAddress,
+		Delegate:    detachedMessageDelegate{},
+
+		receivedAt: m.receivedAt,
+		msgTimeout: m.msgTimeout,
+		connID:     m.connID,
+		propagator: m.propagator,
+		codec:      m.codec,
+	}
+	if m.Headers != nil {
+		c.Headers = m.Headers.clone()
+	}
+	if m.retryHeaders != nil {
+		c.retryHeaders = m.retryHeaders.clone()
+	}
+	m.touchMtx.Lock()
+	c.touchedAt = m.touchedAt
+	m.touchMtx.Unlock()
+	return c
+}
+
+// Envelope returns the headers and the enclosed body of the envelope of the message (see
+// EncodeEnvelope), whether decoded on receipt (see Config.DecodeEnvelopes) or not
+//
+// When the message has no envelope ok is false and body is Body. The returned headers
+// may be those of the message, and must be copied before being modified.
+func (m *Message) Envelope() (headers Headers, body []byte, ok bool) {
+	if m.Headers != nil {
+		return m.Headers, m.Body, true
+	}
+	return DecodeEnvelope(m.Body)
+}
+
+// Release returns the buffer backing Body to a pool when the message was received in
+// zero-copy mode (see Config.ZeroCopy), after which Body must not be used.
+//
+// It is a no-op otherwise, or when called more than once.
+func (m *Message) Release() {
+	if m.frameBuf == nil || !atomic.CompareAndSwapInt32(&m.released, 0, 1) {
+		return
+	}
+	m.Body = nil
+	putFrameBuffer(m.frameBuf)
+}
+
 // DisableAutoResponse disables the automatic response that
 // would normally be sent when a handler.HandleMessage
 // returns (FIN/REQ based on the error value returned).
@@ -50,6 +150,11 @@ func (m *Message) DisableAutoResponse() {
 	atomic.StoreInt32(&m.autoResponseDisabled, 1)
 }
 
+const (
+	handlerReturned int32 = iota + 1
+	handlerAbandoned
+)
+
 // IsAutoResponseDisabled indicates whether or not this message
 // will be responded to automatically
 func (m *Message) IsAutoResponseDisabled() bool {
@@ -61,6 +166,80 @@ func (m *Message) HasResponded() bool {
 	return atomic.LoadInt32(&m.responded) == 1
 }
 
+// IsLastAttempt indicates whether this is the last attempt to handle the message before
+// a Consumer with cfg gives up on it (see Config.MaxAttempts), e.g. to alert, or to handle
+// the failure itself rather than return an error
+func (m *Message) IsLastAttempt(cfg *Config) bool {
+	return cfg.MaxAttempts > 0 && m.Attempts >= cfg.MaxAttempts
+}
+
+// RemainingAttempts returns the number of attempts left after this one before a Consumer
+// with cfg gives up on the message (see Config.MaxAttempts), or -1 when unlimited
+func (m *Message) RemainingAttempts(cfg *Config) int {
+	if cfg.MaxAttempts == 0 {
+		return -1
+	}
+	if m.Attempts >= cfg.MaxAttempts {
+		return 0
+	}
+	return int(cfg.MaxAttempts - m.Attempts)
+}
+
+// PublishedAt returns the time at which the message was published, per the clock of nsqd
+// (see Timestamp)
+func (m *Message) PublishedAt() time.Time {
+	return time.Unix(0, m.Timestamp)
+}
+
+// Age returns the time elapsed since the message was published (see PublishedAt), which
+// includes any clock skew between nsqd and this process
+func (m *Message) Age() time.Duration {
+	return time.Since(m.PublishedAt())
+}
+
+// ConnectionID returns the identifier of the connection this message was received on
+// (see Conn.ID), or 0 when it was not received from nsqd
+func (m *Message) ConnectionID() int64 {
+	return m.connID
+}
+
+// ReceivedAt returns the local time at which this message was received, or the zero
+// time when it was not received from nsqd
+func (m *Message) ReceivedAt() time.Time {
+	return m.receivedAt
+}
+
+// MsgTimeout returns the msg_timeout negotiated with the nsqd this message was
+// received from, after which nsqd requeues it unless it is responded to or touched
+func (m *Message) MsgTimeout() time.Duration {
+	return m.msgTimeout
+}
+
+// Deadline returns the time at which nsqd times this message out, measured from when
+// it was received or last touched, and false when unknown (see MsgTimeout)
+func (m *Message) Deadline() (time.Time, bool) {
+	if m.msgTimeout <= 0 || m.receivedAt.IsZero() {
+		return time.Time{}, false
+	}
+	m.touchMtx.Lock()
+	last := m.touchedAt
+	m.touchMtx.Unlock()
+	if last.Before(m.receivedAt) {
+		last = m.receivedAt
+	}
+	return last.Add(m.msgTimeout), true
+}
+
+// TimeRemaining returns the time left until nsqd times this message out (negative
+// once it has), and false when unknown (see Deadline)
+func (m *Message) TimeRemaining() (time.Duration, bool) {
+	deadline, ok := m.Deadline()
+	if !ok {
+		return 0, false
+	}
+	return time.Until(deadline), true
+}
+
 // Finish sends a FIN command to the nsqd which
 // sent this message
 func (m *Message) Finish() {
@@ -68,6 +247,7 @@ func (m *Message) Finish() {
 		return
 	}
 	m.Delegate.OnFinish(m)
+	m.runRespondedHooks()
 }
 
 // Touch sends a TOUCH command to the nsqd which
@@ -77,6 +257,20 @@ func (m *Message) Touch() {
 		return
 	}
 	m.Delegate.OnTouch(m)
+
+	m.touchMtx.Lock()
+	hook := m.touchHook
+	m.touchedAt = time.Now()
+	m.touchMtx.Unlock()
+	if hook != nil {
+		hook()
+	}
+}
+
+func (m *Message) setTouchHook(hook func()) {
+	m.touchMtx.Lock()
+	m.touchHook = hook
+	m.touchMtx.Unlock()
 }
 
 // Requeue sends a REQ command to the nsqd which
@@ -98,11 +292,59 @@ func (m *Message) RequeueWithoutBackoff(delay time.Duration) {
 	m.doRequeue(delay, false)
 }
 
+// RequeueWithBackoff sends a REQ command to the nsqd which sent this message, with
+// a delay calculated by strategy from the number of attempts of the message and the
+// configured default_requeue_delay and max_requeue_delay (a shared
+// EqualJitterRequeueStrategy when nil), e.g.
+//
+//	if err := process(m.Body); isTransient(err) {
+//		m.RequeueWithBackoff(nil)
+//		return nil
+//	}
+//
+// The delay is bounded by max_requeue_delay and the default max requeue timeout of
+// nsqd (1h), which would otherwise reject the REQ. Like Requeue, this triggers a
+// backoff event on the configured Delegate.
+func (m *Message) RequeueWithBackoff(strategy RequeueDelayStrategy) {
+	if strategy == nil {
+		strategy = defaultRequeueBackoff
+	}
+	defaultDelay, maxDelay := m.requeueDelays()
+	delay := strategy.RequeueDelay(m.Attempts, defaultDelay, maxDelay)
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+	if delay > maxRequeueTimeout {
+		delay = maxRequeueTimeout
+	}
+	if delay < 0 {
+		delay = 0
+	}
+	m.doRequeue(delay, true)
+}
+
+// the default --max-req-timeout of nsqd
+const maxRequeueTimeout = time.Hour
+
+var defaultRequeueBackoff RequeueDelayStrategy = &EqualJitterRequeueStrategy{}
+
+// requeueDelays returns the default and maximum requeue delays of the connection this
+// message was received on (or the defaults of Config)
+func (m *Message) requeueDelays() (time.Duration, time.Duration) {
+	if d, ok := m.Delegate.(interface {
+		requeueDelays() (time.Duration, time.Duration)
+	}); ok {
+		return d.requeueDelays()
+	}
+	return 90 * time.Second, 15 * time.Minute
+}
+
 func (m *Message) doRequeue(delay time.Duration, backoff bool) {
 	if !atomic.CompareAndSwapInt32(&m.responded, 0, 1) {
 		return
 	}
 	m.Delegate.OnRequeue(m, delay, backoff)
+	m.runRespondedHooks()
 }
 
 // WriteTo implements the WriterTo interface and serializes
@@ -149,16 +391,14 @@ func (m *Message) WriteTo(w io.Writer) (int64, error) {
 //                          2-byte
 //                         attempts
 func DecodeMessage(b []byte) (*Message, error) {
-	var msg Message
-
-	if len(b) < 10+MsgIDLength {
-		return nil, errors.New("not enough data to decode valid message")
+	m, err := protocol.DecodeMessage(b)
+	if err != nil {
+		return nil, err
 	}
-
-	msg.Timestamp = int64(binary.BigEndian.Uint64(b[:8]))
-	msg.Attempts = binary.BigEndian.Uint16(b[8:10])
-	copy(msg.ID[:], b[10:10+MsgIDLength])
-	msg.Body = b[10+MsgIDLength:]
-
-	return &msg, nil
+	return &Message{
+		ID:        MessageID(m.ID),
+		Body:      m.Body,
+		Timestamp: m.Timestamp,
+		Attempts:  m.Attempts,
+	}, nil
 }
@@ -0,0 +1,112 @@
+package nsq
+
+import "context"
+
+// Header keys of the propagation headers extracted by Message.Context
+const (
+	// W3C trace context and baggage (https://www.w3.org/TR/trace-context/)
+	HeaderTraceParent = "traceparent"
+	HeaderTraceState  = "tracestate"
+	HeaderBaggage     = "baggage"
+	// the time by which the producer expects the message to be handled (see
+	// Headers.SetTime), applied as the deadline of the context
+	HeaderDeadline = "nsq-deadline"
+)
+
+// Propagator extracts the values carried in the headers of a message, e.g. the trace
+// context of the producing request, into a context (see Message.Context and
+// Config.Propagator)
+type Propagator interface {
+	Extract(ctx context.Context, headers Headers) context.Context
+}
+
+// PropagatorFunc is an adapter to allow the use of ordinary functions as a Propagator
+type PropagatorFunc func(ctx context.Context, headers Headers) context.Context
+
+// Extract implements Propagator
+func (f PropagatorFunc) Extract(ctx context.Context, headers Headers) context.Context {
+	return f(ctx, headers)
+}
+
+// TraceHeaders are the W3C trace context and baggage headers of a message
+type TraceHeaders struct {
+	TraceParent string
+	TraceState  string
+	Baggage     string
+}
+
+type traceHeadersKey struct{}
+
+// TraceHeadersFromContext returns the TraceHeaders extracted by HeaderPropagator
+func TraceHeadersFromContext(ctx context.Context) (TraceHeaders, bool) {
+	h, ok := ctx.Value(traceHeadersKey{}).(TraceHeaders)
+	return h, ok
+}
+
+// HeaderPropagator is the default Propagator, adding the W3C trace context and baggage
+// headers of a message to the context as is (see TraceHeadersFromContext), for tracing
+// libraries to parse
+type HeaderPropagator struct{}
+
+// Extract implements Propagator
+func (HeaderPropagator) Extract(ctx context.Context, headers Headers) context.Context {
+	h := TraceHeaders{
+		TraceParent: headers[HeaderTraceParent],
+		TraceState:  headers[HeaderTraceState],
+		Baggage:     headers[HeaderBaggage],
+	}
+	if h == (TraceHeaders{}) {
+		return ctx
+	}
+	return context.WithValue(ctx, traceHeadersKey{}, h)
+}
+
+// Context returns base with the values extracted from the headers of the envelope of
+// the message (see Envelope) by Config.Propagator (HeaderPropagator by default), e.g.
+//
+//	func (h *handler) HandleMessage(ctx context.Context, m *nsq.Message) error {
+//		ctx = m.Context(ctx)
+//		...
+//
+// When the message carries a HeaderDeadline the context has that deadline (or that of
+// base, when earlier), and is cancelled once the message is responded to.
+func (m *Message) Context(base context.Context) context.Context {
+	headers, _, ok := m.Envelope()
+	if !ok {
+		return base
+	}
+	var p Propagator = HeaderPropagator{}
+	if m.propagator != nil {
+		p = m.propagator
+	}
+	ctx := p.Extract(base, headers)
+
+	if deadline, ok := headers.GetTime(HeaderDeadline); ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		m.onResponded(cancel)
+	}
+	return ctx
+}
+
+// onResponded calls f once the message is responded to (immediately, if it already was)
+func (m *Message) onResponded(f func()) {
+	m.touchMtx.Lock()
+	if !m.HasResponded() {
+		m.respondedHooks = append(m.respondedHooks, f)
+		m.touchMtx.Unlock()
+		return
+	}
+	m.touchMtx.Unlock()
+	f()
+}
+
+func (m *Message) runRespondedHooks() {
+	m.touchMtx.Lock()
+	hooks := m.respondedHooks
+	m.respondedHooks = nil
+	m.touchMtx.Unlock()
+	for _, f := range hooks {
+		f()
+	}
+}
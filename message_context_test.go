@@ -0,0 +1,63 @@
+package nsq
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+type requestIDKey struct{}
+
+func TestMessageContext(t *testing.T) {
+	base := context.Background()
+
+	// no envelope
+	msg := NewMessage(MessageID{}, []byte("body"))
+	if ctx := msg.Context(base); ctx != base {
+		t.Fatalf("context of a message without envelope should be the base context")
+	}
+
+	// default propagator
+	deadline := time.Now().Add(time.Hour)
+	headers := Headers{
+		HeaderTraceParent: "00-0102030000000000000000000000000-0405000000000000-01",
+		HeaderBaggage:     "tenant=acme",
+	}
+	headers.SetTime(HeaderDeadline, deadline)
+	msg = NewMessage(MessageID{}, EncodeEnvelope(headers, []byte("body")))
+	msg.Delegate = &recordingMessageDelegate{}
+	ctx := msg.Context(base)
+	th, ok := TraceHeadersFromContext(ctx)
+	if !ok || th.TraceParent != headers[HeaderTraceParent] || th.Baggage != "tenant=acme" || th.TraceState != "" {
+		t.Fatalf("unexpected trace headers %+v (%v)", th, ok)
+	}
+	if d, ok := ctx.Deadline(); !ok || !d.Equal(deadline) {
+		t.Fatalf("context deadline %s (%v) != %s", d, ok, deadline)
+	}
+	if ctx.Err() != nil {
+		t.Fatalf("context should not be done before the message is responded to")
+	}
+	msg.Finish()
+	if ctx.Err() != context.Canceled {
+		t.Fatalf("context should be cancelled once the message is responded to - %v", ctx.Err())
+	}
+	if ctx := msg.Context(base); ctx.Err() != context.Canceled {
+		t.Fatalf("context of a responded message should be cancelled - %v", ctx.Err())
+	}
+
+	// custom propagator
+	msg = NewMessage(MessageID{}, EncodeEnvelope(Headers{"x-request-id": "r1"}, []byte("body")))
+	msg.propagator = PropagatorFunc(func(ctx context.Context, headers Headers) context.Context {
+		return context.WithValue(ctx, requestIDKey{}, headers["x-request-id"])
+	})
+	ctx = msg.Context(base)
+	if id := ctx.Value(requestIDKey{}); id != "r1" {
+		t.Fatalf("request ID %v != r1", id)
+	}
+	if _, ok := TraceHeadersFromContext(ctx); ok {
+		t.Fatalf("custom propagator should replace the default one")
+	}
+	if _, ok := ctx.Deadline(); ok {
+		t.Fatalf("context should have no deadline")
+	}
+}
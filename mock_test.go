@@ -3,12 +3,20 @@ package nsq
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
+	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -116,7 +124,7 @@ func (n *mockNSQD) handle(conn net.Conn) {
 			n.got = append(n.got, line)
 			params := bytes.Split(line, []byte(" "))
 			switch {
-			case bytes.Equal(params[0], []byte("IDENTIFY")):
+			case bytes.Equal(params[0], []byte("IDENTIFY")), bytes.Equal(params[0], []byte("AUTH")):
 				l := make([]byte, 4)
 				_, err := io.ReadFull(rdr, l)
 				if err != nil {
@@ -131,6 +139,9 @@ func (n *mockNSQD) handle(conn net.Conn) {
 					goto exit
 				}
 				n.t.Logf("%s", b)
+				if bytes.Equal(params[0], []byte("AUTH")) {
+					n.got = append(n.got, b)
+				}
 			case bytes.Equal(params[0], []byte("RDY")):
 				rdy, _ := strconv.Atoi(string(params[1]))
 				rdyCount = rdy
@@ -467,6 +478,11 @@ func TestConsumerBackoffDisconnect(t *testing.T) {
 			t.Fatalf("cmd %d bad %s != %s", i, r, expected[i])
 		}
 	}
+
+	// stop reconnect attempts from logging after the test completes
+	q.SetLogger(nullLogger, LogLevelInfo)
+	q.Stop()
+	<-q.StopChan
 }
 
 func TestConsumerPause(t *testing.T) {
@@ -538,3 +554,2256 @@ done:
 		}
 	}
 }
+
+func TestConsumerPauseResume(t *testing.T) {
+	msgIDGood := MessageID{'1', '2', '3', '4', '5', '6', '7', '8', '9', '0', 'a', 's', 'd', 'f', 'g', 'h'}
+
+	msgGood := NewMessage(msgIDGood, []byte("good"))
+
+	script := []instruction{
+		// IDENTIFY
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		// SUB
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		instruction{20 * time.Millisecond, FrameTypeMessage, frameMessage(msgGood)},
+		// needed to exit test
+		instruction{200 * time.Millisecond, -1, []byte("exit")},
+	}
+
+	addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	n := newMockNSQD(t, script, addr.String())
+
+	topicName := "test_pause_resume" + strconv.Itoa(int(time.Now().Unix()))
+	config := NewConfig()
+	config.MaxInFlight = 5
+	q, _ := NewConsumer(topicName, "ch", config)
+	q.SetLogger(newTestLogger(t), LogLevelDebug)
+	q.AddHandler(&testHandler{})
+	err := q.ConnectToNSQD(n.tcpAddr.String())
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	timeoutCh := time.After(500 * time.Millisecond)
+	pauseCh := time.After(50 * time.Millisecond)
+	unpauseCh := time.After(75 * time.Millisecond)
+	for {
+		select {
+		case <-n.exitChan:
+			t.Log("clean exit")
+			goto done
+		case <-timeoutCh:
+			t.Log("timeout")
+			goto done
+		case <-pauseCh:
+			q.Pause()
+			if !q.IsPaused() {
+				t.Fatal("consumer should be paused")
+			}
+			// a no-op while paused
+			q.ChangeMaxInFlight(config.MaxInFlight + 1)
+		case <-unpauseCh:
+			q.Resume()
+		}
+	}
+done:
+
+	for i, r := range n.got {
+		t.Logf("%d: %s", i, r)
+	}
+
+	expected := []string{
+		"IDENTIFY",
+		"SUB " + topicName + " ch",
+		"RDY 5",
+		fmt.Sprintf("FIN %s", msgIDGood),
+		"RDY 0",
+		"RDY 6",
+	}
+	if len(n.got) != len(expected) {
+		t.Fatalf("we got %d commands != %d expected", len(n.got), len(expected))
+	}
+	for i, r := range n.got {
+		if string(r) != expected[i] {
+			t.Fatalf("cmd %d bad %s != %s", i, r, expected[i])
+		}
+	}
+}
+
+func TestConsumerHandlerWithContext(t *testing.T) {
+	msgID := MessageID{'c', 't', 'x', '4', '5', '6', '7', '8', '9', '0', 'a', 's', 'd', 'f', 'g', 'h'}
+	msg := NewMessage(msgID, []byte("slow"))
+
+	script := []instruction{
+		// IDENTIFY
+		instruction{0, FrameTypeResponse, []byte(`{"max_rdy_count":2500,"msg_timeout":50}`)},
+		// SUB
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		instruction{20 * time.Millisecond, FrameTypeMessage, frameMessage(msg)},
+		// needed to exit test
+		instruction{200 * time.Millisecond, -1, []byte("exit")},
+	}
+
+	addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	n := newMockNSQD(t, script, addr.String())
+
+	topicName := "test_context" + strconv.Itoa(int(time.Now().Unix()))
+	config := NewConfig()
+	config.MaxInFlight = 1
+	q, _ := NewConsumer(topicName, "ch", config)
+	q.SetLogger(newTestLogger(t), LogLevelDebug)
+
+	errChan := make(chan error, 1)
+	q.AddHandlerWithContext(HandlerWithContextFunc(func(ctx context.Context, m *Message) error {
+		select {
+		case <-ctx.Done():
+			errChan <- ctx.Err()
+		case <-time.After(time.Second):
+			errChan <- nil
+		}
+		return nil
+	}))
+	err := q.ConnectToNSQD(n.tcpAddr.String())
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	select {
+	case err := <-errChan:
+		if err != context.Canceled {
+			t.Fatalf("handler context should be cancelled after msg_timeout, got %v", err)
+		}
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("timeout waiting for handler")
+	}
+
+	<-n.exitChan
+	q.SetLogger(nullLogger, LogLevelInfo)
+	q.Stop()
+	<-q.StopChan
+}
+
+func TestConsumerBatchHandler(t *testing.T) {
+	msgIDs := []MessageID{
+		MessageID{'b', 'a', 't', 'c', 'h', '1', '7', '8', '9', '0', 'a', 's', 'd', 'f', 'g', 'h'},
+		MessageID{'b', 'a', 't', 'c', 'h', '2', '7', '8', '9', '0', 'a', 's', 'd', 'f', 'g', 'h'},
+		MessageID{'b', 'a', 't', 'c', 'h', '3', '7', '8', '9', '0', 'a', 's', 'd', 'f', 'g', 'h'},
+	}
+
+	script := []instruction{
+		// IDENTIFY
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		// SUB
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		instruction{20 * time.Millisecond, FrameTypeMessage, frameMessage(NewMessage(msgIDs[0], []byte("good")))},
+		instruction{5 * time.Millisecond, FrameTypeMessage, frameMessage(NewMessage(msgIDs[1], []byte("bad")))},
+		instruction{5 * time.Millisecond, FrameTypeMessage, frameMessage(NewMessage(msgIDs[2], []byte("good")))},
+		// needed to exit test
+		instruction{100 * time.Millisecond, -1, []byte("exit")},
+	}
+
+	addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	n := newMockNSQD(t, script, addr.String())
+
+	topicName := "test_batch" + strconv.Itoa(int(time.Now().Unix()))
+	config := NewConfig()
+	config.MaxInFlight = 3
+	config.BackoffMultiplier = 10 * time.Millisecond
+	q, _ := NewConsumer(topicName, "ch", config)
+	q.SetLogger(newTestLogger(t), LogLevelDebug)
+
+	var batchSizes []int
+	q.AddBatchHandler(BatchHandlerFunc(func(messages []*Message) []error {
+		batchSizes = append(batchSizes, len(messages))
+		errs := make([]error, len(messages))
+		for i, m := range messages {
+			if string(m.Body) == "bad" {
+				errs[i] = errors.New("bad")
+			}
+		}
+		return errs
+	}), 3, time.Second)
+	err := q.ConnectToNSQD(n.tcpAddr.String())
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	<-n.exitChan
+
+	var responses []string
+	for _, r := range n.got {
+		if bytes.HasPrefix(r, []byte("FIN")) || bytes.HasPrefix(r, []byte("REQ")) {
+			responses = append(responses, string(r))
+		}
+	}
+	expected := []string{
+		fmt.Sprintf("FIN %s", msgIDs[0]),
+		fmt.Sprintf("REQ %s 0", msgIDs[1]),
+		fmt.Sprintf("FIN %s", msgIDs[2]),
+	}
+	if len(batchSizes) != 1 || batchSizes[0] != 3 {
+		t.Fatalf("expected a single batch of 3 messages, got %v", batchSizes)
+	}
+	if strings.Join(responses, ",") != strings.Join(expected, ",") {
+		t.Fatalf("responses %v != %v", responses, expected)
+	}
+
+	q.SetLogger(nullLogger, LogLevelInfo)
+	q.Stop()
+	<-q.StopChan
+}
+
+func TestConsumerHandlerTimeout(t *testing.T) {
+	for _, disableAutoResponse := range []bool{false, true} {
+		disableAutoResponse := disableAutoResponse
+		msgID := MessageID{'t', 'i', 'm', 'e', 'o', 'u', 't', '8', '9', '0', 'a', 's', 'd', 'f', 'g', 'h'}
+		msg := NewMessage(msgID, []byte("stuck"))
+
+		script := []instruction{
+			// IDENTIFY
+			instruction{0, FrameTypeResponse, []byte("OK")},
+			// SUB
+			instruction{0, FrameTypeResponse, []byte("OK")},
+			instruction{20 * time.Millisecond, FrameTypeMessage, frameMessage(msg)},
+			// needed to exit test
+			instruction{200 * time.Millisecond, -1, []byte("exit")},
+		}
+
+		addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+		n := newMockNSQD(t, script, addr.String())
+
+		topicName := "test_handler_timeout" + strconv.Itoa(int(time.Now().Unix()))
+		config := NewConfig()
+		config.MaxInFlight = 1
+		config.HandlerTimeout = 50 * time.Millisecond
+		config.BackoffMultiplier = 10 * time.Millisecond
+		q, _ := NewConsumer(topicName, "ch", config)
+		q.SetLogger(newTestLogger(t), LogLevelDebug)
+
+		errChan := make(chan error, 1)
+		q.AddHandlerWithContext(HandlerWithContextFunc(func(ctx context.Context, m *Message) error {
+			if disableAutoResponse {
+				m.DisableAutoResponse()
+			}
+			<-ctx.Done()
+			// give the consumer a chance to FIN if it (incorrectly) waited for us
+			time.Sleep(20 * time.Millisecond)
+			errChan <- ctx.Err()
+			if disableAutoResponse {
+				// the message is not requeued on its behalf
+				m.Finish()
+			}
+			return nil
+		}))
+		err := q.ConnectToNSQD(n.tcpAddr.String())
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+
+		select {
+		case err := <-errChan:
+			if err != context.Canceled {
+				t.Fatalf("handler context should be cancelled after handler_timeout, got %v", err)
+			}
+		case <-time.After(500 * time.Millisecond):
+			t.Fatal("timeout waiting for handler")
+		}
+
+		<-n.exitChan
+
+		var responses []string
+		for _, r := range n.got {
+			if bytes.HasPrefix(r, []byte("FIN")) || bytes.HasPrefix(r, []byte("REQ")) {
+				responses = append(responses, string(r))
+			}
+		}
+		expected := fmt.Sprintf("REQ %s 0", msgID)
+		if disableAutoResponse {
+			expected = fmt.Sprintf("FIN %s", msgID)
+		}
+		if len(responses) != 1 || responses[0] != expected {
+			t.Fatalf("responses %v != [%s]", responses, expected)
+		}
+		if stats := q.Stats(); stats.MessagesTimedOut != 1 {
+			t.Fatalf("expected 1 timed out message, got %d", stats.MessagesTimedOut)
+		}
+
+		q.SetLogger(nullLogger, LogLevelInfo)
+		q.Stop()
+		<-q.StopChan
+	}
+}
+
+func TestConsumerAutoTouch(t *testing.T) {
+	msgID := MessageID{'t', 'o', 'u', 'c', 'h', '6', '7', '8', '9', '0', 'a', 's', 'd', 'f', 'g', 'h'}
+	msg := NewMessage(msgID, []byte("slow"))
+
+	script := []instruction{
+		// IDENTIFY
+		instruction{0, FrameTypeResponse, []byte(`{"max_rdy_count":2500,"msg_timeout":40}`)},
+		// SUB
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		instruction{20 * time.Millisecond, FrameTypeMessage, frameMessage(msg)},
+		// needed to exit test
+		instruction{300 * time.Millisecond, -1, []byte("exit")},
+	}
+
+	addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	n := newMockNSQD(t, script, addr.String())
+
+	topicName := "test_auto_touch" + strconv.Itoa(int(time.Now().Unix()))
+	config := NewConfig()
+	config.MaxInFlight = 1
+	config.AutoTouch = true
+	config.AutoTouchFraction = 0.5
+	q, _ := NewConsumer(topicName, "ch", config)
+	q.SetLogger(newTestLogger(t), LogLevelDebug)
+
+	errChan := make(chan error, 1)
+	q.AddHandlerWithContext(HandlerWithContextFunc(func(ctx context.Context, m *Message) error {
+		select {
+		case <-ctx.Done():
+			errChan <- ctx.Err()
+		case <-time.After(110 * time.Millisecond):
+			errChan <- nil
+		}
+		return nil
+	}))
+	err := q.ConnectToNSQD(n.tcpAddr.String())
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	select {
+	case err := <-errChan:
+		if err != nil {
+			t.Fatalf("handler context should not be cancelled while auto-touching, got %v", err)
+		}
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("timeout waiting for handler")
+	}
+
+	<-n.exitChan
+
+	var touches int
+	var responses []string
+	for _, r := range n.got {
+		switch {
+		case bytes.HasPrefix(r, []byte("TOUCH")):
+			if len(responses) > 0 {
+				t.Fatalf("TOUCH sent after %s", responses[0])
+			}
+			touches++
+		case bytes.HasPrefix(r, []byte("FIN")) || bytes.HasPrefix(r, []byte("REQ")):
+			responses = append(responses, string(r))
+		}
+	}
+	if touches < 3 {
+		t.Fatalf("expected at least 3 TOUCH commands, got %d", touches)
+	}
+	if len(responses) != 1 || responses[0] != fmt.Sprintf("FIN %s", msgID) {
+		t.Fatalf("unexpected responses %v", responses)
+	}
+
+	q.SetLogger(nullLogger, LogLevelInfo)
+	q.Stop()
+	<-q.StopChan
+}
+
+func TestConsumerStopWithContext(t *testing.T) {
+	msgID := MessageID{'s', 't', 'o', 'p', '5', '6', '7', '8', '9', '0', 'a', 's', 'd', 'f', 'g', 'h'}
+	msg := NewMessage(msgID, []byte("stuck"))
+
+	script := []instruction{
+		// IDENTIFY
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		// SUB
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		instruction{20 * time.Millisecond, FrameTypeMessage, frameMessage(msg)},
+		// needed to exit test
+		instruction{200 * time.Millisecond, -1, []byte("exit")},
+	}
+
+	addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	n := newMockNSQD(t, script, addr.String())
+
+	topicName := "test_stop_context" + strconv.Itoa(int(time.Now().Unix()))
+	config := NewConfig()
+	config.MaxInFlight = 1
+	q, _ := NewConsumer(topicName, "ch", config)
+	q.SetLogger(nullLogger, LogLevelInfo)
+
+	handling := make(chan int)
+	release := make(chan int)
+	q.AddHandler(HandlerFunc(func(m *Message) error {
+		close(handling)
+		<-release
+		return nil
+	}))
+	err := q.ConnectToNSQD(n.tcpAddr.String())
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	<-handling
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	inFlight, err := q.StopWithContext(ctx)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+	if inFlight != 1 {
+		t.Fatalf("expected 1 message in flight, got %d", inFlight)
+	}
+
+	select {
+	case <-q.StopChan:
+	default:
+		t.Fatal("consumer should be stopped")
+	}
+	close(release)
+
+	<-n.exitChan
+	if string(n.got[len(n.got)-1]) != "CLS" {
+		t.Fatalf("expected CLS to be sent, got %s", n.got[len(n.got)-1])
+	}
+}
+
+func TestConsumerOnStop(t *testing.T) {
+	msg := NewMessage(MessageID{'o', 'n', 's', 't', 'o', 'p'}, []byte("batched"))
+
+	script := []instruction{
+		// IDENTIFY
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		// SUB
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		instruction{20 * time.Millisecond, FrameTypeMessage, frameMessage(msg)},
+		// needed to exit test
+		instruction{100 * time.Millisecond, -1, []byte("exit")},
+	}
+
+	addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	n := newMockNSQD(t, script, addr.String())
+
+	topicName := "test_on_stop" + strconv.Itoa(int(time.Now().Unix()))
+	q, _ := NewConsumer(topicName, "ch", NewConfig())
+	q.SetLogger(nullLogger, LogLevelInfo)
+
+	// hold messages for a batch, to be flushed on stop
+	batch := make(chan *Message, 1)
+	q.AddHandler(HandlerFunc(func(m *Message) error {
+		m.DisableAutoResponse()
+		batch <- m
+		return nil
+	}))
+	var hooks []string
+	q.OnStop(func(ctx context.Context) {
+		hooks = append(hooks, "flush")
+		(<-batch).Finish()
+	})
+	q.OnStop(func(ctx context.Context) {
+		hooks = append(hooks, "checkpoint")
+	})
+	err := q.ConnectToNSQD(n.tcpAddr.String())
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	q.Stop()
+	<-n.exitChan
+
+	if len(hooks) != 2 || hooks[0] != "flush" || hooks[1] != "checkpoint" {
+		t.Fatalf("unexpected hooks %v", hooks)
+	}
+	var got []string
+	for _, r := range n.got {
+		got = append(got, string(r))
+	}
+	// FIN is written by the connection's write loop, so may race CLS
+	sort.Strings(got[4:])
+	expected := []string{
+		"IDENTIFY",
+		"SUB " + topicName + " ch",
+		"RDY 1",
+		"RDY 0",
+		"CLS",
+		fmt.Sprintf("FIN %s", msg.ID),
+	}
+	if len(got) != len(expected) {
+		t.Fatalf("got %v, expected %v", got, expected)
+	}
+	for i := range got {
+		if got[i] != expected[i] {
+			t.Fatalf("cmd %d bad %s != %s", i, got[i], expected[i])
+		}
+	}
+}
+
+func TestConsumerOnDelivery(t *testing.T) {
+	msgGood := NewMessage(MessageID{'d', 'e', 'l', 'i', 'v', 'e', 'r', 'y', 'g'}, []byte("good"))
+	msgBad := NewMessage(MessageID{'d', 'e', 'l', 'i', 'v', 'e', 'r', 'y', 'b'}, []byte("bad"))
+
+	script := []instruction{
+		// IDENTIFY
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		// SUB
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		instruction{20 * time.Millisecond, FrameTypeMessage, frameMessage(msgGood)},
+		instruction{20 * time.Millisecond, FrameTypeMessage, frameMessage(msgBad)},
+		// needed to exit test
+		instruction{100 * time.Millisecond, -1, []byte("exit")},
+	}
+
+	addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	n := newMockNSQD(t, script, addr.String())
+
+	topicName := "test_on_delivery" + strconv.Itoa(int(time.Now().Unix()))
+	config := NewConfig()
+	config.MaxInFlight = 2
+	q, _ := NewConsumer(topicName, "ch", config)
+	q.SetLogger(nullLogger, LogLevelInfo)
+
+	var mtx sync.Mutex
+	var records []DeliveryRecord
+	q.OnDelivery(func(record DeliveryRecord) {
+		mtx.Lock()
+		records = append(records, record)
+		mtx.Unlock()
+	})
+	q.AddHandler(HandlerFunc(func(m *Message) error {
+		time.Sleep(5 * time.Millisecond)
+		if string(m.Body) == "bad" {
+			return errors.New("bad")
+		}
+		return nil
+	}))
+	err := q.ConnectToNSQD(n.tcpAddr.String())
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	<-n.exitChan
+	q.Stop()
+	<-q.StopChan
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	if len(records) != 2 {
+		t.Fatalf("unexpected records %+v", records)
+	}
+	for i, expected := range []struct {
+		msg     *Message
+		outcome DeliveryOutcome
+	}{{msgGood, DeliveryFinished}, {msgBad, DeliveryRequeued}} {
+		record := records[i]
+		if record.MessageID != expected.msg.ID || record.Outcome != expected.outcome ||
+			record.NSQDAddress != n.tcpAddr.String() || record.Err != nil {
+			t.Fatalf("unexpected record %+v", record)
+		}
+		if record.HandlerLatency < 5*time.Millisecond {
+			t.Fatalf("unexpected handler latency %s", record.HandlerLatency)
+		}
+	}
+}
+
+// wraps a net.Conn, hiding the CloseRead/CloseWrite methods of *net.TCPConn
+type wrappedConn struct {
+	net.Conn
+}
+
+func TestConsumerDialContext(t *testing.T) {
+	msg := NewMessage(MessageID{'d', 'i', 'a', 'l'}, []byte("dialed"))
+
+	script := []instruction{
+		// IDENTIFY
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		// SUB
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		instruction{20 * time.Millisecond, FrameTypeMessage, frameMessage(msg)},
+		// needed to exit test
+		instruction{100 * time.Millisecond, -1, []byte("exit")},
+	}
+
+	addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	n := newMockNSQD(t, script, addr.String())
+
+	var dialed []string
+	config := NewConfig()
+	config.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if _, ok := ctx.Deadline(); !ok {
+			return nil, errors.New("expected a deadline")
+		}
+		dialed = append(dialed, addr)
+		conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return wrappedConn{conn}, nil
+	}
+	q, _ := NewConsumer("test_dial_context", "ch", config)
+	q.SetLogger(nullLogger, LogLevelInfo)
+	handled := make(chan *Message, 1)
+	q.AddHandler(HandlerFunc(func(m *Message) error {
+		handled <- m
+		return nil
+	}))
+	err := q.ConnectToNSQD(n.tcpAddr.String())
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if m := <-handled; m.ID != msg.ID {
+		t.Fatalf("unexpected message %s", m.ID)
+	}
+	if len(dialed) != 1 || dialed[0] != n.tcpAddr.String() {
+		t.Fatalf("unexpected dials %v", dialed)
+	}
+
+	<-n.exitChan
+	q.Stop()
+	select {
+	case <-q.StopChan:
+	case <-time.After(time.Second):
+		t.Fatal("consumer did not stop")
+	}
+}
+
+func TestConsumerUnixSocket(t *testing.T) {
+	msg := NewMessage(MessageID{'u', 'n', 'i', 'x'}, []byte("unix"))
+
+	script := []instruction{
+		// IDENTIFY
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		// SUB
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		instruction{20 * time.Millisecond, FrameTypeMessage, frameMessage(msg)},
+		// needed to exit test
+		instruction{100 * time.Millisecond, -1, []byte("exit")},
+	}
+
+	dir, err := ioutil.TempDir("", "nsq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "nsqd.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := &mockNSQD{
+		t:           t,
+		script:      script,
+		tcpListener: l,
+		exitChan:    make(chan int),
+	}
+	go n.listen()
+
+	q, _ := NewConsumer("test_unix_socket", "ch", NewConfig())
+	q.SetLogger(nullLogger, LogLevelInfo)
+	handled := make(chan *Message, 1)
+	q.AddHandler(HandlerFunc(func(m *Message) error {
+		handled <- m
+		return nil
+	}))
+	err = q.ConnectToNSQD("unix://" + path)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if m := <-handled; m.ID != msg.ID || m.NSQDAddress != "unix://"+path {
+		t.Fatalf("unexpected message %s from %s", m.ID, m.NSQDAddress)
+	}
+
+	<-n.exitChan
+	q.Stop()
+	<-q.StopChan
+}
+
+func TestConsumerBufferSizes(t *testing.T) {
+	msg := NewMessage(MessageID{'b', 'u', 'f'}, bytes.Repeat([]byte("b"), 2000))
+
+	script := []instruction{
+		// IDENTIFY
+		instruction{0, FrameTypeResponse, []byte(`{"max_rdy_count":2500}`)},
+		// SUB
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		instruction{20 * time.Millisecond, FrameTypeMessage, frameMessage(msg)},
+		// needed to exit test
+		instruction{100 * time.Millisecond, -1, []byte("exit")},
+	}
+
+	addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	n := newMockNSQD(t, script, addr.String())
+
+	config := NewConfig()
+	config.ReadBufferSize = 512
+	config.WriteBufferSize = 1 << 20
+	q, _ := NewConsumer("test_buffer_sizes", "ch", config)
+	q.SetLogger(nullLogger, LogLevelInfo)
+	handled := make(chan *Message, 1)
+	q.AddHandler(HandlerFunc(func(m *Message) error {
+		handled <- m
+		return nil
+	}))
+	err := q.ConnectToNSQD(n.tcpAddr.String())
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if m := <-handled; !bytes.Equal(m.Body, msg.Body) {
+		t.Fatalf("unexpected body %q", m.Body)
+	}
+
+	conn := q.conns()[0]
+	conn.mtx.Lock()
+	readSize, writeSize := conn.bufReader.Size(), conn.bufWriter.Size()
+	conn.mtx.Unlock()
+	if readSize != 512 || writeSize != 1<<20 {
+		t.Fatalf("unexpected buffer sizes %d/%d", readSize, writeSize)
+	}
+
+	<-n.exitChan
+	q.Stop()
+	<-q.StopChan
+	conn.mtx.Lock()
+	defer conn.mtx.Unlock()
+	if conn.bufReader != nil || conn.bufWriter != nil {
+		t.Fatal("expected buffers to be released")
+	}
+	if _, err := conn.Write([]byte("x")); err != ErrNotConnected {
+		t.Fatalf("unexpected write error %v", err)
+	}
+}
+
+func TestConsumerZeroCopy(t *testing.T) {
+	msgs := []*Message{
+		NewMessage(MessageID{'z', 'e', 'r', 'o', 'a'}, []byte("auto")),
+		NewMessage(MessageID{'z', 'e', 'r', 'o', 'b'}, []byte("held")),
+	}
+
+	script := []instruction{
+		// IDENTIFY
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		// SUB
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		instruction{20 * time.Millisecond, FrameTypeMessage, frameMessage(msgs[0])},
+		instruction{0, FrameTypeMessage, frameMessage(msgs[1])},
+		// needed to exit test
+		instruction{100 * time.Millisecond, -1, []byte("exit")},
+	}
+
+	addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	n := newMockNSQD(t, script, addr.String())
+
+	config := NewConfig()
+	config.ZeroCopy = true
+	config.MaxInFlight = 2
+	q, _ := NewConsumer("test_zero_copy", "ch", config)
+	q.SetLogger(nullLogger, LogLevelInfo)
+	handled := make(chan *Message, 2)
+	q.AddHandler(HandlerFunc(func(m *Message) error {
+		if m.frameBuf == nil {
+			t.Error("expected a pooled buffer")
+		}
+		if string(m.Body) == "held" {
+			m.DisableAutoResponse()
+			m.Finish()
+		}
+		handled <- m
+		return nil
+	}))
+	err := q.ConnectToNSQD(n.tcpAddr.String())
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	auto, held := <-handled, <-handled
+
+	<-n.exitChan
+	q.Stop()
+	<-q.StopChan
+	if atomic.LoadInt32(&auto.released) != 1 {
+		t.Fatal("expected the auto-responded message to be released")
+	}
+	if atomic.LoadInt32(&held.released) != 0 || string(held.Body) != "held" {
+		t.Fatal("expected the held message not to be released")
+	}
+	held.Release()
+}
+
+func TestConsumerZeroCopyHandlerTimeout(t *testing.T) {
+	msgs := []*Message{
+		NewMessage(MessageID{'z', 'e', 'r', 'o', 't'}, []byte("stuck")),
+		NewMessage(MessageID{'z', 'e', 'r', 'o', 'n'}, []byte("next!")),
+	}
+
+	script := []instruction{
+		// IDENTIFY
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		// SUB
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		instruction{20 * time.Millisecond, FrameTypeMessage, frameMessage(msgs[0])},
+		// read once the first message has been requeued on its handler's behalf
+		instruction{100 * time.Millisecond, FrameTypeMessage, frameMessage(msgs[1])},
+		// needed to exit test
+		instruction{100 * time.Millisecond, -1, []byte("exit")},
+	}
+
+	addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	n := newMockNSQD(t, script, addr.String())
+
+	config := NewConfig()
+	config.ZeroCopy = true
+	config.MaxInFlight = 2
+	config.HandlerTimeout = 30 * time.Millisecond
+	config.BackoffMultiplier = 10 * time.Millisecond
+	q, _ := NewConsumer("test_zero_copy_timeout", "ch", config)
+	q.SetLogger(nullLogger, LogLevelInfo)
+	bodies := make(chan string, 2)
+	var stuck *Message
+	q.AddHandlerWithContext(HandlerWithContextFunc(func(ctx context.Context, m *Message) error {
+		if string(m.Body) == "stuck" {
+			stuck = m
+			<-ctx.Done()
+			// keep using the body after the message was requeued
+			time.Sleep(150 * time.Millisecond)
+		}
+		bodies <- string(m.Body)
+		return nil
+	}))
+	err := q.ConnectToNSQD(n.tcpAddr.String())
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	<-n.exitChan
+	q.Stop()
+	<-q.StopChan
+	got := []string{<-bodies, <-bodies}
+	sort.Strings(got)
+	if got[0] != "next!" || got[1] != "stuck" {
+		t.Fatalf("unexpected bodies %q", got)
+	}
+	if atomic.LoadInt32(&stuck.released) != 1 {
+		t.Fatal("expected the message to be released once its handler returned")
+	}
+}
+
+func TestConsumerKeyedHandlers(t *testing.T) {
+	for _, handlerTimeout := range []time.Duration{0, 20 * time.Millisecond} {
+		msgs := []*Message{
+			NewMessage(MessageID{'k', 'e', 'y', 'a', '1', '6', '7', '8', '9', '0', 'a', 's', 'd', 'f', 'g', 'h'},
+				EncodeEnvelope(Headers{HeaderKey: "a"}, []byte("a1"))),
+			NewMessage(MessageID{'k', 'e', 'y', 'a', '2', '6', '7', '8', '9', '0', 'a', 's', 'd', 'f', 'g', 'h'},
+				EncodeEnvelope(Headers{HeaderKey: "a"}, []byte("a2"))),
+			NewMessage(MessageID{'k', 'e', 'y', 'b', '1', '6', '7', '8', '9', '0', 'a', 's', 'd', 'f', 'g', 'h'},
+				EncodeEnvelope(Headers{HeaderKey: "b"}, []byte("b1"))),
+		}
+
+		script := []instruction{
+			// IDENTIFY
+			instruction{0, FrameTypeResponse, []byte("OK")},
+			// SUB
+			instruction{0, FrameTypeResponse, []byte("OK")},
+			instruction{20 * time.Millisecond, FrameTypeMessage, frameMessage(msgs[0])},
+			instruction{0, FrameTypeMessage, frameMessage(msgs[1])},
+			instruction{0, FrameTypeMessage, frameMessage(msgs[2])},
+			// needed to exit test
+			instruction{200 * time.Millisecond, -1, []byte("exit")},
+		}
+
+		addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+		n := newMockNSQD(t, script, addr.String())
+
+		topicName := "test_keyed" + strconv.Itoa(int(time.Now().Unix()))
+		config := NewConfig()
+		config.MaxInFlight = 3
+		// a1 times out, a2 must still wait for its handler to return
+		config.HandlerTimeout = handlerTimeout
+		config.BackoffMultiplier = 10 * time.Millisecond
+		q, _ := NewConsumer(topicName, "ch", config)
+		q.SetLogger(newTestLogger(t), LogLevelDebug)
+
+		var mtx sync.Mutex
+		var order []string
+		q.AddKeyedHandlers(HandlerWithContextFunc(func(ctx context.Context, m *Message) error {
+			_, body, _ := DecodeEnvelope(m.Body)
+			if string(body) == "a1" {
+				time.Sleep(50 * time.Millisecond)
+			}
+			mtx.Lock()
+			order = append(order, string(body))
+			mtx.Unlock()
+			return nil
+		}), 2, nil)
+		err := q.ConnectToNSQD(n.tcpAddr.String())
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+
+		<-n.exitChan
+
+		mtx.Lock()
+		result := strings.Join(order, ",")
+		mtx.Unlock()
+		// "a" messages are handled in order, "b" concurrently (ahead of the slow a1)
+		if result != "b1,a1,a2" {
+			t.Fatalf("handled %s, expected b1,a1,a2", result)
+		}
+
+		q.SetLogger(nullLogger, LogLevelInfo)
+		q.Stop()
+		<-q.StopChan
+	}
+}
+
+func TestConsumerFilter(t *testing.T) {
+	msgIDKeep := MessageID{'k', 'e', 'e', 'p', '5', '6', '7', '8', '9', '0', 'a', 's', 'd', 'f', 'g', 'h'}
+	msgIDDrop := MessageID{'d', 'r', 'o', 'p', '5', '6', '7', '8', '9', '0', 'a', 's', 'd', 'f', 'g', 'h'}
+
+	script := []instruction{
+		// IDENTIFY
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		// SUB
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		instruction{20 * time.Millisecond, FrameTypeMessage, frameMessage(NewMessage(msgIDDrop, []byte("tenant-b")))},
+		instruction{5 * time.Millisecond, FrameTypeMessage, frameMessage(NewMessage(msgIDKeep, []byte("tenant-a")))},
+		// needed to exit test
+		instruction{100 * time.Millisecond, -1, []byte("exit")},
+	}
+
+	addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	n := newMockNSQD(t, script, addr.String())
+
+	topicName := "test_filter" + strconv.Itoa(int(time.Now().Unix()))
+	config := NewConfig()
+	config.MaxInFlight = 2
+	q, _ := NewConsumer(topicName, "ch", config)
+	q.SetLogger(newTestLogger(t), LogLevelDebug)
+
+	var handled []string
+	q.AddHandler(HandlerFunc(func(m *Message) error {
+		handled = append(handled, string(m.Body))
+		return nil
+	}))
+	q.AddFilter(func(m *Message) bool {
+		return string(m.Body) == "tenant-a"
+	})
+	err := q.ConnectToNSQD(n.tcpAddr.String())
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	<-n.exitChan
+
+	var responses []string
+	for _, r := range n.got {
+		if bytes.HasPrefix(r, []byte("FIN")) || bytes.HasPrefix(r, []byte("REQ")) {
+			responses = append(responses, string(r))
+		}
+	}
+	expected := []string{
+		fmt.Sprintf("FIN %s", msgIDDrop),
+		fmt.Sprintf("FIN %s", msgIDKeep),
+	}
+	if strings.Join(responses, ",") != strings.Join(expected, ",") {
+		t.Fatalf("responses %v != %v", responses, expected)
+	}
+	if len(handled) != 1 || handled[0] != "tenant-a" {
+		t.Fatalf("unexpected handled messages %v", handled)
+	}
+	if stats := q.Stats(); stats.MessagesFiltered != 1 || stats.MessagesFinished != 2 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	q.SetLogger(nullLogger, LogLevelInfo)
+	q.Stop()
+	<-q.StopChan
+}
+
+func TestConsumerEvents(t *testing.T) {
+	msgIDGood := MessageID{'e', 'v', 'g', 'o', 'o', 'd', '7', '8', '9', '0', 'a', 's', 'd', 'f', 'g', 'h'}
+	msgIDBad := MessageID{'e', 'v', 'b', 'a', 'd', '6', '7', '8', '9', '0', 'a', 's', 'd', 'f', 'g', 'h'}
+	msgIDGiveUp := MessageID{'e', 'v', 'g', 'i', 'v', 'e', '7', '8', '9', '0', 'a', 's', 'd', 'f', 'g', 'h'}
+	msgGiveUp := NewMessage(msgIDGiveUp, []byte("good"))
+	msgGiveUp.Attempts = 10
+
+	script := []instruction{
+		// IDENTIFY
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		// SUB
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		instruction{20 * time.Millisecond, FrameTypeMessage, frameMessage(NewMessage(msgIDGood, []byte("good")))},
+		instruction{20 * time.Millisecond, FrameTypeMessage, frameMessage(NewMessage(msgIDBad, []byte("bad")))},
+		instruction{50 * time.Millisecond, FrameTypeMessage, frameMessage(msgGiveUp)},
+		// needed to exit test
+		instruction{100 * time.Millisecond, -1, []byte("exit")},
+	}
+
+	addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	n := newMockNSQD(t, script, addr.String())
+
+	topicName := "test_events" + strconv.Itoa(int(time.Now().Unix()))
+	config := NewConfig()
+	config.MaxInFlight = 5
+	config.MaxAttempts = 5
+	config.BackoffMultiplier = 10 * time.Millisecond
+	q, _ := NewConsumer(topicName, "ch", config)
+	q.SetLogger(newTestLogger(t), LogLevelDebug)
+
+	var mtx sync.Mutex
+	var events []string
+	var all int
+	q.OnEvent(func(e Event) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		if e.Subscription.Topic != topicName {
+			t.Errorf("unexpected subscription %v", e.Subscription)
+		}
+		desc := e.Type.String()
+		if e.Message != nil {
+			desc += " " + string(e.Message.ID[:])
+		}
+		events = append(events, desc)
+	}, EventMessageFinished, EventMessageRequeued, EventGiveUp, EventBackoffStarted, EventBackoffEnded)
+	q.OnEvent(func(e Event) {
+		if e.Type == EventConnectionIOError {
+			// the mock closing the connection may race Stop
+			return
+		}
+		mtx.Lock()
+		all++
+		mtx.Unlock()
+	})
+	q.AddHandler(&testHandler{})
+	err := q.ConnectToNSQD(n.tcpAddr.String())
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	<-n.exitChan
+	q.SetLogger(nullLogger, LogLevelInfo)
+	q.Stop()
+	<-q.StopChan
+
+	expected := []string{
+		"MessageFinished " + string(msgIDGood[:]),
+		"MessageRequeued " + string(msgIDBad[:]),
+		"BackoffStarted",
+		"GiveUp " + string(msgIDGiveUp[:]),
+		"MessageFinished " + string(msgIDGiveUp[:]),
+		"BackoffEnded",
+	}
+	mtx.Lock()
+	defer mtx.Unlock()
+	if strings.Join(events, ",") != strings.Join(expected, ",") {
+		t.Fatalf("events %v != %v", events, expected)
+	}
+	// including ConnectionAdded and ConnectionRemoved
+	if all != len(expected)+2 {
+		t.Fatalf("expected %d events, got %d", len(expected)+2, all)
+	}
+}
+
+func TestConsumerTriggerClearBackoff(t *testing.T) {
+	script := []instruction{
+		// IDENTIFY
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		// SUB
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		// needed to exit test
+		instruction{150 * time.Millisecond, -1, []byte("exit")},
+	}
+
+	addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	n := newMockNSQD(t, script, addr.String())
+
+	topicName := "test_trigger_clear_backoff" + strconv.Itoa(int(time.Now().Unix()))
+	config := NewConfig()
+	config.MaxInFlight = 5
+	q, _ := NewConsumer(topicName, "ch", config)
+	q.SetLogger(newTestLogger(t), LogLevelDebug)
+	q.AddHandler(&testHandler{})
+	err := q.ConnectToNSQD(n.tcpAddr.String())
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	q.TriggerBackoff(time.Hour)
+	inBackoff, duration, successesNeeded := q.BackoffState()
+	if !inBackoff || duration != time.Hour || successesNeeded != 1 {
+		t.Fatalf("unexpected backoff state %v %s %d", inBackoff, duration, successesNeeded)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	q.ClearBackoff()
+	inBackoff, duration, successesNeeded = q.BackoffState()
+	if inBackoff || duration != 0 || successesNeeded != 0 {
+		t.Fatalf("unexpected backoff state %v %s %d", inBackoff, duration, successesNeeded)
+	}
+
+	<-n.exitChan
+	q.SetLogger(nullLogger, LogLevelInfo)
+	q.Stop()
+	<-q.StopChan
+
+	for i, r := range n.got {
+		t.Logf("%d: %s", i, r)
+	}
+
+	expected := []string{
+		"IDENTIFY",
+		"SUB " + topicName + " ch",
+		"RDY 5",
+		"RDY 0",
+		"RDY 5",
+	}
+	if len(n.got) != len(expected) {
+		t.Fatalf("we got %d commands != %d expected", len(n.got), len(expected))
+	}
+	for i, r := range n.got {
+		if string(r) != expected[i] {
+			t.Fatalf("cmd %d bad %s != %s", i, r, expected[i])
+		}
+	}
+}
+
+func TestConsumerErrors(t *testing.T) {
+	script := []instruction{
+		// IDENTIFY
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		// SUB
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		instruction{20 * time.Millisecond, FrameTypeError, []byte("E_INVALID bad things")},
+		// needed to exit test
+		instruction{100 * time.Millisecond, -1, []byte("exit")},
+	}
+
+	addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	n := newMockNSQD(t, script, addr.String())
+
+	topicName := "test_errors" + strconv.Itoa(int(time.Now().Unix()))
+	q, _ := NewConsumer(topicName, "ch", NewConfig())
+	q.SetLogger(nullLogger, LogLevelInfo)
+	q.AddHandler(&testHandler{})
+	err := q.ConnectToNSQD(n.tcpAddr.String())
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	select {
+	case err := <-q.Errors():
+		e, ok := err.(ErrConsumer)
+		if !ok || e.Op != "protocol" || e.Addr != n.tcpAddr.String() {
+			t.Fatalf("unexpected error %#v", err)
+		}
+		if _, ok := e.Err.(ErrProtocol); !ok {
+			t.Fatalf("unexpected underlying error %#v", e.Err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for error")
+	}
+
+	<-n.exitChan
+	q.Stop()
+	<-q.StopChan
+}
+
+func TestConsumerHealthy(t *testing.T) {
+	script := []instruction{
+		// IDENTIFY
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		// SUB
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		// needed to exit test
+		instruction{100 * time.Millisecond, -1, []byte("exit")},
+	}
+
+	addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	n := newMockNSQD(t, script, addr.String())
+
+	topicName := "test_healthy" + strconv.Itoa(int(time.Now().Unix()))
+	q, _ := NewConsumer(topicName, "ch", NewConfig())
+	q.SetLogger(nullLogger, LogLevelInfo)
+	q.AddHandler(&testHandler{})
+	if err := q.Healthy(); err == nil {
+		t.Fatal("expected an unconnected consumer to be unhealthy")
+	}
+	err := q.ConnectToNSQD(n.tcpAddr.String())
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	if err := q.Healthy(); err != nil {
+		t.Fatalf("expected consumer to be healthy - %s", err)
+	}
+	q.TriggerBackoff(time.Hour)
+	if err := q.Healthy(); err == nil {
+		t.Fatal("expected consumer in backoff to be unhealthy")
+	}
+	q.ClearBackoff()
+	if err := q.Healthy(); err != nil {
+		t.Fatalf("expected consumer to be healthy - %s", err)
+	}
+
+	<-n.exitChan
+	q.Stop()
+	<-q.StopChan
+	if err := q.Healthy(); err == nil {
+		t.Fatal("expected a stopped consumer to be unhealthy")
+	}
+}
+
+func TestConsumerBackoffPerConnection(t *testing.T) {
+	msgIDBad := MessageID{'p', 'c', 'b', 'a', 'd', '6', '7', '8', '9', '0', 'a', 's', 'd', 'f', 'g', 'h'}
+	msgIDGood := MessageID{'p', 'c', 'g', 'o', 'o', 'd', '7', '8', '9', '0', 'a', 's', 'd', 'f', 'g', 'h'}
+
+	script1 := []instruction{
+		// IDENTIFY
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		// SUB
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		instruction{20 * time.Millisecond, FrameTypeMessage, frameMessage(NewMessage(msgIDBad, []byte("bad")))},
+		// needed to exit test
+		instruction{100 * time.Millisecond, -1, []byte("exit")},
+	}
+	script2 := []instruction{
+		// IDENTIFY
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		// SUB
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		// while the other connection is in backoff
+		instruction{40 * time.Millisecond, FrameTypeMessage, frameMessage(NewMessage(msgIDGood, []byte("good")))},
+		// needed to exit test
+		instruction{100 * time.Millisecond, -1, []byte("exit")},
+	}
+
+	addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	n1 := newMockNSQD(t, script1, addr.String())
+	n2 := newMockNSQD(t, script2, addr.String())
+
+	topicName := "test_backoff_per_conn" + strconv.Itoa(int(time.Now().Unix()))
+	config := NewConfig()
+	// RDY is distributed once both are connected
+	config.MaxInFlight = 0
+	config.BackoffPerConnection = true
+	config.BackoffMultiplier = 20 * time.Millisecond
+	q, _ := NewConsumer(topicName, "ch", config)
+	q.SetLogger(newTestLogger(t), LogLevelDebug)
+	q.AddHandler(&testHandler{})
+	err := q.ConnectToNSQDs([]string{n1.tcpAddr.String(), n2.tcpAddr.String()})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	q.ChangeMaxInFlight(2)
+
+	<-n1.exitChan
+	<-n2.exitChan
+	if inBackoff, _, _ := q.BackoffState(); inBackoff {
+		t.Fatal("consumer should not be in (global) backoff")
+	}
+	q.SetLogger(nullLogger, LogLevelInfo)
+	q.Stop()
+	<-q.StopChan
+
+	for _, tc := range []struct {
+		n        *mockNSQD
+		expected []string
+	}{
+		{n1, []string{
+			"IDENTIFY",
+			"SUB " + topicName + " ch",
+			"RDY 1",
+			"RDY 0",
+			fmt.Sprintf("REQ %s 0", msgIDBad),
+			"RDY 1",
+		}},
+		{n2, []string{
+			"IDENTIFY",
+			"SUB " + topicName + " ch",
+			"RDY 1",
+			fmt.Sprintf("FIN %s", msgIDGood),
+		}},
+	} {
+		got := make([]string, len(tc.n.got))
+		for i, r := range tc.n.got {
+			got[i] = string(r)
+		}
+		if strings.Join(got, ",") != strings.Join(tc.expected, ",") {
+			t.Fatalf("commands %v != %v", got, tc.expected)
+		}
+	}
+}
+
+func TestConsumerWaitConnectionsLost(t *testing.T) {
+	script := []instruction{
+		// IDENTIFY
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		// SUB
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		// closes the listener, so reconnecting fails
+		instruction{20 * time.Millisecond, -1, []byte("exit")},
+	}
+
+	addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	n := newMockNSQD(t, script, addr.String())
+
+	topicName := "test_wait_conns_lost" + strconv.Itoa(int(time.Now().Unix()))
+	config := NewConfig()
+	config.LookupdPollInterval = 10 * time.Millisecond
+	config.MaxReconnectAttempts = 3
+	q, _ := NewConsumer(topicName, "ch", config)
+	q.SetLogger(nullLogger, LogLevelInfo)
+	q.AddHandler(&testHandler{})
+	err := q.ConnectToNSQD(n.tcpAddr.String())
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = q.Wait(ctx)
+	terr, ok := err.(ErrTerminated)
+	if !ok || terr.Cause != ErrConnectionsLost {
+		t.Fatalf("expected ErrTerminated caused by ErrConnectionsLost, got %v", err)
+	}
+}
+
+func TestConsumerExpiringMessages(t *testing.T) {
+	msgIDFin := MessageID{'e', 'x', 'f', 'i', 'n', '6', '7', '8', '9', '0', 'a', 's', 'd', 'f', 'g', 'h'}
+	msgIDLost := MessageID{'e', 'x', 'l', 'o', 's', 't', '7', '8', '9', '0', 'a', 's', 'd', 'f', 'g', 'h'}
+
+	script := []instruction{
+		// IDENTIFY
+		instruction{0, FrameTypeResponse, []byte(`{"max_rdy_count":2500,"msg_timeout":100}`)},
+		// SUB
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		instruction{20 * time.Millisecond, FrameTypeMessage, frameMessage(NewMessage(msgIDFin, []byte("fin")))},
+		instruction{5 * time.Millisecond, FrameTypeMessage, frameMessage(NewMessage(msgIDLost, []byte("lost")))},
+		// needed to exit test
+		instruction{150 * time.Millisecond, -1, []byte("exit")},
+	}
+
+	addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	n := newMockNSQD(t, script, addr.String())
+
+	topicName := "test_expiring" + strconv.Itoa(int(time.Now().Unix()))
+	config := NewConfig()
+	config.MaxInFlight = 2
+	config.ExpiringMessageFraction = 0.5
+	config.RequeueExpiringMessages = true
+	q, _ := NewConsumer(topicName, "ch", config)
+	q.SetLogger(newTestLogger(t), LogLevelDebug)
+
+	q.AddHandler(HandlerFunc(func(m *Message) error {
+		m.DisableAutoResponse()
+		if string(m.Body) == "fin" {
+			m.Finish()
+		}
+		return nil
+	}))
+	var inFlight []*Message
+	q.OnEvent(func(e Event) {
+		inFlight = q.InFlightMessages()
+	}, EventMessageExpiring)
+	err := q.ConnectToNSQD(n.tcpAddr.String())
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	<-n.exitChan
+
+	var responses []string
+	for _, r := range n.got {
+		if bytes.HasPrefix(r, []byte("FIN")) || bytes.HasPrefix(r, []byte("REQ")) {
+			responses = append(responses, string(r))
+		}
+	}
+	expected := []string{
+		fmt.Sprintf("FIN %s", msgIDFin),
+		fmt.Sprintf("REQ %s 0", msgIDLost),
+	}
+	if strings.Join(responses, ",") != strings.Join(expected, ",") {
+		t.Fatalf("responses %v != %v", responses, expected)
+	}
+	if len(inFlight) != 1 || inFlight[0].ID != msgIDLost {
+		t.Fatalf("unexpected in-flight messages %v", inFlight)
+	}
+	if stats := q.Stats(); stats.MessagesExpiring != 1 || stats.MessagesInFlight != 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	q.SetLogger(nullLogger, LogLevelInfo)
+	q.Stop()
+	<-q.StopChan
+}
+
+func TestConsumerConnectionStats(t *testing.T) {
+	msgIDGood := MessageID{'c', 's', 'g', 'o', 'o', 'd', '7', '8', '9', '0', 'a', 's', 'd', 'f', 'g', 'h'}
+	msgIDBad := MessageID{'c', 's', 'b', 'a', 'd', '6', '7', '8', '9', '0', 'a', 's', 'd', 'f', 'g', 'h'}
+
+	script := []instruction{
+		// IDENTIFY
+		instruction{0, FrameTypeResponse, []byte(`{"max_rdy_count":2500,"version":"1.2.1","max_deflate_level":6}`)},
+		// SUB
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		instruction{20 * time.Millisecond, FrameTypeMessage, frameMessage(NewMessage(msgIDGood, []byte("good")))},
+		instruction{5 * time.Millisecond, FrameTypeMessage, frameMessage(NewMessage(msgIDBad, []byte("bad")))},
+		instruction{5 * time.Millisecond, FrameTypeError, []byte("E_FIN_FAILED FIN failed")},
+		// needed to exit test
+		instruction{200 * time.Millisecond, -1, []byte("exit")},
+	}
+
+	addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	n := newMockNSQD(t, script, addr.String())
+
+	topicName := "test_conn_stats" + strconv.Itoa(int(time.Now().Unix()))
+	config := NewConfig()
+	config.MaxInFlight = 2
+	q, _ := NewConsumer(topicName, "ch", config)
+	q.SetLogger(nullLogger, LogLevelInfo)
+	q.AddHandler(&testHandler{})
+	err := q.ConnectToNSQD(n.tcpAddr.String())
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	stats := q.ConnectionStats()
+	if len(stats) != 1 {
+		t.Fatalf("expected 1 connection, got %d", len(stats))
+	}
+	s := stats[0]
+	if s.Addr != n.tcpAddr.String() || s.MessagesReceived != 2 ||
+		s.MessagesFinished != 1 || s.MessagesRequeued != 1 || s.InFlight != 0 {
+		t.Fatalf("unexpected stats %+v", s)
+	}
+	if s.LastHeartbeat.IsZero() {
+		t.Fatal("LastHeartbeat should be set on connect")
+	}
+	if perr, ok := s.LastError.(ErrProtocol); !ok || perr.Reason != "E_FIN_FAILED FIN failed" || s.LastErrorTime.IsZero() {
+		t.Fatalf("unexpected last error %v at %s", s.LastError, s.LastErrorTime)
+	}
+	if resp := s.IdentifyResponse; resp == nil || resp.Version != "1.2.1" || resp.MaxDeflateLevel != 6 {
+		t.Fatalf("unexpected identify response %+v", resp)
+	}
+
+	<-n.exitChan
+	q.Stop()
+	<-q.StopChan
+}
+
+func TestConsumerMaxInFlightBytes(t *testing.T) {
+	large := bytes.Repeat([]byte("a"), 60)
+	msgs := []*Message{
+		NewMessage(MessageID{'b', 'y', 't', 'e', 's', 'a'}, large),
+		NewMessage(MessageID{'b', 'y', 't', 'e', 's', 'b'}, large),
+		NewMessage(MessageID{'b', 'y', 't', 'e', 's', 'c'}, []byte("small")),
+		NewMessage(MessageID{'b', 'y', 't', 'e', 's', 'd'}, []byte("small")),
+	}
+
+	script := []instruction{
+		// IDENTIFY
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		// SUB
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		instruction{10 * time.Millisecond, FrameTypeMessage, frameMessage(msgs[0])},
+		instruction{5 * time.Millisecond, FrameTypeMessage, frameMessage(msgs[1])},
+		// withheld until the first large message is finished
+		instruction{5 * time.Millisecond, FrameTypeMessage, frameMessage(msgs[2])},
+		instruction{10 * time.Millisecond, FrameTypeMessage, frameMessage(msgs[3])},
+		// needed to exit test
+		instruction{100 * time.Millisecond, -1, []byte("exit")},
+	}
+
+	addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	n := newMockNSQD(t, script, addr.String())
+
+	topicName := "test_max_in_flight_bytes" + strconv.Itoa(int(time.Now().Unix()))
+	config := NewConfig()
+	config.MaxInFlight = 5
+	config.MaxInFlightBytes = 100
+	q, _ := NewConsumer(topicName, "ch", config)
+	q.SetLogger(newTestLogger(t), LogLevelDebug)
+	q.AddHandler(HandlerFunc(func(m *Message) error {
+		if len(m.Body) > 50 {
+			time.Sleep(30 * time.Millisecond)
+		}
+		return nil
+	}))
+	err := q.ConnectToNSQD(n.tcpAddr.String())
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	select {
+	case <-n.exitChan:
+		t.Log("clean exit")
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+
+	var got []string
+	for i, r := range n.got {
+		t.Logf("%d: %s", i, r)
+		got = append(got, string(r))
+	}
+	expected := []string{
+		"IDENTIFY",
+		"SUB " + topicName + " ch",
+		"RDY 5",
+		"RDY 0",
+		// RDY is restored as the first large message is finished
+		"RDY 5",
+		fmt.Sprintf("FIN %s", msgs[0].ID),
+		fmt.Sprintf("FIN %s", msgs[1].ID),
+		fmt.Sprintf("FIN %s", msgs[2].ID),
+		fmt.Sprintf("FIN %s", msgs[3].ID),
+	}
+	if len(got) != len(expected) {
+		t.Fatalf("got %v, expected %v", got, expected)
+	}
+	for i := range got {
+		if got[i] != expected[i] {
+			t.Fatalf("cmd %d bad %s != %s", i, got[i], expected[i])
+		}
+	}
+	if stats := q.Stats(); stats.InFlightBytes != 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	q.SetLogger(nullLogger, LogLevelInfo)
+	q.Stop()
+	<-q.StopChan
+}
+
+func TestConnSocketOptions(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	config := NewConfig()
+	if !config.TCPNoDelay {
+		t.Fatal("TCP_NODELAY should be enabled by default")
+	}
+	if err := config.Set("socket_send_buffer", -1); err == nil {
+		t.Fatal("expected an error for a negative socket buffer size")
+	}
+	config.TCPNoDelay = false
+	config.SocketSendBuffer = 64 * 1024
+	config.SocketReceiveBuffer = 64 * 1024
+
+	for _, keepAlive := range []time.Duration{5 * time.Second, -1} {
+		config.TCPKeepAlive = keepAlive
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = NewConn(l.Addr().String(), config, nil).setSocketOptions(conn)
+		conn.Close()
+		if err != nil {
+			t.Fatalf("failed to set socket options (keepalive %s): %s", keepAlive, err)
+		}
+	}
+}
+
+func TestConsumerConnectionEvents(t *testing.T) {
+	script := []instruction{
+		// IDENTIFY
+		instruction{0, FrameTypeResponse, []byte(`{"max_rdy_count":2500,"msg_timeout":30000}`)},
+		// SUB
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		instruction{20 * time.Millisecond, FrameTypeResponse, []byte("_heartbeat_")},
+		instruction{20 * time.Millisecond, FrameTypeResponse, []byte("_heartbeat_")},
+		// closes the connection
+		instruction{20 * time.Millisecond, -1, []byte("exit")},
+	}
+
+	addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	n := newMockNSQD(t, script, addr.String())
+
+	q, _ := NewConsumer("test_connection_events", "ch", NewConfig())
+	q.SetLogger(nullLogger, LogLevelInfo)
+	events := make(chan Event, 10)
+	q.OnEvent(func(e Event) { events <- e },
+		EventIdentifyResponse, EventHeartbeat, EventConnectionIOError, EventConnectionRemoved)
+	q.AddHandler(&MyTestHandler{})
+	err := q.ConnectToNSQD(n.tcpAddr.String())
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	var got []Event
+	for len(got) < 5 {
+		select {
+		case e := <-events:
+			got = append(got, e)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for events, got %v", got)
+		}
+	}
+	if got[0].Type != EventIdentifyResponse || got[0].IdentifyResponse.MsgTimeout != 30000 {
+		t.Fatalf("unexpected identify event %+v", got[0])
+	}
+	for _, e := range got[1:3] {
+		if e.Type != EventHeartbeat || e.HeartbeatInterval <= 0 {
+			t.Fatalf("unexpected heartbeat event %+v", e)
+		}
+	}
+	if got[3].Type != EventConnectionIOError || got[3].Err != io.EOF {
+		t.Fatalf("unexpected IO error event %+v", got[3])
+	}
+	if got[4].Type != EventConnectionRemoved || got[4].Err != io.EOF {
+		t.Fatalf("unexpected connection removed event %+v", got[4])
+	}
+
+	q.Stop()
+	<-q.StopChan
+}
+
+func TestProducerIdentifyResponse(t *testing.T) {
+	script := []instruction{
+		// IDENTIFY
+		instruction{0, FrameTypeResponse, []byte(`{"max_rdy_count":2500,"max_msg_timeout":900000,"msg_timeout":60000}`)},
+		// needed to exit test
+		instruction{100 * time.Millisecond, -1, []byte("exit")},
+	}
+
+	addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	n := newMockNSQD(t, script, addr.String())
+
+	p, _ := NewProducer(n.tcpAddr.String(), NewConfig())
+	p.SetLogger(nullLogger, LogLevelInfo)
+	if resp := p.IdentifyResponse(); resp != nil {
+		t.Fatalf("unexpected identify response before connecting %+v", resp)
+	}
+	if err := p.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	if resp := p.IdentifyResponse(); resp == nil || resp.MaxMsgTimeout != 900000 || resp.MsgTimeout != 60000 {
+		t.Fatalf("unexpected identify response %+v", resp)
+	}
+
+	<-n.exitChan
+	p.Stop()
+}
+
+func TestConsumerMissedHeartbeats(t *testing.T) {
+	script := []instruction{
+		// IDENTIFY
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		// SUB
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		instruction{20 * time.Millisecond, FrameTypeResponse, []byte("_heartbeat_")},
+		// needed to exit test
+		instruction{300 * time.Millisecond, -1, []byte("exit")},
+	}
+
+	addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	n := newMockNSQD(t, script, addr.String())
+
+	config := NewConfig()
+	config.HeartbeatInterval = 50 * time.Millisecond
+	config.MaxMissedHeartbeats = 2
+	q, _ := NewConsumer("test_missed_heartbeats", "ch", config)
+	q.SetLogger(nullLogger, LogLevelInfo)
+	removed := make(chan Event, 1)
+	q.OnEvent(func(e Event) { removed <- e }, EventConnectionRemoved)
+	q.AddHandler(&MyTestHandler{})
+	start := time.Now()
+	err := q.ConnectToNSQD(n.tcpAddr.String())
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	select {
+	case e := <-removed:
+		if e.Err == nil || !strings.Contains(e.Err.Error(), "no heartbeat received") {
+			t.Fatalf("unexpected close reason %v", e.Err)
+		}
+		if elapsed := time.Since(start); elapsed < 125*time.Millisecond {
+			t.Fatalf("connection closed after %s, before missing 2 heartbeats", elapsed)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("connection was not closed after missing heartbeats")
+	}
+
+	<-n.exitChan
+	q.Stop()
+	<-q.StopChan
+}
+
+func TestConnWriteTimeout(t *testing.T) {
+	config := NewConfig()
+	config.WriteTimeout = 100 * time.Millisecond
+	c := NewConn("127.0.0.1:0", config, nil)
+	if timeout := c.writeTimeout(Publish("topic", []byte("body"))); timeout != 100*time.Millisecond {
+		t.Fatalf("unexpected publish write timeout %s", timeout)
+	}
+
+	config.PublishWriteTimeout = 300 * time.Millisecond
+	for cmd, expected := range map[*Command]time.Duration{
+		Publish("topic", []byte("body")):                      300 * time.Millisecond,
+		DeferredPublish("topic", time.Second, []byte("body")): 300 * time.Millisecond,
+		Finish(MessageID{}):                                   100 * time.Millisecond,
+		Requeue(MessageID{}, 0):                               100 * time.Millisecond,
+		Nop():                                                 100 * time.Millisecond,
+	} {
+		if timeout := c.writeTimeout(cmd); timeout != expected {
+			t.Fatalf("unexpected write timeout %s for %s", timeout, cmd)
+		}
+	}
+
+	// nothing reads from the other end of the pipe
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	c.conn, c.w = client, client
+	start := time.Now()
+	_, err := deadlineWriter{c, c.writeTimeout(Finish(MessageID{}))}.Write([]byte("FIN"))
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond || elapsed > 250*time.Millisecond {
+		t.Fatalf("unexpected FIN write timeout after %s", elapsed)
+	}
+}
+
+func TestConsumerDrainTimeout(t *testing.T) {
+	msg := NewMessage(MessageID{'d', 'r', 'a', 'i', 'n'}, []byte("drain"))
+
+	script := []instruction{
+		// IDENTIFY
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		// SUB
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		instruction{20 * time.Millisecond, FrameTypeMessage, frameMessage(msg)},
+		// needed to exit test (CLS is never acknowledged)
+		instruction{500 * time.Millisecond, -1, []byte("exit")},
+	}
+
+	addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	n := newMockNSQD(t, script, addr.String())
+
+	config := NewConfig()
+	config.DrainTimeout = 100 * time.Millisecond
+	q, _ := NewConsumer("test_drain_timeout", "ch", config)
+	q.SetLogger(nullLogger, LogLevelInfo)
+	handling := make(chan struct{})
+	release := make(chan struct{})
+	q.AddHandler(HandlerFunc(func(m *Message) error {
+		close(handling)
+		<-release
+		return nil
+	}))
+	err := q.ConnectToNSQD(n.tcpAddr.String())
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	<-handling
+
+	start := time.Now()
+	q.Stop()
+	select {
+	case <-q.StopChan:
+	case <-time.After(time.Second):
+		t.Fatal("consumer did not stop after the drain timeout")
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Fatalf("consumer stopped after %s, before the drain timeout", elapsed)
+	}
+	if abandoned := q.Stats().MessagesAbandoned; abandoned != 1 {
+		t.Fatalf("expected 1 abandoned message, got %d", abandoned)
+	}
+	close(release)
+
+	<-n.exitChan
+}
+
+func TestProducerAuthProvider(t *testing.T) {
+	script := []instruction{
+		// IDENTIFY
+		instruction{0, FrameTypeResponse, []byte(`{"max_rdy_count":2500,"auth_required":true}`)},
+		// AUTH
+		instruction{0, FrameTypeResponse, []byte(`{"identity":"test"}`)},
+		// needed to exit test
+		instruction{100 * time.Millisecond, -1, []byte("exit")},
+	}
+
+	addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	n := newMockNSQD(t, script, addr.String())
+
+	config := NewConfig()
+	config.AuthSecret = "static"
+	var calls []string
+	config.AuthProvider = AuthProviderFunc(func(ctx context.Context, addr string) (string, error) {
+		calls = append(calls, addr)
+		if len(calls) > 1 {
+			return "", errors.New("token expired")
+		}
+		return "token", nil
+	})
+	p, _ := NewProducer(n.tcpAddr.String(), config)
+	p.SetLogger(nullLogger, LogLevelInfo)
+	if err := p.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	<-n.exitChan
+	p.Stop()
+
+	if len(calls) != 1 || calls[0] != n.tcpAddr.String() {
+		t.Fatalf("unexpected AuthProvider calls %v", calls)
+	}
+	if len(n.got) < 3 || string(n.got[1]) != "AUTH" || string(n.got[2]) != "token" {
+		t.Fatalf("unexpected commands %q", n.got)
+	}
+
+	// the secret is requested again for each connection
+	n = newMockNSQD(t, script, addr.String())
+	p, _ = NewProducer(n.tcpAddr.String(), config)
+	p.SetLogger(nullLogger, LogLevelInfo)
+	if err := p.Ping(); err == nil || !strings.Contains(err.Error(), "token expired") {
+		t.Fatalf("expected an ErrAuth, got %v", err)
+	}
+	<-n.exitChan
+	p.Stop()
+}
+
+func TestConsumerFrameTracer(t *testing.T) {
+	msg := NewMessage(MessageID{'t', 'r', 'a', 'c', 'e'}, []byte("traced message body"))
+	framed := frameMessage(msg)
+
+	script := []instruction{
+		// IDENTIFY
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		// SUB
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		instruction{20 * time.Millisecond, FrameTypeMessage, framed},
+		// needed to exit test
+		instruction{100 * time.Millisecond, -1, []byte("exit")},
+	}
+
+	addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	n := newMockNSQD(t, script, addr.String())
+
+	var mtx sync.Mutex
+	var frames []TracedFrame
+	config := NewConfig()
+	config.FrameTraceMaxBytes = 8
+	config.FrameTracer = func(frame TracedFrame) {
+		mtx.Lock()
+		frames = append(frames, frame)
+		mtx.Unlock()
+	}
+	q, _ := NewConsumer("test_frame_tracer", "ch", config)
+	q.SetLogger(nullLogger, LogLevelDebug)
+	q.AddHandler(HandlerFunc(func(m *Message) error { return nil }))
+	err := q.ConnectToNSQD(n.tcpAddr.String())
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	<-n.exitChan
+	q.Stop()
+	<-q.StopChan
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	var trace []string
+	for _, f := range frames {
+		if f.NSQDAddress != n.tcpAddr.String() {
+			t.Fatalf("unexpected address %s", f.NSQDAddress)
+		}
+		if f.Direction == FrameWritten {
+			trace = append(trace, fmt.Sprintf("%s %s", f.Direction, f.Command))
+		} else {
+			trace = append(trace, fmt.Sprintf("%s %d %q/%d", f.Direction, f.FrameType, f.Payload, f.Size))
+		}
+	}
+	// the response to SUB may be read before or after RDY is written
+	expected := []string{
+		"write IDENTIFY",
+		`read 0 "OK"/2`,
+		"write SUB test_frame_tracer ch",
+		"write RDY 1",
+		`read 0 "OK"/2`,
+		fmt.Sprintf("read 2 %q/%d", framed[:8], len(framed)),
+		"write FIN " + string(msg.ID[:]),
+	}
+	if len(trace) < len(expected) {
+		t.Fatalf("unexpected frames\n%s", strings.Join(trace, "\n"))
+	}
+	got := append([]string(nil), trace[:len(expected)]...)
+	sort.Strings(got)
+	sort.Strings(expected)
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("unexpected frames\n%s", strings.Join(trace, "\n"))
+	}
+
+	c := NewConn("127.0.0.1:0", config, nil)
+	c.SetLoggerLevel(LogLevelInfo)
+	if c.tracing() {
+		t.Fatal("frames should only be traced at LogLevelDebug")
+	}
+}
+
+func TestConsumerSharedWriteLoops(t *testing.T) {
+	var nsqds []*mockNSQD
+	var msgs []*Message
+	for i := 0; i < 3; i++ {
+		msg := NewMessage(MessageID{'s', 'h', byte('0' + i)}, bytes.Repeat([]byte("s"), 5000))
+		script := []instruction{
+			// IDENTIFY
+			instruction{0, FrameTypeResponse, []byte("OK")},
+			// SUB
+			instruction{0, FrameTypeResponse, []byte("OK")},
+			instruction{20 * time.Millisecond, FrameTypeMessage, frameMessage(msg)},
+			// needed to exit test
+			instruction{100 * time.Millisecond, -1, []byte("exit")},
+		}
+		addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+		nsqds = append(nsqds, newMockNSQD(t, script, addr.String()))
+		msgs = append(msgs, msg)
+	}
+
+	config := NewConfig()
+	config.SharedWriteLoops = 2
+	q, _ := NewConsumer("test_shared_write_loops", "ch", config)
+	q.SetLogger(nullLogger, LogLevelInfo)
+	q.AddHandler(HandlerFunc(func(m *Message) error {
+		if len(m.Body) != 5000 {
+			return errors.New("unexpected body")
+		}
+		return nil
+	}))
+	for _, n := range nsqds {
+		err := q.ConnectToNSQD(n.tcpAddr.String())
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	for _, conn := range q.conns() {
+		conn.mtx.Lock()
+		buffered := conn.bufReader != nil || conn.bufWriter != nil
+		conn.mtx.Unlock()
+		if buffered {
+			t.Fatal("expected no dedicated buffers")
+		}
+	}
+
+	for i, n := range nsqds {
+		<-n.exitChan
+		fin := fmt.Sprintf("FIN %s", msgs[i].ID)
+		if got := n.got[len(n.got)-1]; string(got) != fin {
+			t.Fatalf("unexpected last command %q, expected %q", got, fin)
+		}
+	}
+	q.Stop()
+	<-q.StopChan
+	if stats := q.Stats(); stats.MessagesFinished != 3 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	// the loops are stopped once the last connection using them has closed
+	sharedWriteLoopsMtx.Lock()
+	_, running := sharedWriteLoops[2]
+	sharedWriteLoopsMtx.Unlock()
+	if running {
+		t.Fatal("expected the shared write loops to be stopped")
+	}
+}
+
+func TestProducerSendCommand(t *testing.T) {
+	script := []instruction{
+		// IDENTIFY
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		// XPING
+		instruction{50 * time.Millisecond, FrameTypeResponse, []byte("PONG a")},
+		// XBAD
+		instruction{50 * time.Millisecond, FrameTypeError, []byte("E_INVALID unknown verb")},
+		// needed to exit test
+		instruction{100 * time.Millisecond, -1, []byte("exit")},
+	}
+
+	addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	n := newMockNSQD(t, script, addr.String())
+
+	p, _ := NewProducer(n.tcpAddr.String(), NewConfig())
+	p.SetLogger(nullLogger, LogLevelInfo)
+	resp, err := p.SendCommand(NewRawCommand("XPING", [][]byte{[]byte("a")}, nil))
+	if err != nil || string(resp) != "PONG a" {
+		t.Fatalf("unexpected response %q (%v)", resp, err)
+	}
+	doneChan := make(chan *ProducerTransaction, 1)
+	err = p.SendCommandAsync(NewRawCommand("XBAD", nil, nil), doneChan, "arg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := <-doneChan
+	if _, ok := tr.Error.(ErrProtocol); !ok || tr.Response != nil || tr.Args[0] != "arg" {
+		t.Fatalf("unexpected transaction %+v", tr)
+	}
+	<-n.exitChan
+	p.Stop()
+
+	if len(n.got) != 3 || string(n.got[1]) != "XPING a" || string(n.got[2]) != "XBAD" {
+		t.Fatalf("unexpected commands %q", n.got)
+	}
+}
+
+// writeRecordingConn records the data of each write
+type writeRecordingConn struct {
+	net.Conn
+	mtx    sync.Mutex
+	writes []string
+}
+
+func (c *writeRecordingConn) Write(p []byte) (int, error) {
+	c.mtx.Lock()
+	c.writes = append(c.writes, string(p))
+	c.mtx.Unlock()
+	return c.Conn.Write(p)
+}
+
+func TestConsumerWriteCoalesce(t *testing.T) {
+	var msgs []*Message
+	script := []instruction{
+		// IDENTIFY
+		instruction{0, FrameTypeResponse, []byte(`{"max_rdy_count":2500}`)},
+		// SUB
+		instruction{0, FrameTypeResponse, []byte("OK")},
+	}
+	for i := 0; i < 3; i++ {
+		msg := NewMessage(MessageID{'c', 'o', byte('0' + i)}, []byte("coalesced"))
+		script = append(script, instruction{0, FrameTypeMessage, frameMessage(msg)})
+		msgs = append(msgs, msg)
+	}
+	// the RDY command is flushed after the linger
+	script[2].delay = 100 * time.Millisecond
+	// needed to exit test
+	script = append(script, instruction{200 * time.Millisecond, -1, []byte("exit")})
+
+	addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	n := newMockNSQD(t, script, addr.String())
+
+	recorder := &writeRecordingConn{}
+	config := NewConfig()
+	config.MaxInFlight = 3
+	config.WriteCoalesceLinger = 50 * time.Millisecond
+	config.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+		recorder.Conn = conn
+		return recorder, err
+	}
+	q, _ := NewConsumer("test_write_coalesce", "ch", config)
+	q.SetLogger(nullLogger, LogLevelInfo)
+	q.AddHandler(HandlerFunc(func(m *Message) error { return nil }))
+	// delivery hooks are called once the coalesced FINs have been written
+	var unwritten int32
+	q.OnDelivery(func(record DeliveryRecord) {
+		recorder.mtx.Lock()
+		defer recorder.mtx.Unlock()
+		fin := fmt.Sprintf("FIN %s\n", record.MessageID)
+		for _, w := range recorder.writes {
+			if strings.Contains(w, fin) {
+				return
+			}
+		}
+		atomic.AddInt32(&unwritten, 1)
+	})
+	err := q.ConnectToNSQD(n.tcpAddr.String())
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	<-n.exitChan
+	q.Stop()
+	<-q.StopChan
+
+	if n := atomic.LoadInt32(&unwritten); n != 0 {
+		t.Fatalf("expected delivery hooks to be called after the FINs were written, %d were not", n)
+	}
+	var fins string
+	for _, msg := range msgs {
+		fins += fmt.Sprintf("FIN %s\n", msg.ID)
+	}
+	recorder.mtx.Lock()
+	defer recorder.mtx.Unlock()
+	for _, w := range recorder.writes {
+		if w == fins {
+			return
+		}
+	}
+	t.Fatalf("expected the FINs to be coalesced in a single write, got %q", recorder.writes)
+}
+
+func TestConsumerIdentifyMetadata(t *testing.T) {
+	script := []instruction{
+		// IDENTIFY
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		// SUB
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		// needed to exit test
+		instruction{50 * time.Millisecond, -1, []byte("exit")},
+	}
+
+	addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	n := newMockNSQD(t, script, addr.String())
+
+	config := NewConfig()
+	config.UserAgent = "test/1.0"
+	config.IdentifyMetadata = map[string]string{"region": "eu", "deployment": "prod", "hostname": "ignored"}
+	bodies := make(chan map[string]interface{}, 1)
+	config.IdentifyHook = func(addr string, body map[string]interface{}) {
+		body["sent_by"] = "hook"
+		bodies <- body
+	}
+	q, _ := NewConsumer("test_identify_metadata", "ch", config)
+	q.SetLogger(nullLogger, LogLevelInfo)
+	q.AddHandler(&testHandler{})
+	if err := q.ConnectToNSQD(n.tcpAddr.String()); err != nil {
+		t.Fatal(err)
+	}
+	<-n.exitChan
+	q.Stop()
+	<-q.StopChan
+
+	body := <-bodies
+	if body["region"] != "eu" || body["deployment"] != "prod" || body["hostname"] == "ignored" {
+		t.Fatalf("unexpected IDENTIFY body %v", body)
+	}
+	if ua := body["user_agent"]; ua != "test/1.0 (deployment=prod; region=eu)" {
+		t.Fatalf("unexpected user agent %v", ua)
+	}
+}
+
+func TestConsumerMessageReceipt(t *testing.T) {
+	msgID := MessageID{'r', 'c', 'p', 't', '5', '6', '7', '8', '9', '0', 'a', 's', 'd', 'f', 'g', 'h'}
+	msg := NewMessage(msgID, []byte("receipt"))
+
+	script := []instruction{
+		// IDENTIFY
+		instruction{0, FrameTypeResponse, []byte(`{"max_rdy_count":2500,"msg_timeout":30000}`)},
+		// SUB
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		instruction{20 * time.Millisecond, FrameTypeMessage, frameMessage(msg)},
+		// needed to exit test
+		instruction{100 * time.Millisecond, -1, []byte("exit")},
+	}
+
+	addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	n := newMockNSQD(t, script, addr.String())
+
+	q, _ := NewConsumer("test_message_receipt", "ch", NewConfig())
+	q.SetLogger(nullLogger, LogLevelInfo)
+	received := make(chan *Message, 1)
+	q.AddHandler(HandlerFunc(func(m *Message) error {
+		received <- m
+		return nil
+	}))
+	start := time.Now()
+	if err := q.ConnectToNSQD(n.tcpAddr.String()); err != nil {
+		t.Fatal(err)
+	}
+	m := <-received
+	stats := q.ConnectionStats()
+	<-n.exitChan
+	q.Stop()
+	<-q.StopChan
+
+	if m.NSQDAddress != n.tcpAddr.String() || len(stats) != 1 || m.ConnectionID() != stats[0].ID {
+		t.Fatalf("unexpected receipt %s (%d), stats %+v", m.NSQDAddress, m.ConnectionID(), stats)
+	}
+	if m.ReceivedAt().Before(start) || m.MsgTimeout() != 30*time.Second {
+		t.Fatalf("unexpected receipt time %s, msg_timeout %s", m.ReceivedAt(), m.MsgTimeout())
+	}
+	deadline, ok := m.Deadline()
+	if !ok || !deadline.Equal(m.ReceivedAt().Add(30*time.Second)) {
+		t.Fatalf("unexpected deadline %s (%v)", deadline, ok)
+	}
+	if remaining, ok := m.TimeRemaining(); !ok || remaining <= 0 || remaining > 30*time.Second {
+		t.Fatalf("unexpected time remaining %s (%v)", remaining, ok)
+	}
+
+	unreceived := NewMessage(msgID, nil)
+	if _, ok := unreceived.Deadline(); ok || unreceived.ConnectionID() != 0 {
+		t.Fatalf("message not received from nsqd should have no deadline or connection")
+	}
+}
+
+func TestConsumerStreamBody(t *testing.T) {
+	large := bytes.Repeat([]byte("0123456789abcdef"), 64*1024)
+	msgLarge := NewMessage(MessageID{'l', 'a', 'r', 'g', 'e', '6', '7', '8', '9', '0', 'a', 's', 'd', 'f', 'g', 'h'}, large)
+	msgSkipped := NewMessage(MessageID{'s', 'k', 'i', 'p', '5', '6', '7', '8', '9', '0', 'a', 's', 'd', 'f', 'g', 'h'}, large)
+	msgSmall := NewMessage(MessageID{'s', 'm', 'a', 'l', 'l', '6', '7', '8', '9', '0', 'a', 's', 'd', 'f', 'g', 'h'}, []byte("small"))
+
+	script := []instruction{
+		// IDENTIFY
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		// SUB
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		instruction{20 * time.Millisecond, FrameTypeMessage, frameMessage(msgLarge)},
+		instruction{0, FrameTypeMessage, frameMessage(msgSkipped)},
+		instruction{0, FrameTypeMessage, frameMessage(msgSmall)},
+		// needed to exit test
+		instruction{200 * time.Millisecond, -1, []byte("exit")},
+	}
+
+	addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	n := newMockNSQD(t, script, addr.String())
+
+	config := NewConfig()
+	config.StreamBodyThreshold = 1024
+	config.MaxInFlight = 3
+	q, _ := NewConsumer("test_stream_body", "ch", config)
+	q.SetLogger(nullLogger, LogLevelInfo)
+
+	type result struct {
+		id       MessageID
+		streamed bool
+		size     int64
+		body     []byte
+		err      error
+	}
+	results := make(chan result, 3)
+	q.AddHandler(HandlerFunc(func(m *Message) error {
+		r := result{id: m.ID, streamed: m.Streamed(), size: m.BodySize()}
+		if m.ID != msgSkipped.ID {
+			r.body, r.err = ioutil.ReadAll(m.BodyReader())
+		}
+		results <- r
+		return nil
+	}))
+	if err := q.ConnectToNSQD(n.tcpAddr.String()); err != nil {
+		t.Fatal(err)
+	}
+	<-n.exitChan
+	q.Stop()
+	<-q.StopChan
+
+	for _, want := range []struct {
+		msg      *Message
+		streamed bool
+	}{{msgLarge, true}, {msgSkipped, true}, {msgSmall, false}} {
+		var r result
+		select {
+		case r = <-results:
+		default:
+			t.Fatalf("msg %s not handled", want.msg.ID)
+		}
+		if r.id != want.msg.ID || r.streamed != want.streamed || r.size != int64(len(want.msg.Body)) || r.err != nil {
+			t.Fatalf("unexpected result for msg %s: %s streamed %v, size %d (%v)",
+				want.msg.ID, r.id, r.streamed, r.size, r.err)
+		}
+		if want.msg.ID != msgSkipped.ID && !bytes.Equal(r.body, want.msg.Body) {
+			t.Fatalf("unexpected body of msg %s (%d bytes)", r.id, len(r.body))
+		}
+	}
+	var fins int
+	for _, cmd := range n.got {
+		if bytes.HasPrefix(cmd, []byte("FIN ")) {
+			fins++
+		}
+	}
+	if fins != 3 {
+		t.Fatalf("all messages should be finished, got %q", n.got)
+	}
+}
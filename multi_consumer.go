@@ -0,0 +1,315 @@
+package nsq
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Subscription identifies a topic/channel pair consumed by a Consumer
+type Subscription struct {
+	Topic   string
+	Channel string
+}
+
+type subscriptionKey struct{}
+
+// SubscriptionFromContext returns the Subscription of the Consumer that delivered
+// the message being handled, given the context passed to a HandlerWithContext
+//
+// This is primarily useful for handlers shared by the Consumers of a MultiConsumer.
+func SubscriptionFromContext(ctx context.Context) (Subscription, bool) {
+	s, ok := ctx.Value(subscriptionKey{}).(Subscription)
+	return s, ok
+}
+
+// MultiConsumer consumes from several topic/channel pairs as a single unit.
+//
+// It manages one Consumer per Subscription (the NSQ protocol allows a single
+// subscription per connection) that share handler goroutines, a max-in-flight
+// budget, and a Stop lifecycle. Handlers can determine the Subscription a
+// message was received on via SubscriptionFromContext.
+type MultiConsumer struct {
+	consumers []*Consumer
+
+	// the shared max-in-flight budget, and the subscription its remainder (see
+	// ChangeMaxInFlight) is given to first
+	mtx              sync.Mutex
+	maxInFlight      int
+	rotation         int
+	rotationInterval time.Duration
+
+	stopFlag int32
+	exitChan chan int
+
+	// read from this channel to block until all consumers are cleanly stopped
+	StopChan chan int
+}
+
+// NewMultiConsumer creates a new instance of MultiConsumer for the specified subscriptions
+//
+// config.MaxInFlight is the budget shared by all subscriptions (see ChangeMaxInFlight).
+func NewMultiConsumer(subscriptions []Subscription, config *Config) (*MultiConsumer, error) {
+	if len(subscriptions) == 0 {
+		return nil, errors.New("no subscriptions")
+	}
+
+	m := &MultiConsumer{
+		rotationInterval: config.RDYRedistributeInterval,
+		StopChan:         make(chan int),
+		exitChan:         make(chan int),
+	}
+	for _, s := range subscriptions {
+		c, err := NewConsumer(s.Topic, s.Channel, config)
+		if err != nil {
+			// nothing is connected (nor handling) yet, exit immediately
+			for _, c := range m.consumers {
+				c.exit()
+			}
+			return nil, err
+		}
+		m.consumers = append(m.consumers, c)
+	}
+	m.ChangeMaxInFlight(config.MaxInFlight)
+	go m.rotationLoop()
+
+	go func() {
+		for _, c := range m.consumers {
+			<-c.StopChan
+		}
+		close(m.StopChan)
+	}()
+
+	return m, nil
+}
+
+// Consumers returns the underlying Consumers, one per Subscription (in order)
+func (m *MultiConsumer) Consumers() []*Consumer {
+	return m.consumers
+}
+
+// Stats retrieves the aggregated connection and message statistics of all consumers
+func (m *MultiConsumer) Stats() *ConsumerStats {
+	stats := &ConsumerStats{}
+	for _, c := range m.consumers {
+		stats.add(c.Stats())
+	}
+	return stats
+}
+
+// SetLogger assigns the logger to use as well as a level for all consumers
+//
+// See Consumer.SetLogger for details.
+func (m *MultiConsumer) SetLogger(l logger, lvl LogLevel) {
+	for _, c := range m.consumers {
+		c.SetLogger(l, lvl)
+	}
+}
+
+// SetLoggerLevel sets the package logging level for all consumers
+func (m *MultiConsumer) SetLoggerLevel(lvl LogLevel) {
+	for _, c := range m.consumers {
+		c.SetLoggerLevel(lvl)
+	}
+}
+
+// SetBehaviorDelegate sets the behavior delegate of all consumers
+//
+// See Consumer.SetBehaviorDelegate for details.
+func (m *MultiConsumer) SetBehaviorDelegate(cb interface{}) {
+	for _, c := range m.consumers {
+		c.SetBehaviorDelegate(cb)
+	}
+}
+
+// ChangeMaxInFlight sets the maximum number of messages allowed in-flight across
+// all subscriptions.
+//
+// The budget is divided evenly between subscriptions. When it is smaller than the number
+// of subscriptions, those left without any are rotated every Config.RDYRedistributeInterval,
+// like the RDY count of a Consumer with more connections than max-in-flight.
+func (m *MultiConsumer) ChangeMaxInFlight(maxInFlight int) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.maxInFlight = maxInFlight
+	m.divideMaxInFlight()
+}
+
+// divideMaxInFlight divides the budget between subscriptions, giving its remainder to
+// those starting at m.rotation. m.mtx must be held
+func (m *MultiConsumer) divideMaxInFlight() {
+	n := len(m.consumers)
+	for i, c := range m.consumers {
+		share := m.maxInFlight / n
+		if (i-m.rotation+n)%n < m.maxInFlight%n {
+			share++
+		}
+		c.ChangeMaxInFlight(share)
+	}
+}
+
+// rotationLoop rotates a budget smaller than the number of subscriptions between them,
+// so none is starved
+func (m *MultiConsumer) rotationLoop() {
+	ticker := time.NewTicker(m.rotationInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m.mtx.Lock()
+			if n := len(m.consumers); m.maxInFlight > 0 && m.maxInFlight < n {
+				m.rotation = (m.rotation + 1) % n
+				m.divideMaxInFlight()
+			}
+			m.mtx.Unlock()
+		case <-m.exitChan:
+			return
+		}
+	}
+}
+
+// Pause stops message flow for all subscriptions (see Consumer.Pause)
+func (m *MultiConsumer) Pause() {
+	for _, c := range m.consumers {
+		c.Pause()
+	}
+}
+
+// Resume restarts message flow for all subscriptions (see Consumer.Resume)
+func (m *MultiConsumer) Resume() {
+	for _, c := range m.consumers {
+		c.Resume()
+	}
+}
+
+// Use appends middleware to the chain wrapping handlers of all consumers (see Consumer.Use)
+func (m *MultiConsumer) Use(mw ...HandlerMiddleware) {
+	for _, c := range m.consumers {
+		c.Use(mw...)
+	}
+}
+
+// AddFilter adds a MessageFilter to all consumers (see Consumer.AddFilter)
+func (m *MultiConsumer) AddFilter(filter MessageFilter) {
+	for _, c := range m.consumers {
+		c.AddFilter(filter)
+	}
+}
+
+// AddHandler sets the Handler for messages received on any subscription
+//
+// See AddConcurrentHandlersWithContext.
+func (m *MultiConsumer) AddHandler(handler Handler) {
+	m.AddConcurrentHandlers(handler, 1)
+}
+
+// AddConcurrentHandlers sets the Handler for messages received on any subscription
+//
+// See AddConcurrentHandlersWithContext.
+func (m *MultiConsumer) AddConcurrentHandlers(handler Handler, concurrency int) {
+	m.AddConcurrentHandlersWithContext(handlerAdapter{handler}, concurrency)
+}
+
+// AddHandlerWithContext sets the HandlerWithContext for messages received on any subscription
+//
+// See AddConcurrentHandlersWithContext.
+func (m *MultiConsumer) AddHandlerWithContext(handler HandlerWithContext) {
+	m.AddConcurrentHandlersWithContext(handler, 1)
+}
+
+// AddConcurrentHandlersWithContext sets the HandlerWithContext for messages received on
+// any subscription. At most concurrency messages are handled at a time, regardless of
+// which subscription they were received on.
+//
+// This can be called after connecting to NSQD or NSQ Lookupd (see
+// Consumer.AddConcurrentHandlersWithContext).
+func (m *MultiConsumer) AddConcurrentHandlersWithContext(handler HandlerWithContext, concurrency int) {
+	pool := &pooledHandler{
+		handler: handler,
+		slots:   make(chan struct{}, concurrency),
+	}
+	for _, c := range m.consumers {
+		c.AddConcurrentHandlersWithContext(pool, concurrency)
+	}
+}
+
+// ConnectToNSQLookupd adds an nsqlookupd address for all subscriptions
+//
+// See Consumer.ConnectToNSQLookupd for details.
+func (m *MultiConsumer) ConnectToNSQLookupd(addr string) error {
+	return m.ConnectToNSQLookupds([]string{addr})
+}
+
+// ConnectToNSQLookupds adds multiple nsqlookupd addresses for all subscriptions
+//
+// See Consumer.ConnectToNSQLookupds for details.
+func (m *MultiConsumer) ConnectToNSQLookupds(addresses []string) error {
+	for _, c := range m.consumers {
+		err := c.ConnectToNSQLookupds(addresses)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetNSQLookupdAddresses replaces the nsqlookupd addresses of all subscriptions
+//
+// See Consumer.SetNSQLookupdAddresses for details.
+func (m *MultiConsumer) SetNSQLookupdAddresses(addresses []string) error {
+	for _, c := range m.consumers {
+		err := c.SetNSQLookupdAddresses(addresses)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ConnectToNSQD connects all subscriptions directly to the specified nsqd
+//
+// See Consumer.ConnectToNSQD for details.
+func (m *MultiConsumer) ConnectToNSQD(addr string) error {
+	return m.ConnectToNSQDs([]string{addr})
+}
+
+// ConnectToNSQDs connects all subscriptions directly to the specified nsqds
+//
+// See Consumer.ConnectToNSQDs for details.
+func (m *MultiConsumer) ConnectToNSQDs(addresses []string) error {
+	for _, c := range m.consumers {
+		err := c.ConnectToNSQDs(addresses)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Stop will initiate a graceful stop of all consumers (permanent)
+//
+// NOTE: receive on StopChan to block until this process completes
+func (m *MultiConsumer) Stop() {
+	if !atomic.CompareAndSwapInt32(&m.stopFlag, 0, 1) {
+		return
+	}
+	close(m.exitChan)
+	for _, c := range m.consumers {
+		c.Stop()
+	}
+}
+
+// pooledHandler limits the number of concurrent calls to handler, across
+// all of the consumers it was added to
+type pooledHandler struct {
+	handler HandlerWithContext
+	slots   chan struct{}
+}
+
+func (p *pooledHandler) HandleMessage(ctx context.Context, message *Message) error {
+	p.slots <- struct{}{}
+	defer func() { <-p.slots }()
+	return p.handler.HandleMessage(ctx, message)
+}
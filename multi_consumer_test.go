@@ -0,0 +1,138 @@
+package nsq
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMultiConsumerMaxInFlight(t *testing.T) {
+	config := NewConfig()
+	config.MaxInFlight = 5
+	m, err := NewMultiConsumer([]Subscription{
+		{"multi_a", "ch"},
+		{"multi_b", "ch"},
+		{"multi_c", "ch"},
+	}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.SetLogger(nullLogger, LogLevelInfo)
+	m.AddConcurrentHandlers(&testHandler{}, 2)
+
+	for _, tc := range []struct {
+		maxInFlight int
+		expected    []int32
+	}{
+		{5, []int32{2, 2, 1}},
+		{2, []int32{1, 1, 0}},
+		{0, []int32{0, 0, 0}},
+		{9, []int32{3, 3, 3}},
+	} {
+		m.ChangeMaxInFlight(tc.maxInFlight)
+		for i, c := range m.Consumers() {
+			if c.getMaxInFlight() != tc.expected[i] {
+				t.Fatalf("max_in_flight %d: consumer %d got %d, expected %d",
+					tc.maxInFlight, i, c.getMaxInFlight(), tc.expected[i])
+			}
+		}
+	}
+
+	m.Stop()
+	select {
+	case <-m.StopChan:
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for MultiConsumer to stop")
+	}
+}
+
+func TestMultiConsumerMaxInFlightRotation(t *testing.T) {
+	config := NewConfig()
+	config.MaxInFlight = 1
+	config.RDYRedistributeInterval = 10 * time.Millisecond
+	m, err := NewMultiConsumer([]Subscription{
+		{"multi_a", "ch"},
+		{"multi_b", "ch"},
+		{"multi_c", "ch"},
+	}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.SetLogger(nullLogger, LogLevelInfo)
+	m.AddConcurrentHandlers(&testHandler{}, 1)
+
+	// the budget is never exceeded, and reaches every subscription in turn
+	served := make([]bool, 3)
+	deadline := time.Now().Add(time.Second)
+	for !served[0] || !served[1] || !served[2] {
+		if time.Now().After(deadline) {
+			t.Fatalf("not every subscription was given the budget %v", served)
+		}
+		m.mtx.Lock()
+		var total int32
+		for i, c := range m.Consumers() {
+			total += c.getMaxInFlight()
+			if c.getMaxInFlight() > 0 {
+				served[i] = true
+			}
+		}
+		m.mtx.Unlock()
+		if total != 1 {
+			t.Fatalf("max_in_flight %d exceeds the budget of 1", total)
+		}
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	m.Stop()
+	<-m.StopChan
+}
+
+func TestMultiConsumerInvalidSubscription(t *testing.T) {
+	_, err := NewMultiConsumer([]Subscription{{"ok", "ch"}, {"not ok", "ch"}}, NewConfig())
+	if err == nil {
+		t.Fatal("expected an error for an invalid topic name")
+	}
+	_, err = NewMultiConsumer(nil, NewConfig())
+	if err == nil {
+		t.Fatal("expected an error for no subscriptions")
+	}
+}
+
+func TestPooledHandler(t *testing.T) {
+	var running, maxRunning int32
+	pool := &pooledHandler{
+		handler: HandlerWithContextFunc(func(ctx context.Context, m *Message) error {
+			n := atomic.AddInt32(&running, 1)
+			for {
+				max := atomic.LoadInt32(&maxRunning)
+				if n <= max || atomic.CompareAndSwapInt32(&maxRunning, max, n) {
+					break
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+			atomic.AddInt32(&running, -1)
+			return nil
+		}),
+		slots: make(chan struct{}, 2),
+	}
+
+	ctx := context.WithValue(context.Background(), subscriptionKey{}, Subscription{"pooled", "ch"})
+	done := make(chan int)
+	for i := 0; i < 6; i++ {
+		go func() {
+			pool.HandleMessage(ctx, &Message{})
+			done <- 1
+		}()
+	}
+	for i := 0; i < 6; i++ {
+		<-done
+	}
+
+	if maxRunning != 2 {
+		t.Fatalf("expected at most 2 concurrent handlers, got %d", maxRunning)
+	}
+	if s, ok := SubscriptionFromContext(ctx); !ok || s.Topic != "pooled" {
+		t.Fatalf("unexpected subscription %v", s)
+	}
+}
@@ -0,0 +1,345 @@
+// Package nsqcloudevents implements CloudEvents (https://cloudevents.io) bindings for
+// NSQ messages, modeled on the Kafka protocol binding:
+//
+// In binary mode the event data is the body of an envelope (see nsq.EncodeEnvelope),
+// whose headers carry the context attributes, prefixed "ce_" (e.g. "ce_type"), and the
+// datacontenttype as the "content-type" header.
+//
+// In structured mode the body is the JSON event format, in an envelope with a
+// "content-type" header of "application/cloudevents+json".
+//
+//	err := nsqcloudevents.Publish(producer, "orders", nsqcloudevents.Event{
+//		ID:              uuid,
+//		Source:          "/orders",
+//		Type:            "com.example.order.created",
+//		DataContentType: "application/json",
+//		Data:            data,
+//	}, nsqcloudevents.Binary)
+//
+//	consumer.AddHandlerWithContext(nsqcloudevents.Handler(
+//		func(ctx context.Context, e nsqcloudevents.Event, m *nsq.Message) error {
+//			...
+//		}))
+package nsqcloudevents
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/nsqio/go-nsq"
+)
+
+// SpecVersion is the version of the CloudEvents specification implemented
+const SpecVersion = "1.0"
+
+// ContentTypeStructured is the content type of events in structured mode
+const ContentTypeStructured = "application/cloudevents+json"
+
+// the prefix of the headers of context attributes in binary mode
+const headerPrefix = "ce_"
+
+// Mode is the binding mode of events published in messages
+type Mode int
+
+// Binding modes
+const (
+	Binary Mode = iota
+	Structured
+)
+
+// ErrNotCloudEvent is returned by Decode for messages that do not carry an event
+var ErrNotCloudEvent = errors.New("message is not a cloudevent")
+
+// Event is a CloudEvent
+type Event struct {
+	// required context attributes (SpecVersion defaults to SpecVersion)
+	ID          string
+	Source      string
+	SpecVersion string
+	Type        string
+
+	// optional context attributes
+	DataContentType string
+	DataSchema      string
+	Subject         string
+	Time            time.Time
+
+	// extension context attributes, by (lower-case alphanumeric) name
+	Extensions map[string]string
+
+	Data []byte
+}
+
+// the names of the context attributes defined by the specification
+var attributes = map[string]bool{
+	"id": true, "source": true, "specversion": true, "type": true, "datacontenttype": true,
+	"dataschema": true, "subject": true, "time": true, "data": true, "data_base64": true,
+}
+
+// Validate returns an error when a required attribute of e is missing, or an extension
+// attribute is not named per the specification
+func (e Event) Validate() error {
+	var missing []string
+	for _, a := range []struct{ name, value string }{
+		{"id", e.ID}, {"source", e.Source}, {"type", e.Type},
+	} {
+		if a.value == "" {
+			missing = append(missing, a.name)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("cloudevent is missing required attributes %s", strings.Join(missing, ", "))
+	}
+	if e.SpecVersion != "" && e.SpecVersion != SpecVersion {
+		return fmt.Errorf("unsupported cloudevents specversion %s", e.SpecVersion)
+	}
+	for name := range e.Extensions {
+		if !validExtensionName(name) {
+			return fmt.Errorf("invalid cloudevent extension attribute name %q", name)
+		}
+	}
+	return nil
+}
+
+func validExtensionName(name string) bool {
+	if name == "" || len(name) > 20 || attributes[name] {
+		return false
+	}
+	for _, c := range name {
+		if !('a' <= c && c <= 'z' || '0' <= c && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// Encode returns the body of a message carrying e in mode
+func Encode(e Event, mode Mode) ([]byte, error) {
+	if err := e.Validate(); err != nil {
+		return nil, err
+	}
+	if mode == Structured {
+		body, err := marshalStructured(e)
+		if err != nil {
+			return nil, err
+		}
+		return nsq.EncodeEnvelope(nsq.Headers{nsq.HeaderContentType: ContentTypeStructured}, body), nil
+	}
+
+	headers := nsq.Headers{
+		headerPrefix + "id":          e.ID,
+		headerPrefix + "source":      e.Source,
+		headerPrefix + "specversion": SpecVersion,
+		headerPrefix + "type":        e.Type,
+	}
+	if e.DataContentType != "" {
+		headers.Set(nsq.HeaderContentType, e.DataContentType)
+	}
+	if e.DataSchema != "" {
+		headers.Set(headerPrefix+"dataschema", e.DataSchema)
+	}
+	if e.Subject != "" {
+		headers.Set(headerPrefix+"subject", e.Subject)
+	}
+	if !e.Time.IsZero() {
+		headers.Set(headerPrefix+"time", e.Time.UTC().Format(time.RFC3339Nano))
+	}
+	for name, value := range e.Extensions {
+		headers.Set(headerPrefix+name, value)
+	}
+	return nsq.EncodeEnvelope(headers, e.Data), nil
+}
+
+// Decode returns the event carried by message, in either mode, or ErrNotCloudEvent
+func Decode(message *nsq.Message) (Event, error) {
+	headers, body, ok := message.Envelope()
+	if !ok {
+		return Event{}, ErrNotCloudEvent
+	}
+	if strings.HasPrefix(headers.Get(nsq.HeaderContentType), "application/cloudevents") {
+		return unmarshalStructured(body)
+	}
+	if headers.Get(headerPrefix+"specversion") == "" {
+		return Event{}, ErrNotCloudEvent
+	}
+
+	e := Event{
+		ID:              headers.Get(headerPrefix + "id"),
+		Source:          headers.Get(headerPrefix + "source"),
+		SpecVersion:     headers.Get(headerPrefix + "specversion"),
+		Type:            headers.Get(headerPrefix + "type"),
+		DataContentType: headers.Get(nsq.HeaderContentType),
+		DataSchema:      headers.Get(headerPrefix + "dataschema"),
+		Subject:         headers.Get(headerPrefix + "subject"),
+		Data:            body,
+	}
+	if len(body) == 0 {
+		e.Data = nil
+	}
+	if t, ok := headers.GetTime(headerPrefix + "time"); ok {
+		e.Time = t
+	}
+	for k, v := range headers {
+		name := strings.TrimPrefix(k, headerPrefix)
+		if name == k || attributes[name] {
+			continue
+		}
+		if e.Extensions == nil {
+			e.Extensions = make(map[string]string)
+		}
+		e.Extensions[name] = v
+	}
+	return e, e.Validate()
+}
+
+// isJSON indicates whether data of contentType is encoded inline in structured mode
+func isJSON(contentType string) bool {
+	if i := strings.IndexByte(contentType, ';'); i != -1 {
+		contentType = contentType[:i]
+	}
+	contentType = strings.TrimSpace(contentType)
+	return contentType == "" || contentType == "application/json" || contentType == "text/json" ||
+		strings.HasSuffix(contentType, "+json")
+}
+
+func marshalStructured(e Event) ([]byte, error) {
+	m := map[string]interface{}{
+		"id":          e.ID,
+		"source":      e.Source,
+		"specversion": SpecVersion,
+		"type":        e.Type,
+	}
+	if e.DataContentType != "" {
+		m["datacontenttype"] = e.DataContentType
+	}
+	if e.DataSchema != "" {
+		m["dataschema"] = e.DataSchema
+	}
+	if e.Subject != "" {
+		m["subject"] = e.Subject
+	}
+	if !e.Time.IsZero() {
+		m["time"] = e.Time.UTC().Format(time.RFC3339Nano)
+	}
+	for name, value := range e.Extensions {
+		m[name] = value
+	}
+	if e.Data != nil {
+		if isJSON(e.DataContentType) && json.Valid(e.Data) {
+			m["data"] = json.RawMessage(e.Data)
+		} else {
+			m["data_base64"] = base64.StdEncoding.EncodeToString(e.Data)
+		}
+	}
+	return json.Marshal(m)
+}
+
+func unmarshalStructured(body []byte) (Event, error) {
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(body, &m); err != nil {
+		return Event{}, fmt.Errorf("invalid structured cloudevent - %s", err)
+	}
+
+	var e Event
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		raw := m[name]
+		switch name {
+		case "data":
+			e.Data = []byte(raw)
+			continue
+		case "data_base64":
+			var s string
+			if err := json.Unmarshal(raw, &s); err != nil {
+				return Event{}, fmt.Errorf("invalid cloudevent data_base64 - %s", err)
+			}
+			data, err := base64.StdEncoding.DecodeString(s)
+			if err != nil {
+				return Event{}, fmt.Errorf("invalid cloudevent data_base64 - %s", err)
+			}
+			e.Data = data
+			continue
+		}
+
+		value, err := attributeString(raw)
+		if err != nil {
+			return Event{}, fmt.Errorf("invalid cloudevent attribute %s - %s", name, err)
+		}
+		switch name {
+		case "id":
+			e.ID = value
+		case "source":
+			e.Source = value
+		case "specversion":
+			e.SpecVersion = value
+		case "type":
+			e.Type = value
+		case "datacontenttype":
+			e.DataContentType = value
+		case "dataschema":
+			e.DataSchema = value
+		case "subject":
+			e.Subject = value
+		case "time":
+			t, err := time.Parse(time.RFC3339Nano, value)
+			if err != nil {
+				return Event{}, fmt.Errorf("invalid cloudevent time - %s", err)
+			}
+			e.Time = t
+		default:
+			if e.Extensions == nil {
+				e.Extensions = make(map[string]string)
+			}
+			e.Extensions[name] = value
+		}
+	}
+	return e, e.Validate()
+}
+
+// attributeString returns the value of an attribute in its canonical string form
+// (extension attributes may be JSON booleans or numbers)
+func attributeString(raw json.RawMessage) (string, error) {
+	var v interface{}
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return "", err
+	}
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case bool, float64:
+		return string(raw), nil
+	}
+	return "", errors.New("not a string, boolean or number")
+}
+
+// Publish synchronously publishes e in mode to topic
+func Publish(producer *nsq.Producer, topic string, e Event, mode Mode) error {
+	body, err := Encode(e, mode)
+	if err != nil {
+		return err
+	}
+	return producer.Publish(topic, body)
+}
+
+// Handler returns an nsq.HandlerWithContext calling fn with the event carried by each
+// message (see Decode). Messages that are not valid events are REQueued with the error
+// of Decode (and eventually dead-lettered, when enabled) without calling fn.
+func Handler(fn func(ctx context.Context, e Event, message *nsq.Message) error) nsq.HandlerWithContext {
+	return nsq.HandlerWithContextFunc(func(ctx context.Context, message *nsq.Message) error {
+		e, err := Decode(message)
+		if err != nil {
+			return err
+		}
+		return fn(ctx, e, message)
+	})
+}
@@ -0,0 +1,102 @@
+package nsqcloudevents
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nsqio/go-nsq"
+	"github.com/nsqio/go-nsq/nsqtest"
+)
+
+func TestEncodeDecode(t *testing.T) {
+	events := []Event{
+		{
+			ID:              "1",
+			Source:          "/orders",
+			Type:            "com.example.order.created",
+			DataContentType: "application/json",
+			DataSchema:      "https://example.com/order.json",
+			Subject:         "order-1",
+			Time:            time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC),
+			Extensions:      map[string]string{"tenant": "acme"},
+			Data:            []byte(`{"total":42}`),
+		},
+		{
+			ID:              "2",
+			Source:          "/images",
+			Type:            "com.example.image.uploaded",
+			DataContentType: "image/png",
+			Data:            []byte{0x89, 'P', 'N', 'G', 0x00},
+		},
+		{ID: "3", Source: "/pings", Type: "com.example.ping"},
+	}
+	for _, mode := range []Mode{Binary, Structured} {
+		for _, e := range events {
+			body, err := Encode(e, mode)
+			if err != nil {
+				t.Fatal(err)
+			}
+			msg, _ := nsqtest.NewMessage(body)
+			got, err := Decode(msg)
+			if err != nil {
+				t.Fatalf("mode %d, event %s: %s", mode, e.ID, err)
+			}
+			e.SpecVersion = SpecVersion
+			if !reflect.DeepEqual(got, e) {
+				t.Fatalf("mode %d: decoded event %+v != %+v", mode, got, e)
+			}
+		}
+	}
+
+	body, _ := Encode(events[0], Binary)
+	headers, _, _ := nsq.DecodeEnvelope(body)
+	if headers.Get("ce_type") != events[0].Type || headers.Get(nsq.HeaderContentType) != "application/json" ||
+		headers.Get("ce_tenant") != "acme" {
+		t.Fatalf("unexpected binary headers %v", headers)
+	}
+	body, _ = Encode(events[0], Structured)
+	headers, data, _ := nsq.DecodeEnvelope(body)
+	if headers.Get(nsq.HeaderContentType) != ContentTypeStructured || !strings.Contains(string(data), `"data":{"total":42}`) {
+		t.Fatalf("unexpected structured event %v %s", headers, data)
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	msg, _ := nsqtest.NewMessage([]byte("plain"))
+	if _, err := Decode(msg); err != ErrNotCloudEvent {
+		t.Fatalf("unexpected error %v", err)
+	}
+	msg, _ = nsqtest.NewMessage([]byte("data"), nsqtest.WithHeaders(nsq.Headers{"ce_specversion": "1.0", "ce_id": "1"}))
+	if _, err := Decode(msg); err == nil || !strings.Contains(err.Error(), "missing required attributes source, type") {
+		t.Fatalf("unexpected error %v", err)
+	}
+	msg, _ = nsqtest.NewMessage([]byte(`{"id":"1","source":"/s","type":"t","specversion":"1.0","count":3,"ok":true}`),
+		nsqtest.WithHeaders(nsq.Headers{nsq.HeaderContentType: ContentTypeStructured}))
+	e, err := Decode(msg)
+	if err != nil || e.Extensions["count"] != "3" || e.Extensions["ok"] != "true" {
+		t.Fatalf("unexpected event %+v (%v)", e, err)
+	}
+	if _, err := Encode(Event{ID: "1", Source: "/s", Type: "t", Extensions: map[string]string{"Bad-Name": ""}}, Binary); err == nil {
+		t.Fatalf("invalid extension name should be rejected")
+	}
+}
+
+func TestHandler(t *testing.T) {
+	var got Event
+	h := Handler(func(ctx context.Context, e Event, m *nsq.Message) error {
+		got = e
+		return nil
+	})
+	body, _ := Encode(Event{ID: "1", Source: "/s", Type: "t"}, Binary)
+	msg, _ := nsqtest.NewMessage(body)
+	if err := h.HandleMessage(context.Background(), msg); err != nil || got.ID != "1" {
+		t.Fatalf("unexpected event %+v (%v)", got, err)
+	}
+	msg, _ = nsqtest.NewMessage([]byte("plain"))
+	if err := h.HandleMessage(context.Background(), msg); err != ErrNotCloudEvent {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
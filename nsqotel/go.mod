@@ -0,0 +1,18 @@
+module github.com/nsqio/go-nsq/nsqotel
+
+go 1.20
+
+require (
+	github.com/nsqio/go-nsq v1.0.8
+	go.opentelemetry.io/otel v1.24.0
+	go.opentelemetry.io/otel/trace v1.24.0
+)
+
+require (
+	github.com/go-logr/logr v1.4.1 // indirect
+	github.com/go-logr/stdr v1.2.2 // indirect
+	github.com/golang/snappy v0.0.1 // indirect
+	go.opentelemetry.io/otel/metric v1.24.0 // indirect
+)
+
+replace github.com/nsqio/go-nsq => ../
@@ -0,0 +1,150 @@
+// Package nsqotel provides OpenTelemetry tracing instrumentation for go-nsq
+//
+// Producers inject the current trace context into the headers of an envelope
+// (see nsq.EncodeEnvelope) with Inject, and Consumers start a span per handled
+// message, linked to the producing trace, with the middleware returned by Middleware.
+package nsqotel
+
+import (
+	"context"
+
+	"github.com/nsqio/go-nsq"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "github.com/nsqio/go-nsq/nsqotel"
+
+type config struct {
+	tracerProvider trace.TracerProvider
+	propagator     propagation.TextMapPropagator
+	link           bool
+}
+
+// Option configures the instrumentation
+type Option func(*config)
+
+// WithTracerProvider sets the TracerProvider used to create spans (default: the global provider)
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return func(c *config) {
+		c.tracerProvider = tp
+	}
+}
+
+// WithPropagator sets the propagator used to inject and extract trace context
+// (default: the global propagator)
+func WithPropagator(p propagation.TextMapPropagator) Option {
+	return func(c *config) {
+		c.propagator = p
+	}
+}
+
+// WithLinks causes consumer spans to start a new trace linked to the producing span,
+// rather than being its child
+func WithLinks() Option {
+	return func(c *config) {
+		c.link = true
+	}
+}
+
+func newConfig(opts []Option) *config {
+	c := &config{
+		tracerProvider: otel.GetTracerProvider(),
+		propagator:     otel.GetTextMapPropagator(),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Inject adds the trace context of ctx to headers, to be published in an envelope
+//
+//	headers := nsq.Headers{}
+//	nsqotel.Inject(ctx, headers)
+//	producer.Publish(topic, nsq.EncodeEnvelope(headers, body))
+func Inject(ctx context.Context, headers nsq.Headers, opts ...Option) {
+	newConfig(opts).propagator.Inject(ctx, propagation.MapCarrier(headers))
+}
+
+// Extract returns ctx with the trace context carried in the envelope of message (if any)
+func Extract(ctx context.Context, message *nsq.Message, opts ...Option) context.Context {
+	return extract(ctx, newConfig(opts), message)
+}
+
+// Propagator returns an nsq.Propagator (see nsq.Config.Propagator) extracting the
+// trace context carried in message envelopes, for use with nsq.Message.Context
+func Propagator(opts ...Option) nsq.Propagator {
+	c := newConfig(opts)
+	return nsq.PropagatorFunc(func(ctx context.Context, headers nsq.Headers) context.Context {
+		return c.propagator.Extract(ctx, propagation.MapCarrier(headers))
+	})
+}
+
+func extract(ctx context.Context, c *config, message *nsq.Message) context.Context {
+	headers, _, ok := message.Envelope()
+	if !ok {
+		return ctx
+	}
+	return c.propagator.Extract(ctx, propagation.MapCarrier(headers))
+}
+
+// Middleware returns an nsq.HandlerMiddleware (see Consumer.Use) that starts a consumer
+// span for every handled message, parented to (or linked with) the trace context
+// extracted from the message envelope.
+//
+// The span records the message ID, attempts, nsqd address and the outcome of handling
+// (FIN, or REQ when the handler returns an error).
+func Middleware(opts ...Option) nsq.HandlerMiddleware {
+	c := newConfig(opts)
+	tracer := c.tracerProvider.Tracer(instrumentationName)
+
+	return func(next nsq.HandlerWithContext) nsq.HandlerWithContext {
+		return nsq.HandlerWithContextFunc(func(ctx context.Context, m *nsq.Message) error {
+			s, _ := nsq.SubscriptionFromContext(ctx)
+			attrs := []attribute.KeyValue{
+				attribute.String("messaging.system", "nsq"),
+				attribute.String("messaging.operation", "process"),
+				attribute.String("messaging.destination.name", s.Topic),
+				attribute.String("messaging.nsq.channel", s.Channel),
+				attribute.String("messaging.message.id", string(m.ID[:])),
+				attribute.Int("messaging.nsq.attempts", int(m.Attempts)),
+				attribute.String("messaging.nsq.nsqd_address", m.NSQDAddress),
+			}
+			spanOpts := []trace.SpanStartOption{
+				trace.WithSpanKind(trace.SpanKindConsumer),
+				trace.WithAttributes(attrs...),
+			}
+
+			producerCtx := extract(context.Background(), c, m)
+			if c.link {
+				if sc := trace.SpanContextFromContext(producerCtx); sc.IsValid() {
+					spanOpts = append(spanOpts, trace.WithLinks(trace.Link{SpanContext: sc}))
+				}
+			} else {
+				ctx = extract(ctx, c, m)
+			}
+
+			ctx, span := tracer.Start(ctx, s.Topic+" process", spanOpts...)
+			defer span.End()
+
+			err := next.HandleMessage(ctx, m)
+			switch {
+			case m.IsAutoResponseDisabled():
+				span.SetAttributes(attribute.String("messaging.nsq.outcome", "manual"))
+			case err != nil:
+				span.SetAttributes(attribute.String("messaging.nsq.outcome", "requeue"))
+			default:
+				span.SetAttributes(attribute.String("messaging.nsq.outcome", "finish"))
+			}
+			if err != nil {
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+			}
+			return err
+		})
+	}
+}
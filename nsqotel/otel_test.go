@@ -0,0 +1,65 @@
+package nsqotel
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nsqio/go-nsq"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+func TestMiddlewarePropagation(t *testing.T) {
+	opts := []Option{
+		WithTracerProvider(noop.NewTracerProvider()),
+		WithPropagator(propagation.TraceContext{}),
+	}
+
+	producerSpan := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID{0x01, 0x02, 0x03},
+		SpanID:     trace.SpanID{0x04, 0x05},
+		TraceFlags: trace.FlagsSampled,
+	})
+	headers := nsq.Headers{}
+	Inject(trace.ContextWithSpanContext(context.Background(), producerSpan), headers, opts...)
+	if headers["traceparent"] == "" {
+		t.Fatalf("trace context was not injected: %v", headers)
+	}
+
+	msg := nsq.NewMessage(nsq.MessageID{}, nsq.EncodeEnvelope(headers, []byte("body")))
+	var got trace.SpanContext
+	handler := Middleware(opts...)(nsq.HandlerWithContextFunc(func(ctx context.Context, m *nsq.Message) error {
+		got = trace.SpanContextFromContext(ctx)
+		return nil
+	}))
+	handler.HandleMessage(context.Background(), msg)
+
+	if got.TraceID() != producerSpan.TraceID() {
+		t.Fatalf("handler trace ID %s != producer trace ID %s", got.TraceID(), producerSpan.TraceID())
+	}
+
+	// without an envelope there is nothing to extract
+	msg = nsq.NewMessage(nsq.MessageID{}, []byte("body"))
+	handler.HandleMessage(context.Background(), msg)
+	if got.IsValid() {
+		t.Fatalf("unexpected span context %v", got)
+	}
+}
+
+func TestPropagator(t *testing.T) {
+	spanContext := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID{0x01, 0x02, 0x03},
+		SpanID:     trace.SpanID{0x04, 0x05},
+		TraceFlags: trace.FlagsSampled,
+	})
+	headers := nsq.Headers{}
+	Inject(trace.ContextWithSpanContext(context.Background(), spanContext), headers,
+		WithPropagator(propagation.TraceContext{}))
+
+	p := Propagator(WithPropagator(propagation.TraceContext{}))
+	got := trace.SpanContextFromContext(p.Extract(context.Background(), headers))
+	if got.TraceID() != spanContext.TraceID() || !got.IsRemote() {
+		t.Fatalf("extracted span context %v != %v", got, spanContext)
+	}
+}
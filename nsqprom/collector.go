@@ -0,0 +1,193 @@
+// Package nsqprom exposes metrics of go-nsq Consumers as a prometheus.Collector
+package nsqprom
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/nsqio/go-nsq"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ConsumerCollector is a prometheus.Collector for a set of nsq.Consumers
+//
+// Message counters, connection counts and backoff state are labeled by topic and
+// channel, per-connection RDY and in-flight counts and handler latency are additionally
+// labeled by nsqd address.
+type ConsumerCollector struct {
+	mtx       sync.RWMutex
+	consumers map[*nsq.Consumer]struct{}
+
+	received      *prometheus.Desc
+	finished      *prometheus.Desc
+	requeued      *prometheus.Desc
+	timedOut      *prometheus.Desc
+	filtered      *prometheus.Desc
+	dedupHits     *prometheus.Desc
+	dedupMisses   *prometheus.Desc
+	slowHandlers  *prometheus.Desc
+	handlerPanics *prometheus.Desc
+	abandoned     *prometheus.Desc
+	connections   *prometheus.Desc
+	inFlightBytes *prometheus.Desc
+	backoffLevel  *prometheus.Desc
+	rdy           *prometheus.Desc
+	inFlight      *prometheus.Desc
+
+	latency *prometheus.HistogramVec
+}
+
+// NewConsumerCollector returns a ConsumerCollector whose metric names are prefixed
+// with namespace (e.g. `<namespace>_nsq_consumer_messages_received_total`)
+func NewConsumerCollector(namespace string) *ConsumerCollector {
+	name := func(n string) string {
+		return prometheus.BuildFQName(namespace, "nsq_consumer", n)
+	}
+	labels := []string{"topic", "channel"}
+	connLabels := []string{"topic", "channel", "nsqd"}
+
+	return &ConsumerCollector{
+		consumers: make(map[*nsq.Consumer]struct{}),
+
+		received: prometheus.NewDesc(name("messages_received_total"),
+			"Number of messages received from nsqd.", labels, nil),
+		finished: prometheus.NewDesc(name("messages_finished_total"),
+			"Number of messages FINished.", labels, nil),
+		requeued: prometheus.NewDesc(name("messages_requeued_total"),
+			"Number of messages REQueued.", labels, nil),
+		timedOut: prometheus.NewDesc(name("messages_timed_out_total"),
+			"Number of messages whose handler exceeded the handler timeout.", labels, nil),
+		filtered: prometheus.NewDesc(name("messages_filtered_total"),
+			"Number of messages rejected by a filter.", labels, nil),
+		dedupHits: prometheus.NewDesc(name("dedup_hits_total"),
+			"Number of messages suppressed as duplicates.", labels, nil),
+		dedupMisses: prometheus.NewDesc(name("dedup_misses_total"),
+			"Number of messages checked for duplicates and not found.", labels, nil),
+		slowHandlers: prometheus.NewDesc(name("slow_handlers_total"),
+			"Number of handler invocations exceeding the slow handler threshold.", labels, nil),
+		handlerPanics: prometheus.NewDesc(name("handler_panics_total"),
+			"Number of handler panics recovered.", labels, nil),
+		abandoned: prometheus.NewDesc(name("messages_abandoned_total"),
+			"Number of messages in flight when connections were closed on stop.", labels, nil),
+		connections: prometheus.NewDesc(name("connections"),
+			"Number of connections to nsqd.", labels, nil),
+		inFlightBytes: prometheus.NewDesc(name("in_flight_bytes"),
+			"Summed body size of messages in flight.", labels, nil),
+		backoffLevel: prometheus.NewDesc(name("backoff_level"),
+			"Number of successful messages required to exit backoff (0 when not backing off).",
+			labels, nil),
+		rdy: prometheus.NewDesc(name("rdy"),
+			"Current RDY count of a connection.", connLabels, nil),
+		inFlight: prometheus.NewDesc(name("messages_in_flight"),
+			"Number of messages in flight on a connection.", connLabels, nil),
+
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "nsq_consumer",
+			Name:      "handler_duration_seconds",
+			Help:      "Duration of handler invocations.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"topic", "channel", "nsqd", "outcome"}),
+	}
+}
+
+// Add starts collecting metrics for consumer, installing middleware (see Consumer.Use)
+// to observe handler latency
+func (c *ConsumerCollector) Add(consumer *nsq.Consumer) {
+	c.mtx.Lock()
+	c.consumers[consumer] = struct{}{}
+	c.mtx.Unlock()
+	consumer.Use(c.Middleware())
+}
+
+// Remove stops collecting metrics for consumer (e.g. once it has been stopped)
+func (c *ConsumerCollector) Remove(consumer *nsq.Consumer) {
+	c.mtx.Lock()
+	delete(c.consumers, consumer)
+	c.mtx.Unlock()
+}
+
+// Middleware returns an nsq.HandlerMiddleware observing handler latency
+//
+// It is installed by Add and only needs to be used directly for handlers of
+// consumers that are not added to the collector.
+func (c *ConsumerCollector) Middleware() nsq.HandlerMiddleware {
+	return func(next nsq.HandlerWithContext) nsq.HandlerWithContext {
+		return nsq.HandlerWithContextFunc(func(ctx context.Context, m *nsq.Message) error {
+			start := time.Now()
+			err := next.HandleMessage(ctx, m)
+
+			outcome := "success"
+			if err != nil {
+				outcome = "error"
+			}
+			s, _ := nsq.SubscriptionFromContext(ctx)
+			c.latency.WithLabelValues(s.Topic, s.Channel, m.NSQDAddress, outcome).
+				Observe(time.Since(start).Seconds())
+			return err
+		})
+	}
+}
+
+// Describe implements prometheus.Collector
+func (c *ConsumerCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.received
+	ch <- c.finished
+	ch <- c.requeued
+	ch <- c.timedOut
+	ch <- c.filtered
+	ch <- c.dedupHits
+	ch <- c.dedupMisses
+	ch <- c.slowHandlers
+	ch <- c.handlerPanics
+	ch <- c.abandoned
+	ch <- c.connections
+	ch <- c.inFlightBytes
+	ch <- c.backoffLevel
+	ch <- c.rdy
+	ch <- c.inFlight
+	c.latency.Describe(ch)
+}
+
+// Collect implements prometheus.Collector
+func (c *ConsumerCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+
+	for consumer := range c.consumers {
+		s := consumer.Subscription()
+		stats := consumer.Stats()
+
+		counter := func(desc *prometheus.Desc, v uint64) {
+			ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue,
+				float64(v), s.Topic, s.Channel)
+		}
+		counter(c.received, stats.MessagesReceived)
+		counter(c.finished, stats.MessagesFinished)
+		counter(c.requeued, stats.MessagesRequeued)
+		counter(c.timedOut, stats.MessagesTimedOut)
+		counter(c.filtered, stats.MessagesFiltered)
+		counter(c.dedupHits, stats.DedupHits)
+		counter(c.dedupMisses, stats.DedupMisses)
+		counter(c.slowHandlers, stats.SlowHandlers)
+		counter(c.handlerPanics, stats.HandlerPanics)
+		counter(c.abandoned, stats.MessagesAbandoned)
+
+		ch <- prometheus.MustNewConstMetric(c.connections, prometheus.GaugeValue,
+			float64(stats.Connections), s.Topic, s.Channel)
+		ch <- prometheus.MustNewConstMetric(c.inFlightBytes, prometheus.GaugeValue,
+			float64(stats.InFlightBytes), s.Topic, s.Channel)
+		ch <- prometheus.MustNewConstMetric(c.backoffLevel, prometheus.GaugeValue,
+			float64(stats.BackoffLevel), s.Topic, s.Channel)
+
+		for _, conn := range consumer.ConnectionStats() {
+			ch <- prometheus.MustNewConstMetric(c.rdy, prometheus.GaugeValue,
+				float64(conn.RDY), s.Topic, s.Channel, conn.Addr)
+			ch <- prometheus.MustNewConstMetric(c.inFlight, prometheus.GaugeValue,
+				float64(conn.InFlight), s.Topic, s.Channel, conn.Addr)
+		}
+	}
+
+	c.latency.Collect(ch)
+}
@@ -0,0 +1,58 @@
+package nsqprom
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/nsqio/go-nsq"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestConsumerCollector(t *testing.T) {
+	consumer, err := nsq.NewConsumer("collector_test", "ch", nsq.NewConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewConsumerCollector("test")
+	c.Add(consumer)
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(c)
+
+	handler := c.Middleware()(nsq.HandlerWithContextFunc(func(ctx context.Context, m *nsq.Message) error {
+		return errors.New("boom")
+	}))
+	handler.HandleMessage(context.Background(), &nsq.Message{NSQDAddress: "127.0.0.1:4150"})
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := make(map[string]bool)
+	for _, f := range families {
+		found[f.GetName()] = true
+	}
+	for _, name := range []string{
+		"test_nsq_consumer_messages_received_total",
+		"test_nsq_consumer_connections",
+		"test_nsq_consumer_in_flight_bytes",
+		"test_nsq_consumer_backoff_level",
+		"test_nsq_consumer_handler_duration_seconds",
+	} {
+		if !found[name] {
+			t.Errorf("metric %s was not collected", name)
+		}
+	}
+
+	c.Remove(consumer)
+	families, err = registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range families {
+		if f.GetName() == "test_nsq_consumer_messages_received_total" {
+			t.Error("metrics collected for a removed consumer")
+		}
+	}
+}
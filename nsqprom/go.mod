@@ -0,0 +1,10 @@
+module github.com/nsqio/go-nsq/nsqprom
+
+go 1.13
+
+require (
+	github.com/nsqio/go-nsq v1.0.8
+	github.com/prometheus/client_golang v1.11.1
+)
+
+replace github.com/nsqio/go-nsq => ../
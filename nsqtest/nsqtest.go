@@ -0,0 +1,161 @@
+// Package nsqtest provides utilities for testing message handlers, building messages
+// as received from nsqd and recording how handlers respond to them.
+//
+//	func TestHandler(t *testing.T) {
+//		msg, d := nsqtest.NewMessage([]byte(`{"id":1}`), nsqtest.WithAttempts(3))
+//		if err := handler.HandleMessage(msg); err != nil {
+//			t.Fatal(err)
+//		}
+//		msg.Finish()
+//		if !d.Finished() {
+//			t.Fatal("message was not finished")
+//		}
+//	}
+package nsqtest
+
+import (
+	"encoding/hex"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nsqio/go-nsq"
+)
+
+var lastID = uint64(rand.New(rand.NewSource(time.Now().UnixNano())).Int63())
+
+// NewMessageID returns a unique, valid message ID (16 hex characters, like those
+// generated by nsqd)
+func NewMessageID() nsq.MessageID {
+	var b [nsq.MsgIDLength / 2]byte
+	id := atomic.AddUint64(&lastID, 1)
+	for i := len(b) - 1; i >= 0; i-- {
+		b[i] = byte(id)
+		id >>= 8
+	}
+	var msgID nsq.MessageID
+	hex.Encode(msgID[:], b[:])
+	return msgID
+}
+
+// MessageOption sets a field of a message built by NewMessage
+type MessageOption func(m *nsq.Message)
+
+// WithID sets the ID of the message (default: NewMessageID)
+func WithID(id nsq.MessageID) MessageOption {
+	return func(m *nsq.Message) {
+		m.ID = id
+	}
+}
+
+// WithAttempts sets the number of attempts of the message (default: 1)
+func WithAttempts(attempts uint16) MessageOption {
+	return func(m *nsq.Message) {
+		m.Attempts = attempts
+	}
+}
+
+// WithTimestamp sets the time the message was published (default: now)
+func WithTimestamp(t time.Time) MessageOption {
+	return func(m *nsq.Message) {
+		m.Timestamp = t.UnixNano()
+	}
+}
+
+// WithNSQDAddress sets the address of the nsqd the message was received from
+// (default: "127.0.0.1:4150")
+func WithNSQDAddress(addr string) MessageOption {
+	return func(m *nsq.Message) {
+		m.NSQDAddress = addr
+	}
+}
+
+// WithHeaders encloses the body of the message in an envelope with headers (see
+// nsq.EncodeEnvelope), as published by nsq.Producer.PublishWithHeaders
+func WithHeaders(headers nsq.Headers) MessageOption {
+	return func(m *nsq.Message) {
+		m.Body = nsq.EncodeEnvelope(headers, m.Body)
+	}
+}
+
+// NewMessage returns a message with body, as received on its first attempt, and the
+// Delegate recording the responses to it
+func NewMessage(body []byte, opts ...MessageOption) (*nsq.Message, *Delegate) {
+	m := nsq.NewMessage(NewMessageID(), body)
+	m.Attempts = 1
+	m.NSQDAddress = "127.0.0.1:4150"
+	for _, opt := range opts {
+		opt(m)
+	}
+	d := &Delegate{}
+	m.Delegate = d
+	return m, d
+}
+
+// Requeue is a REQ recorded by Delegate
+type Requeue struct {
+	Delay   time.Duration
+	Backoff bool
+}
+
+// Delegate is an nsq.MessageDelegate recording the responses to messages, in place
+// of the connection to nsqd
+type Delegate struct {
+	mtx      sync.Mutex
+	finished int
+	requeues []Requeue
+	touches  int
+}
+
+// OnFinish implements nsq.MessageDelegate
+func (d *Delegate) OnFinish(m *nsq.Message) {
+	d.mtx.Lock()
+	d.finished++
+	d.mtx.Unlock()
+}
+
+// OnRequeue implements nsq.MessageDelegate
+func (d *Delegate) OnRequeue(m *nsq.Message, delay time.Duration, backoff bool) {
+	d.mtx.Lock()
+	d.requeues = append(d.requeues, Requeue{Delay: delay, Backoff: backoff})
+	d.mtx.Unlock()
+}
+
+// OnTouch implements nsq.MessageDelegate
+func (d *Delegate) OnTouch(m *nsq.Message) {
+	d.mtx.Lock()
+	d.touches++
+	d.mtx.Unlock()
+}
+
+// Finished indicates whether a message was FINished
+func (d *Delegate) Finished() bool {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	return d.finished > 0
+}
+
+// Requeued returns the last REQ of a message, if it was requeued
+func (d *Delegate) Requeued() (Requeue, bool) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if len(d.requeues) == 0 {
+		return Requeue{}, false
+	}
+	return d.requeues[len(d.requeues)-1], true
+}
+
+// Touches returns the number of times a message was TOUCHed
+func (d *Delegate) Touches() int {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	return d.touches
+}
+
+// Responded indicates whether a message was either FINished or REQueued
+func (d *Delegate) Responded() bool {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	return d.finished > 0 || len(d.requeues) > 0
+}
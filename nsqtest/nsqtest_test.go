@@ -0,0 +1,61 @@
+package nsqtest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nsqio/go-nsq"
+)
+
+func TestNewMessageID(t *testing.T) {
+	seen := make(map[nsq.MessageID]bool)
+	for i := 0; i < 1000; i++ {
+		id := NewMessageID()
+		for _, c := range id {
+			if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+				t.Fatalf("invalid message ID %s", id)
+			}
+		}
+		if seen[id] {
+			t.Fatalf("duplicate message ID %s", id)
+		}
+		seen[id] = true
+	}
+}
+
+func TestNewMessage(t *testing.T) {
+	id := NewMessageID()
+	ts := time.Unix(1600000000, 0)
+	msg, d := NewMessage([]byte("body"), WithID(id), WithAttempts(3), WithTimestamp(ts),
+		WithHeaders(nsq.Headers{"k": "v"}))
+	if msg.ID != id || msg.Attempts != 3 || msg.Timestamp != ts.UnixNano() {
+		t.Fatalf("unexpected message %+v", msg)
+	}
+	headers, body, ok := msg.Envelope()
+	if !ok || headers.Get("k") != "v" || string(body) != "body" {
+		t.Fatalf("unexpected envelope %v %q (%v)", headers, body, ok)
+	}
+
+	msg.Touch()
+	msg.Touch()
+	if d.Touches() != 2 || d.Responded() {
+		t.Fatalf("message should be touched twice and not responded to")
+	}
+	msg.RequeueWithoutBackoff(time.Second)
+	msg.Finish()
+	if req, ok := d.Requeued(); !ok || req != (Requeue{Delay: time.Second}) {
+		t.Fatalf("unexpected requeue %+v (%v)", req, ok)
+	}
+	if d.Finished() {
+		t.Fatalf("message should only be responded to once")
+	}
+
+	msg, d = NewMessage(nil)
+	if msg.Attempts != 1 || msg.Delegate != d {
+		t.Fatalf("unexpected message %+v", msg)
+	}
+	msg.Finish()
+	if !d.Finished() || !msg.HasResponded() {
+		t.Fatalf("message should be finished")
+	}
+}
@@ -0,0 +1,464 @@
+package nsq
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// PatternConsumer consumes a channel of every topic whose name matches a pattern.
+//
+// Topics are discovered by polling the /topics endpoint of the configured nsqlookupd
+// instances every LookupdPollInterval. A Consumer is started for each matching topic
+// as it appears and stopped when it is no longer registered with any nsqlookupd.
+//
+// All topics share the handler goroutines added via AddConcurrentHandlers (or
+// AddConcurrentHandlersWithContext). Handlers can determine the topic a message was
+// received on via SubscriptionFromContext.
+type PatternConsumer struct {
+	pattern *regexp.Regexp
+	channel string
+	config  Config
+
+	logger logger
+	logLvl LogLevel
+
+	mtx              sync.RWMutex
+	handler          HandlerWithContext
+	concurrency      int
+	middleware       []HandlerMiddleware
+	filters          []MessageFilter
+	consumers        map[string]*Consumer
+	lookupdHTTPAddrs []string
+	overrides        topicOverrides
+
+	connectedFlag int32
+	stopFlag      int32
+	wg            sync.WaitGroup
+
+	// read from this channel to block until all consumers are cleanly stopped
+	StopChan chan int
+	exitChan chan int
+}
+
+// NewPatternConsumer creates a new instance of PatternConsumer for the specified channel
+// of all topics matching pattern (a regular expression that must match the entire topic
+// name, e.g. `orders\..*`)
+func NewPatternConsumer(pattern string, channel string, config *Config) (*PatternConsumer, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	re, err := regexp.Compile("^(?:" + pattern + ")$")
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ValidateChannelName(channel); err != nil {
+		return nil, err
+	}
+
+	return &PatternConsumer{
+		pattern: re,
+		channel: channel,
+		config:  *config,
+
+		logger: log.New(os.Stderr, "", log.Flags()),
+		logLvl: LogLevelInfo,
+
+		consumers: make(map[string]*Consumer),
+		overrides: newTopicOverrides(),
+
+		StopChan: make(chan int),
+		exitChan: make(chan int),
+	}, nil
+}
+
+// SetLogger assigns the logger to use as well as a level, for this PatternConsumer
+// and all of the Consumers it starts
+//
+// See Consumer.SetLogger for details.
+//
+// This panics if called after connecting to NSQ Lookupd
+func (p *PatternConsumer) SetLogger(l logger, lvl LogLevel) {
+	if atomic.LoadInt32(&p.connectedFlag) == 1 {
+		panic("already connected")
+	}
+	p.logger = l
+	p.logLvl = lvl
+}
+
+// Use appends middleware to the chain wrapping the handler of every topic (see Consumer.Use)
+//
+// This can be called after connecting to NSQ Lookupd, in which case the middleware
+// applies to subsequent messages of the running Consumers and to those started later.
+func (p *PatternConsumer) Use(mw ...HandlerMiddleware) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.middleware = append(p.middleware, mw...)
+	for _, c := range p.consumers {
+		c.Use(mw...)
+	}
+}
+
+// AddFilter adds a MessageFilter for every topic (see Consumer.AddFilter)
+//
+// This can be called after connecting to NSQ Lookupd, in which case the filter
+// applies to the running Consumers and to those started later.
+func (p *PatternConsumer) AddFilter(filter MessageFilter) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.filters = append(p.filters, filter)
+	for _, c := range p.consumers {
+		c.AddFilter(filter)
+	}
+}
+
+// AddHandler sets the Handler for messages received on any matching topic
+//
+// See AddConcurrentHandlersWithContext.
+func (p *PatternConsumer) AddHandler(handler Handler) {
+	p.AddConcurrentHandlers(handler, 1)
+}
+
+// AddConcurrentHandlers sets the Handler for messages received on any matching topic
+//
+// See AddConcurrentHandlersWithContext.
+func (p *PatternConsumer) AddConcurrentHandlers(handler Handler, concurrency int) {
+	p.AddConcurrentHandlersWithContext(handlerAdapter{handler}, concurrency)
+}
+
+// AddHandlerWithContext sets the HandlerWithContext for messages received on any matching topic
+//
+// See AddConcurrentHandlersWithContext.
+func (p *PatternConsumer) AddHandlerWithContext(handler HandlerWithContext) {
+	p.AddConcurrentHandlersWithContext(handler, 1)
+}
+
+// AddConcurrentHandlersWithContext sets the HandlerWithContext for messages received on
+// any matching topic. At most concurrency messages are handled at a time, regardless of
+// which topic they were received on.
+//
+// Unlike Consumer, only a single handler can be set.
+//
+// This panics if called more than once. Since connecting to NSQ Lookupd requires a
+// handler, it is always set before any Consumer is started.
+func (p *PatternConsumer) AddConcurrentHandlersWithContext(handler HandlerWithContext, concurrency int) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if p.handler != nil {
+		panic("handler already set")
+	}
+	p.handler = &pooledHandler{
+		handler: handler,
+		slots:   make(chan struct{}, concurrency),
+	}
+	p.concurrency = concurrency
+}
+
+// ConnectToNSQLookupds adds nsqlookupd addresses to the list for this PatternConsumer
+// and begins polling them for matching topics
+//
+// See Consumer.ConnectToNSQLookupds for details.
+func (p *PatternConsumer) ConnectToNSQLookupds(addresses []string) error {
+	for _, addr := range addresses {
+		err := p.ConnectToNSQLookupd(addr)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ConnectToNSQLookupd adds an nsqlookupd address to the list for this PatternConsumer
+//
+// If it is the first to be added, matching topics are discovered immediately and a
+// goroutine is spawned to handle continual polling.
+func (p *PatternConsumer) ConnectToNSQLookupd(addr string) error {
+	if atomic.LoadInt32(&p.stopFlag) == 1 {
+		return errors.New("consumer stopped")
+	}
+	p.mtx.RLock()
+	handler := p.handler
+	p.mtx.RUnlock()
+	if handler == nil {
+		return errors.New("no handlers")
+	}
+
+	if err := validatedLookupAddr(addr); err != nil {
+		return err
+	}
+
+	atomic.StoreInt32(&p.connectedFlag, 1)
+
+	p.mtx.Lock()
+	for _, x := range p.lookupdHTTPAddrs {
+		if x == addr {
+			p.mtx.Unlock()
+			return nil
+		}
+	}
+	p.lookupdHTTPAddrs = append(p.lookupdHTTPAddrs, addr)
+	numLookupd := len(p.lookupdHTTPAddrs)
+	p.mtx.Unlock()
+
+	if numLookupd == 1 {
+		p.queryTopics()
+		p.wg.Add(1)
+		go p.topicsLoop()
+	}
+
+	return nil
+}
+
+// Topics returns the (sorted) names of the topics currently being consumed
+func (p *PatternConsumer) Topics() []string {
+	p.mtx.RLock()
+	topics := make([]string, 0, len(p.consumers))
+	for topic := range p.consumers {
+		topics = append(topics, topic)
+	}
+	p.mtx.RUnlock()
+	sort.Strings(topics)
+	return topics
+}
+
+// Stats retrieves the aggregated connection and message statistics of the Consumers
+// of all topics currently being consumed
+func (p *PatternConsumer) Stats() *ConsumerStats {
+	stats := &ConsumerStats{}
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
+	for _, c := range p.consumers {
+		stats.add(c.Stats())
+	}
+	return stats
+}
+
+// Stop will initiate a graceful stop of the PatternConsumer and all of its Consumers (permanent)
+//
+// NOTE: receive on StopChan to block until this process completes
+func (p *PatternConsumer) Stop() {
+	if !atomic.CompareAndSwapInt32(&p.stopFlag, 0, 1) {
+		return
+	}
+
+	p.log(LogLevelInfo, "stopping...")
+	close(p.exitChan)
+
+	go func() {
+		// once the loop exits no more consumers are started
+		p.wg.Wait()
+
+		p.mtx.Lock()
+		consumers := p.consumers
+		p.consumers = make(map[string]*Consumer)
+		p.mtx.Unlock()
+
+		for _, c := range consumers {
+			c.Stop()
+		}
+		for _, c := range consumers {
+			<-c.StopChan
+		}
+		close(p.StopChan)
+	}()
+}
+
+func (p *PatternConsumer) topicsLoop() {
+	ticker := time.NewTicker(p.config.LookupdPollInterval)
+
+	for {
+		select {
+		case <-ticker.C:
+			p.queryTopics()
+		case <-p.exitChan:
+			goto exit
+		}
+	}
+
+exit:
+	ticker.Stop()
+	p.log(LogLevelInfo, "exiting topicsLoop")
+	p.wg.Done()
+}
+
+type topicsResp struct {
+	Topics []string `json:"topics"`
+}
+
+// queryTopics makes an HTTP req to every configured nsqlookupd instance to discover
+// the topics matching the pattern, starting and stopping Consumers as needed.
+//
+// When any nsqlookupd cannot be queried no Consumers are stopped, since a topic
+// only registered with that nsqlookupd would otherwise appear to have disappeared.
+func (p *PatternConsumer) queryTopics() {
+	p.mtx.RLock()
+	addrs := make([]string, len(p.lookupdHTTPAddrs))
+	copy(addrs, p.lookupdHTTPAddrs)
+	p.mtx.RUnlock()
+
+	complete := true
+	matched := make(map[string]bool)
+	for _, addr := range addrs {
+		endpoint := topicsEndpoint(addr)
+		p.log(LogLevelDebug, "querying nsqlookupd %s", endpoint)
+
+		var data topicsResp
+		err := apiRequestNegotiateV1(p.config.lookupdHTTPClient(), p.config.LookupdHTTPHeader,
+			"GET", endpoint, nil, &data)
+		if err != nil {
+			p.log(LogLevelError, "error querying nsqlookupd (%s) - %s", endpoint, err)
+			complete = false
+			continue
+		}
+		for _, topic := range data.Topics {
+			if p.pattern.MatchString(topic) && IsValidTopicName(topic) {
+				matched[topic] = true
+			}
+		}
+	}
+
+	p.mtx.Lock()
+	if atomic.LoadInt32(&p.stopFlag) == 1 {
+		p.mtx.Unlock()
+		return
+	}
+	configs := make(map[string]*Config)
+	for topic := range matched {
+		if _, ok := p.consumers[topic]; ok {
+			continue
+		}
+		config, err := p.overrides.config(&p.config, topic)
+		if err != nil {
+			p.log(LogLevelError, "error starting consumer for topic %s - %s", topic, err)
+			continue
+		}
+		configs[topic] = config
+	}
+	// middleware and filters added while the new Consumers are starting are applied
+	// when they are registered below
+	handler, concurrency := p.handler, p.concurrency
+	middleware, filters := p.middleware, p.filters
+	p.mtx.Unlock()
+
+	// the Consumers of new topics are started without holding mtx, since connecting them
+	// queries nsqlookupd
+	started := make(map[string]*Consumer)
+	for topic, config := range configs {
+		c, err := p.startConsumer(topic, config, addrs, handler, concurrency, middleware, filters)
+		if err != nil {
+			p.log(LogLevelError, "error starting consumer for topic %s - %s", topic, err)
+			continue
+		}
+		started[topic] = c
+	}
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	stopped := atomic.LoadInt32(&p.stopFlag) == 1
+	for topic, c := range started {
+		if _, ok := p.consumers[topic]; ok || stopped {
+			c.Stop()
+			continue
+		}
+		if len(p.middleware) > len(middleware) {
+			c.Use(p.middleware[len(middleware):]...)
+		}
+		for _, filter := range p.filters[len(filters):] {
+			c.AddFilter(filter)
+		}
+		p.log(LogLevelInfo, "started consuming topic %s", topic)
+		p.consumers[topic] = c
+	}
+
+	if !complete || stopped {
+		return
+	}
+	for topic, c := range p.consumers {
+		if matched[topic] {
+			continue
+		}
+		p.log(LogLevelInfo, "topic %s no longer exists, stopping", topic)
+		c.Stop()
+		delete(p.consumers, topic)
+	}
+}
+
+// SetTopicOverrides sets Config options (see Config.Set) overriding the shared Config
+// for topic, once a Consumer is started for it
+//
+// It returns an error for an invalid option or value.
+func (p *PatternConsumer) SetTopicOverrides(topic string, options map[string]interface{}) error {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	return p.overrides.set(&p.config, topic, options)
+}
+
+// SetTopicOptions sets typed options (see NewConfigWith), applied after those set by
+// SetTopicOverrides, overriding the shared Config for topic, once a Consumer is started
+// for it
+//
+// It returns an error when the resulting Config is invalid.
+func (p *PatternConsumer) SetTopicOptions(topic string, opts ...Option) error {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	return p.overrides.setOpts(&p.config, topic, opts)
+}
+
+// startConsumer starts a Consumer of topic with config (see SetTopicOverrides),
+// connected to lookupdAddrs
+func (p *PatternConsumer) startConsumer(topic string, config *Config, lookupdAddrs []string,
+	handler HandlerWithContext, concurrency int,
+	middleware []HandlerMiddleware, filters []MessageFilter) (*Consumer, error) {
+	c, err := NewConsumer(topic, p.channel, config)
+	if err != nil {
+		return nil, err
+	}
+	c.SetLogger(p.logger, p.logLvl)
+	c.Use(middleware...)
+	for _, filter := range filters {
+		c.AddFilter(filter)
+	}
+	c.AddConcurrentHandlersWithContext(handler, concurrency)
+	err = c.ConnectToNSQLookupds(lookupdAddrs)
+	if err != nil {
+		c.Stop()
+		return nil, err
+	}
+	return c, nil
+}
+
+func topicsEndpoint(addr string) string {
+	urlString := addr
+	if !strings.Contains(urlString, "://") {
+		urlString = "http://" + addr
+	}
+
+	u, err := url.Parse(urlString)
+	if err != nil {
+		// validated in ConnectToNSQLookupd
+		panic(err)
+	}
+	u.Path = "/topics"
+	u.RawQuery = ""
+	return u.String()
+}
+
+func (p *PatternConsumer) log(lvl LogLevel, line string, args ...interface{}) {
+	if p.logger == nil || p.logLvl > lvl {
+		return
+	}
+
+	p.logger.Output(2, fmt.Sprintf("%-4s [%s/%s] %s",
+		lvl, p.pattern, p.channel,
+		fmt.Sprintf(line, args...)))
+}
@@ -0,0 +1,216 @@
+package nsq
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type mockLookupd struct {
+	sync.Mutex
+	topics []string
+	// when set, /lookup requests for slowTopic are signalled on lookups and block until
+	// unblock is closed
+	slowTopic string
+	lookups   chan struct{}
+	unblock   chan struct{}
+}
+
+func (l *mockLookupd) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("X-NSQ-Content-Type", "nsq; version=1.0")
+	switch req.URL.Path {
+	case "/topics":
+		l.Lock()
+		topics := `"` + strings.Join(l.topics, `","`) + `"`
+		l.Unlock()
+		fmt.Fprintf(w, `{"topics":[%s]}`, topics)
+	case "/lookup":
+		l.Lock()
+		slow := l.slowTopic != "" && req.URL.Query().Get("topic") == l.slowTopic
+		lookups, unblock := l.lookups, l.unblock
+		l.Unlock()
+		if slow {
+			lookups <- struct{}{}
+			<-unblock
+		}
+		fmt.Fprint(w, `{"channels":[],"producers":[]}`)
+	default:
+		w.WriteHeader(404)
+	}
+}
+
+func (l *mockLookupd) setTopics(topics ...string) {
+	l.Lock()
+	l.topics = topics
+	l.Unlock()
+}
+
+func TestPatternConsumer(t *testing.T) {
+	lookupd := &mockLookupd{}
+	lookupd.setTopics("orders.eu", "orders.us", "payments")
+	srv := httptest.NewServer(lookupd)
+	defer srv.Close()
+
+	config := NewConfig()
+	config.LookupdPollInterval = 20 * time.Millisecond
+	p, err := NewPatternConsumer(`orders\..*`, "ch", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.SetLogger(nullLogger, LogLevelInfo)
+	p.AddConcurrentHandlers(&testHandler{}, 2)
+	if err := p.SetTopicOptions("orders.us", WithMaxInFlight(25)); err != nil {
+		t.Fatal(err)
+	}
+
+	err = p.ConnectToNSQLookupd(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitForTopics := func(expected ...string) {
+		deadline := time.Now().Add(time.Second)
+		for {
+			topics := p.Topics()
+			if strings.Join(topics, ",") == strings.Join(expected, ",") {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("topics %v != %v", topics, expected)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	waitForTopics("orders.eu", "orders.us")
+	p.mtx.RLock()
+	us, eu := p.consumers["orders.us"].getMaxInFlight(), p.consumers["orders.eu"].getMaxInFlight()
+	p.mtx.RUnlock()
+	if us != 25 || eu != 1 {
+		t.Fatalf("unexpected max in flight %d/%d", us, eu)
+	}
+
+	lookupd.setTopics("orders.eu", "orders.apac", "payments")
+	waitForTopics("orders.apac", "orders.eu")
+
+	p.Stop()
+	select {
+	case <-p.StopChan:
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for PatternConsumer to stop")
+	}
+	if len(p.Topics()) != 0 {
+		t.Fatalf("expected no topics after stop, got %v", p.Topics())
+	}
+}
+
+func TestPatternConsumerSlowLookupd(t *testing.T) {
+	lookupd := &mockLookupd{}
+	lookupd.setTopics("orders.eu")
+	srv := httptest.NewServer(lookupd)
+	defer srv.Close()
+
+	config := NewConfig()
+	config.LookupdPollInterval = 20 * time.Millisecond
+	p, _ := NewPatternConsumer(`orders\..*`, "ch", config)
+	p.SetLogger(nullLogger, LogLevelInfo)
+	p.AddHandler(&testHandler{})
+	if err := p.ConnectToNSQLookupd(srv.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	// the Consumer of a new topic connects to a slow nsqlookupd
+	lookups, unblock := make(chan struct{}, 16), make(chan struct{})
+	lookupd.Lock()
+	lookupd.slowTopic, lookupd.lookups, lookupd.unblock = "orders.us", lookups, unblock
+	lookupd.Unlock()
+	lookupd.setTopics("orders.eu", "orders.us")
+	<-lookups
+
+	topics := make(chan []string)
+	go func() { topics <- p.Topics() }()
+	select {
+	case got := <-topics:
+		if len(got) != 1 || got[0] != "orders.eu" {
+			t.Fatalf("unexpected topics %v", got)
+		}
+	case <-time.After(time.Second):
+		close(unblock)
+		t.Fatal("Topics blocked while a Consumer was connecting")
+	}
+
+	lookupd.Lock()
+	lookupd.slowTopic = ""
+	lookupd.Unlock()
+	close(unblock)
+	p.Stop()
+	<-p.StopChan
+}
+
+func TestPatternConsumerAddAfterConnect(t *testing.T) {
+	lookupd := &mockLookupd{}
+	lookupd.setTopics("orders.eu")
+	srv := httptest.NewServer(lookupd)
+	defer srv.Close()
+
+	config := NewConfig()
+	config.LookupdPollInterval = 20 * time.Millisecond
+	p, _ := NewPatternConsumer(`orders\..*`, "ch", config)
+	p.SetLogger(nullLogger, LogLevelInfo)
+	p.AddHandler(&testHandler{})
+	if err := p.ConnectToNSQLookupd(srv.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	// the Consumer of orders.us is still connecting when the filter and middleware are added
+	lookups, unblock := make(chan struct{}, 16), make(chan struct{})
+	lookupd.Lock()
+	lookupd.slowTopic, lookupd.lookups, lookupd.unblock = "orders.us", lookups, unblock
+	lookupd.Unlock()
+	lookupd.setTopics("orders.eu", "orders.us")
+	<-lookups
+
+	p.AddFilter(func(*Message) bool { return true })
+	p.Use(func(next HandlerWithContext) HandlerWithContext { return next })
+
+	lookupd.Lock()
+	lookupd.slowTopic = ""
+	lookupd.Unlock()
+	close(unblock)
+	lookupd.setTopics("orders.eu", "orders.us", "orders.apac")
+
+	deadline := time.Now().Add(time.Second)
+	for len(p.Topics()) != 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected topics %v", p.Topics())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	p.mtx.RLock()
+	for topic, c := range p.consumers {
+		c.filtersMtx.RLock()
+		filters := len(c.filters)
+		c.filtersMtx.RUnlock()
+		c.middlewareMtx.RLock()
+		middleware := len(c.middleware)
+		c.middlewareMtx.RUnlock()
+		if filters != 1 || middleware != 1 {
+			t.Errorf("%s has %d filters and %d middleware, expected 1 and 1", topic, filters, middleware)
+		}
+	}
+	p.mtx.RUnlock()
+
+	p.Stop()
+	<-p.StopChan
+}
+
+func TestPatternConsumerInvalidPattern(t *testing.T) {
+	_, err := NewPatternConsumer(`orders\.(`, "ch", NewConfig())
+	if err == nil {
+		t.Fatal("expected an error for an invalid pattern")
+	}
+}
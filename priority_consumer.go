@@ -0,0 +1,167 @@
+package nsq
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// PriorityTopic is a topic consumed by a PriorityConsumer, with the relative share of
+// handler slots given to its messages
+type PriorityTopic struct {
+	Topic  string
+	Weight int
+}
+
+// PriorityConsumer consumes the same channel of several topics (e.g. `orders.high`
+// and `orders.low`), scheduling the shared handler goroutines between them by weight.
+//
+// NSQ has no server-side message priorities. When messages of several topics are
+// waiting to be handled, handler slots are given to each topic in proportion to its
+// weight (e.g. 4:1); when a topic has no messages waiting, its slots go to the others.
+//
+// It is a MultiConsumer (see NewMultiConsumer for details of the shared max-in-flight
+// budget), except that handlers added via AddConcurrentHandlersWithContext are scheduled
+// by priority.
+type PriorityConsumer struct {
+	*MultiConsumer
+
+	weights []int
+}
+
+// NewPriorityConsumer creates a new instance of PriorityConsumer for the specified
+// channel of topics, in order of priority (ties in scheduling go to earlier topics)
+//
+// Every weight must be >= 1.
+func NewPriorityConsumer(topics []PriorityTopic, channel string, config *Config) (*PriorityConsumer, error) {
+	subscriptions := make([]Subscription, 0, len(topics))
+	weights := make([]int, 0, len(topics))
+	for _, t := range topics {
+		if t.Weight < 1 {
+			return nil, errors.New("priority weight must be >= 1")
+		}
+		subscriptions = append(subscriptions, Subscription{t.Topic, channel})
+		weights = append(weights, t.Weight)
+	}
+
+	m, err := NewMultiConsumer(subscriptions, config)
+	if err != nil {
+		return nil, err
+	}
+	return &PriorityConsumer{
+		MultiConsumer: m,
+		weights:       weights,
+	}, nil
+}
+
+// AddHandler sets the Handler for messages received on any topic
+//
+// See AddConcurrentHandlersWithContext.
+func (p *PriorityConsumer) AddHandler(handler Handler) {
+	p.AddConcurrentHandlers(handler, 1)
+}
+
+// AddConcurrentHandlers sets the Handler for messages received on any topic
+//
+// See AddConcurrentHandlersWithContext.
+func (p *PriorityConsumer) AddConcurrentHandlers(handler Handler, concurrency int) {
+	p.AddConcurrentHandlersWithContext(handlerAdapter{handler}, concurrency)
+}
+
+// AddHandlerWithContext sets the HandlerWithContext for messages received on any topic
+//
+// See AddConcurrentHandlersWithContext.
+func (p *PriorityConsumer) AddHandlerWithContext(handler HandlerWithContext) {
+	p.AddConcurrentHandlersWithContext(handler, 1)
+}
+
+// AddConcurrentHandlersWithContext sets the HandlerWithContext for messages received on
+// any topic. At most concurrency messages are handled at a time, with free slots given
+// to the topics with messages waiting by weight.
+//
+// This can be called after connecting to NSQD or NSQ Lookupd (see
+// Consumer.AddConcurrentHandlersWithContext).
+func (p *PriorityConsumer) AddConcurrentHandlersWithContext(handler HandlerWithContext, concurrency int) {
+	slots := newPrioritySlots(p.weights, concurrency)
+	for i, c := range p.consumers {
+		c.AddConcurrentHandlersWithContext(&priorityHandler{
+			handler:  handler,
+			slots:    slots,
+			priority: i,
+		}, concurrency)
+	}
+}
+
+// priorityHandler calls handler once granted a slot for its priority
+type priorityHandler struct {
+	handler  HandlerWithContext
+	slots    *prioritySlots
+	priority int
+}
+
+func (h *priorityHandler) HandleMessage(ctx context.Context, message *Message) error {
+	h.slots.acquire(h.priority)
+	defer h.slots.release()
+	return h.handler.HandleMessage(ctx, message)
+}
+
+// prioritySlots grants a fixed number of slots to waiters of several priorities, using
+// smooth weighted round-robin between the priorities with waiters
+type prioritySlots struct {
+	mtx     sync.Mutex
+	free    int
+	weights []int
+	current []int
+	waiters [][]chan struct{}
+}
+
+func newPrioritySlots(weights []int, n int) *prioritySlots {
+	return &prioritySlots{
+		free:    n,
+		weights: weights,
+		current: make([]int, len(weights)),
+		waiters: make([][]chan struct{}, len(weights)),
+	}
+}
+
+// acquire blocks until a slot is granted to priority
+func (s *prioritySlots) acquire(priority int) {
+	s.mtx.Lock()
+	if s.free > 0 {
+		s.free--
+		s.mtx.Unlock()
+		return
+	}
+	ch := make(chan struct{})
+	s.waiters[priority] = append(s.waiters[priority], ch)
+	s.mtx.Unlock()
+	<-ch
+}
+
+// release passes a slot to the next waiter (if any)
+func (s *prioritySlots) release() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	best := -1
+	total := 0
+	for i, waiters := range s.waiters {
+		if len(waiters) == 0 {
+			continue
+		}
+		s.current[i] += s.weights[i]
+		total += s.weights[i]
+		if best == -1 || s.current[i] > s.current[best] {
+			best = i
+		}
+	}
+	if best == -1 {
+		s.free++
+		return
+	}
+	s.current[best] -= total
+
+	ch := s.waiters[best][0]
+	s.waiters[best] = s.waiters[best][1:]
+	close(ch)
+}
@@ -0,0 +1,55 @@
+package nsq
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPrioritySlots(t *testing.T) {
+	slots := newPrioritySlots([]int{4, 1}, 1)
+	slots.acquire(0)
+
+	granted := make(chan int, 20)
+	wait := func(priority int) {
+		slots.acquire(priority)
+		granted <- priority
+	}
+	for i := 0; i < 10; i++ {
+		go wait(0)
+		go wait(1)
+	}
+	// let every goroutine queue up
+	for {
+		slots.mtx.Lock()
+		n := len(slots.waiters[0]) + len(slots.waiters[1])
+		slots.mtx.Unlock()
+		if n == 20 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	var order []int
+	for i := 0; i < 20; i++ {
+		slots.release()
+		order = append(order, <-granted)
+	}
+	expected := []int{0, 0, 1, 0, 0, 0, 0, 1, 0, 0, 0, 0, 1, 1, 1, 1, 1, 1, 1, 1}
+	for i := range expected {
+		if order[i] != expected[i] {
+			t.Fatalf("unexpected order %v", order)
+		}
+	}
+
+	slots.release()
+	if slots.free != 1 {
+		t.Fatalf("expected the slot to be freed, got %d free", slots.free)
+	}
+}
+
+func TestPriorityConsumerInvalidWeight(t *testing.T) {
+	topics := []PriorityTopic{{"orders.high", 4}, {"orders.low", 0}}
+	if _, err := NewPriorityConsumer(topics, "ch", NewConfig()); err == nil {
+		t.Fatal("expected an error for a weight of 0")
+	}
+}
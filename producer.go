@@ -25,6 +25,11 @@ type producerConn interface {
 // and will lazily connect to that instance (and re-connect)
 // when Publish commands are executed.
 type Producer struct {
+	// 64bit atomic vars need to be first for proper alignment on 32bit platforms
+	bestEffortDropped uint64
+	lastHeartbeat     int64
+	pendingTimeout    int64
+
 	id     int64
 	addr   string
 	conn   producerConn
@@ -42,11 +47,23 @@ type Producer struct {
 	transactions    []*ProducerTransaction
 	state           int32
 
+	// a slot per pending command when Config.MaxPendingCommands is set
+	pending chan struct{}
+
 	concurrentProducers int32
 	stopFlag            int32
 	exitChan            chan int
 	wg                  sync.WaitGroup
 	guard               sync.Mutex
+
+	// the *IdentifyResponse of the current connection
+	identifyResp atomic.Value
+
+	// the buffer of PublishBestEffort and its loop, started on first use under
+	// bestEffortMtx (rather than guard, held while connecting)
+	bestEffort    *bestEffortBuffer
+	bestEffortMtx sync.Mutex
+	bestEffortWg  sync.WaitGroup
 }
 
 // ProducerTransaction is returned by the async publish methods
@@ -57,6 +74,9 @@ type ProducerTransaction struct {
 	doneChan chan *ProducerTransaction
 	Error    error         // the error (or nil) of the publish command
 	Args     []interface{} // the slice of variadic arguments passed to PublishAsync or MultiPublishAsync
+
+	// the data of the response to the command (e.g. "OK"), nil on error
+	Response []byte
 }
 
 func (t *ProducerTransaction) finish() {
@@ -65,7 +85,9 @@ func (t *ProducerTransaction) finish() {
 	}
 }
 
-// NewProducer returns an instance of Producer for the specified address
+// NewProducer returns an instance of Producer for the specified address, either a TCP
+// address (`host:port`), the path of a unix socket (`unix:///path/to/nsqd.sock`) or a
+// WebSocket endpoint relaying to nsqd (`ws://host/path` or `wss://host/path`)
 //
 // The only valid way to create a Config is via NewConfig, using a struct literal will panic.
 // After Config is passed into NewProducer the values are no longer mutable (they are copied).
@@ -89,6 +111,10 @@ func NewProducer(addr string, config *Config) (*Producer, error) {
 		responseChan:    make(chan []byte),
 		errorChan:       make(chan []byte),
 	}
+	if config.MaxPendingCommands > 0 {
+		p.pending = make(chan struct{}, config.MaxPendingCommands)
+	}
+	p.pendingTimeout = int64(config.PendingCommandsTimeout)
 
 	// Set default logger for all log levels
 	l := log.New(os.Stderr, "", log.Flags())
@@ -115,6 +141,27 @@ func (w *Producer) Ping() error {
 	return w.conn.WriteCommand(Nop())
 }
 
+// Healthy returns nil when the Producer is connected to nsqd and has received a
+// heartbeat within the last two HeartbeatIntervals, otherwise an error describing
+// why it is not, for use in health checks
+//
+// NOTE: the Producer connects lazily on the first publish, use Ping to connect eagerly
+func (w *Producer) Healthy() error {
+	if atomic.LoadInt32(&w.stopFlag) == 1 {
+		return ErrStopped
+	}
+	if atomic.LoadInt32(&w.state) != StateConnected {
+		return ErrNotConnected
+	}
+	if interval := w.config.HeartbeatInterval; interval > 0 {
+		since := time.Since(time.Unix(0, atomic.LoadInt64(&w.lastHeartbeat)))
+		if since > 2*interval {
+			return fmt.Errorf("(%s) no heartbeat received in %s", w.addr, since)
+		}
+	}
+	return nil
+}
+
 // SetLogger assigns the logger to use as well as a level
 //
 // The logger parameter is an interface that requires the following
@@ -181,6 +228,7 @@ func (w *Producer) Stop() {
 	w.close()
 	w.guard.Unlock()
 	w.wg.Wait()
+	w.stopBestEffort()
 }
 
 // PublishAsync publishes a message body to the specified topic
@@ -192,6 +240,10 @@ func (w *Producer) Stop() {
 // and the response error if present
 func (w *Producer) PublishAsync(topic string, body []byte, doneChan chan *ProducerTransaction,
 	args ...interface{}) error {
+	body, err := w.prepare(topic, body)
+	if err != nil {
+		return err
+	}
 	return w.sendCommandAsync(Publish(topic, body), doneChan, args)
 }
 
@@ -204,6 +256,10 @@ func (w *Producer) PublishAsync(topic string, body []byte, doneChan chan *Produc
 // and the response error if present
 func (w *Producer) MultiPublishAsync(topic string, body [][]byte, doneChan chan *ProducerTransaction,
 	args ...interface{}) error {
+	body, err := w.prepareAll(topic, body)
+	if err != nil {
+		return err
+	}
 	cmd, err := MultiPublish(topic, body)
 	if err != nil {
 		return err
@@ -211,15 +267,82 @@ func (w *Producer) MultiPublishAsync(topic string, body [][]byte, doneChan chan
 	return w.sendCommandAsync(cmd, doneChan, args)
 }
 
+// SendCommand synchronously sends an arbitrary command (see NewRawCommand), returning
+// the data of its response, or an ErrProtocol for an error response
+//
+// Responses are correlated with commands in the order they were sent, so cmd must be
+// answered by exactly one response or error frame, as every nsqd command a Producer
+// may send is.
+func (w *Producer) SendCommand(cmd *Command) ([]byte, error) {
+	doneChan := make(chan *ProducerTransaction)
+	err := w.sendCommandAsync(cmd, doneChan, nil)
+	if err != nil {
+		close(doneChan)
+		return nil, err
+	}
+	t := <-doneChan
+	return t.Response, t.Error
+}
+
+// SendCommandAsync sends an arbitrary command (see NewRawCommand) asynchronously, as
+// PublishAsync does, its response is set as ProducerTransaction.Response
+func (w *Producer) SendCommandAsync(cmd *Command, doneChan chan *ProducerTransaction,
+	args ...interface{}) error {
+	return w.sendCommandAsync(cmd, doneChan, args)
+}
+
 // Publish synchronously publishes a message body to the specified topic, returning
 // an error if publish failed
 func (w *Producer) Publish(topic string, body []byte) error {
+	body, err := w.prepare(topic, body)
+	if err != nil {
+		return err
+	}
 	return w.sendCommand(Publish(topic, body))
 }
 
+// PublishWithHeaders synchronously publishes a message body with headers, in an envelope
+// (see EncodeEnvelope) unless headers is empty, to the specified topic, returning an error
+// if publish failed
+//
+// Consumers with Config.DecodeEnvelopes receive the headers as Message.Headers.
+func (w *Producer) PublishWithHeaders(topic string, headers Headers, body []byte) error {
+	if len(headers) > 0 {
+		body = EncodeEnvelope(headers, body)
+	}
+	return w.Publish(topic, body)
+}
+
+// PublishValue synchronously publishes v, marshaled with Config.Codec, to the specified
+// topic, returning an error if marshaling or publish failed
+//
+// When the codec has a content type (see RegisterCodec) other than ContentTypeJSON, the
+// body is published in an envelope with a HeaderContentType header, so consumers decode it
+// with the same codec (see Message.Decode) regardless of their own Config.Codec. JSON
+// bodies (the default) are published as is.
+func (w *Producer) PublishValue(topic string, v interface{}) error {
+	codec := w.config.Codec
+	if codec == nil {
+		codec = JSONCodec{}
+	}
+	body, err := codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+	contentType := codecContentType(codec)
+	if contentType == "" || contentType == ContentTypeJSON {
+		return w.Publish(topic, body)
+	}
+	return w.PublishWithHeaders(topic, Headers{HeaderContentType: contentType}, body)
+}
+
 // MultiPublish synchronously publishes a slice of message bodies to the specified topic, returning
 // an error if publish failed
 func (w *Producer) MultiPublish(topic string, body [][]byte) error {
+	body, err := w.prepareAll(topic, body)
+	if err != nil {
+		return err
+	}
 	cmd, err := MultiPublish(topic, body)
 	if err != nil {
 		return err
@@ -231,6 +354,10 @@ func (w *Producer) MultiPublish(topic string, body [][]byte) error {
 // where the message will queue at the channel level until the timeout expires, returning
 // an error if publish failed
 func (w *Producer) DeferredPublish(topic string, delay time.Duration, body []byte) error {
+	body, err := w.prepare(topic, body)
+	if err != nil {
+		return err
+	}
 	return w.sendCommand(DeferredPublish(topic, delay, body))
 }
 
@@ -244,9 +371,39 @@ func (w *Producer) DeferredPublish(topic string, delay time.Duration, body []byt
 // and the response error if present
 func (w *Producer) DeferredPublishAsync(topic string, delay time.Duration, body []byte,
 	doneChan chan *ProducerTransaction, args ...interface{}) error {
+	body, err := w.prepare(topic, body)
+	if err != nil {
+		return err
+	}
 	return w.sendCommandAsync(DeferredPublish(topic, delay, body), doneChan, args)
 }
 
+// prepare validates a message body published to topic per Config.SchemaValidator, and
+// compresses it per Config.MessageCompression
+func (w *Producer) prepare(topic string, body []byte) ([]byte, error) {
+	if w.config.SchemaValidator != nil {
+		if err := validateSchema(w.config.SchemaValidator, topic, body); err != nil {
+			return nil, err
+		}
+	}
+	return compressBody(body, w.config.MessageCompression, w.config.MessageCompressionThreshold)
+}
+
+func (w *Producer) prepareAll(topic string, bodies [][]byte) ([][]byte, error) {
+	if w.config.SchemaValidator == nil && w.config.MessageCompression == "" {
+		return bodies, nil
+	}
+	prepared := make([][]byte, len(bodies))
+	for i, body := range bodies {
+		var err error
+		prepared[i], err = w.prepare(topic, body)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return prepared, nil
+}
+
 func (w *Producer) sendCommand(cmd *Command) error {
 	doneChan := make(chan *ProducerTransaction)
 	err := w.sendCommandAsync(cmd, doneChan, nil)
@@ -260,6 +417,13 @@ func (w *Producer) sendCommand(cmd *Command) error {
 
 func (w *Producer) sendCommandAsync(cmd *Command, doneChan chan *ProducerTransaction,
 	args []interface{}) error {
+	// fail publishing to an invalid topic up front, rather than with E_BAD_TOPIC from nsqd
+	if isPublish(cmd) && len(cmd.Params) > 0 {
+		if err := ValidateTopicName(string(cmd.Params[0])); err != nil {
+			return err
+		}
+	}
+
 	// keep track of how many outstanding producers we're dealing with
 	// in order to later ensure that we clean them all up...
 	atomic.AddInt32(&w.concurrentProducers, 1)
@@ -272,6 +436,10 @@ func (w *Producer) sendCommandAsync(cmd *Command, doneChan chan *ProducerTransac
 		}
 	}
 
+	if err := w.acquirePending(); err != nil {
+		return err
+	}
+
 	t := &ProducerTransaction{
 		cmd:      cmd,
 		doneChan: doneChan,
@@ -281,12 +449,78 @@ func (w *Producer) sendCommandAsync(cmd *Command, doneChan chan *ProducerTransac
 	select {
 	case w.transactionChan <- t:
 	case <-w.exitChan:
+		w.releasePending()
 		return ErrStopped
 	}
 
 	return nil
 }
 
+// UpdateConfig changes the options in delta (named and coerced as by Config.Set) while
+// the Producer is running, which is limited to pending_commands_timeout
+//
+// The changes are applied together or not at all (see Consumer.UpdateConfig).
+func (w *Producer) UpdateConfig(delta map[string]interface{}) error {
+	w.guard.Lock()
+	defer w.guard.Unlock()
+	cfg := w.config.Clone()
+	cfg.PendingCommandsTimeout = time.Duration(atomic.LoadInt64(&w.pendingTimeout))
+	if err := updateConfig(cfg, delta, producerRuntimeOptions); err != nil {
+		return err
+	}
+	atomic.StoreInt64(&w.pendingTimeout, int64(cfg.PendingCommandsTimeout))
+	return nil
+}
+
+// checkConfigUpdate returns the error UpdateConfig would return for delta, without
+// applying it
+func (w *Producer) checkConfigUpdate(delta map[string]interface{}) error {
+	w.guard.Lock()
+	defer w.guard.Unlock()
+	cfg := w.config.Clone()
+	cfg.PendingCommandsTimeout = time.Duration(atomic.LoadInt64(&w.pendingTimeout))
+	return updateConfig(cfg, delta, producerRuntimeOptions)
+}
+
+// the options that can be changed by Producer.UpdateConfig
+var producerRuntimeOptions = map[string]bool{
+	"pending_commands_timeout": true,
+}
+
+// acquirePending takes a pending command slot, waiting up to
+// Config.PendingCommandsTimeout for one to be released
+func (w *Producer) acquirePending() error {
+	if w.pending == nil {
+		return nil
+	}
+	select {
+	case w.pending <- struct{}{}:
+		return nil
+	default:
+	}
+	timeout := time.Duration(atomic.LoadInt64(&w.pendingTimeout))
+	if timeout <= 0 {
+		return ErrBackpressure
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case w.pending <- struct{}{}:
+		return nil
+	case <-timer.C:
+		return ErrBackpressure
+	case <-w.exitChan:
+		return ErrStopped
+	}
+}
+
+func (w *Producer) releasePending() {
+	if w.pending != nil {
+		<-w.pending
+	}
+}
+
 func (w *Producer) connect() error {
 	w.guard.Lock()
 	defer w.guard.Unlock()
@@ -312,12 +546,14 @@ func (w *Producer) connect() error {
 		w.conn.SetLoggerForLevel(w.logger[index], LogLevel(index), format)
 	}
 
-	_, err := w.conn.Connect()
+	resp, err := w.conn.Connect()
 	if err != nil {
 		w.conn.Close()
 		w.log(LogLevelError, "(%s) error connecting to nsqd - %s", w.addr, err)
 		return err
 	}
+	w.identifyResp.Store(resp)
+	atomic.StoreInt64(&w.lastHeartbeat, time.Now().UnixNano())
 	atomic.StoreInt32(&w.state, StateConnected)
 	w.closeChan = make(chan int)
 	w.wg.Add(1)
@@ -326,6 +562,20 @@ func (w *Producer) connect() error {
 	return nil
 }
 
+// IdentifyResponse returns a copy of the features negotiated with nsqd via IDENTIFY by
+// the current (or last) connection, e.g. to size batches by its limits
+//
+// It returns nil before the Producer has connected, or if nsqd does not support
+// feature negotiation.
+func (w *Producer) IdentifyResponse() *IdentifyResponse {
+	resp, _ := w.identifyResp.Load().(*IdentifyResponse)
+	if resp == nil {
+		return nil
+	}
+	copied := *resp
+	return &copied
+}
+
 func (w *Producer) close() {
 	if !atomic.CompareAndSwapInt32(&w.state, StateConnected, StateDisconnected) {
 		return
@@ -369,8 +619,11 @@ exit:
 func (w *Producer) popTransaction(frameType int32, data []byte) {
 	t := w.transactions[0]
 	w.transactions = w.transactions[1:]
+	w.releasePending()
 	if frameType == FrameTypeError {
 		t.Error = ErrProtocol{string(data)}
+	} else {
+		t.Response = data
 	}
 	t.finish()
 }
@@ -378,6 +631,7 @@ func (w *Producer) popTransaction(frameType int32, data []byte) {
 func (w *Producer) transactionCleanup() {
 	// clean up transactions we can easily account for
 	for _, t := range w.transactions {
+		w.releasePending()
 		t.Error = ErrNotConnected
 		t.finish()
 	}
@@ -389,6 +643,7 @@ func (w *Producer) transactionCleanup() {
 	for {
 		select {
 		case t := <-w.transactionChan:
+			w.releasePending()
 			t.Error = ErrNotConnected
 			t.finish()
 		default:
@@ -418,8 +673,10 @@ func (w *Producer) log(lvl LogLevel, line string, args ...interface{}) {
 
 func (w *Producer) onConnResponse(c *Conn, data []byte) { w.responseChan <- data }
 func (w *Producer) onConnError(c *Conn, data []byte)    { w.errorChan <- data }
-func (w *Producer) onConnHeartbeat(c *Conn)             {}
 func (w *Producer) onConnIOError(c *Conn, err error)    { w.close() }
+func (w *Producer) onConnHeartbeat(c *Conn) {
+	atomic.StoreInt64(&w.lastHeartbeat, time.Now().UnixNano())
+}
 func (w *Producer) onConnClose(c *Conn) {
 	w.guard.Lock()
 	defer w.guard.Unlock()
@@ -9,6 +9,7 @@ import (
 	"os"
 	"runtime"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -255,6 +256,278 @@ func TestProducerHeartbeat(t *testing.T) {
 	readMessages(topicName, t, msgCount+1)
 }
 
+func TestProducerBestEffortBuffer(t *testing.T) {
+	b := newBestEffortBuffer(2, false)
+	b.push(bestEffortEntry{"t", []byte("1")})
+	b.push(bestEffortEntry{"t", []byte("2")})
+	if !b.push(bestEffortEntry{"t", []byte("3")}) {
+		t.Fatal("push to a full buffer should report a drop")
+	}
+	e, _ := b.pop()
+	if string(e.body) != "2" {
+		t.Fatalf("oldest entry should have been dropped, got %s", e.body)
+	}
+
+	b = newBestEffortBuffer(2, true)
+	b.push(bestEffortEntry{"t", []byte("1")})
+	b.push(bestEffortEntry{"t", []byte("2")})
+	b.push(bestEffortEntry{"t", []byte("3")})
+	e, _ = b.pop()
+	if string(e.body) != "1" {
+		t.Fatalf("newest entry should have been dropped, got %s", e.body)
+	}
+	e, _ = b.pop()
+	if string(e.body) != "2" {
+		t.Fatalf("unexpected entry %s", e.body)
+	}
+	if _, ok := b.pop(); ok {
+		t.Fatal("buffer should be empty")
+	}
+}
+
+func TestProducerPublishBestEffortDisconnected(t *testing.T) {
+	config := NewConfig()
+	config.DialTimeout = 50 * time.Millisecond
+	w, _ := NewProducer("127.0.0.1:1", config)
+	w.SetLogger(nullLogger, LogLevelInfo)
+
+	for i := 0; i < 3; i++ {
+		if err := w.PublishBestEffort("write_test", []byte("test")); err != nil {
+			t.Fatalf("best-effort publish should not fail - %s", err)
+		}
+	}
+
+	w.Stop()
+
+	if w.BestEffortDropped() != 3 {
+		t.Fatalf("dropped count %d != 3", w.BestEffortDropped())
+	}
+	if err := w.PublishBestEffort("write_test", []byte("test")); err != ErrStopped {
+		t.Fatalf("should not be able to publish after Stop() - %v", err)
+	}
+}
+
+func TestProducerPublishBestEffortStop(t *testing.T) {
+	config := NewConfig()
+	config.DialTimeout = 50 * time.Millisecond
+	config.BestEffortBufferSize = 1024
+	w, _ := NewProducer("127.0.0.1:1", config)
+	w.SetLogger(nullLogger, LogLevelInfo)
+
+	// every message accepted concurrently with Stop is accounted for
+	var accepted uint64
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for w.PublishBestEffort("write_test", []byte("test")) == nil {
+				atomic.AddUint64(&accepted, 1)
+			}
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	w.Stop()
+	wg.Wait()
+
+	if dropped := w.BestEffortDropped(); dropped != atomic.LoadUint64(&accepted) {
+		t.Fatalf("dropped count %d != %d accepted", dropped, accepted)
+	}
+}
+
+func TestProducerInvalidTopic(t *testing.T) {
+	config := NewConfig()
+	config.DialTimeout = 50 * time.Millisecond
+	w, _ := NewProducer("127.0.0.1:1", config)
+	w.SetLogger(nullLogger, LogLevelInfo)
+	defer w.Stop()
+
+	// the topic is validated before connecting
+	for _, err := range []error{
+		w.Publish("orders/eu", []byte("test")),
+		w.MultiPublish("", [][]byte{[]byte("test")}),
+		w.DeferredPublishAsync("orders eu", time.Second, []byte("test"), nil),
+		w.PublishBestEffort("orders#ephemeral#ephemeral", []byte("test")),
+	} {
+		if err == nil || !strings.Contains(err.Error(), "invalid topic name") {
+			t.Fatalf("expected an invalid topic name error, got %v", err)
+		}
+	}
+	if w.BestEffortDropped() != 0 {
+		t.Fatal("expected the invalid best-effort message not to be buffered")
+	}
+}
+
+func TestProducerHealthy(t *testing.T) {
+	config := NewConfig()
+	config.HeartbeatInterval = 100 * time.Millisecond
+	p, _ := NewProducer("127.0.0.1:0", config)
+	p.SetLogger(nullLogger, LogLevelInfo)
+	if err := p.Healthy(); err != ErrNotConnected {
+		t.Fatalf("expected ErrNotConnected, got %v", err)
+	}
+
+	p.conn = newMockProducerConn(&producerConnDelegate{p})
+	atomic.StoreInt64(&p.lastHeartbeat, time.Now().UnixNano())
+	atomic.StoreInt32(&p.state, StateConnected)
+	if err := p.Healthy(); err != nil {
+		t.Fatalf("expected producer to be healthy - %s", err)
+	}
+
+	atomic.StoreInt64(&p.lastHeartbeat, time.Now().Add(-time.Second).UnixNano())
+	if err := p.Healthy(); err == nil {
+		t.Fatal("expected producer with a stale heartbeat to be unhealthy")
+	}
+	p.onConnHeartbeat(nil)
+	if err := p.Healthy(); err != nil {
+		t.Fatalf("expected producer to be healthy - %s", err)
+	}
+}
+
+// recordingProducerConn records the bodies of the commands written
+type recordingProducerConn struct {
+	producerConn
+	mtx    sync.Mutex
+	bodies [][]byte
+}
+
+func (m *recordingProducerConn) WriteCommand(cmd *Command) error {
+	m.mtx.Lock()
+	m.bodies = append(m.bodies, cmd.Body)
+	m.mtx.Unlock()
+	return m.producerConn.WriteCommand(cmd)
+}
+
+func TestProducerPublishValue(t *testing.T) {
+	config := NewConfig()
+	p, _ := NewProducer("127.0.0.1:0", config)
+	p.SetLogger(nullLogger, LogLevelInfo)
+	conn := &recordingProducerConn{producerConn: newMockProducerConn(&producerConnDelegate{p})}
+	p.conn = conn
+	atomic.StoreInt32(&p.state, StateConnected)
+	p.closeChan = make(chan int)
+	p.wg.Add(1)
+	go p.router()
+	defer p.Stop()
+
+	// JSON bodies are published as is
+	if err := p.PublishValue("test", map[string]int{"a": 1}); err != nil {
+		t.Fatal(err)
+	}
+	p.config.Codec = RawCodec{}
+	if err := p.PublishValue("test", "raw"); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.mtx.Lock()
+	defer conn.mtx.Unlock()
+	if len(conn.bodies) != 2 || string(conn.bodies[0]) != `{"a":1}` {
+		t.Fatalf("unexpected bodies %q", conn.bodies)
+	}
+	headers, body, ok := DecodeEnvelope(conn.bodies[1])
+	if !ok || headers.Get(HeaderContentType) != ContentTypeRaw || string(body) != "raw" {
+		t.Fatalf("unexpected envelope %v %q", headers, body)
+	}
+}
+
+func TestProducerPublishBestEffortCompression(t *testing.T) {
+	config := NewConfig()
+	config.MessageCompression = "gzip"
+	p, _ := NewProducer("127.0.0.1:0", config)
+	p.SetLogger(nullLogger, LogLevelInfo)
+	conn := &recordingProducerConn{producerConn: newMockProducerConn(&producerConnDelegate{p})}
+	p.conn = conn
+	atomic.StoreInt32(&p.state, StateConnected)
+	p.closeChan = make(chan int)
+	p.wg.Add(1)
+	go p.router()
+	defer p.Stop()
+
+	body := bytes.Repeat([]byte("compressible "), 200)
+	if err := p.PublishBestEffort("test", body); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		conn.mtx.Lock()
+		bodies := conn.bodies
+		conn.mtx.Unlock()
+		if len(bodies) == 1 {
+			headers, _, ok := DecodeEnvelope(bodies[0])
+			if !ok || headers.Get(HeaderContentEncoding) != "gzip" {
+				t.Fatalf("expected a compressed body, got %d bytes", len(bodies[0]))
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for the best-effort publish")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// silentProducerConn never receives responses from nsqd
+type silentProducerConn struct {
+	mockProducerConn
+}
+
+func (m *silentProducerConn) WriteCommand(cmd *Command) error {
+	return nil
+}
+
+func TestProducerMaxPendingCommands(t *testing.T) {
+	config := NewConfig()
+	config.MaxPendingCommands = 2
+	p, _ := NewProducer("127.0.0.1:0", config)
+	p.SetLogger(nullLogger, LogLevelInfo)
+
+	p.conn = &silentProducerConn{mockProducerConn{closeCh: make(chan struct{})}}
+	atomic.StoreInt32(&p.state, StateConnected)
+	p.closeChan = make(chan int)
+	p.wg.Add(1)
+	go p.router()
+
+	doneChan := make(chan *ProducerTransaction, 3)
+	for i := 0; i < 2; i++ {
+		if err := p.PublishAsync("test", []byte("body"), doneChan); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := p.PublishAsync("test", []byte("body"), doneChan); err != ErrBackpressure {
+		t.Fatalf("expected ErrBackpressure, got %v", err)
+	}
+
+	if err := p.UpdateConfig(map[string]interface{}{"max_pending_commands": 3}); err == nil {
+		t.Fatal("expected an error changing max_pending_commands")
+	}
+	if err := p.UpdateConfig(map[string]interface{}{"pending_commands_timeout": "50ms"}); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if err := p.Publish("test", []byte("body")); err != ErrBackpressure {
+		t.Fatalf("expected ErrBackpressure, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Fatalf("expected to wait for a pending command slot, waited %s", elapsed)
+	}
+
+	// responding frees a slot
+	p.responseChan <- []byte("OK")
+	if tr := <-doneChan; tr.Error != nil {
+		t.Fatalf("unexpected error %s", tr.Error)
+	}
+	if err := p.PublishAsync("test", []byte("body"), doneChan); err != nil {
+		t.Fatal(err)
+	}
+
+	p.Stop()
+	for i := 0; i < 2; i++ {
+		if tr := <-doneChan; tr.Error != ErrNotConnected {
+			t.Fatalf("expected ErrNotConnected, got %v", tr.Error)
+		}
+	}
+}
+
 func readMessages(topicName string, t *testing.T, msgCount int) {
 	config := NewConfig()
 	config.DefaultRequeueDelay = 0
@@ -1,11 +1,14 @@
 package nsq
 
 import (
-	"encoding/binary"
-	"errors"
 	"fmt"
 	"io"
+	"os"
 	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/nsqio/go-nsq/protocol"
 )
 
 // MagicV1 is the initial identifier sent when connecting for V1 clients
@@ -16,9 +19,9 @@ var MagicV2 = []byte("  V2")
 
 // frame types
 const (
-	FrameTypeResponse int32 = 0
-	FrameTypeError    int32 = 1
-	FrameTypeMessage  int32 = 2
+	FrameTypeResponse int32 = protocol.FrameTypeResponse
+	FrameTypeError    int32 = protocol.FrameTypeError
+	FrameTypeMessage  int32 = protocol.FrameTypeMessage
 )
 
 var validTopicChannelNameRegex = regexp.MustCompile(`^[\.a-zA-Z0-9_-]+(#ephemeral)?$`)
@@ -40,6 +43,91 @@ func isValidName(name string) bool {
 	return validTopicChannelNameRegex.MatchString(name)
 }
 
+// ValidateTopicName checks a topic name for correctness, returning an error
+// describing why it is invalid
+func ValidateTopicName(name string) error {
+	return validateName("topic", name)
+}
+
+// ValidateChannelName checks a channel name for correctness, returning an error
+// describing why it is invalid
+func ValidateChannelName(name string) error {
+	return validateName("channel", name)
+}
+
+func validateName(kind string, name string) error {
+	if len(name) < 1 {
+		return fmt.Errorf("invalid %s name: empty", kind)
+	}
+	if len(name) > 64 {
+		return fmt.Errorf("invalid %s name %q: %d characters > 64", kind, name, len(name))
+	}
+	if validTopicChannelNameRegex.MatchString(name) {
+		return nil
+	}
+	for _, c := range strings.TrimSuffix(name, EphemeralSuffix) {
+		if !isValidNameChar(c) {
+			return fmt.Errorf("invalid %s name %q: invalid character %q "+
+				"(only a-z, A-Z, 0-9, '.', '_' and '-' are allowed, with an optional %s suffix)",
+				kind, name, c, EphemeralSuffix)
+		}
+	}
+	return fmt.Errorf("invalid %s name %q", kind, name)
+}
+
+func isValidNameChar(c rune) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') ||
+		c == '.' || c == '_' || c == '-'
+}
+
+// EphemeralSuffix is the suffix of ephemeral topic and channel names
+//
+// nsqd never persists the messages of ephemeral topics and channels to disk, and
+// deletes them once their last client disconnects (or, for topics, their last channel
+// is deleted).
+const EphemeralSuffix = "#ephemeral"
+
+// EphemeralName returns name with EphemeralSuffix (unless it is already ephemeral)
+func EphemeralName(name string) string {
+	if IsEphemeral(name) {
+		return name
+	}
+	return name + EphemeralSuffix
+}
+
+// IsEphemeral returns whether a topic or channel name is ephemeral
+func IsEphemeral(name string) bool {
+	return strings.HasSuffix(name, EphemeralSuffix)
+}
+
+// TransientChannelName returns an ephemeral channel name unique to this process,
+// prefix followed by the hostname and pid (e.g. "cache.host-1.4242#ephemeral")
+//
+// This is useful for broadcast style consumption, where every instance of a service
+// receives every message (on its own channel) and the channel should not outlive it.
+//
+// Invalid characters of the hostname are replaced and it is truncated as needed to
+// form a valid name.
+func TransientChannelName(prefix string) string {
+	hostname, _ := os.Hostname()
+	hostname = strings.Map(func(c rune) rune {
+		if isValidNameChar(c) {
+			return c
+		}
+		return '-'
+	}, hostname)
+
+	suffix := "." + strconv.Itoa(os.Getpid()) + EphemeralSuffix
+	name := prefix
+	if hostname != "" {
+		name += "." + hostname
+	}
+	if max := 64 - len(suffix); len(name) > max {
+		name = name[:max]
+	}
+	return name + suffix
+}
+
 // ReadResponse is a client-side utility function to read from the supplied Reader
 // according to the NSQ protocol spec:
 //
@@ -49,25 +137,7 @@ func isValidName(name string) bool {
 //    ------------------------...
 //        size       data
 func ReadResponse(r io.Reader) ([]byte, error) {
-	var msgSize int32
-
-	// message size
-	err := binary.Read(r, binary.BigEndian, &msgSize)
-	if err != nil {
-		return nil, err
-	}
-
-	if msgSize < 0 {
-		return nil, fmt.Errorf("response msg size is negative: %v", msgSize)
-	}
-	// message binary data
-	buf := make([]byte, msgSize)
-	_, err = io.ReadFull(r, buf)
-	if err != nil {
-		return nil, err
-	}
-
-	return buf, nil
+	return protocol.ReadResponse(r)
 }
 
 // UnpackResponse is a client-side utility function that unpacks serialized data
@@ -81,20 +151,12 @@ func ReadResponse(r io.Reader) ([]byte, error) {
 //
 // Returns a triplicate of: frame type, data ([]byte), error
 func UnpackResponse(response []byte) (int32, []byte, error) {
-	if len(response) < 4 {
-		return -1, nil, errors.New("length of response is too small")
-	}
-
-	return int32(binary.BigEndian.Uint32(response)), response[4:], nil
+	return protocol.UnpackResponse(response)
 }
 
 // ReadUnpackedResponse reads and parses data from the underlying
 // TCP connection according to the NSQ TCP protocol spec and
 // returns the frameType, data or error
 func ReadUnpackedResponse(r io.Reader) (int32, []byte, error) {
-	resp, err := ReadResponse(r)
-	if err != nil {
-		return -1, nil, err
-	}
-	return UnpackResponse(resp)
+	return protocol.ReadUnpackedResponse(r)
 }
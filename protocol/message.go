@@ -0,0 +1,58 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// MsgIDLength is the number of bytes of a message ID
+const MsgIDLength = 16
+
+// Message is the data of a FrameTypeMessage frame
+type Message struct {
+	ID        [MsgIDLength]byte
+	Body      []byte
+	Timestamp int64
+	Attempts  uint16
+}
+
+// DecodeMessage decodes the data of a FrameTypeMessage frame, whose Body aliases b:
+//
+//	[x][x][x][x][x][x][x][x][x][x][x][x][x][x][x][x][x][x][x][x][x][x][x][x][x][x][x][x][x][x]...
+//	|       (int64)        ||    ||      (hex string encoded in ASCII)           || (binary)
+//	|       8-byte         ||    ||                 16-byte                      || N-byte
+//	------------------------------------------------------------------------------------------...
+//	  nanosecond timestamp    ^^                   message ID                       message body
+//	                       (uint16)
+//	                        2-byte
+//	                       attempts
+func DecodeMessage(b []byte) (*Message, error) {
+	var msg Message
+
+	if len(b) < 10+MsgIDLength {
+		return nil, errors.New("not enough data to decode valid message")
+	}
+
+	msg.Timestamp = int64(binary.BigEndian.Uint64(b[:8]))
+	msg.Attempts = binary.BigEndian.Uint16(b[8:10])
+	copy(msg.ID[:], b[10:10+MsgIDLength])
+	msg.Body = b[10+MsgIDLength:]
+
+	return &msg, nil
+}
+
+// WriteTo writes the encoding of m (the data of a FrameTypeMessage frame) to w
+func (m *Message) WriteTo(w io.Writer) (int64, error) {
+	var buf [10 + MsgIDLength]byte
+	binary.BigEndian.PutUint64(buf[:8], uint64(m.Timestamp))
+	binary.BigEndian.PutUint16(buf[8:10], m.Attempts)
+	copy(buf[10:], m.ID[:])
+
+	n, err := w.Write(buf[:])
+	if err != nil {
+		return int64(n), err
+	}
+	b, err := w.Write(m.Body)
+	return int64(n + b), err
+}
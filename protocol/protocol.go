@@ -0,0 +1,92 @@
+// Package protocol implements the framing of the NSQ TCP protocol, for tooling such as
+// proxies, sniffers and custom clients.
+//
+// It is the implementation used by package nsq, whose ReadResponse, UnpackResponse,
+// ReadUnpackedResponse and DecodeMessage functions are equivalent to those here.
+//
+// See https://nsq.io/clients/tcp_protocol_spec.html
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// MagicV2 is the initial identifier sent by clients of the V2 protocol when connecting
+var MagicV2 = []byte("  V2")
+
+// frame types
+const (
+	FrameTypeResponse int32 = 0
+	FrameTypeError    int32 = 1
+	FrameTypeMessage  int32 = 2
+)
+
+// ReadResponse reads a size prefixed response from r:
+//
+//	[x][x][x][x][x][x][x][x]...
+//	|  (int32) || (binary)
+//	|  4-byte  || N-byte
+//	------------------------...
+//	    size       data
+func ReadResponse(r io.Reader) ([]byte, error) {
+	var msgSize int32
+
+	// message size
+	err := binary.Read(r, binary.BigEndian, &msgSize)
+	if err != nil {
+		return nil, err
+	}
+
+	if msgSize < 0 {
+		return nil, fmt.Errorf("response msg size is negative: %v", msgSize)
+	}
+	// message binary data
+	buf := make([]byte, msgSize)
+	_, err = io.ReadFull(r, buf)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf, nil
+}
+
+// UnpackResponse unpacks a response read by ReadResponse into its frame type and data:
+//
+//	[x][x][x][x][x][x][x][x]...
+//	|  (int32) || (binary)
+//	|  4-byte  || N-byte
+//	------------------------...
+//	  frame ID     data
+func UnpackResponse(response []byte) (int32, []byte, error) {
+	if len(response) < 4 {
+		return -1, nil, errors.New("length of response is too small")
+	}
+
+	return int32(binary.BigEndian.Uint32(response)), response[4:], nil
+}
+
+// ReadUnpackedResponse reads a frame from r, returning its frame type and data
+func ReadUnpackedResponse(r io.Reader) (int32, []byte, error) {
+	resp, err := ReadResponse(r)
+	if err != nil {
+		return -1, nil, err
+	}
+	return UnpackResponse(resp)
+}
+
+// WriteFrame writes a frame of frameType with data to w, as nsqd does
+func WriteFrame(w io.Writer, frameType int32, data []byte) (int, error) {
+	var header [8]byte
+	binary.BigEndian.PutUint32(header[:4], uint32(len(data)+4))
+	binary.BigEndian.PutUint32(header[4:], uint32(frameType))
+
+	n, err := w.Write(header[:])
+	if err != nil {
+		return n, err
+	}
+	m, err := w.Write(data)
+	return n + m, err
+}
@@ -0,0 +1,38 @@
+package protocol
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestFrames(t *testing.T) {
+	msg := &Message{Body: []byte("body"), Timestamp: 42, Attempts: 3}
+	copy(msg.ID[:], "0123456789abcdef")
+	var data bytes.Buffer
+	msg.WriteTo(&data)
+
+	var buf bytes.Buffer
+	WriteFrame(&buf, FrameTypeResponse, []byte("OK"))
+	WriteFrame(&buf, FrameTypeMessage, data.Bytes())
+
+	frameType, resp, err := ReadUnpackedResponse(&buf)
+	if err != nil || frameType != FrameTypeResponse || string(resp) != "OK" {
+		t.Fatalf("unexpected frame %d %q (%v)", frameType, resp, err)
+	}
+	frameType, resp, err = ReadUnpackedResponse(&buf)
+	if err != nil || frameType != FrameTypeMessage {
+		t.Fatalf("unexpected frame %d (%v)", frameType, err)
+	}
+	decoded, err := DecodeMessage(resp)
+	if err != nil || decoded.ID != msg.ID || string(decoded.Body) != "body" ||
+		decoded.Timestamp != 42 || decoded.Attempts != 3 {
+		t.Fatalf("unexpected message %+v (%v)", decoded, err)
+	}
+
+	if _, err := DecodeMessage([]byte("short")); err == nil {
+		t.Fatal("expected an error for a short message")
+	}
+	if _, _, err := UnpackResponse([]byte{0}); err == nil {
+		t.Fatal("expected an error for a short response")
+	}
+}
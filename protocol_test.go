@@ -0,0 +1,89 @@
+package nsq
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestValidateName(t *testing.T) {
+	tests := []struct {
+		name  string
+		valid bool
+		err   string
+	}{
+		{"orders", true, ""},
+		{"orders.v2_a-b#ephemeral", true, ""},
+		{"", false, "empty"},
+		{strings.Repeat("a", 65), false, "65 characters > 64"},
+		{"orders/eu", false, "invalid character '/'"},
+		{"orders#ephemeral#ephemeral", false, "invalid character '#'"},
+	}
+	for _, tt := range tests {
+		err := ValidateTopicName(tt.name)
+		if tt.valid != (err == nil) || IsValidTopicName(tt.name) != tt.valid {
+			t.Fatalf("ValidateTopicName(%q) = %v, expected valid %v", tt.name, err, tt.valid)
+		}
+		if err != nil && !strings.Contains(err.Error(), tt.err) {
+			t.Fatalf("ValidateTopicName(%q) = %v, expected %q", tt.name, err, tt.err)
+		}
+	}
+	if err := ValidateChannelName("a b"); err == nil || !strings.Contains(err.Error(), "channel") {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestEphemeralName(t *testing.T) {
+	if EphemeralName("ch") != "ch#ephemeral" || EphemeralName("ch#ephemeral") != "ch#ephemeral" {
+		t.Fatal("unexpected ephemeral name")
+	}
+	if IsEphemeral("ch") || !IsEphemeral("ch#ephemeral") {
+		t.Fatal("unexpected IsEphemeral result")
+	}
+
+	for _, prefix := range []string{"cache", strings.Repeat("p", 80)} {
+		name := TransientChannelName(prefix)
+		if !IsEphemeral(name) {
+			t.Fatalf("transient channel name %q is not ephemeral", name)
+		}
+		if err := ValidateChannelName(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestReadPooledFrame(t *testing.T) {
+	msg := NewMessage(MessageID{'z', 'e', 'r', 'o'}, bytes.Repeat([]byte("z"), 3000))
+	var frames bytes.Buffer
+	for _, frame := range [][]byte{
+		framedResponse(FrameTypeResponse, []byte("OK")),
+		framedResponse(FrameTypeMessage, frameMessage(msg)),
+	} {
+		frames.Write(frame)
+	}
+
+	frameType, data, buf, err := readPooledFrame(&frames)
+	if err != nil || frameType != FrameTypeResponse || string(data) != "OK" || buf != nil {
+		t.Fatalf("unexpected frame %d %q %v (%v)", frameType, data, buf, err)
+	}
+
+	frameType, data, buf, err = readPooledFrame(&frames)
+	if err != nil || frameType != FrameTypeMessage || buf == nil || cap(*buf) != 4096 {
+		t.Fatalf("unexpected frame %d %v (%v)", frameType, buf, err)
+	}
+	decoded, _ := DecodeMessage(data)
+	decoded.frameBuf = buf
+	if decoded.ID != msg.ID || !bytes.Equal(decoded.Body, msg.Body) {
+		t.Fatalf("unexpected message %s %q", decoded.ID, decoded.Body)
+	}
+	decoded.Release()
+	decoded.Release()
+	if decoded.Body != nil {
+		t.Fatal("expected Body to be released")
+	}
+
+	if _, _, _, err := readPooledFrame(&frames); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+}
@@ -0,0 +1,126 @@
+package nsq
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// serve accepts connections on a new listener, calling handle for each
+func serve(t *testing.T, handle func(conn net.Conn)) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go handle(conn)
+		}
+	}()
+	return l
+}
+
+// tunnel connects conn to addr, once the proxy handshake has completed
+func tunnel(conn net.Conn, addr string) {
+	target, err := net.Dial("tcp", addr)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go io.Copy(target, conn)
+	io.Copy(conn, target)
+	conn.Close()
+}
+
+func testProxyDial(t *testing.T, proxyURL string, target string) {
+	dial, err := NewProxyDialContext(proxyURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	conn, err := dial(ctx, "tcp", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.Write([]byte("  V2"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "  V2" {
+		t.Fatalf("unexpected echo %q (%v)", buf, err)
+	}
+}
+
+func TestProxyDialContext(t *testing.T) {
+	echo := serve(t, func(conn net.Conn) {
+		io.Copy(conn, conn)
+		conn.Close()
+	})
+	defer echo.Close()
+	_, port, _ := net.SplitHostPort(echo.Addr().String())
+
+	socks5 := serve(t, func(conn net.Conn) {
+		buf := make([]byte, 256)
+		// greeting (offering no authentication and username/password), choose the latter
+		io.ReadFull(conn, buf[:4])
+		conn.Write([]byte{0x05, 0x02})
+		// VER, ULEN, UNAME, PLEN, PASSWD
+		io.ReadFull(conn, buf[:2])
+		user := make([]byte, buf[1])
+		io.ReadFull(conn, user)
+		io.ReadFull(conn, buf[:1])
+		pass := make([]byte, buf[0])
+		io.ReadFull(conn, pass)
+		if string(user) != "user" || string(pass) != "pass" {
+			conn.Write([]byte{0x01, 0x01})
+			conn.Close()
+			return
+		}
+		conn.Write([]byte{0x01, 0x00})
+		// VER, CMD, RSV, ATYP (domain name), then the length-prefixed domain and port
+		io.ReadFull(conn, buf[:5])
+		atyp := buf[3]
+		host := make([]byte, buf[4])
+		io.ReadFull(conn, host)
+		io.ReadFull(conn, buf[:2])
+		if atyp != 0x03 || string(host) != "localhost" {
+			conn.Write([]byte{0x05, 0x04, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+			conn.Close()
+			return
+		}
+		conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 127, 0, 0, 1, 0, 0})
+		tunnel(conn, net.JoinHostPort("127.0.0.1", port))
+	})
+	defer socks5.Close()
+	testProxyDial(t, "socks5://user:pass@"+socks5.Addr().String(), "localhost:"+port)
+
+	httpProxy := serve(t, func(conn net.Conn) {
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil || req.Method != "CONNECT" || req.Header.Get("Proxy-Authorization") != "Basic dXNlcjpwYXNz" {
+			conn.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\n\r\n"))
+			conn.Close()
+			return
+		}
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		tunnel(conn, req.Host)
+	})
+	defer httpProxy.Close()
+	testProxyDial(t, "http://user:pass@"+httpProxy.Addr().String(), echo.Addr().String())
+
+	dial, _ := NewProxyDialContext("http://"+httpProxy.Addr().String(), nil)
+	if _, err := dial(context.Background(), "tcp", echo.Addr().String()); err == nil {
+		t.Fatal("expected an error without proxy credentials")
+	}
+	if _, err := NewProxyDialContext("ftp://proxy:21", nil); err == nil {
+		t.Fatal("expected an error for an unsupported scheme")
+	}
+}
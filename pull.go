@@ -0,0 +1,50 @@
+package nsq
+
+import (
+	"sync/atomic"
+)
+
+// Messages returns a channel of the messages received by this Consumer, as an
+// alternative to adding a handler, e.g. to integrate with an existing worker pool.
+//
+// Auto-response is disabled for every message, so the caller must explicitly
+// Finish or Requeue (or Touch) each one. Messages that exceeded MaxAttempts are
+// given up on (and dead-lettered, see Config.DeadLetter) without being sent on the
+// channel, as are those rejected by Config.SchemaValidator, which are responded to per
+// the DecodeErrorHandler. Features that wrap handlers (middleware, HandlerTimeout,
+// rate limiting, idempotency, etc.) do not apply.
+//
+// The same channel is returned on every call, and is closed once the Consumer stops.
+// The caller must keep receiving until then, otherwise Stop blocks as it would for a
+// blocked handler. When handlers have also been added, messages are distributed
+// between them and this channel.
+func (r *Consumer) Messages() <-chan *Message {
+	r.messagesOnce.Do(func() {
+		r.messagesChan = make(chan *Message)
+		atomic.AddInt32(&r.runningHandlers, 1)
+		go r.messagesLoop()
+	})
+	return r.messagesChan
+}
+
+func (r *Consumer) messagesLoop() {
+	r.log(LogLevelDebug, "starting Messages channel")
+
+	for message := range r.incomingMessages {
+		if r.shouldFailMessage(message, nil) {
+			message.Finish()
+			continue
+		}
+		if !r.validMessage(message) {
+			continue
+		}
+		message.DisableAutoResponse()
+		r.messagesChan <- message
+	}
+	close(r.messagesChan)
+
+	r.log(LogLevelDebug, "stopping Messages channel")
+	if atomic.AddInt32(&r.runningHandlers, -1) == 0 {
+		r.exit()
+	}
+}
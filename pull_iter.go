@@ -0,0 +1,47 @@
+//go:build go1.23
+// +build go1.23
+
+package nsq
+
+import (
+	"context"
+	"iter"
+)
+
+// All returns an iterator over the messages received by this Consumer (see Messages),
+// for use in a range-over-func loop:
+//
+//	for msg, err := range consumer.All(ctx) {
+//		if err != nil {
+//			return err
+//		}
+//		...
+//		msg.Finish()
+//	}
+//
+// Iteration ends once the Consumer stops, after yielding the error returned by Wait
+// if it stopped itself. When ctx is done, ctx.Err() is yielded and iteration ends.
+// Breaking out of the loop early leaves the Consumer running, so the caller must
+// resume iterating (or receiving from Messages) for it to stop.
+func (r *Consumer) All(ctx context.Context) iter.Seq2[*Message, error] {
+	messages := r.Messages()
+	return func(yield func(*Message, error) bool) {
+		for {
+			select {
+			case <-ctx.Done():
+				yield(nil, ctx.Err())
+				return
+			case message, ok := <-messages:
+				if !ok {
+					if err := r.Wait(ctx); err != nil {
+						yield(nil, err)
+					}
+					return
+				}
+				if !yield(message, nil) {
+					return
+				}
+			}
+		}
+	}
+}
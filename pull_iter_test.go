@@ -0,0 +1,48 @@
+//go:build go1.23
+// +build go1.23
+
+package nsq
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestConsumerAll(t *testing.T) {
+	q, _ := NewConsumer("all_test", "ch", NewConfig())
+	q.SetLogger(nullLogger, LogLevelInfo)
+
+	go func() {
+		for i := 0; i < 3; i++ {
+			msg := NewMessage(MessageID{'a', byte(i)}, nil)
+			msg.Delegate = &recordingMessageDelegate{}
+			q.incomingMessages <- msg
+		}
+		q.Stop()
+	}()
+
+	var n int
+	for msg, err := range q.All(context.Background()) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg.Finish()
+		n++
+	}
+	if n != 3 {
+		t.Fatalf("expected 3 messages, got %d", n)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	q, _ = NewConsumer("all_test", "ch", NewConfig())
+	q.SetLogger(nullLogger, LogLevelInfo)
+	for _, err := range q.All(ctx) {
+		if err != context.DeadlineExceeded {
+			t.Fatalf("unexpected error %v", err)
+		}
+	}
+	q.Stop()
+	<-q.StopChan
+}
@@ -0,0 +1,91 @@
+package nsq
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConsumerMessages(t *testing.T) {
+	config := NewConfig()
+	config.MaxAttempts = 2
+	q, _ := NewConsumer("messages_test", "ch", config)
+	q.SetLogger(nullLogger, LogLevelInfo)
+
+	messages := q.Messages()
+	if q.Messages() != messages {
+		t.Fatal("expected the same channel")
+	}
+
+	exceeded := NewMessage(MessageID{'e'}, nil)
+	exceeded.Attempts = 3
+	exceededDelegate := &recordingMessageDelegate{}
+	exceeded.Delegate = exceededDelegate
+	msg := NewMessage(MessageID{'m'}, nil)
+	msg.Attempts = 1
+	delegate := &recordingMessageDelegate{}
+	msg.Delegate = delegate
+
+	go func() {
+		q.incomingMessages <- exceeded
+		q.incomingMessages <- msg
+	}()
+	received := <-messages
+	if received != msg || !received.IsAutoResponseDisabled() {
+		t.Fatalf("unexpected message %+v", received)
+	}
+	if exceededDelegate.finished != 1 {
+		t.Fatal("message exceeding MaxAttempts was not finished")
+	}
+	received.Finish()
+	if delegate.finished != 1 {
+		t.Fatal("message was not finished")
+	}
+
+	q.Stop()
+	select {
+	case _, ok := <-messages:
+		if ok {
+			t.Fatal("unexpected message after stop")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for Messages to be closed")
+	}
+	<-q.StopChan
+}
+
+func TestConsumerMessagesSchemaValidation(t *testing.T) {
+	config := NewConfig()
+	config.SchemaValidator = SchemaValidatorFunc(func(topic string, contentType string, body []byte) error {
+		if string(body) != "valid" {
+			return ErrSchemaValidation{Topic: topic, Violations: []string{"invalid body"}}
+		}
+		return nil
+	})
+	q, _ := NewConsumer("messages_schema_test", "ch", config)
+	q.SetLogger(nullLogger, LogLevelInfo)
+	messages := q.Messages()
+
+	invalid := NewMessage(MessageID{'i'}, []byte("invalid"))
+	invalidDelegate := &recordingMessageDelegate{}
+	invalid.Delegate = invalidDelegate
+	valid := NewMessage(MessageID{'v'}, []byte("valid"))
+	valid.Delegate = &recordingMessageDelegate{}
+
+	go func() {
+		q.incomingMessages <- invalid
+		q.incomingMessages <- valid
+	}()
+	if received := <-messages; received != valid {
+		t.Fatalf("unexpected message %+v", received)
+	}
+	// the default DecodeErrorHandler requeues rejected messages
+	if invalidDelegate.requeued != 1 {
+		t.Fatal("rejected message was not requeued")
+	}
+	valid.Finish()
+
+	q.Stop()
+	for range messages {
+	}
+	<-q.StopChan
+}
@@ -0,0 +1,62 @@
+package nsq
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket, holding at most one second's worth of tokens
+type rateLimiter struct {
+	mtx    sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64) *rateLimiter {
+	return &rateLimiter{
+		rate: rate,
+		last: time.Now(),
+	}
+}
+
+// reserve takes n tokens, returning how long to wait until they are available
+func (l *rateLimiter) reserve(n int) time.Duration {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	now := time.Now()
+	burst := l.rate
+	if burst < 1 {
+		burst = 1
+	}
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > burst {
+		l.tokens = burst
+	}
+	l.last = now
+
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// rateLimit blocks until n messages may be handled without exceeding
+// Config.MaxMessagesPerSecond
+func (r *Consumer) rateLimit(n int) {
+	if r.rateLimiter == nil {
+		return
+	}
+	d := r.rateLimiter.reserve(n)
+	if d <= 0 {
+		return
+	}
+	t := time.NewTimer(d)
+	select {
+	case <-t.C:
+	case <-r.exitChan:
+		t.Stop()
+	}
+}
@@ -0,0 +1,109 @@
+package nsq
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// RDYStrategy defines a policy for choosing which connections receive RDY when
+// the Consumer periodically redistributes RDY (every RDYRedistributeInterval).
+//
+// Redistribution occurs when max-in-flight is lower than the number of connections
+// or the Consumer is in backoff, meaning only some connections can have a non-zero
+// RDY count at any given time. Connections that have been idle for LowRdyIdleTimeout
+// (or have held RDY for longer than LowRdyTimeout) give up their RDY beforehand.
+type RDYStrategy interface {
+	// Select returns up to n of the candidate connections, each of which will
+	// be sent RDY 1
+	Select(candidates []*Conn, n int) []*Conn
+}
+
+// RandomRDYStrategy selects connections uniformly at random (default)
+type RandomRDYStrategy struct {
+	rngOnce sync.Once
+	rngMtx  sync.Mutex
+	rng     *rand.Rand
+}
+
+// Select returns n randomly chosen candidates
+func (s *RandomRDYStrategy) Select(candidates []*Conn, n int) []*Conn {
+	// lazily initialize the RNG
+	s.rngOnce.Do(func() {
+		if s.rng != nil {
+			return
+		}
+		s.rng = rand.New(rand.NewSource(time.Now().UnixNano()))
+	})
+
+	s.rngMtx.Lock()
+	perm := s.rng.Perm(len(candidates))
+	s.rngMtx.Unlock()
+
+	if n > len(candidates) {
+		n = len(candidates)
+	}
+	selected := make([]*Conn, 0, n)
+	for _, i := range perm[:n] {
+		selected = append(selected, candidates[i])
+	}
+	return selected
+}
+
+// WeightedRDYStrategy selects connections at random, weighted by the number of
+// messages each is expected to deliver, so that busy nsqd aren't starved of RDY
+// while idle ones hold it
+//
+// The weight of a connection is the depth of the channel on its nsqd (see
+// Conn.ChannelDepth, which requires Config.DepthMonitorInterval) or, when unknown,
+// the number of messages received over the recent past (see Conn.MessageRate).
+// Every connection has a weight of at least 1, so idle nsqd are still selected
+// occasionally.
+type WeightedRDYStrategy struct {
+	rngOnce sync.Once
+	rngMtx  sync.Mutex
+	rng     *rand.Rand
+}
+
+// Select returns n candidates chosen by weighted random sampling
+func (s *WeightedRDYStrategy) Select(candidates []*Conn, n int) []*Conn {
+	// lazily initialize the RNG
+	s.rngOnce.Do(func() {
+		if s.rng != nil {
+			return
+		}
+		s.rng = rand.New(rand.NewSource(time.Now().UnixNano()))
+	})
+
+	// weighted sampling without replacement (Efraimidis-Spirakis), selecting the
+	// candidates with the largest u^(1/weight) for uniformly random u
+	type keyed struct {
+		conn *Conn
+		key  float64
+	}
+	keys := make([]keyed, len(candidates))
+	s.rngMtx.Lock()
+	for i, c := range candidates {
+		keys[i] = keyed{c, math.Pow(s.rng.Float64(), 1/rdyWeight(c))}
+	}
+	s.rngMtx.Unlock()
+	sort.Slice(keys, func(i, j int) bool { return keys[i].key > keys[j].key })
+
+	if n > len(candidates) {
+		n = len(candidates)
+	}
+	selected := make([]*Conn, 0, n)
+	for _, k := range keys[:n] {
+		selected = append(selected, k.conn)
+	}
+	return selected
+}
+
+func rdyWeight(c *Conn) float64 {
+	if depth := c.ChannelDepth(); depth >= 0 {
+		return 1 + float64(depth)
+	}
+	return 1 + c.MessageRate()*messageRateWindow.Seconds()
+}
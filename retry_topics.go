@@ -0,0 +1,186 @@
+package nsq
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// RetryTopicNamer is an interface accepted by `SetBehaviorDelegate()`
+// for customizing the names of the retry topics of a Consumer (see Config.RetryTiers)
+type RetryTopicNamer interface {
+	RetryTopic(topic string, channel string, tier int) string
+}
+
+// defaultRetryTopic returns `<topic>.retry.<tier>` (keeping any ephemeral suffix last)
+func defaultRetryTopic(topic string, channel string, tier int) string {
+	if strings.HasSuffix(topic, "#ephemeral") {
+		return fmt.Sprintf("%s.retry.%d#ephemeral", strings.TrimSuffix(topic, "#ephemeral"), tier)
+	}
+	return fmt.Sprintf("%s.retry.%d", topic, tier)
+}
+
+func (r *Consumer) retryTopic(tier int) string {
+	if namer, ok := r.behaviorDelegate.(RetryTopicNamer); ok {
+		return namer.RetryTopic(r.topic, r.channel, tier)
+	}
+	return defaultRetryTopic(r.topic, r.channel, tier)
+}
+
+// retryDelay returns the delay before a message republished to tier is delivered
+func (r *Consumer) retryDelay(tier int) time.Duration {
+	multiplier := math.Pow(r.config.RetryTierMultiplier, float64(tier-1))
+	return time.Duration(float64(r.config.RetryTierDelay) * multiplier)
+}
+
+// set on messages whose body was not an envelope before being retried, so that the
+// original body is passed to handlers
+const headerRetryUnwrap = "nsq-retry-unwrap"
+
+var errRetryTiersExhausted = errors.New("retry tiers exhausted")
+
+// requeueFailed responds to message after its handler failed, republishing it to the
+// next retry topic (see Config.RetryTiers) or REQueueing it
+func (r *Consumer) requeueFailed(message *Message) {
+	if r.config.RetryTiers > 0 {
+		err := r.retry(message)
+		if err == nil {
+			message.Finish()
+			return
+		}
+		if err != errRetryTiersExhausted {
+			r.log(LogLevelError, "msg %s failed to publish to retry topic - %s", message.ID, err)
+		}
+	}
+	message.Requeue(-1)
+}
+
+// retry republishes message, wrapped in an envelope recording its retry tier and
+// attempts, to the next retry topic with a delay via the nsqd it was received from
+func (r *Consumer) retry(message *Message) error {
+	var headers Headers
+	var body []byte
+	unwrap := false
+	if message.retryHeaders != nil {
+		headers = message.retryHeaders.clone()
+		body = message.Body
+		unwrap = true
+	} else {
+		var ok bool
+		headers, body, ok = message.Envelope()
+		headers = headers.clone()
+		unwrap = !ok
+	}
+
+	tier, _ := strconv.Atoi(headers[HeaderRetryTier])
+	if tier >= r.config.RetryTiers {
+		return errRetryTiersExhausted
+	}
+	tier++
+	topic := r.retryTopic(tier)
+	if !IsValidTopicName(topic) {
+		return fmt.Errorf("invalid retry topic name %q", topic)
+	}
+
+	attempts, _ := strconv.Atoi(headers[HeaderRetryAttempts])
+	headers[HeaderRetryTier] = strconv.Itoa(tier)
+	headers[HeaderRetryAttempts] = strconv.Itoa(attempts + int(message.Attempts))
+	if _, ok := headers[HeaderOriginalTopic]; !ok {
+		headers[HeaderOriginalTopic] = r.topic
+		headers[HeaderOriginalChannel] = r.channel
+		headers[HeaderMessageID] = string(message.ID[:])
+	}
+	if unwrap {
+		headers[headerRetryUnwrap] = "1"
+	}
+
+	producer, err := r.deadLetterProducer(message.NSQDAddress)
+	if err != nil {
+		return err
+	}
+	delay := r.retryDelay(tier)
+	r.log(LogLevelDebug, "msg %s republished to %s (delay %s)", message.ID, topic, delay)
+	return producer.DeferredPublish(topic, delay, EncodeEnvelope(headers, body))
+}
+
+// RetryConsumers returns the Consumers of the retry topics of this Consumer (see
+// Config.RetryTiers), once connected, in order of tier
+func (r *Consumer) RetryConsumers() []*Consumer {
+	r.retryMtx.Lock()
+	defer r.retryMtx.Unlock()
+	return append([]*Consumer(nil), r.retryConsumers...)
+}
+
+// connectRetryConsumers creates the Consumers of the retry topics (the first time it
+// is called) and calls connect on each
+func (r *Consumer) connectRetryConsumers(connect func(c *Consumer) error) error {
+	if r.config.RetryTiers == 0 || r.retryParent != nil {
+		return nil
+	}
+
+	r.retryMtx.Lock()
+	if r.retryConsumers == nil {
+		for tier := 1; tier <= r.config.RetryTiers; tier++ {
+			c, err := NewConsumer(r.retryTopic(tier), r.channel, r.config.Clone())
+			if err != nil {
+				r.retryMtx.Unlock()
+				return err
+			}
+			c.retryParent = r
+			c.SetLoggerLevel(r.getLogLevel())
+			for index := range r.logger {
+				l, _ := r.getLogger(LogLevel(index))
+				c.SetLoggerForLevel(l, LogLevel(index))
+			}
+			if r.behaviorDelegate != nil {
+				c.SetBehaviorDelegate(r.behaviorDelegate)
+			}
+			atomic.AddInt32(&c.runningHandlers, 1)
+			go c.retryRelayLoop()
+			r.retryConsumers = append(r.retryConsumers, c)
+		}
+	}
+	consumers := r.retryConsumers
+	r.retryMtx.Unlock()
+
+	for _, c := range consumers {
+		if err := connect(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// retryRelayLoop passes the messages received by a retry Consumer to the handlers of
+// the Consumer whose retry topic it consumes
+func (r *Consumer) retryRelayLoop() {
+	r.log(LogLevelDebug, "starting retry relay")
+
+	for message := range r.incomingMessages {
+		headers, body, ok := message.Envelope()
+		if ok && headers[HeaderRetryTier] != "" && headers[headerRetryUnwrap] == "1" {
+			message.retryHeaders = headers
+			message.Headers = nil
+			message.Body = body
+		}
+		r.retryParent.incomingMessages <- message
+	}
+
+	r.log(LogLevelDebug, "stopping retry relay")
+	if atomic.AddInt32(&r.runningHandlers, -1) == 0 {
+		r.exit()
+	}
+}
+
+// stopRetryConsumers stops the retry Consumers, blocking until they have stopped
+// relaying messages
+func (r *Consumer) stopRetryConsumers() {
+	for _, c := range r.RetryConsumers() {
+		c.Stop()
+		<-c.StopChan
+	}
+}
@@ -0,0 +1,89 @@
+package nsq
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestConsumerRetryTopic(t *testing.T) {
+	config := NewConfig()
+	config.RetryTiers = 3
+	config.RetryTierDelay = 10 * time.Second
+	q, _ := NewConsumer("orders", "billing", config)
+
+	for tier, expected := range map[int]time.Duration{1: 10 * time.Second, 2: 40 * time.Second, 3: 160 * time.Second} {
+		if delay := q.retryDelay(tier); delay != expected {
+			t.Fatalf("unexpected delay %s for tier %d", delay, tier)
+		}
+	}
+	if topic := q.retryTopic(2); topic != "orders.retry.2" {
+		t.Fatalf("unexpected retry topic %s", topic)
+	}
+	if topic := defaultRetryTopic("orders#ephemeral", "billing", 1); topic != "orders.retry.1#ephemeral" {
+		t.Fatalf("unexpected ephemeral retry topic %s", topic)
+	}
+}
+
+func TestConsumerRetryTiersExhausted(t *testing.T) {
+	config := NewConfig()
+	config.RetryTiers = 2
+	q, _ := NewConsumer("retry_exhausted_test", "ch", config)
+	q.SetLogger(nullLogger, LogLevelInfo)
+	defer q.Stop()
+
+	delegate := &recordingMessageDelegate{}
+	msg := NewMessage(MessageID{'r', 'e', 't', 'r', 'y'}, []byte("body"))
+	msg.Delegate = delegate
+	msg.retryHeaders = Headers{HeaderRetryTier: "2", headerRetryUnwrap: "1"}
+	q.requeueFailed(msg)
+	if delegate.finished != 0 || delegate.requeued != 1 {
+		t.Fatalf("unexpected response %+v", delegate)
+	}
+}
+
+func TestConsumerRetryRelay(t *testing.T) {
+	config := NewConfig()
+	config.RetryTiers = 2
+	q, _ := NewConsumer("retry_relay_test", "ch", config)
+	q.SetLogger(nullLogger, LogLevelInfo)
+
+	bodies := make(chan []byte, 2)
+	q.AddHandler(HandlerFunc(func(m *Message) error {
+		bodies <- m.Body
+		return nil
+	}))
+
+	err := q.connectRetryConsumers(func(c *Consumer) error { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	retryConsumers := q.RetryConsumers()
+	if len(retryConsumers) != 2 || retryConsumers[1].topic != "retry_relay_test.retry.2" {
+		t.Fatalf("unexpected retry consumers %v", retryConsumers)
+	}
+
+	wrapped := EncodeEnvelope(Headers{HeaderRetryTier: "1", headerRetryUnwrap: "1"}, []byte("raw"))
+	enveloped := EncodeEnvelope(Headers{HeaderRetryTier: "2", "trace": "abc"}, []byte("payload"))
+	for _, body := range [][]byte{wrapped, enveloped} {
+		msg := NewMessage(MessageID{}, body)
+		msg.Delegate = &recordingMessageDelegate{}
+		retryConsumers[0].incomingMessages <- msg
+	}
+	if body := <-bodies; string(body) != "raw" {
+		t.Fatalf("unexpected body %q", body)
+	}
+	if body := <-bodies; !bytes.Equal(body, enveloped) {
+		t.Fatalf("enveloped body should be passed as is, got %q", body)
+	}
+
+	q.Stop()
+	select {
+	case <-q.StopChan:
+	case <-time.After(5 * time.Second):
+		t.Fatal("consumer did not stop")
+	}
+	for _, c := range retryConsumers {
+		<-c.StopChan
+	}
+}
@@ -0,0 +1,443 @@
+package nsq
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// SchemaValidator validates message bodies (see Config.SchemaValidator), returning an
+// ErrSchemaValidation (or another error) to reject body
+//
+// contentType is the HeaderContentType header of the envelope of the message (or "" when
+// it has none), and body is the body of the envelope.
+type SchemaValidator interface {
+	Validate(topic string, contentType string, body []byte) error
+}
+
+// SchemaValidatorFunc is an adapter to allow the use of ordinary functions as a
+// SchemaValidator
+type SchemaValidatorFunc func(topic string, contentType string, body []byte) error
+
+// Validate implements SchemaValidator
+func (f SchemaValidatorFunc) Validate(topic string, contentType string, body []byte) error {
+	return f(topic, contentType, body)
+}
+
+// validateSchema validates body (or the body of its envelope) with validator
+func validateSchema(validator SchemaValidator, topic string, body []byte) error {
+	headers, body, _ := DecodeEnvelope(body)
+	return validator.Validate(topic, headers.Get(HeaderContentType), body)
+}
+
+// JSONSchemaValidator is a SchemaValidator validating bodies against JSON Schemas
+// (https://json-schema.org) added per topic and content type, e.g.
+//
+//	validator := nsq.NewJSONSchemaValidator()
+//	err := validator.AddSchema("orders", "", []byte(`{
+//		"type": "object",
+//		"required": ["id", "total"],
+//		"properties": {
+//			"id": {"type": "string", "minLength": 1},
+//			"total": {"type": "number", "minimum": 0}
+//		}
+//	}`))
+//	config.SchemaValidator = validator
+//
+// Bodies of topics (and content types) without a schema are accepted. The validation
+// keywords type, enum, const, properties, required, additionalProperties, items, minItems,
+// maxItems, minimum, maximum, exclusiveMinimum, exclusiveMaximum, multipleOf, minLength,
+// maxLength, pattern, allOf, anyOf, oneOf and not are supported, others (e.g. $ref and
+// format) are ignored.
+type JSONSchemaValidator struct {
+	mtx     sync.RWMutex
+	schemas map[schemaKey]*jsonSchema
+}
+
+type schemaKey struct {
+	topic       string
+	contentType string
+}
+
+// NewJSONSchemaValidator returns a JSONSchemaValidator without schemas
+func NewJSONSchemaValidator() *JSONSchemaValidator {
+	return &JSONSchemaValidator{schemas: make(map[schemaKey]*jsonSchema)}
+}
+
+// AddSchema sets the JSON Schema of the bodies of messages of topic with contentType
+// (see LookupCodec for the accepted forms), or of any content type without a schema of
+// its own when contentType is ""
+func (v *JSONSchemaValidator) AddSchema(topic string, contentType string, schema []byte) error {
+	var doc interface{}
+	if err := json.Unmarshal(schema, &doc); err != nil {
+		return fmt.Errorf("invalid JSON schema - %s", err)
+	}
+	s, err := compileJSONSchema(doc)
+	if err != nil {
+		return fmt.Errorf("invalid JSON schema - %s", err)
+	}
+	if contentType != "" {
+		contentType = normalizeContentType(contentType)
+	}
+	v.mtx.Lock()
+	v.schemas[schemaKey{topic, contentType}] = s
+	v.mtx.Unlock()
+	return nil
+}
+
+// Validate implements SchemaValidator
+func (v *JSONSchemaValidator) Validate(topic string, contentType string, body []byte) error {
+	v.mtx.RLock()
+	s, ok := v.schemas[schemaKey{topic, normalizeContentType(contentType)}]
+	if !ok {
+		s, ok = v.schemas[schemaKey{topic, ""}]
+	}
+	v.mtx.RUnlock()
+	if !ok {
+		return nil
+	}
+
+	var doc interface{}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return ErrSchemaValidation{Topic: topic, ContentType: contentType,
+			Violations: []string{"invalid JSON - " + err.Error()}}
+	}
+	if violations := s.validate("", doc, nil); len(violations) > 0 {
+		return ErrSchemaValidation{Topic: topic, ContentType: contentType, Violations: violations}
+	}
+	return nil
+}
+
+// jsonSchema is a compiled JSON Schema
+type jsonSchema struct {
+	// set for the boolean schemas true and false
+	always *bool
+
+	types    []string
+	enum     []interface{}
+	constant []interface{}
+
+	properties           map[string]*jsonSchema
+	required             []string
+	additionalProperties *jsonSchema
+
+	items    *jsonSchema
+	minItems *float64
+	maxItems *float64
+
+	minimum          *float64
+	maximum          *float64
+	exclusiveMinimum *float64
+	exclusiveMaximum *float64
+	multipleOf       *float64
+
+	minLength *float64
+	maxLength *float64
+	pattern   *regexp.Regexp
+
+	allOf []*jsonSchema
+	anyOf []*jsonSchema
+	oneOf []*jsonSchema
+	not   *jsonSchema
+}
+
+func compileJSONSchema(doc interface{}) (*jsonSchema, error) {
+	if b, ok := doc.(bool); ok {
+		return &jsonSchema{always: &b}, nil
+	}
+	m, ok := doc.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("schema must be an object or a boolean")
+	}
+
+	s := &jsonSchema{}
+	var err error
+	switch t := m["type"].(type) {
+	case nil:
+	case string:
+		s.types = []string{t}
+	case []interface{}:
+		for _, v := range t {
+			name, ok := v.(string)
+			if !ok {
+				return nil, errors.New("type must be a string or an array of strings")
+			}
+			s.types = append(s.types, name)
+		}
+	default:
+		return nil, errors.New("type must be a string or an array of strings")
+	}
+	if enum, ok := m["enum"]; ok {
+		if s.enum, ok = enum.([]interface{}); !ok {
+			return nil, errors.New("enum must be an array")
+		}
+	}
+	if c, ok := m["const"]; ok {
+		s.constant = []interface{}{c}
+	}
+
+	if props, ok := m["properties"]; ok {
+		pm, ok := props.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("properties must be an object")
+		}
+		s.properties = make(map[string]*jsonSchema, len(pm))
+		for name, p := range pm {
+			if s.properties[name], err = compileJSONSchema(p); err != nil {
+				return nil, fmt.Errorf("properties/%s: %s", name, err)
+			}
+		}
+	}
+	if req, ok := m["required"]; ok {
+		names, ok := req.([]interface{})
+		if !ok {
+			return nil, errors.New("required must be an array of strings")
+		}
+		for _, v := range names {
+			name, ok := v.(string)
+			if !ok {
+				return nil, errors.New("required must be an array of strings")
+			}
+			s.required = append(s.required, name)
+		}
+	}
+	for _, kw := range []struct {
+		name string
+		dst  **jsonSchema
+	}{
+		{"additionalProperties", &s.additionalProperties},
+		{"items", &s.items},
+		{"not", &s.not},
+	} {
+		if v, ok := m[kw.name]; ok {
+			if *kw.dst, err = compileJSONSchema(v); err != nil {
+				return nil, fmt.Errorf("%s: %s", kw.name, err)
+			}
+		}
+	}
+	for _, kw := range []struct {
+		name string
+		dst  *[]*jsonSchema
+	}{
+		{"allOf", &s.allOf},
+		{"anyOf", &s.anyOf},
+		{"oneOf", &s.oneOf},
+	} {
+		v, ok := m[kw.name]
+		if !ok {
+			continue
+		}
+		list, ok := v.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s must be an array of schemas", kw.name)
+		}
+		for i, item := range list {
+			sub, err := compileJSONSchema(item)
+			if err != nil {
+				return nil, fmt.Errorf("%s/%d: %s", kw.name, i, err)
+			}
+			*kw.dst = append(*kw.dst, sub)
+		}
+	}
+	for _, kw := range []struct {
+		name string
+		dst  **float64
+	}{
+		{"minItems", &s.minItems},
+		{"maxItems", &s.maxItems},
+		{"minimum", &s.minimum},
+		{"maximum", &s.maximum},
+		{"exclusiveMinimum", &s.exclusiveMinimum},
+		{"exclusiveMaximum", &s.exclusiveMaximum},
+		{"multipleOf", &s.multipleOf},
+		{"minLength", &s.minLength},
+		{"maxLength", &s.maxLength},
+	} {
+		if v, ok := m[kw.name]; ok {
+			f, ok := v.(float64)
+			if !ok {
+				return nil, fmt.Errorf("%s must be a number", kw.name)
+			}
+			*kw.dst = &f
+		}
+	}
+	if p, ok := m["pattern"]; ok {
+		expr, ok := p.(string)
+		if !ok {
+			return nil, errors.New("pattern must be a string")
+		}
+		if s.pattern, err = regexp.Compile(expr); err != nil {
+			return nil, fmt.Errorf("pattern: %s", err)
+		}
+	}
+	return s, nil
+}
+
+// jsonType returns the JSON Schema type of v, as decoded by encoding/json
+func jsonType(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		if v == math.Trunc(v) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	}
+	return "object"
+}
+
+// validate appends the violations of v (at path) to violations
+func (s *jsonSchema) validate(path string, v interface{}, violations []string) []string {
+	fail := func(format string, args ...interface{}) {
+		p := path
+		if p == "" {
+			p = "/"
+		}
+		violations = append(violations, p+": "+fmt.Sprintf(format, args...))
+	}
+
+	if s.always != nil {
+		if !*s.always {
+			fail("is not allowed")
+		}
+		return violations
+	}
+
+	typ := jsonType(v)
+	if len(s.types) > 0 {
+		matched := false
+		for _, t := range s.types {
+			if t == typ || (t == "number" && typ == "integer") {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			fail("must be of type %s, got %s", strings.Join(s.types, " or "), typ)
+			return violations
+		}
+	}
+	if s.enum != nil && !containsJSON(s.enum, v) {
+		fail("must be one of the enum values")
+	}
+	if s.constant != nil && !reflect.DeepEqual(s.constant[0], v) {
+		fail("must be the const value")
+	}
+
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for _, name := range s.required {
+			if _, ok := v[name]; !ok {
+				fail("property %s is required", name)
+			}
+		}
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if p, ok := s.properties[name]; ok {
+				violations = p.validate(path+"/"+name, v[name], violations)
+			} else if s.additionalProperties != nil {
+				violations = s.additionalProperties.validate(path+"/"+name, v[name], violations)
+			}
+		}
+	case []interface{}:
+		if s.minItems != nil && float64(len(v)) < *s.minItems {
+			fail("must have at least %v items", *s.minItems)
+		}
+		if s.maxItems != nil && float64(len(v)) > *s.maxItems {
+			fail("must have at most %v items", *s.maxItems)
+		}
+		if s.items != nil {
+			for i, item := range v {
+				violations = s.items.validate(path+"/"+strconv.Itoa(i), item, violations)
+			}
+		}
+	case float64:
+		if s.minimum != nil && v < *s.minimum {
+			fail("must be >= %v", *s.minimum)
+		}
+		if s.maximum != nil && v > *s.maximum {
+			fail("must be <= %v", *s.maximum)
+		}
+		if s.exclusiveMinimum != nil && v <= *s.exclusiveMinimum {
+			fail("must be > %v", *s.exclusiveMinimum)
+		}
+		if s.exclusiveMaximum != nil && v >= *s.exclusiveMaximum {
+			fail("must be < %v", *s.exclusiveMaximum)
+		}
+		if s.multipleOf != nil && *s.multipleOf > 0 {
+			if q := v / *s.multipleOf; q != math.Trunc(q) {
+				fail("must be a multiple of %v", *s.multipleOf)
+			}
+		}
+	case string:
+		n := float64(utf8.RuneCountInString(v))
+		if s.minLength != nil && n < *s.minLength {
+			fail("must be at least %v characters", *s.minLength)
+		}
+		if s.maxLength != nil && n > *s.maxLength {
+			fail("must be at most %v characters", *s.maxLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(v) {
+			fail("must match %s", s.pattern)
+		}
+	}
+
+	for _, sub := range s.allOf {
+		violations = sub.validate(path, v, violations)
+	}
+	if len(s.anyOf) > 0 {
+		matched := false
+		for _, sub := range s.anyOf {
+			if len(sub.validate(path, v, nil)) == 0 {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			fail("must match at least one schema of anyOf")
+		}
+	}
+	if len(s.oneOf) > 0 {
+		matched := 0
+		for _, sub := range s.oneOf {
+			if len(sub.validate(path, v, nil)) == 0 {
+				matched++
+			}
+		}
+		if matched != 1 {
+			fail("must match exactly one schema of oneOf, matched %d", matched)
+		}
+	}
+	if s.not != nil && len(s.not.validate(path, v, nil)) == 0 {
+		fail("must not match the schema of not")
+	}
+	return violations
+}
+
+func containsJSON(values []interface{}, v interface{}) bool {
+	for _, value := range values {
+		if reflect.DeepEqual(value, v) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,153 @@
+package nsq
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const orderSchema = `{
+	"type": "object",
+	"required": ["id", "total"],
+	"additionalProperties": false,
+	"properties": {
+		"id": {"type": "string", "pattern": "^o-[0-9]+$"},
+		"total": {"type": "number", "minimum": 0},
+		"status": {"enum": ["new", "paid"]},
+		"items": {
+			"type": "array",
+			"minItems": 1,
+			"items": {"type": "object", "required": ["sku"], "properties": {"qty": {"type": "integer"}}}
+		},
+		"note": {"anyOf": [{"type": "null"}, {"type": "string", "maxLength": 5}]}
+	}
+}`
+
+func TestJSONSchemaValidator(t *testing.T) {
+	v := NewJSONSchemaValidator()
+	if err := v.AddSchema("orders", "", []byte(orderSchema)); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.AddSchema("orders", "application/x-legacy+json", []byte(`{"type": "array"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.AddSchema("bad", "", []byte(`{"pattern": "("}`)); err == nil {
+		t.Fatalf("invalid schema should be rejected")
+	}
+
+	tests := []struct {
+		topic       string
+		contentType string
+		body        string
+		violations  []string
+	}{
+		{"orders", "", `{"id": "o-1", "total": 9.5, "items": [{"sku": "a", "qty": 2}], "note": null}`, nil},
+		{"orders", "application/json; charset=utf-8", `{"id": "o-1", "total": 0}`, nil},
+		{"orders", "application/x-legacy+json", `[1]`, nil},
+		{"other", "", `not json`, nil},
+		{"orders", "", `{"id": "x", "total": -1, "status": "lost", "extra": 1}`, []string{
+			"/extra: is not allowed",
+			"/id: must match ^o-[0-9]+$",
+			"/status: must be one of the enum values",
+			"/total: must be >= 0",
+		}},
+		{"orders", "", `{"items": [], "note": "too long"}`, []string{
+			"/: property id is required",
+			"/: property total is required",
+			"/items: must have at least 1 items",
+			"/note: must match at least one schema of anyOf",
+		}},
+		{"orders", "", `{"id": "o-1", "total": 1, "items": [{"qty": 1.5}]}`, []string{
+			"/items/0: property sku is required",
+			"/items/0/qty: must be of type integer, got number",
+		}},
+		{"orders", "", `[1]`, []string{"/: must be of type object, got array"}},
+	}
+	for _, tt := range tests {
+		err := v.Validate(tt.topic, tt.contentType, []byte(tt.body))
+		if tt.violations == nil {
+			if err != nil {
+				t.Fatalf("%s: unexpected error %v", tt.body, err)
+			}
+			continue
+		}
+		verr, ok := err.(ErrSchemaValidation)
+		if !ok || verr.Topic != tt.topic || !reflect.DeepEqual(verr.Violations, tt.violations) {
+			t.Fatalf("%s: unexpected error %#v", tt.body, err)
+		}
+	}
+}
+
+func TestProducerSchemaValidation(t *testing.T) {
+	v := NewJSONSchemaValidator()
+	v.AddSchema("orders", "", []byte(orderSchema))
+	config := NewConfig()
+	config.SchemaValidator = v
+	p, _ := NewProducer("127.0.0.1:0", config)
+	p.SetLogger(nullLogger, LogLevelInfo)
+
+	err := p.PublishWithHeaders("orders", Headers{HeaderContentType: "application/json"}, []byte(`{"id": "o-1"}`))
+	if verr, ok := err.(ErrSchemaValidation); !ok || verr.ContentType != "application/json" {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if _, ok := p.MultiPublish("orders", [][]byte{[]byte(`{}`)}).(ErrSchemaValidation); !ok {
+		t.Fatalf("multi-publish should be validated")
+	}
+	if _, ok := p.PublishBestEffort("orders", []byte(`{}`)).(ErrSchemaValidation); !ok {
+		t.Fatalf("best-effort publish should be validated")
+	}
+}
+
+func TestConsumerSchemaValidation(t *testing.T) {
+	valid := NewMessage(MessageID{'v', 'a', 'l', 'i', 'd'}, []byte(`{"id": "o-1", "total": 1}`))
+	invalid := NewMessage(MessageID{'i', 'n', 'v', 'a', 'l', 'i', 'd'}, []byte(`{"id": "o-1"}`))
+
+	script := []instruction{
+		// IDENTIFY
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		// SUB
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		instruction{20 * time.Millisecond, FrameTypeMessage, frameMessage(valid)},
+		instruction{0, FrameTypeMessage, frameMessage(invalid)},
+		// needed to exit test
+		instruction{50 * time.Millisecond, -1, []byte("exit")},
+	}
+	addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	n := newMockNSQD(t, script, addr.String())
+
+	v := NewJSONSchemaValidator()
+	v.AddSchema("orders", "", []byte(orderSchema))
+	config := NewConfig()
+	config.SchemaValidator = v
+	config.MaxInFlight = 2
+	q, _ := NewConsumer("orders", "ch", config)
+	q.SetLogger(nullLogger, LogLevelInfo)
+	handled := make(chan MessageID, 2)
+	q.AddHandler(HandlerFunc(func(m *Message) error {
+		handled <- m.ID
+		return nil
+	}))
+	rejected := make(chan error, 2)
+	q.SetDecodeErrorHandler(func(ctx context.Context, m *Message, err error) error {
+		rejected <- err
+		return nil
+	})
+	if err := q.ConnectToNSQD(n.tcpAddr.String()); err != nil {
+		t.Fatal(err)
+	}
+	<-n.exitChan
+	q.Stop()
+	<-q.StopChan
+
+	if len(handled) != 1 || <-handled != valid.ID {
+		t.Fatalf("only the valid message should be handled")
+	}
+	if len(rejected) != 1 {
+		t.Fatalf("the invalid message should be rejected")
+	}
+	if _, ok := (<-rejected).(ErrSchemaValidation); !ok {
+		t.Fatalf("rejected message should have an ErrSchemaValidation")
+	}
+}
@@ -0,0 +1,18 @@
+package nsq
+
+import (
+	"hash/fnv"
+	"math"
+)
+
+// shadowSampled returns true if message should be handled by a shadow Consumer (see
+// Config.Shadow), deterministically by message ID so that every shadow Consumer of
+// the same topic handles the same messages
+func (r *Consumer) shadowSampled(message *Message) bool {
+	if !r.config.Shadow || r.config.ShadowFraction >= 1 {
+		return true
+	}
+	h := fnv.New32a()
+	h.Write(message.ID[:])
+	return float64(h.Sum32()) < r.config.ShadowFraction*math.MaxUint32
+}
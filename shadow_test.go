@@ -0,0 +1,53 @@
+package nsq
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestConsumerShadowSampled(t *testing.T) {
+	config := NewConfig()
+	config.Shadow = true
+	config.ShadowFraction = 0.25
+	q, _ := NewConsumer("shadow_test", "canary", config)
+	q.SetLogger(nullLogger, LogLevelInfo)
+	defer q.Stop()
+
+	rng := rand.New(rand.NewSource(99))
+	var sampled int
+	for i := 0; i < 10000; i++ {
+		msg := NewMessage(MessageID{}, nil)
+		rng.Read(msg.ID[:])
+		if q.shadowSampled(msg) {
+			sampled++
+		}
+		if q.shadowSampled(msg) != q.shadowSampled(NewMessage(msg.ID, nil)) {
+			t.Fatal("sampling is not deterministic")
+		}
+	}
+	if sampled < 2300 || sampled > 2700 {
+		t.Fatalf("sampled %d of 10000 messages, expected ~2500", sampled)
+	}
+
+	q.config.Shadow = false
+	if !q.shadowSampled(NewMessage(MessageID{}, nil)) {
+		t.Fatal("every message should be sampled when not in shadow mode")
+	}
+}
+
+func TestConnShadowNeverRequeues(t *testing.T) {
+	config := NewConfig()
+	config.Shadow = true
+	c := NewConn("127.0.0.1:4150", config, nil)
+	c.SetLogger(nullLogger, LogLevelInfo, "")
+
+	msg := NewMessage(MessageID{'s', 'h', 'a', 'd', 'o', 'w'}, nil)
+	msg.Delegate = &connMessageDelegate{c}
+	go msg.Requeue(time.Second)
+
+	resp := <-c.msgResponseChan
+	if !resp.success || string(resp.cmd.Name) != "FIN" {
+		t.Fatalf("expected FIN, got %s", resp.cmd)
+	}
+}
@@ -0,0 +1,98 @@
+package nsq
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// sharedWrite is a message response or command queued to a shared write loop
+type sharedWrite struct {
+	c    *Conn
+	resp *msgResponse
+	cmd  *Command
+}
+
+// sharedWriteLoopSet is a set of write loops shared by the connections counted by refs
+type sharedWriteLoopSet struct {
+	n     int
+	loops []chan sharedWrite
+	next  int
+	refs  int
+	stop  chan struct{}
+}
+
+// write loops shared by connections, keyed by Config.SharedWriteLoops, started on
+// first use and stopped once the last connection using them has closed
+var (
+	sharedWriteLoopsMtx sync.Mutex
+	sharedWriteLoops    = make(map[int]*sharedWriteLoopSet)
+)
+
+// acquireSharedWriteLoop returns the next of n shared write loops (round robin), and
+// the set it belongs to, to be released with releaseSharedWriteLoops
+func acquireSharedWriteLoop(n int) (*sharedWriteLoopSet, chan sharedWrite) {
+	sharedWriteLoopsMtx.Lock()
+	defer sharedWriteLoopsMtx.Unlock()
+	set, ok := sharedWriteLoops[n]
+	if !ok {
+		set = &sharedWriteLoopSet{
+			n:     n,
+			loops: make([]chan sharedWrite, n),
+			stop:  make(chan struct{}),
+		}
+		for i := range set.loops {
+			set.loops[i] = make(chan sharedWrite)
+			go runSharedWriteLoop(set.loops[i], set.stop)
+		}
+		sharedWriteLoops[n] = set
+	}
+	set.refs++
+	set.next++
+	return set, set.loops[set.next%n]
+}
+
+// releaseSharedWriteLoops releases the loop of set acquired by a closed connection,
+// stopping the loops of set once no connection uses them
+func releaseSharedWriteLoops(set *sharedWriteLoopSet) {
+	sharedWriteLoopsMtx.Lock()
+	defer sharedWriteLoopsMtx.Unlock()
+	set.refs--
+	if set.refs > 0 {
+		return
+	}
+	close(set.stop)
+	delete(sharedWriteLoops, set.n)
+}
+
+// runSharedWriteLoop writes the responses and commands queued by its connections, in
+// order per connection, until stop is closed
+func runSharedWriteLoop(writes chan sharedWrite, stop chan struct{}) {
+	for {
+		var w sharedWrite
+		select {
+		case w = <-writes:
+		case <-stop:
+			return
+		}
+
+		// once a connection is closing, its responses are done with as they would have
+		// been by cleanup()
+		closing := false
+		select {
+		case <-w.c.exitChan:
+			closing = true
+		default:
+		}
+
+		switch {
+		case w.resp != nil && closing:
+			atomic.AddInt64(&w.c.messagesInFlight, -1)
+			w.c.responseWritten(w.resp, ErrNotConnected)
+			putMsgResponse(w.resp)
+		case w.resp != nil:
+			w.c.writeResponse(w.resp)
+		case !closing:
+			w.c.writeCmd(w.cmd)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package nsq
+
+import (
+	"crypto/tls"
+	"os"
+	"sync"
+	"time"
+)
+
+// CertificateReloader provides a client certificate loaded from a certificate and key
+// file, reloading them when they change on disk (e.g. rotated by cert-manager or a
+// SPIFFE helper), so that new connections use the current certificate without restarting
+// Consumers and Producers.
+//
+// Set its GetClientCertificate method as tls.Config.GetClientCertificate (or use the
+// tls_cert_reload option, see Config).
+type CertificateReloader struct {
+	certFile string
+	keyFile  string
+
+	// minimum duration between checks of the files for changes
+	checkInterval time.Duration
+
+	mtx       sync.Mutex
+	cert      *tls.Certificate
+	modTime   time.Time
+	checkedAt time.Time
+}
+
+// NewCertificateReloader creates a CertificateReloader for the given PEM encoded
+// certificate and key files, returning an error if they cannot be loaded
+func NewCertificateReloader(certFile string, keyFile string) (*CertificateReloader, error) {
+	r := &CertificateReloader{
+		certFile:      certFile,
+		keyFile:       keyFile,
+		checkInterval: time.Second,
+	}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload loads the certificate and key files
+func (r *CertificateReloader) Reload() error {
+	modTime, err := r.filesModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+
+	r.mtx.Lock()
+	r.cert = &cert
+	r.modTime = modTime
+	r.checkedAt = time.Now()
+	r.mtx.Unlock()
+	return nil
+}
+
+// GetClientCertificate returns the current certificate, first reloading it if the
+// files have changed. If they fail to load (e.g. mid-rotation) the previously loaded
+// certificate is returned.
+func (r *CertificateReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	r.mtx.Lock()
+	cert := r.cert
+	check := time.Since(r.checkedAt) >= r.checkInterval
+	if check {
+		r.checkedAt = time.Now()
+	}
+	r.mtx.Unlock()
+
+	if check {
+		modTime, err := r.filesModTime()
+		if err == nil && !modTime.Equal(r.loadedModTime()) {
+			if err := r.Reload(); err == nil {
+				r.mtx.Lock()
+				cert = r.cert
+				r.mtx.Unlock()
+			}
+		}
+	}
+	return cert, nil
+}
+
+func (r *CertificateReloader) loadedModTime() time.Time {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return r.modTime
+}
+
+// filesModTime returns the latest modification time of the certificate and key files
+func (r *CertificateReloader) filesModTime() (time.Time, error) {
+	var latest time.Time
+	for _, filename := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(filename)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
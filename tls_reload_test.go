@@ -0,0 +1,100 @@
+package nsq
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a new self-signed certificate for cn and its key to certFile and
+// keyFile, with the given modification time
+func writeTestCert(t *testing.T, cn string, certFile string, keyFile string, modTime time.Time) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	os.Chtimes(certFile, modTime, modTime)
+	os.Chtimes(keyFile, modTime, modTime)
+}
+
+func TestCertificateReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nsq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile := filepath.Join(dir, "client.pem")
+	keyFile := filepath.Join(dir, "client.key")
+
+	commonName := func(r *CertificateReloader) string {
+		cert, err := r.GetClientCertificate(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return leaf.Subject.CommonName
+	}
+
+	now := time.Now()
+	writeTestCert(t, "first", certFile, keyFile, now.Add(-time.Minute))
+	r, err := NewCertificateReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.checkInterval = 0
+	if cn := commonName(r); cn != "first" {
+		t.Fatalf("unexpected certificate %s", cn)
+	}
+
+	writeTestCert(t, "rotated", certFile, keyFile, now)
+	if cn := commonName(r); cn != "rotated" {
+		t.Fatalf("expected the rotated certificate, got %s", cn)
+	}
+
+	// a partially written rotation keeps the current certificate
+	ioutil.WriteFile(certFile, []byte("garbage"), 0600)
+	os.Chtimes(certFile, now.Add(time.Minute), now.Add(time.Minute))
+	if cn := commonName(r); cn != "rotated" {
+		t.Fatalf("expected the current certificate, got %s", cn)
+	}
+
+	writeTestCert(t, "config", certFile, keyFile, now)
+	config := NewConfig()
+	config.Set("tls_cert_reload", true)
+	config.Set("tls_cert", certFile)
+	if err := config.Set("tls_key", keyFile); err != nil {
+		t.Fatal(err)
+	}
+	if config.TlsConfig.GetClientCertificate == nil || len(config.TlsConfig.Certificates) != 0 {
+		t.Fatal("expected GetClientCertificate to be set")
+	}
+}
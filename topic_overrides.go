@@ -0,0 +1,67 @@
+package nsq
+
+import (
+	"fmt"
+	"sort"
+)
+
+// topicOverrides are the options overriding a shared Config for the Consumers of
+// individual topics (see ConsumerGroup.SetTopicOverrides and
+// PatternConsumer.SetTopicOverrides)
+type topicOverrides struct {
+	options map[string]map[string]interface{}
+	opts    map[string][]Option
+}
+
+func newTopicOverrides() topicOverrides {
+	return topicOverrides{
+		options: make(map[string]map[string]interface{}),
+		opts:    make(map[string][]Option),
+	}
+}
+
+// set validates and sets the options of topic, replacing any previously set
+func (o topicOverrides) set(base *Config, topic string, options map[string]interface{}) error {
+	if _, err := topicConfig(base, topic, options, o.opts[topic]); err != nil {
+		return err
+	}
+	o.options[topic] = options
+	return nil
+}
+
+// setOpts validates and sets the typed options of topic, replacing any previously set
+func (o topicOverrides) setOpts(base *Config, topic string, opts []Option) error {
+	if _, err := topicConfig(base, topic, o.options[topic], opts); err != nil {
+		return err
+	}
+	o.opts[topic] = opts
+	return nil
+}
+
+// config returns the Config of topic, merging its options into a copy of base
+func (o topicOverrides) config(base *Config, topic string) (*Config, error) {
+	return topicConfig(base, topic, o.options[topic], o.opts[topic])
+}
+
+// topicConfig returns a copy of base with options (in order of name), then opts, applied
+func topicConfig(base *Config, topic string, options map[string]interface{}, opts []Option) (*Config, error) {
+	names := make([]string, 0, len(options))
+	for option := range options {
+		names = append(names, option)
+	}
+	sort.Strings(names)
+
+	config := base.Clone()
+	for _, option := range names {
+		if err := config.Set(option, options[option]); err != nil {
+			return nil, fmt.Errorf("topic %s: %s", topic, err)
+		}
+	}
+	for _, opt := range opts {
+		opt(config)
+	}
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("topic %s: %s", topic, err)
+	}
+	return config, nil
+}
@@ -0,0 +1,80 @@
+package nsq
+
+// FrameDirection is the direction of a traced frame (see Config.FrameTracer)
+type FrameDirection int
+
+// Frame directions
+const (
+	// a frame read from nsqd
+	FrameRead FrameDirection = iota
+	// a command written to nsqd
+	FrameWritten
+)
+
+// String returns the string form of a FrameDirection
+func (d FrameDirection) String() string {
+	if d == FrameWritten {
+		return "write"
+	}
+	return "read"
+}
+
+// TracedFrame describes a frame read from, or a command written to, an nsqd connection
+type TracedFrame struct {
+	NSQDAddress string
+	Direction   FrameDirection
+
+	// the type of frames read (FrameTypeResponse, FrameTypeError or FrameTypeMessage),
+	// and the command (name and params) of commands written
+	FrameType int32
+	Command   string
+
+	// the frame data or command body, truncated to Config.FrameTraceMaxBytes, and its
+	// full size
+	Payload []byte
+	Size    int
+}
+
+// FrameTracer is called with every frame read from and command written to nsqd (see
+// Config.FrameTracer)
+type FrameTracer func(frame TracedFrame)
+
+// tracing returns whether frames should be passed to Config.FrameTracer
+func (c *Conn) tracing() bool {
+	return c.config.FrameTracer != nil && c.getLogLevel() == LogLevelDebug
+}
+
+func (c *Conn) traceRead(frameType int32, data []byte) {
+	if !c.tracing() {
+		return
+	}
+	c.config.FrameTracer(TracedFrame{
+		NSQDAddress: c.addr,
+		Direction:   FrameRead,
+		FrameType:   frameType,
+		Payload:     c.tracePayload(data),
+		Size:        len(data),
+	})
+}
+
+func (c *Conn) traceWrite(cmd *Command) {
+	if !c.tracing() {
+		return
+	}
+	c.config.FrameTracer(TracedFrame{
+		NSQDAddress: c.addr,
+		Direction:   FrameWritten,
+		FrameType:   -1,
+		Command:     cmd.String(),
+		Payload:     c.tracePayload(cmd.Body),
+		Size:        len(cmd.Body),
+	})
+}
+
+// tracePayload returns a copy of data, truncated to Config.FrameTraceMaxBytes
+func (c *Conn) tracePayload(data []byte) []byte {
+	if max := c.config.FrameTraceMaxBytes; max > 0 && len(data) > max {
+		data = data[:max]
+	}
+	return append([]byte(nil), data...)
+}
@@ -0,0 +1,39 @@
+//go:build go1.18
+// +build go1.18
+
+package nsq
+
+import (
+	"context"
+)
+
+// AddTypedHandler sets a handler for messages received by c, whose bodies are decoded
+// into a T (see Message.Decode) before calling fn with both the decoded value and the
+// raw message. Bodies encoded in an envelope (see EncodeEnvelope) are decoded from the
+// envelope body.
+//
+// Messages that cannot be decoded are passed to the DecodeErrorHandler of c (see
+// Consumer.SetDecodeErrorHandler) without calling fn.
+func AddTypedHandler[T any](c *Consumer, fn func(ctx context.Context, msg T, raw *Message) error) {
+	AddConcurrentTypedHandlers(c, fn, 1)
+}
+
+// AddConcurrentTypedHandlers sets a handler for messages received by c, spawning
+// concurrency goroutines (see AddTypedHandler and Consumer.AddConcurrentHandlers)
+func AddConcurrentTypedHandlers[T any](c *Consumer, fn func(ctx context.Context, msg T, raw *Message) error, concurrency int) {
+	c.AddConcurrentHandlersWithContext(&typedHandler[T]{c: c, fn: fn}, concurrency)
+}
+
+type typedHandler[T any] struct {
+	c  *Consumer
+	fn func(ctx context.Context, msg T, raw *Message) error
+}
+
+func (h *typedHandler[T]) HandleMessage(ctx context.Context, message *Message) error {
+	var v T
+	err := message.Decode(&v)
+	if err != nil {
+		return h.c.onDecodeError(ctx, message, err)
+	}
+	return h.fn(ctx, v, message)
+}
@@ -0,0 +1,67 @@
+//go:build go1.18
+// +build go1.18
+
+package nsq
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+type typedTestEvent struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+func TestTypedHandler(t *testing.T) {
+	q, _ := NewConsumer("typed_test", "ch", NewConfig())
+	q.SetLogger(nullLogger, LogLevelInfo)
+
+	var got []typedTestEvent
+	h := &typedHandler[typedTestEvent]{c: q, fn: func(ctx context.Context, e typedTestEvent, m *Message) error {
+		got = append(got, e)
+		return nil
+	}}
+
+	ctx := context.Background()
+	bodies := [][]byte{
+		[]byte(`{"name":"a","count":1}`),
+		EncodeEnvelope(Headers{HeaderKey: "b"}, []byte(`{"name":"b","count":2}`)),
+	}
+	for _, body := range bodies {
+		err := h.HandleMessage(ctx, NewMessage(MessageID{}, body))
+		if err != nil {
+			t.Fatalf("unexpected error %s", err)
+		}
+	}
+	if len(got) != 2 || got[0] != (typedTestEvent{"a", 1}) || got[1] != (typedTestEvent{"b", 2}) {
+		t.Fatalf("unexpected decoded events %v", got)
+	}
+
+	// undecodable messages are returned as errors by default
+	err := h.HandleMessage(ctx, NewMessage(MessageID{}, []byte("not json")))
+	if err == nil {
+		t.Fatal("expected a decode error")
+	}
+
+	var decodeErr error
+	q.SetDecodeErrorHandler(func(ctx context.Context, m *Message, err error) error {
+		decodeErr = err
+		return nil
+	})
+	err = h.HandleMessage(ctx, NewMessage(MessageID{}, []byte("not json")))
+	if err != nil || decodeErr == nil {
+		t.Fatalf("expected the decode error handler to be called, got %v", err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("handler should not be called for undecodable messages, got %v", got)
+	}
+
+	q.SetDecodeErrorHandler(func(ctx context.Context, m *Message, err error) error {
+		return errors.New("requeue")
+	})
+	if err = h.HandleMessage(ctx, NewMessage(MessageID{}, []byte("not json"))); err == nil || err.Error() != "requeue" {
+		t.Fatalf("expected the decode error handler's error, got %v", err)
+	}
+}
@@ -0,0 +1,317 @@
+package nsq
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// webSocketGUID is appended to Sec-WebSocket-Key to compute Sec-WebSocket-Accept (RFC 6455)
+const webSocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xa
+)
+
+// webSocketURL returns the URL of a `ws://host[:port]/path` or `wss://host[:port]/path`
+// address
+func webSocketURL(addr string) (*url.URL, bool) {
+	if !strings.HasPrefix(addr, "ws://") && !strings.HasPrefix(addr, "wss://") {
+		return nil, false
+	}
+	u, err := url.Parse(addr)
+	if err != nil || u.Host == "" {
+		return nil, false
+	}
+	return u, true
+}
+
+// webSocketHostPort returns the host:port to dial for a WebSocket URL
+func webSocketHostPort(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	if u.Scheme == "wss" {
+		return net.JoinHostPort(u.Hostname(), "443")
+	}
+	return net.JoinHostPort(u.Hostname(), "80")
+}
+
+// dialWebSocket dials the WebSocket endpoint at u via dial, returning a connection that
+// carries the NSQ TCP protocol in binary WebSocket messages
+//
+// wss:// endpoints are secured with tlsConf (the NSQ level TLS negotiated via IDENTIFY
+// is independent of it).
+func dialWebSocket(ctx context.Context, dial DialContextFunc, u *url.URL, tlsConf *tls.Config) (net.Conn, error) {
+	conn, err := dial(ctx, "tcp", webSocketHostPort(u))
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if u.Scheme == "wss" {
+		conf := &tls.Config{}
+		if tlsConf != nil {
+			conf = tlsConf.Clone()
+		}
+		if conf.ServerName == "" {
+			conf.ServerName = u.Hostname()
+		}
+		tlsConn := tls.Client(conn, conf)
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	ws, err := webSocketHandshake(conn, u)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("websocket %s: %s", u.Host, err)
+	}
+	conn.SetDeadline(time.Time{})
+	return ws, nil
+}
+
+// webSocketHandshake performs the opening handshake of a client on conn
+func webSocketHandshake(conn net.Conn, u *url.URL) (*wsConn, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce)
+
+	req := &http.Request{
+		Method: "GET",
+		URL:    &url.URL{Path: u.Path, RawQuery: u.RawQuery},
+		Host:   u.Host,
+		Header: make(http.Header),
+	}
+	if req.URL.Path == "" {
+		req.URL.Path = "/"
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	if u.User != nil {
+		password, _ := u.User.Password()
+		req.SetBasicAuth(u.User.Username(), password)
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		resp.Body.Close()
+		return nil, fmt.Errorf("upgrade failed - %s", resp.Status)
+	}
+	if !strings.EqualFold(resp.Header.Get("Upgrade"), "websocket") {
+		return nil, errors.New("upgrade failed - missing Upgrade header")
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != webSocketAccept(key) {
+		return nil, errors.New("upgrade failed - invalid Sec-WebSocket-Accept")
+	}
+	return &wsConn{Conn: conn, br: br, client: true}, nil
+}
+
+// webSocketAccept returns the Sec-WebSocket-Accept value for key
+func webSocketAccept(key string) string {
+	h := sha1.Sum([]byte(key + webSocketGUID))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// wsConn is a net.Conn reading and writing the payload of binary WebSocket messages,
+// answering pings and close frames as it reads
+type wsConn struct {
+	net.Conn
+	br *bufio.Reader
+
+	// client frames are masked, server frames are not
+	client bool
+
+	// remaining bytes of the payload of the current data frame, and its masking key
+	remaining int64
+	mask      []byte
+	maskPos   int
+
+	writeMtx sync.Mutex
+	closed   bool
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	for c.remaining == 0 {
+		if err := c.nextFrame(); err != nil {
+			return 0, err
+		}
+	}
+	if int64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.br.Read(p)
+	c.remaining -= int64(n)
+	if c.mask != nil {
+		c.unmask(p[:n])
+	}
+	return n, err
+}
+
+// nextFrame reads frame headers until that of a data frame, handling control frames
+func (c *wsConn) nextFrame() error {
+	var header [2]byte
+	if _, err := io.ReadFull(c.br, header[:]); err != nil {
+		return err
+	}
+	opcode := header[0] & 0x0f
+	masked := header[1]&0x80 != 0
+	length := int64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return err
+		}
+		length = int64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return err
+		}
+		length = int64(binary.BigEndian.Uint64(ext[:]))
+		if length < 0 {
+			return errors.New("websocket: invalid frame length")
+		}
+	}
+	c.mask = nil
+	c.maskPos = 0
+	if masked {
+		c.mask = make([]byte, 4)
+		if _, err := io.ReadFull(c.br, c.mask); err != nil {
+			return err
+		}
+	}
+
+	switch opcode {
+	case wsOpContinuation, wsOpBinary, wsOpText:
+		c.remaining = length
+		return nil
+	case wsOpClose, wsOpPing, wsOpPong:
+		if length > 125 {
+			return errors.New("websocket: control frame too long")
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(c.br, payload); err != nil {
+			return err
+		}
+		c.unmask(payload)
+		switch opcode {
+		case wsOpClose:
+			c.writeFrame(wsOpClose, payload)
+			return io.EOF
+		case wsOpPing:
+			_, err := c.writeFrame(wsOpPong, payload)
+			return err
+		}
+		return nil
+	}
+	return fmt.Errorf("websocket: unexpected opcode %d", opcode)
+}
+
+func (c *wsConn) unmask(b []byte) {
+	if c.mask == nil {
+		return
+	}
+	for i := range b {
+		b[i] ^= c.mask[c.maskPos%4]
+		c.maskPos++
+	}
+}
+
+// Write sends p as a single binary message
+func (c *wsConn) Write(p []byte) (int, error) {
+	return c.writeFrame(wsOpBinary, p)
+}
+
+func (c *wsConn) writeFrame(opcode byte, p []byte) (int, error) {
+	c.writeMtx.Lock()
+	defer c.writeMtx.Unlock()
+	if c.closed {
+		return 0, io.ErrClosedPipe
+	}
+
+	frame := make([]byte, 0, 14+len(p))
+	frame = append(frame, 0x80|opcode)
+	var maskBit byte
+	if c.client {
+		maskBit = 0x80
+	}
+	switch {
+	case len(p) < 126:
+		frame = append(frame, maskBit|byte(len(p)))
+	case len(p) <= 0xffff:
+		frame = append(frame, maskBit|126, byte(len(p)>>8), byte(len(p)))
+	default:
+		frame = append(frame, maskBit|127)
+		frame = append(frame, make([]byte, 8)...)
+		binary.BigEndian.PutUint64(frame[len(frame)-8:], uint64(len(p)))
+	}
+	if c.client {
+		var key [4]byte
+		if _, err := rand.Read(key[:]); err != nil {
+			return 0, err
+		}
+		frame = append(frame, key[:]...)
+		start := len(frame)
+		frame = append(frame, p...)
+		for i := range p {
+			frame[start+i] ^= key[i%4]
+		}
+	} else {
+		frame = append(frame, p...)
+	}
+
+	if _, err := c.Conn.Write(frame); err != nil {
+		return 0, err
+	}
+	if opcode == wsOpClose {
+		c.closed = true
+	}
+	return len(p), nil
+}
+
+// CloseRead shuts down the reading side of the underlying connection
+func (c *wsConn) CloseRead() error {
+	return closeRead(c.Conn)
+}
+
+// CloseWrite sends a close frame and shuts down the writing side of the underlying
+// connection
+func (c *wsConn) CloseWrite() error {
+	c.writeFrame(wsOpClose, nil)
+	return closeWrite(c.Conn)
+}
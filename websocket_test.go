@@ -0,0 +1,123 @@
+package nsq
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// serveWebSocket relays WebSocket connections to the TCP address target
+func serveWebSocket(t *testing.T, target string) net.Listener {
+	return serve(t, func(conn net.Conn) {
+		br := bufio.NewReader(conn)
+		req, err := http.ReadRequest(br)
+		if err != nil || req.Header.Get("Upgrade") != "websocket" || req.URL.Path != "/nsq" {
+			conn.Write([]byte("HTTP/1.1 400 Bad Request\r\n\r\n"))
+			conn.Close()
+			return
+		}
+		conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\n" +
+			"Upgrade: websocket\r\nConnection: Upgrade\r\n" +
+			"Sec-WebSocket-Accept: " + webSocketAccept(req.Header.Get("Sec-WebSocket-Key")) + "\r\n\r\n"))
+
+		ws := &wsConn{Conn: conn, br: br}
+		nsqd, err := net.Dial("tcp", target)
+		if err != nil {
+			conn.Close()
+			return
+		}
+		go io.Copy(nsqd, ws)
+		io.Copy(ws, nsqd)
+		conn.Close()
+	})
+}
+
+func TestConsumerWebSocket(t *testing.T) {
+	msg := NewMessage(MessageID{'w', 's'}, bytes.Repeat([]byte("w"), 70000))
+
+	script := []instruction{
+		// IDENTIFY
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		// SUB
+		instruction{0, FrameTypeResponse, []byte("OK")},
+		instruction{20 * time.Millisecond, FrameTypeMessage, frameMessage(msg)},
+		// needed to exit test
+		instruction{100 * time.Millisecond, -1, []byte("exit")},
+	}
+
+	addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	n := newMockNSQD(t, script, addr.String())
+	l := serveWebSocket(t, n.tcpAddr.String())
+	defer l.Close()
+
+	q, _ := NewConsumer("test_websocket", "ch", NewConfig())
+	q.SetLogger(nullLogger, LogLevelInfo)
+	handled := make(chan *Message, 1)
+	q.AddHandler(HandlerFunc(func(m *Message) error {
+		handled <- m
+		return nil
+	}))
+	wsAddr := "ws://" + l.Addr().String() + "/nsq"
+	err := q.ConnectToNSQD(wsAddr)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if m := <-handled; !bytes.Equal(m.Body, msg.Body) || m.NSQDAddress != wsAddr {
+		t.Fatalf("unexpected message %s from %s", m.ID, m.NSQDAddress)
+	}
+
+	<-n.exitChan
+	q.Stop()
+	<-q.StopChan
+
+	if _, err := NewConn("ws://"+l.Addr().String()+"/other", NewConfig(), nil).Connect(); err == nil {
+		t.Fatal("expected an error for a failed upgrade")
+	}
+}
+
+func TestWebSocketControlFrames(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	c := &wsConn{Conn: client, br: bufio.NewReader(client), client: true}
+	s := &wsConn{Conn: server, br: bufio.NewReader(server)}
+
+	go func() {
+		s.writeFrame(wsOpPing, []byte("ping"))
+		s.Write([]byte("data"))
+		s.writeFrame(wsOpClose, nil)
+	}()
+	pong := make(chan []byte, 1)
+	go func() {
+		// FIN|opcode, MASK|length, the masking key, then the masked payload
+		frame := make([]byte, 10)
+		io.ReadFull(s.br, frame)
+		if frame[0] != 0x80|wsOpPong || frame[1] != 0x80|4 {
+			pong <- nil
+			return
+		}
+		for i := range frame[6:] {
+			frame[6+i] ^= frame[2+i%4]
+		}
+		pong <- frame[6:]
+		// the reply to the close frame
+		io.Copy(ioutil.Discard, s.br)
+	}()
+
+	buf := make([]byte, 16)
+	n, err := c.Read(buf)
+	if err != nil || string(buf[:n]) != "data" {
+		t.Fatalf("unexpected read %q (%v)", buf[:n], err)
+	}
+	if p := <-pong; string(p) != "ping" {
+		t.Fatalf("unexpected pong %q", p)
+	}
+	if _, err := c.Read(buf); err != io.EOF {
+		t.Fatalf("expected EOF after a close frame, got %v", err)
+	}
+}